@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNtfyActions is the number of action buttons Ntfy shows on a notification
+const maxNtfyActions = 3
+
+// minCallbackSecretLength is the shortest secret accepted for signing action tokens
+const minCallbackSecretLength = 16
+
+// actionPath is the path of the callback URLs, followed by the token
+const actionPath = "/actions/"
+
+// maxUsedActionTokens caps how many used, unexpired action tokens a callback server remembers
+const maxUsedActionTokens = 10000
+
+// ActionButton is an action button of a route's notifications that publishes a command to MQTT
+// when tapped. Topic and payload are Go templates over the message the notification is for.
+type ActionButton struct {
+	Label   string `yaml:"label"`
+	Topic   string `yaml:"topic"`
+	Payload string `yaml:"payload,omitempty"`
+	QoS     int    `yaml:"qos,omitempty"`
+	Retain  bool   `yaml:"retain,omitempty"`
+	Clear   bool   `yaml:"clear,omitempty"` // dismiss the notification once the command succeeded
+}
+
+// NtfyAction is an http action button of an Ntfy notification
+type NtfyAction struct {
+	Label  string
+	URL    string
+	Method string
+	Clear  bool
+}
+
+// header formats the action in the short format of Ntfy's Actions header
+func (a NtfyAction) header() string {
+	parts := []string{"http", quoteActionValue(a.Label), a.URL}
+	if a.Method != "" {
+		parts = append(parts, "method="+a.Method)
+	}
+	if a.Clear {
+		parts = append(parts, "clear=true")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// quoteActionValue quotes a value of the Actions header that contains separators
+func quoteActionValue(value string) string {
+	if !strings.ContainsAny(value, `,;"'`) {
+		return value
+	}
+	if !strings.Contains(value, `"`) {
+		return `"` + value + `"`
+	}
+	return "'" + value + "'"
+}
+
+// validate checks an action button; prefix names it in errors
+func (a ActionButton) validate(prefix string) error {
+	if a.Label == "" {
+		return fmt.Errorf("%s.label is required", prefix)
+	}
+	if a.Topic == "" {
+		return fmt.Errorf("%s.topic is required", prefix)
+	}
+	if !isTemplate(a.Topic) && strings.ContainsAny(a.Topic, "+#") {
+		return fmt.Errorf("%s.topic must not contain wildcards (got %q)", prefix, a.Topic)
+	}
+	if a.QoS < 0 || a.QoS > 2 {
+		return fmt.Errorf("%s.qos must be 0, 1, or 2 (got %d)", prefix, a.QoS)
+	}
+	for key, text := range map[string]string{"topic": a.Topic, "payload": a.Payload} {
+		if isTemplate(text) {
+			if _, err := parseOptionTemplate(text); err != nil {
+				return fmt.Errorf("%s.%s is not a valid template: %w", prefix, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// actionCommand is the MQTT message an action token authorizes, signed into the callback URL
+type actionCommand struct {
+	Connection string `json:"c,omitempty"`
+	Topic      string `json:"t"`
+	Payload    string `json:"p,omitempty"`
+	QoS        byte   `json:"q,omitempty"`
+	Retain     bool   `json:"r,omitempty"`
+	Expires    int64  `json:"e"` // Unix time after which the token is rejected
+	Nonce      string `json:"n"` // makes each token single-use
+}
+
+// Errors of verifying action tokens
+var (
+	errInvalidActionToken = errors.New("invalid action token")
+	errExpiredActionToken = errors.New("action token has expired")
+	errUsedActionToken    = errors.New("action token has already been used")
+	errTooManyUsedTokens  = errors.New("too many used action tokens")
+)
+
+// CallbackConfig configures the action callback server
+type CallbackConfig struct {
+	Listen   string        // address to listen on, e.g. ":8081"
+	BaseURL  string        // URL Ntfy clients reach the server at
+	Secret   []byte        // key signing the action tokens
+	TokenTTL time.Duration // how long an action button works after the notification is sent
+}
+
+// CallbackServer serves the URLs of action buttons: a valid, unexpired token publishes the command
+// it carries on the MQTT connection it names, once
+type CallbackServer struct {
+	config CallbackConfig
+	now    func() time.Time
+	logger *slog.Logger
+	server *http.Server
+
+	mu      sync.Mutex
+	clients map[string]MQTTClient // by connection name
+	used    map[string]int64      // expiry of used tokens, by nonce
+}
+
+// NewCallbackServer creates a callback server; Start serves it
+func NewCallbackServer(config CallbackConfig, logger *slog.Logger) *CallbackServer {
+	return &CallbackServer{
+		config:  config,
+		now:     time.Now,
+		logger:  logger,
+		clients: map[string]MQTTClient{},
+		used:    map[string]int64{},
+	}
+}
+
+// AddConnection makes commands for the named connection publish on client
+func (s *CallbackServer) AddConnection(name string, client MQTTClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[name] = client
+}
+
+// Start listens on the configured address and serves callbacks in the background
+func (s *CallbackServer) Start() error {
+	listener, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen for action callbacks: %w", err)
+	}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Action callback server failed", "error", err)
+		}
+	}()
+	return nil
+}
+
+// Stop closes the server
+func (s *CallbackServer) Stop() {
+	if s.server != nil {
+		_ = s.server.Close()
+	}
+}
+
+// ActionURL returns the callback URL that publishes command, valid for the token TTL
+func (s *CallbackServer) ActionURL(command actionCommand) string {
+	command.Expires = s.now().Add(s.config.TokenTTL).Unix()
+	command.Nonce = rand.Text()
+	claims, _ := json.Marshal(command)
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(s.sign(payload))
+	return strings.TrimSuffix(s.config.BaseURL, "/") + actionPath + token
+}
+
+func (s *CallbackServer) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, s.config.Secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verify checks the signature and expiry of a token and returns its command
+func (s *CallbackServer) verify(token string) (actionCommand, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return actionCommand{}, errInvalidActionToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, s.sign(payload)) {
+		return actionCommand{}, errInvalidActionToken
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return actionCommand{}, errInvalidActionToken
+	}
+	var command actionCommand
+	if err := json.Unmarshal(claims, &command); err != nil || command.Topic == "" || command.Nonce == "" {
+		return actionCommand{}, errInvalidActionToken
+	}
+	if s.now().Unix() > command.Expires {
+		return actionCommand{}, errExpiredActionToken
+	}
+	return command, nil
+}
+
+// use marks the token of command as used until it expires. Tokens that expired are forgotten, as
+// verify rejects them anyway; if too many unexpired ones are left, the token is not accepted.
+func (s *CallbackServer) use(command actionCommand) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.used[command.Nonce]; ok {
+		return errUsedActionToken
+	}
+	if len(s.used) >= maxUsedActionTokens {
+		now := s.now().Unix()
+		for nonce, expires := range s.used {
+			if now > expires {
+				delete(s.used, nonce)
+			}
+		}
+		if len(s.used) >= maxUsedActionTokens {
+			return errTooManyUsedTokens
+		}
+	}
+	s.used[command.Nonce] = command.Expires
+	return nil
+}
+
+// release makes the token of a command that could not be published usable again
+func (s *CallbackServer) release(command actionCommand) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.used, command.Nonce)
+}
+
+// ServeHTTP implements http.Handler
+func (s *CallbackServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, actionPath)
+	if !ok || token == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	command, err := s.verify(token)
+	if errors.Is(err, errExpiredActionToken) {
+		http.Error(w, "Action Expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		s.logger.Warn("Rejected action callback with an invalid token", "remote", r.RemoteAddr)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := s.use(command); err != nil {
+		if errors.Is(err, errUsedActionToken) {
+			s.logger.Warn("Rejected action callback with a used token", "remote", r.RemoteAddr, "topic", command.Topic)
+			http.Error(w, "Action Already Used", http.StatusGone)
+			return
+		}
+		s.logger.Error("Rejected action callback", "error", err, "topic", command.Topic)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	connection := command.Connection
+	if connection == "" {
+		connection = DefaultConnectionName
+	}
+	s.mu.Lock()
+	client, ok := s.clients[connection]
+	s.mu.Unlock()
+	if !ok {
+		s.logger.Error("Action callback for an unknown MQTT connection", "connection", connection, "topic", command.Topic)
+		s.release(command)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if err := client.Publish(command.Topic, command.QoS, command.Retain, []byte(command.Payload)); err != nil {
+		s.logger.Error("Failed to publish action command", "error", err, "connection", connection, "topic", command.Topic)
+		s.release(command)
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Info("Published action command", "connection", connection, "topic", command.Topic, "payload", command.Payload)
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// SetCallbacks makes the bridge add the action buttons of routes, served by callbacks
+func (b *Bridge) SetCallbacks(callbacks *CallbackServer) {
+	b.callbacks = callbacks
+}
+
+// actionButtons renders the action buttons of route for a received message
+func (b *Bridge) actionButtons(route Route, data messageData) ([]NtfyAction, error) {
+	if route.Actions == nil {
+		return nil, nil
+	}
+	if b.callbacks == nil {
+		b.logger.Warn("Route has actions but no callback server is configured; sending without buttons", "route", route.Topic)
+		return nil, nil
+	}
+	var actions []NtfyAction
+	for _, button := range *route.Actions {
+		topic, err := b.renderOption(button.Topic, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render action topic: %w", err)
+		}
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("action %q rendered an invalid topic %q", button.Label, topic)
+		}
+		payload, err := b.renderOption(button.Payload, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render action payload: %w", err)
+		}
+		actions = append(actions, NtfyAction{
+			Label: button.Label,
+			URL: b.callbacks.ActionURL(actionCommand{
+				Connection: route.Connection,
+				Topic:      topic,
+				Payload:    payload,
+				QoS:        byte(button.QoS),
+				Retain:     button.Retain,
+			}),
+			Method: http.MethodPost,
+			Clear:  button.Clear,
+		})
+	}
+	return actions, nil
+}
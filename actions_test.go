@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCallbackServer returns a CallbackServer publishing on a memoryBroker and serving over httptest
+func testCallbackServer(t *testing.T) (*CallbackServer, *httptest.Server, chan MQTTMessage) {
+	t.Helper()
+	broker := newMemoryBroker()
+	client := broker.connect(nil)
+	commands := make(chan MQTTMessage, 10)
+	if err := client.Subscribe(Subscription{Topic: "#", Callback: func(msg MQTTMessage) { commands <- msg }}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	callbacks := NewCallbackServer(CallbackConfig{Secret: []byte("0123456789abcdef"), TokenTTL: time.Hour}, testLogger())
+	callbacks.AddConnection(DefaultConnectionName, client)
+	server := httptest.NewServer(callbacks)
+	t.Cleanup(server.Close)
+	callbacks.config.BaseURL = server.URL
+	return callbacks, server, commands
+}
+
+func TestNtfyActionHeader(t *testing.T) {
+	tests := []struct {
+		action NtfyAction
+		want   string
+	}{
+		{action: NtfyAction{Label: "Close", URL: "https://cb.example.com/actions/x", Method: "POST"}, want: "http, Close, https://cb.example.com/actions/x, method=POST"},
+		{action: NtfyAction{Label: "Close, now", URL: "https://cb.example.com/actions/x", Clear: true}, want: `http, "Close, now", https://cb.example.com/actions/x, clear=true`},
+		{action: NtfyAction{Label: `Say "hi"`, URL: "https://cb.example.com/actions/x"}, want: `http, 'Say "hi"', https://cb.example.com/actions/x`},
+	}
+
+	for _, tt := range tests {
+		if got := tt.action.header(); got != tt.want {
+			t.Errorf("header() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestActionButtonValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		button ActionButton
+		want   error
+	}{
+		{name: "valid", button: ActionButton{Label: "Close", Topic: "garage/door/set", Payload: "CLOSE", QoS: 1}},
+		{name: "templated", button: ActionButton{Label: "Ack", Topic: "alarms/{{.JSON.id}}/ack", Payload: "{{.Topic}}"}},
+		{name: "no label", button: ActionButton{Topic: "garage/door/set"}, want: fmt.Errorf("actions[0].label is required")},
+		{name: "no topic", button: ActionButton{Label: "Close"}, want: fmt.Errorf("actions[0].topic is required")},
+		{name: "wildcard topic", button: ActionButton{Label: "Close", Topic: "garage/+/set"}, want: fmt.Errorf("actions[0].topic must not contain wildcards (got \"garage/+/set\")")},
+		{name: "invalid qos", button: ActionButton{Label: "Close", Topic: "garage/door/set", QoS: 3}, want: fmt.Errorf("actions[0].qos must be 0, 1, or 2 (got 3)")},
+		{name: "invalid payload template", button: ActionButton{Label: "Close", Topic: "garage/door/set", Payload: "{{.Door}}"}, want: fmt.Errorf("actions[0].payload is not a valid template: template: option:1:2: executing \"option\" at <.Door>: can't evaluate field Door in type main.messageData")},
+	}
+
+	for _, tt := range tests {
+		err := tt.button.validate("actions[0]")
+		if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+			t.Errorf("validate(%s) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCallbackServerTokens(t *testing.T) {
+	callbacks := NewCallbackServer(CallbackConfig{BaseURL: "https://cb.example.com/", Secret: []byte("0123456789abcdef"), TokenTTL: time.Hour}, testLogger())
+	now := time.Now()
+	callbacks.now = func() time.Time { return now }
+
+	actionURL := callbacks.ActionURL(actionCommand{Topic: "garage/door/set", Payload: "CLOSE", QoS: 1})
+	token, ok := strings.CutPrefix(actionURL, "https://cb.example.com/actions/")
+	if !ok {
+		t.Fatalf("ActionURL() = %s, want a URL below the base URL", actionURL)
+	}
+
+	command, err := callbacks.verify(token)
+	if err != nil || command.Topic != "garage/door/set" || command.Payload != "CLOSE" || command.QoS != 1 {
+		t.Errorf("verify() = %+v, %v, want the signed command", command, err)
+	}
+
+	payload, signature, _ := strings.Cut(token, ".")
+	forged := NewCallbackServer(CallbackConfig{Secret: []byte("fedcba9876543210"), TokenTTL: time.Hour}, testLogger())
+	forgedURL := forged.ActionURL(actionCommand{Topic: "garage/door/set", Payload: "OPEN"})
+	forgedPayload, _, _ := strings.Cut(forgedURL[strings.LastIndex(forgedURL, "/")+1:], ".")
+	for name, token := range map[string]string{
+		"no signature":      payload,
+		"other payload":     forgedPayload + "." + signature,
+		"other secret":      forgedURL[strings.LastIndex(forgedURL, "/")+1:],
+		"invalid signature": payload + ".!!!",
+	} {
+		if _, err := callbacks.verify(token); err != errInvalidActionToken {
+			t.Errorf("verify(%s) = %v, want %v", name, err, errInvalidActionToken)
+		}
+	}
+
+	if other := callbacks.ActionURL(actionCommand{Topic: "garage/door/set", Payload: "CLOSE", QoS: 1}); other == actionURL {
+		t.Errorf("ActionURL() returned %s twice, want a new token for every button", actionURL)
+	}
+	if err := callbacks.use(command); err != nil {
+		t.Errorf("use() = %v, want nil", err)
+	}
+	if err := callbacks.use(command); err != errUsedActionToken {
+		t.Errorf("use() of a used token = %v, want %v", err, errUsedActionToken)
+	}
+	callbacks.release(command)
+	if err := callbacks.use(command); err != nil {
+		t.Errorf("use() after release = %v, want nil", err)
+	}
+
+	now = now.Add(time.Hour + time.Second)
+	if _, err := callbacks.verify(token); err != errExpiredActionToken {
+		t.Errorf("verify() after the TTL = %v, want %v", err, errExpiredActionToken)
+	}
+}
+
+func TestCallbackServerPublishes(t *testing.T) {
+	callbacks, server, commands := testCallbackServer(t)
+	actionURL := callbacks.ActionURL(actionCommand{Topic: "garage/door/set", Payload: "CLOSE"})
+
+	resp, err := http.Get(actionURL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Post(actionURL, "", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("POST status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	select {
+	case msg := <-commands:
+		if msg.Topic != "garage/door/set" || string(msg.Payload) != "CLOSE" {
+			t.Errorf("Published %s %q, want garage/door/set CLOSE", msg.Topic, msg.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command was not published")
+	}
+
+	tests := []struct {
+		name string
+		url  string
+		want int
+	}{
+		{name: "used token", url: actionURL, want: http.StatusGone},
+		{name: "forged token", url: actionURL + "x", want: http.StatusForbidden},
+		{name: "unknown connection", url: callbacks.ActionURL(actionCommand{Connection: "cabin", Topic: "cabin/door/set"}), want: http.StatusServiceUnavailable},
+		{name: "other path", url: server.URL + "/health", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp, err := http.Post(tt.url, "", nil)
+		if err != nil {
+			t.Fatalf("POST %s failed: %v", tt.name, err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("POST %s status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	callbacks.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	resp, err = http.Post(actionURL, "", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("POST of an expired token status = %d, want %d", resp.StatusCode, http.StatusGone)
+	}
+	if len(commands) != 0 {
+		t.Errorf("Rejected callbacks published %d commands", len(commands))
+	}
+}
+
+func TestBridgeActionButtons(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	callbacks, _, commands := testCallbackServer(t)
+	bridge := testBridge()
+	bridge.SetCallbacks(callbacks)
+
+	actions := []ActionButton{
+		{Label: "Close", Topic: "garage/door/set", Payload: "CLOSE", Clear: true},
+		{Label: "Snooze", Topic: "alarms/{{.JSON.id}}/snooze", Payload: "{{.JSON.id}}"},
+	}
+	route := Route{Topic: "garage/door/state", NtfyURL: server.URL + "/garage", PayloadFormat: PayloadFormatJSON, Actions: &actions}
+	if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: []byte(`{"message":"Garage open","id":"a1"}`)}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+
+	header := (<-requests).Header.Get("Actions")
+	buttons := strings.Split(header, "; ")
+	if len(buttons) != 2 || !strings.HasPrefix(buttons[0], "http, Close, "+callbacks.config.BaseURL+"/actions/") ||
+		!strings.HasSuffix(buttons[0], ", method=POST, clear=true") || !strings.HasPrefix(buttons[1], "http, Snooze, ") {
+		t.Fatalf("Actions = %q, want Close and Snooze buttons with callback URLs", header)
+	}
+
+	snoozeURL := strings.Split(buttons[1], ", ")[2]
+	resp, err := http.Post(snoozeURL, "", nil)
+	if err != nil {
+		t.Fatalf("POST failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	select {
+	case msg := <-commands:
+		if msg.Topic != "alarms/a1/snooze" || string(msg.Payload) != "a1" {
+			t.Errorf("Published %s %q, want the rendered command alarms/a1/snooze a1", msg.Topic, msg.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command was not published")
+	}
+}
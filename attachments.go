@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Attachment modes of a route
+const (
+	AttachmentAuto   = "auto"   // binary and image payloads are attachments, text payloads are messages
+	AttachmentAlways = "always" // every payload is an attachment
+	AttachmentNever  = "never"  // every payload is a message
+)
+
+// defaultSnapshotWait is how long an event waits for its snapshot unless configured
+const defaultSnapshotWait = 5 * time.Second
+
+// Defaults for downloading attach URLs; 15M is Ntfy's default attachment size limit
+const (
+	defaultFetchMaxSize = 15 << 20
+	defaultFetchTimeout = 10 * time.Second
+)
+
+// AttachmentFetchConfig configures downloading the files of attach URLs to upload them to Ntfy,
+// for URLs that Ntfy's clients cannot reach (e.g. a camera on the LAN)
+type AttachmentFetchConfig struct {
+	MaxSize int64         // largest file downloaded; larger files are passed on as a link
+	Timeout time.Duration // how long a download may take
+}
+
+// SnapshotPairing attaches images published on a snapshot topic to the notifications of a route
+type SnapshotPairing struct {
+	Topic string        // topic filter of the snapshots
+	Match string        // template for the snapshot topic of an event; empty matches any snapshot
+	Wait  time.Duration // how long an event waits for its snapshot before it is sent without one
+}
+
+// attachmentExtensions are file extensions for sniffed content types mime lacks or is ambiguous about
+var attachmentExtensions = map[string]string{
+	"image/jpeg":               ".jpg",
+	"image/png":                ".png",
+	"image/gif":                ".gif",
+	"image/webp":               ".webp",
+	"image/bmp":                ".bmp",
+	"video/mp4":                ".mp4",
+	"video/webm":               ".webm",
+	"audio/mpeg":               ".mp3",
+	"application/pdf":          ".pdf",
+	"application/zip":          ".zip",
+	"application/octet-stream": ".bin",
+}
+
+// validateAttachmentMode checks an attachment setting
+func validateAttachmentMode(field, mode string) error {
+	switch mode {
+	case "", AttachmentAuto, AttachmentAlways, AttachmentNever:
+		return nil
+	default:
+		return fmt.Errorf("%s must be %q, %q or %q (got %q)", field, AttachmentAuto, AttachmentAlways, AttachmentNever, mode)
+	}
+}
+
+// attachmentType returns the content type of a payload: the MQTT v5 content type if the publisher
+// set one, else the sniffed type
+func attachmentType(msg MQTTMessage) string {
+	if msg.ContentType != "" {
+		return msg.ContentType
+	}
+	return http.DetectContentType(msg.Payload)
+}
+
+// isAttachment reports whether the payload of msg is sent as an attachment under mode. In auto
+// mode that is any payload that is not UTF-8 text, and images, video, audio and PDFs.
+func isAttachment(mode string, msg MQTTMessage) bool {
+	if len(msg.Payload) == 0 {
+		return false
+	}
+	switch mode {
+	case AttachmentAlways:
+		return true
+	case AttachmentNever:
+		return false
+	}
+	if !utf8.Valid(msg.Payload) {
+		return true
+	}
+	contentType, _, _ := mime.ParseMediaType(attachmentType(msg))
+	switch {
+	case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "video/"), strings.HasPrefix(contentType, "audio/"):
+		return true
+	case contentType == "application/pdf":
+		return true
+	}
+	return false
+}
+
+// attachmentFilename returns the default file name of a payload received on topic: the last
+// topic level, with an extension for its content type unless it has one
+func attachmentFilename(topic string, msg MQTTMessage) string {
+	name := path.Base(topic)
+	if name == "" || name == "." || name == "/" {
+		name = "attachment"
+	}
+	if path.Ext(name) != "" {
+		return name
+	}
+	contentType, _, _ := mime.ParseMediaType(attachmentType(msg))
+	if ext, ok := attachmentExtensions[contentType]; ok {
+		return name + ext
+	}
+	if exts, err := mime.ExtensionsByType(contentType); err == nil && len(exts) > 0 {
+		return name + exts[0]
+	}
+	return name + ".bin"
+}
+
+// snapshot is the latest payload received on a snapshot topic
+type snapshot struct {
+	topic    string
+	payload  []byte
+	filename string
+	received time.Time
+}
+
+// snapshotStore keeps the latest snapshot of each topic for events to pair with
+type snapshotStore struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	latest  map[string]snapshot
+	arrived chan struct{} // closed and replaced whenever a snapshot arrives
+}
+
+func newSnapshotStore() *snapshotStore {
+	return &snapshotStore{now: time.Now, latest: map[string]snapshot{}, arrived: make(chan struct{})}
+}
+
+// put stores a snapshot received on topic and wakes the events waiting for one
+func (s *snapshotStore) put(topic string, msg MQTTMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest[topic] = snapshot{
+		topic:    topic,
+		payload:  msg.Payload,
+		filename: attachmentFilename(topic, msg),
+		received: s.now(),
+	}
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+}
+
+// find returns the latest snapshot received since since on a topic matching filter and, if set, topic
+func (s *snapshotStore) find(filter, topic string, since time.Time) (snapshot, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found snapshot
+	ok := false
+	for snapTopic, snap := range s.latest {
+		if topic != "" && snapTopic != topic {
+			continue
+		}
+		if !TopicMatchesFilter(filter, snapTopic) || snap.received.Before(since) {
+			continue
+		}
+		if !ok || snap.received.After(found.received) {
+			found, ok = snap, true
+		}
+	}
+	return found, ok
+}
+
+// wait returns the snapshot for an event received now: one that arrived up to pairing.Wait before
+// the event, or else the first to arrive within pairing.Wait after it
+func (s *snapshotStore) wait(pairing SnapshotPairing, topic string) (snapshot, bool) {
+	_, filter := SplitSharedSubscription(pairing.Topic)
+	since := s.now().Add(-pairing.Wait)
+	timeout := time.NewTimer(pairing.Wait)
+	defer timeout.Stop()
+	for {
+		s.mu.Lock()
+		arrived := s.arrived
+		s.mu.Unlock()
+		if snap, ok := s.find(filter, topic, since); ok {
+			return snap, true
+		}
+		select {
+		case <-arrived:
+		case <-timeout.C:
+			return snapshot{}, false
+		}
+	}
+}
+
+// snapshotSubscription returns the subscription storing the snapshots of a route
+func (b *Bridge) snapshotSubscription(route Route) Subscription {
+	b.mu.Lock()
+	b.filters[route.Connection] = append(b.filters[route.Connection], route.Snapshot.Topic)
+	b.mu.Unlock()
+
+	return Subscription{
+		Topic: route.Snapshot.Topic,
+		QoS:   route.QoS,
+		Callback: func(msg MQTTMessage) {
+			b.logger.Debug("Received snapshot", "topic", msg.Topic, "bytes", len(msg.Payload))
+			b.snapshots.put(msg.Topic, msg)
+			msg.Ack()
+		},
+	}
+}
+
+// attachSnapshot waits for the snapshot of an event received on route and attaches it to message.
+// Without a snapshot the message is sent as it is.
+func (b *Bridge) attachSnapshot(route Route, data messageData, message *NtfyMessage) {
+	topic, err := b.renderOption(route.Snapshot.Match, data)
+	if err != nil {
+		b.logger.Warn("Failed to render snapshot match; pairing with any snapshot", "error", err, "topic", data.Topic)
+		topic = ""
+	}
+	snap, ok := b.snapshots.wait(*route.Snapshot, topic)
+	if !ok {
+		b.logger.Info("No snapshot for event; sending it without an image", "topic", data.Topic, "snapshot_topic", route.Snapshot.Topic, "wait", route.Snapshot.Wait)
+		return
+	}
+	b.logger.Debug("Paired event with snapshot", "topic", data.Topic, "snapshot_topic", snap.topic)
+	message.Attachment = snap.payload
+	if message.Filename == "" {
+		message.Filename = snap.filename
+	}
+}
+
+// parseByteSize parses a size like "15M": a number of bytes with an optional K, M or G suffix
+// (powers of 1024, optionally followed by B)
+func parseByteSize(size string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(number, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(number, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(number, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		number = number[:len(number)-1]
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return value * multiplier, nil
+}
+
+// SetAttachmentFetch sets the limits for downloading attach URLs on routes that fetch them
+func (b *Bridge) SetAttachmentFetch(config AttachmentFetchConfig) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultFetchMaxSize
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultFetchTimeout
+	}
+	b.fetch = config
+	b.fetchClient = &http.Client{Timeout: config.Timeout}
+}
+
+// fetchAttachment downloads the file of an attach URL, failing for files over the size limit
+func (b *Bridge) fetchAttachment(attachURL string) ([]byte, string, error) {
+	resp, err := b.fetchClient.Get(attachURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download attachment: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			b.logger.Warn("Failed to close attachment response body", "error", err)
+		}
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, "", fmt.Errorf("attachment server returned status: %d", resp.StatusCode)
+	}
+	if resp.ContentLength > b.fetch.MaxSize {
+		return nil, "", fmt.Errorf("attachment is %d bytes, more than the limit of %d", resp.ContentLength, b.fetch.MaxSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, b.fetch.MaxSize+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to download attachment: %w", err)
+	}
+	if int64(len(data)) > b.fetch.MaxSize {
+		return nil, "", fmt.Errorf("attachment is more than the limit of %d bytes", b.fetch.MaxSize)
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+// fetchAttach replaces the attach URL of message with the file it points to, so Ntfy clients see
+// the file even where they cannot reach the URL. If the download fails the link is kept.
+func (b *Bridge) fetchAttach(message *NtfyMessage) {
+	data, contentType, err := b.fetchAttachment(message.Attach)
+	if err != nil {
+		b.logger.Warn("Failed to fetch attachment; passing on the link", "error", err, "url", message.Attach)
+		return
+	}
+	if message.Filename == "" {
+		name := "attachment"
+		if u, err := url.Parse(message.Attach); err == nil {
+			name = u.Path
+		}
+		message.Filename = attachmentFilename(name, MQTTMessage{Payload: data, ContentType: contentType})
+	}
+	b.logger.Debug("Fetched attachment", "url", message.Attach, "bytes", len(data), "filename", message.Filename)
+	message.Attachment, message.Attach = data, ""
+}
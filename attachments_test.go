@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testJPEG is enough of a JPEG for content sniffing
+var testJPEG = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00\xff\xd9")
+
+// ntfyRequest is a request received by ntfyRequestServer
+type ntfyRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// ntfyRequestServer starts an Ntfy stand-in that records every request it receives
+func ntfyRequestServer(t *testing.T) (*httptest.Server, chan ntfyRequest) {
+	t.Helper()
+	requests := make(chan ntfyRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- ntfyRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: body}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func TestIsAttachment(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+		msg  MQTTMessage
+		want bool
+	}{
+		{name: "text", msg: MQTTMessage{Payload: []byte("Door opened")}, want: false},
+		{name: "json", msg: MQTTMessage{Payload: []byte(`{"label":"person"}`)}, want: false},
+		{name: "jpeg", msg: MQTTMessage{Payload: testJPEG}, want: true},
+		{name: "not utf-8", msg: MQTTMessage{Payload: []byte{0x00, 0xfe, 0x01}}, want: true},
+		{name: "v5 content type", msg: MQTTMessage{Payload: []byte("GIF-ish"), ContentType: "image/gif"}, want: true},
+		{name: "empty", mode: AttachmentAlways, msg: MQTTMessage{}, want: false},
+		{name: "always text", mode: AttachmentAlways, msg: MQTTMessage{Payload: []byte("log line")}, want: true},
+		{name: "never jpeg", mode: AttachmentNever, msg: MQTTMessage{Payload: testJPEG}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isAttachment(tt.mode, tt.msg); got != tt.want {
+			t.Errorf("isAttachment(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttachmentFilename(t *testing.T) {
+	tests := []struct {
+		topic string
+		msg   MQTTMessage
+		want  string
+	}{
+		{topic: "frigate/door/person/snapshot", msg: MQTTMessage{Payload: testJPEG}, want: "snapshot.jpg"},
+		{topic: "reports/daily.pdf", msg: MQTTMessage{Payload: []byte("%PDF-1.7")}, want: "daily.pdf"},
+		{topic: "camera/still", msg: MQTTMessage{Payload: []byte{0x00, 0x01}}, want: "still.bin"},
+		{topic: "camera/still", msg: MQTTMessage{Payload: []byte("x"), ContentType: "image/png"}, want: "still.png"},
+	}
+
+	for _, tt := range tests {
+		if got := attachmentFilename(tt.topic, tt.msg); got != tt.want {
+			t.Errorf("attachmentFilename(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessageAttachment(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	client := NewNtfyClient(NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1}, testLogger())
+
+	message := NtfyMessage{Message: "Person at the door\nFront camera", Title: "Frigate", Attachment: testJPEG, Filename: "snapshot.jpg"}
+	if _, err := client.SendMessage(server.URL+"/door", message, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	req := <-requests
+	if req.Method != http.MethodPut {
+		t.Errorf("Method = %s, want PUT", req.Method)
+	}
+	if !bytes.Equal(req.Body, testJPEG) {
+		t.Errorf("Body = %q, want the attachment", req.Body)
+	}
+	if got := req.Header.Get("Filename"); got != "snapshot.jpg" {
+		t.Errorf("Filename = %q, want snapshot.jpg", got)
+	}
+	if got := req.Header.Get("Message"); got != `Person at the door\nFront camera` {
+		t.Errorf("Message = %q, want the message with escaped line breaks", got)
+	}
+	if got := req.Header.Get("Title"); got != "Frigate" {
+		t.Errorf("Title = %q, want Frigate", got)
+	}
+}
+
+func TestBridgeBinaryPayload(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	bridge := testBridge()
+
+	route := Route{Topic: "frigate/door/person/snapshot", NtfyURL: server.URL + "/door", Options: NtfyOptions{Title: "Door"}}
+	if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: testJPEG}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	req := <-requests
+	if req.Method != http.MethodPut || !bytes.Equal(req.Body, testJPEG) || req.Header.Get("Filename") != "snapshot.jpg" {
+		t.Errorf("Request = %s with Filename %q, want a PUT of the image as snapshot.jpg", req.Method, req.Header.Get("Filename"))
+	}
+	if got := req.Header.Get("Message"); got != "" {
+		t.Errorf("Message = %q, want none so Ntfy describes the file", got)
+	}
+
+	route.Attachment = AttachmentNever
+	if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: testJPEG}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	if req := <-requests; req.Method != http.MethodPost {
+		t.Errorf("Method = %s with attachment never, want POST", req.Method)
+	}
+}
+
+func TestBridgeSnapshotPairing(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	bridge := testBridge()
+
+	route := Route{
+		Topic:         "frigate/events",
+		NtfyURL:       server.URL + "/frigate",
+		PayloadFormat: PayloadFormatJSON,
+		Options:       NtfyOptions{Message: "{{.JSON.label}} at {{.JSON.camera}}"},
+		Snapshot: &SnapshotPairing{
+			Topic: "frigate/+/+/snapshot",
+			Match: "frigate/{{.JSON.camera}}/{{.JSON.label}}/snapshot",
+			Wait:  500 * time.Millisecond,
+		},
+	}
+	subscriptions := bridge.Subscriptions(route)
+	if len(subscriptions) != 2 || subscriptions[1].Topic != "frigate/+/+/snapshot" {
+		t.Fatalf("Subscriptions() = %+v, want the route and its snapshot topic", subscriptions)
+	}
+	events, snapshots := subscriptions[0], subscriptions[1]
+	event := []byte(`{"label":"person","camera":"door"}`)
+
+	t.Run("snapshot before event", func(t *testing.T) {
+		snapshots.Callback(MQTTMessage{Topic: "frigate/door/person/snapshot", Payload: testJPEG})
+		snapshots.Callback(MQTTMessage{Topic: "frigate/yard/person/snapshot", Payload: []byte("\xff\xd8\xffyard")})
+		acked := make(chan struct{})
+		events.Callback(MQTTMessage{Topic: "frigate/events", Payload: event, QoS: 1, ack: func() { close(acked) }})
+
+		req := <-requests
+		if req.Method != http.MethodPut || !bytes.Equal(req.Body, testJPEG) {
+			t.Errorf("Request = %s %q, want a PUT of the door snapshot", req.Method, req.Body)
+		}
+		if got := req.Header.Get("Message"); got != "person at door" {
+			t.Errorf("Message = %q, want the event's message", got)
+		}
+		if got := req.Header.Get("Filename"); got != "snapshot.jpg" {
+			t.Errorf("Filename = %q, want snapshot.jpg", got)
+		}
+		select {
+		case <-acked:
+		case <-time.After(5 * time.Second):
+			t.Error("Event was not acknowledged")
+		}
+	})
+
+	t.Run("snapshot after event", func(t *testing.T) {
+		bridge.snapshots = newSnapshotStore()
+		events.Callback(MQTTMessage{Topic: "frigate/events", Payload: event})
+		time.Sleep(50 * time.Millisecond)
+		snapshots.Callback(MQTTMessage{Topic: "frigate/door/person/snapshot", Payload: testJPEG})
+
+		if req := <-requests; req.Method != http.MethodPut || !bytes.Equal(req.Body, testJPEG) {
+			t.Errorf("Request = %s %q, want a PUT of the late snapshot", req.Method, req.Body)
+		}
+	})
+
+	t.Run("no snapshot", func(t *testing.T) {
+		bridge.snapshots = newSnapshotStore()
+		events.Callback(MQTTMessage{Topic: "frigate/events", Payload: event})
+
+		select {
+		case req := <-requests:
+			if req.Method != http.MethodPost || string(req.Body) != "person at door" {
+				t.Errorf("Request = %s %q, want the message without an image", req.Method, req.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Event was not delivered without a snapshot")
+		}
+	})
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{size: "1024", want: 1024},
+		{size: "15M", want: 15 << 20},
+		{size: "512KB", want: 512 << 10},
+		{size: "1g", want: 1 << 30},
+		{size: "", wantErr: true},
+		{size: "lots", wantErr: true},
+		{size: "-1M", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.size)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d (error %v)", tt.size, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestSendMessageAttach(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	client := NewNtfyClient(NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1}, testLogger())
+
+	message := NtfyMessage{Message: "Person at the door", Attach: "https://frigate.example.com/snapshot.jpg", Filename: "door.jpg"}
+	if _, err := client.SendMessage(server.URL+"/door", message, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	req := <-requests
+	if req.Method != http.MethodPost || string(req.Body) != "Person at the door" {
+		t.Errorf("Request = %s %q, want a POST of the message", req.Method, req.Body)
+	}
+	if got := req.Header.Get("Attach"); got != message.Attach {
+		t.Errorf("Attach = %q, want %q", got, message.Attach)
+	}
+	if got := req.Header.Get("Filename"); got != "door.jpg" {
+		t.Errorf("Filename = %q, want door.jpg", got)
+	}
+}
+
+func TestBridgeFetchAttach(t *testing.T) {
+	server, requests := ntfyRequestServer(t)
+	camera := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/door/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write(testJPEG)
+	}))
+	t.Cleanup(camera.Close)
+	bridge := testBridge()
+
+	route := Route{Topic: "frigate/events", NtfyURL: server.URL + "/door", PayloadFormat: PayloadFormatJSON, FetchAttach: true}
+	payload := func(path string) []byte {
+		return []byte(`{"message":"Person at the door","attach":"` + camera.URL + path + `"}`)
+	}
+
+	t.Run("fetched", func(t *testing.T) {
+		if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: payload("/api/door/latest")}); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+		req := <-requests
+		if req.Method != http.MethodPut || !bytes.Equal(req.Body, testJPEG) {
+			t.Errorf("Request = %s %q, want a PUT of the fetched image", req.Method, req.Body)
+		}
+		if got := req.Header.Get("Filename"); got != "latest.jpg" {
+			t.Errorf("Filename = %q, want latest.jpg", got)
+		}
+		if got := req.Header.Get("Attach"); got != "" {
+			t.Errorf("Attach = %q, want none for an uploaded file", got)
+		}
+	})
+
+	t.Run("download failed", func(t *testing.T) {
+		if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: payload("/missing")}); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+		if req := <-requests; req.Method != http.MethodPost || req.Header.Get("Attach") != camera.URL+"/missing" {
+			t.Errorf("Request = %s with Attach %q, want the link passed on", req.Method, req.Header.Get("Attach"))
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		bridge.SetAttachmentFetch(AttachmentFetchConfig{MaxSize: 4, Timeout: time.Second})
+		defer bridge.SetAttachmentFetch(AttachmentFetchConfig{})
+		if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: payload("/api/door/latest")}); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+		if req := <-requests; req.Method != http.MethodPost || req.Header.Get("Attach") == "" {
+			t.Errorf("Request = %s with Attach %q, want the link passed on", req.Method, req.Header.Get("Attach"))
+		}
+	})
+
+	t.Run("not fetched", func(t *testing.T) {
+		route := route
+		route.FetchAttach = false
+		if err := bridge.HandleMessage(route, MQTTMessage{Topic: route.Topic, Payload: payload("/api/door/latest")}); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+		if req := <-requests; req.Method != http.MethodPost || req.Header.Get("Attach") != camera.URL+"/api/door/latest" {
+			t.Errorf("Request = %s with Attach %q, want the link", req.Method, req.Header.Get("Attach"))
+		}
+	})
+}
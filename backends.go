@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+// Backend types; BackendNtfy is also the name routes use for their own Ntfy topic
+const (
+	BackendNtfy     = "ntfy"
+	BackendGotify   = "gotify"
+	BackendPushover = "pushover"
+	BackendWebhook  = "webhook"
+	BackendMatrix   = "matrix"
+)
+
+// backendTypes lists the types a backend can have
+var backendTypes = []string{BackendGotify, BackendPushover, BackendWebhook, BackendMatrix}
+
+// BackendConfig configures a named notification backend that routes can deliver to besides or
+// instead of Ntfy; which fields apply depends on the type
+type BackendConfig struct {
+	Type      string `yaml:"type"`
+	URL       string `yaml:"url,omitempty"`
+	Token     string `yaml:"token,omitempty"`
+	TokenFile string `yaml:"token_file,omitempty"`
+
+	// Pushover: the user or group key, how emergency messages repeat and where acknowledgements are published
+	User     string `yaml:"user,omitempty"`
+	Retry    string `yaml:"retry,omitempty"`
+	Expire   string `yaml:"expire,omitempty"`
+	AckTopic string `yaml:"ack_topic,omitempty"`
+
+	// Webhook: templates of the request (url is a template too) and the statuses that mean success
+	Method       string            `yaml:"method,omitempty"`
+	Headers      map[string]string `yaml:"headers,omitempty"`
+	Body         string            `yaml:"body,omitempty"`
+	SuccessCodes []int             `yaml:"success_codes,omitempty"`
+
+	// Matrix: the ID of the room messages are sent to and whether they are HTML
+	Room string `yaml:"room,omitempty"`
+	HTML bool   `yaml:"html,omitempty"`
+}
+
+// validate checks a backend; prefix names it in errors
+func (c BackendConfig) validate(prefix string) error {
+	if !slices.Contains(backendTypes, c.Type) {
+		return fmt.Errorf("%s.type must be %s or %s (got %q)", prefix, strings.Join(backendTypes[:len(backendTypes)-1], ", "), backendTypes[len(backendTypes)-1], c.Type)
+	}
+	if c.Type == BackendWebhook {
+		return c.validateWebhook(prefix)
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s.url must be an http:// or https:// URL (got %q)", prefix, c.URL)
+	}
+	if c.Token != "" && c.TokenFile != "" {
+		return fmt.Errorf("%s.token and %s.token_file are mutually exclusive", prefix, prefix)
+	}
+	if c.Token == "" && c.TokenFile == "" {
+		return fmt.Errorf("%s.token or %s.token_file is required", prefix, prefix)
+	}
+	if c.Type == BackendPushover {
+		if c.Retry != "" {
+			if d, err := time.ParseDuration(c.Retry); err != nil || d < minPushoverRetry {
+				return fmt.Errorf("%s.retry must be a duration of at least %s (got %q)", prefix, minPushoverRetry, c.Retry)
+			}
+		}
+		if c.Expire != "" {
+			if d, err := time.ParseDuration(c.Expire); err != nil || d <= 0 || d > maxPushoverExpire {
+				return fmt.Errorf("%s.expire must be a positive duration of at most %s (got %q)", prefix, maxPushoverExpire, c.Expire)
+			}
+		}
+		if err := validateResultTopic(prefix+".ack_topic", c.AckTopic); err != nil {
+			return err
+		}
+		if !strings.Contains(c.AckTopic, "{{") && strings.ContainsAny(c.AckTopic, "+#") {
+			return fmt.Errorf("%s.ack_topic must not contain wildcards (got %q)", prefix, c.AckTopic)
+		}
+	}
+	if c.Type == BackendMatrix && !strings.HasPrefix(c.Room, "!") {
+		return fmt.Errorf("%s.room must be a room ID starting with ! (got %q)", prefix, c.Room)
+	}
+	return nil
+}
+
+// validateWebhook checks the templates and success codes of a webhook backend
+func (c BackendConfig) validateWebhook(prefix string) error {
+	if c.URL == "" {
+		return fmt.Errorf("%s.url is required", prefix)
+	}
+	if _, err := parseWebhookTemplate("url", c.URL); err != nil {
+		return fmt.Errorf("%s.url is not a valid template: %w", prefix, err)
+	}
+	if u, err := url.Parse(c.URL); !isTemplate(c.URL) && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+		return fmt.Errorf("%s.url must be an http:// or https:// URL (got %q)", prefix, c.URL)
+	}
+	if _, err := parseWebhookTemplate("method", c.Method); err != nil {
+		return fmt.Errorf("%s.method is not a valid template: %w", prefix, err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.Headers)) {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return fmt.Errorf("%s.headers must have valid header names (got %q)", prefix, name)
+		}
+		if _, err := parseWebhookTemplate("header", c.Headers[name]); err != nil {
+			return fmt.Errorf("%s.headers.%s is not a valid template: %w", prefix, name, err)
+		}
+	}
+	if _, err := parseWebhookTemplate("body", c.Body); err != nil {
+		return fmt.Errorf("%s.body is not a valid template: %w", prefix, err)
+	}
+	for i, code := range c.SuccessCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("%s.success_codes[%d] must be an HTTP status code (got %d)", prefix, i, code)
+		}
+	}
+	if c.Token != "" && c.TokenFile != "" {
+		return fmt.Errorf("%s.token and %s.token_file are mutually exclusive", prefix, prefix)
+	}
+	return nil
+}
+
+// setDefaults sets default values for the optional settings of a backend
+func (c *BackendConfig) setDefaults() {
+	if c.Type != BackendPushover {
+		return
+	}
+	if c.URL == "" {
+		c.URL = defaultPushoverURL
+	}
+	if c.Retry == "" {
+		c.Retry = defaultPushoverRetry.String()
+	}
+	if c.Expire == "" {
+		c.Expire = defaultPushoverExpire.String()
+	}
+}
+
+// loadFiles replaces token_file with the contents of the file
+func (c *BackendConfig) loadFiles(prefix string) error {
+	if c.TokenFile != "" {
+		token, err := readSecretFile(c.TokenFile)
+		if err != nil {
+			return fmt.Errorf("%s.token_file: %w", prefix, err)
+		}
+		c.Token, c.TokenFile = token, ""
+	}
+	return nil
+}
+
+// Backend is a named notification service; its client sends to URL with Auth like an Ntfy client
+// sends to a topic URL
+type Backend struct {
+	Name   string
+	Type   string
+	URL    string
+	Auth   NtfyAuth
+	Client NtfyClient
+
+	AckTopic string // template for the topic acknowledgements are published on; empty only logs them
+}
+
+// NewBackend creates the backend configured as name; ntfyConfig supplies the timeout, retry,
+// circuit breaker, TLS and proxy settings shared with Ntfy
+func NewBackend(name string, config BackendConfig, ntfyConfig NtfyConfig, logger *slog.Logger) (Backend, error) {
+	backend := Backend{Name: name, Type: config.Type, URL: config.URL}
+	logger = logger.With("backend", name)
+	switch config.Type {
+	case BackendGotify:
+		backend.Auth = NtfyAuth{Token: config.Token}
+		backend.Client = NewGotifyClient(ntfyConfig, logger)
+	case BackendPushover:
+		retry, err := time.ParseDuration(config.Retry)
+		if err != nil || retry < minPushoverRetry {
+			retry = defaultPushoverRetry
+		}
+		expire, err := time.ParseDuration(config.Expire)
+		if err != nil || expire <= 0 {
+			expire = defaultPushoverExpire
+		}
+		backend.Auth = NtfyAuth{Token: config.Token, Username: config.User}
+		backend.Client = NewPushoverClient(ntfyConfig, retry, expire, logger)
+		backend.AckTopic = config.AckTopic
+	case BackendWebhook:
+		client, err := NewWebhookClient(WebhookConfig{
+			Method:       config.Method,
+			URL:          config.URL,
+			Headers:      config.Headers,
+			Body:         config.Body,
+			SuccessCodes: config.SuccessCodes,
+		}, ntfyConfig, logger)
+		if err != nil {
+			return Backend{}, err
+		}
+		backend.Auth = NtfyAuth{Token: config.Token}
+		backend.Client = client
+	case BackendMatrix:
+		backend.Auth = NtfyAuth{Token: config.Token}
+		backend.Client = NewMatrixClient(ntfyConfig, config.Room, config.HTML, logger)
+	default:
+		return Backend{}, fmt.Errorf("unknown backend type %q", config.Type)
+	}
+	return backend, nil
+}
+
+// priorityLevel returns an Ntfy priority as a number from 1 (min) to 5 (max); unset and unknown
+// priorities are the default 3
+func priorityLevel(priority string) int {
+	switch strings.ToLower(priority) {
+	case "1", "min":
+		return 1
+	case "2", "low":
+		return 2
+	case "4", "high":
+		return 4
+	case "5", "max", "urgent":
+		return 5
+	}
+	return 3
+}
+
+// backendSender performs the requests of backends other than Ntfy with the connection pool, rate
+// limiting, circuit breaker and error classification of HTTPNtfyClient
+type backendSender struct {
+	client     *http.Client
+	config     NtfyConfig
+	service    string
+	rateLimits *RateLimits
+	circuits   *CircuitBreakers
+	logger     *slog.Logger
+
+	successful func(status int) bool // nil accepts every status below 400
+}
+
+func newBackendSender(service string, config NtfyConfig, logger *slog.Logger) *backendSender {
+	return &backendSender{
+		client: &http.Client{
+			Timeout:   config.Timeout,
+			Transport: newNtfyTransport(config, logger),
+		},
+		config:     config,
+		service:    service,
+		rateLimits: defaultRateLimits,
+		circuits:   defaultCircuitBreakers,
+		logger:     logger,
+	}
+}
+
+// CloseIdleConnections closes the sender's idle keep-alive connections
+func (s *backendSender) CloseIdleConnections() {
+	s.client.CloseIdleConnections()
+}
+
+// do sends req once and returns the response body and status (0 if there was no response).
+// Network errors, 429 and 5xx responses are retried by sendWithRetry; other unsuccessful
+// responses are not.
+func (s *backendSender) do(req *http.Request) ([]byte, int, error) {
+	host := req.URL.Host
+	if err := s.rateLimits.Wait(req.Context(), host, retryBudget(s.config), s.logger); err != nil {
+		return nil, 0, retry.Unrecoverable(err)
+	}
+	if err := s.circuits.Allow(host, s.config.CircuitBreaker, s.logger); err != nil {
+		return nil, 0, retry.Unrecoverable(err)
+	}
+
+	resp, err := s.client.Do(req)
+	s.circuits.Record(host, s.config.CircuitBreaker, err != nil || resp.StatusCode >= 500, s.logger)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			s.logger.Warn("Failed to close response body", "error", err)
+		}
+	}()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if s.successful != nil && s.successful(resp.StatusCode) || s.successful == nil && resp.StatusCode < 400 {
+		return body, resp.StatusCode, nil
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay, ok := rateLimitDelay(resp.Header, time.Now())
+		if !ok {
+			delay = defaultRateLimitPause
+		}
+		s.logger.Warn("Server rate limited mqtt2ntfy; pausing delivery", "host", host, "retry_after", delay)
+		s.rateLimits.Pause(host, delay)
+		return body, resp.StatusCode, &NtfyStatusError{StatusCode: resp.StatusCode, RetryAfter: delay, Service: s.service}
+	}
+	if resp.StatusCode >= 500 {
+		return body, resp.StatusCode, &NtfyStatusError{StatusCode: resp.StatusCode, Service: s.service}
+	}
+	s.logger.Debug("Server rejected the message", "status", resp.StatusCode, "response", string(body))
+	return body, resp.StatusCode, retry.Unrecoverable(&NtfyStatusError{StatusCode: resp.StatusCode, Service: s.service})
+}
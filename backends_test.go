@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// backendResponse is a response of backendServer; a zero Status is 200
+type backendResponse struct {
+	Status int
+	Body   string
+}
+
+// backendServer starts a stand-in for a notification backend that records every request and
+// answers them with responses in turn, repeating the last one
+func backendServer(t *testing.T, responses ...backendResponse) (*httptest.Server, chan ntfyRequest) {
+	t.Helper()
+	requests := make(chan ntfyRequest, 10)
+	var mu sync.Mutex
+	next := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- ntfyRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header, Body: body}
+		mu.Lock()
+		response := responses[min(next, len(responses)-1)]
+		next++
+		mu.Unlock()
+		if response.Status != 0 {
+			w.WriteHeader(response.Status)
+		}
+		_, _ = w.Write([]byte(response.Body))
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// testBackendConfig returns the timeout and retry settings of backend clients in tests
+func testBackendConfig() NtfyConfig {
+	return NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 3, RetryDelay: 10 * time.Millisecond}
+}
+
+func TestBridgeRetriesOnlyFailedBackends(t *testing.T) {
+	ntfyServer, ntfyRequests := ntfyRequestServer(t)
+	gotify, gotifyRequests := backendServer(t, backendResponse{Status: http.StatusBadGateway}, backendResponse{Body: `{"id":42}`})
+	gotifyClient := NewGotifyClient(NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1}, testLogger())
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{"home": {Name: "home", Type: BackendGotify, URL: gotify.URL, Client: gotifyClient}})
+
+	both := []string{BackendNtfy, "home"}
+	route := Route{Topic: "garage/door", QoS: 1, NtfyURL: ntfyServer.URL + "/garage", Backends: &both}
+	subscription := bridge.Subscription(route)
+	acked := make(chan struct{})
+	subscription.Callback(MQTTMessage{Topic: "garage/door", Payload: []byte("open"), QoS: 1, ack: func() { close(acked) }, persistent: true})
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not acknowledged after it was delivered")
+	}
+	if len(ntfyRequests) != 1 || len(gotifyRequests) != 2 {
+		t.Errorf("Ntfy got %d requests and Gotify %d, want the redelivery to go to Gotify only", len(ntfyRequests), len(gotifyRequests))
+	}
+	<-ntfyRequests
+
+	// A dead letter only names the backends that failed, and replaying it only delivers to those
+	down, _ := backendServer(t, backendResponse{Status: http.StatusBadGateway})
+	bridge.SetBackends(map[string]Backend{"home": {Name: "home", Type: BackendGotify, URL: down.URL, Client: gotifyClient}})
+	file := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	bridge.SetDeadLetterQueue(NewDeadLetterQueue(file, "", testLogger()))
+	subscription.Callback(MQTTMessage{Topic: "garage/door", Payload: []byte("open")})
+	<-ntfyRequests
+	letters, err := ReadDeadLetters(file)
+	if err != nil || len(letters) != 1 || !slices.Equal(letters[0].Backends, []string{"home"}) {
+		t.Fatalf("Dead letters = %+v, %v, want one for the home backend", letters, err)
+	}
+
+	bridge.SetBackends(map[string]Backend{"home": {Name: "home", Type: BackendGotify, URL: gotify.URL, Client: gotifyClient}})
+	if replayed, failed, err := ReplayDeadLetters(file, bridge, []Route{route}, testLogger()); err != nil || replayed != 1 || failed != 0 {
+		t.Fatalf("ReplayDeadLetters() = %d, %d, %v, want 1 replayed", replayed, failed, err)
+	}
+	if len(ntfyRequests) != 0 {
+		t.Error("Replay delivered the message to Ntfy again")
+	}
+}
+
+func TestPriorityLevel(t *testing.T) {
+	tests := map[string]int{
+		"":        3,
+		"1":       1,
+		"min":     1,
+		"low":     2,
+		"default": 3,
+		"High":    4,
+		"5":       5,
+		"urgent":  5,
+		"max":     5,
+		"bogus":   3,
+	}
+
+	for priority, want := range tests {
+		if got := priorityLevel(priority); got != want {
+			t.Errorf("priorityLevel(%q) = %d, want %d", priority, got, want)
+		}
+	}
+}
+
+func TestBridgeBackends(t *testing.T) {
+	ntfyServer, ntfyRequests := ntfyRequestServer(t)
+	gotify, gotifyRequests := backendServer(t, backendResponse{Body: `{"id":42}`})
+	gotifyClient := NewGotifyClient(testBackendConfig(), testLogger())
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{
+		"home": {Name: "home", Type: BackendGotify, URL: gotify.URL, Auth: NtfyAuth{Token: "AbCdEf123"}, Client: gotifyClient},
+	})
+
+	both := []string{"home", BackendNtfy}
+	route := Route{Topic: "garage/door", NtfyURL: ntfyServer.URL + "/garage", Backends: &both}
+	receipt, err := bridge.deliver(route, MQTTMessage{Topic: "garage/door", Payload: []byte("4|Door opened")})
+	if err != nil {
+		t.Fatalf("deliver failed: %v", err)
+	}
+	if receipt.MessageID != "42" {
+		t.Errorf("Receipt = %+v, want that of the first backend", receipt)
+	}
+	if request := <-gotifyRequests; request.Path != "/message" {
+		t.Errorf("Gotify request path = %s, want /message", request.Path)
+	}
+	if request := <-ntfyRequests; request.Path != "/garage" || request.Header.Get("Priority") != "4" {
+		t.Errorf("Ntfy request = %s with priority %q, want /garage with priority 4", request.Path, request.Header.Get("Priority"))
+	}
+
+	gotifyOnly := []string{"home"}
+	route = Route{Topic: "garage/door", Backends: &gotifyOnly}
+	if err := bridge.HandleMessage(route, MQTTMessage{Topic: "garage/door", Payload: []byte("Door closed")}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	<-gotifyRequests
+	if len(ntfyRequests) != 0 {
+		t.Error("Route without the ntfy backend delivered to Ntfy")
+	}
+
+	unknown := []string{"home", "office"}
+	route = Route{Topic: "garage/door", Backends: &unknown}
+	err = bridge.HandleMessage(route, MQTTMessage{Topic: "garage/door", Payload: []byte("Door opened")})
+	if err == nil || IsTransientDeliveryError(err) {
+		t.Errorf("HandleMessage() error = %v, want a permanent error for the unknown backend", err)
+	}
+	<-gotifyRequests
+
+	unauthorized, _ := backendServer(t, backendResponse{Status: http.StatusUnauthorized})
+	rejected := map[string]Backend{"home": {Name: "home", Type: BackendGotify, URL: unauthorized.URL, Auth: NtfyAuth{Token: "wrong"}, Client: gotifyClient}}
+	bridge.SetBackends(rejected)
+	err = bridge.HandleMessage(route, MQTTMessage{Topic: "garage/door", Payload: []byte("Door opened")})
+	var statusErr *NtfyStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("HandleMessage() error = %v, want the Gotify status", err)
+	}
+}
@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// How often a QoS 1 or 2 message on a persistent session is delivered again after a transient
+// failure before it is dead-lettered, and the delay before the first retry
+const (
+	defaultRedeliveries    = 3
+	defaultRedeliveryDelay = 15 * time.Second
+)
+
+// Route maps an MQTT subscription to an Ntfy destination
+type Route struct {
+	Topic       string
+	QoS         byte
+	NtfyURL     string
+	Priority    string
+	ResultTopic string    // template for the delivery receipt topic; empty disables receipts
+	Auth        *NtfyAuth // credentials for this route; nil uses the bridge's
+
+	Options       NtfyOptions // publish options, merged with the ntfy section's
+	PayloadFormat string      // PayloadFormatText or PayloadFormatJSON
+
+	Attachment  string           // AttachmentAuto, AttachmentAlways or AttachmentNever; empty is auto
+	FetchAttach bool             // download attach URLs and upload the files instead of linking them
+	Snapshot    *SnapshotPairing // images to attach to the route's notifications; nil disables pairing
+
+	Actions    *[]ActionButton // buttons publishing MQTT commands; a pointer keeps Route comparable
+	Connection string          // name of the MQTT connection the route is subscribed on
+
+	Backends     *[]string // names of the backends to deliver to, BackendNtfy for NtfyURL; nil is Ntfy only
+	PushoverUser string    // user or group key replacing that of Pushover backends
+}
+
+// Bridge forwards MQTT messages received on routes to Ntfy
+type Bridge struct {
+	ntfyConfig NtfyConfig
+	auth       NtfyAuth
+	topicAuth  map[string]NtfyAuth // credentials for individual Ntfy topics
+	logger     *slog.Logger
+	active     func() bool
+	deadLetter *DeadLetterQueue
+
+	mu        sync.Mutex
+	stats     BridgeStats
+	filters   map[string][]string           // topic filters of the routes, by connection
+	templates map[string]*template.Template // parsed result topic templates
+	clients   map[string]*HTTPNtfyClient    // one client per Ntfy server, keyed by scheme and host
+
+	optionTemplates map[string]*template.Template // parsed publish option templates
+	snapshots       *snapshotStore
+	fetch           AttachmentFetchConfig
+	fetchClient     *http.Client
+	callbacks       *CallbackServer
+	backends        map[string]Backend
+
+	redeliveries    int                      // deliveries retried in-process for messages awaiting acknowledgement
+	redeliveryDelay time.Duration            // before the first of them; doubles each time
+	held            map[string][]heldMessage // messages waiting for a rate limit to end, by host
+	done            chan struct{}            // closed by Close to stop pending redeliveries
+
+	tracking     context.Context    // cancelled by Close to stop tracking acknowledgements
+	stopTracking context.CancelFunc // cancels tracking
+	trackers     sync.WaitGroup     // goroutines tracking acknowledgements
+}
+
+// heldMessage is a message waiting for the rate limit of its server to end
+type heldMessage struct {
+	route Route
+	msg   MQTTMessage
+}
+
+// BridgeStats counts the messages a Bridge has handled
+type BridgeStats struct {
+	Forwarded    uint64
+	Failed       uint64
+	LastError    string
+	LastErrorAt  time.Time
+	OpenCircuits []string // Ntfy hosts whose circuit breaker is open or half-open
+}
+
+// NewBridge creates a Bridge that delivers messages with the given Ntfy settings
+func NewBridge(ntfyConfig NtfyConfig, auth NtfyAuth, logger *slog.Logger) *Bridge {
+	bridge := &Bridge{
+		ntfyConfig: ntfyConfig,
+		auth:       auth,
+		logger:     logger,
+		templates:  map[string]*template.Template{},
+		filters:    map[string][]string{},
+		clients:    map[string]*HTTPNtfyClient{},
+
+		optionTemplates: map[string]*template.Template{},
+		snapshots:       newSnapshotStore(),
+
+		redeliveries:    defaultRedeliveries,
+		redeliveryDelay: defaultRedeliveryDelay,
+		held:            map[string][]heldMessage{},
+		done:            make(chan struct{}),
+	}
+	bridge.tracking, bridge.stopTracking = context.WithCancel(context.Background())
+	bridge.SetAttachmentFetch(AttachmentFetchConfig{})
+	return bridge
+}
+
+// ntfyClient returns the client for the Ntfy server of ntfyURL, creating it on first use
+func (b *Bridge) ntfyClient(ntfyURL string) (*HTTPNtfyClient, error) {
+	u, err := url.Parse(ntfyURL)
+	if err != nil {
+		return nil, err
+	}
+	server := u.Scheme + "://" + u.Host
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	client, ok := b.clients[server]
+	if !ok {
+		client = NewNtfyClient(b.ntfyConfig, b.logger)
+		b.clients[server] = client
+	}
+	return client, nil
+}
+
+// Close stops pending redeliveries, leaving their messages unacknowledged for the broker to
+// redeliver, stops and waits for the tracking of acknowledgements and closes the idle connections
+// to all Ntfy servers
+func (b *Bridge) Close() {
+	b.stopTracking()
+	b.trackers.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	for _, client := range b.clients {
+		client.CloseIdleConnections()
+	}
+	for _, backend := range b.backends {
+		if client, ok := backend.Client.(interface{ CloseIdleConnections() }); ok {
+			client.CloseIdleConnections()
+		}
+	}
+}
+
+// SetBackends sets the named backends routes can deliver to besides or instead of Ntfy
+func (b *Bridge) SetBackends(backends map[string]Backend) {
+	b.backends = backends
+}
+
+// SetActiveCheck makes the bridge drop messages while active returns false, e.g. while this
+// instance is on standby during leader election
+func (b *Bridge) SetActiveCheck(active func() bool) {
+	b.active = active
+}
+
+// Active reports whether the bridge is forwarding messages, i.e. not on standby
+func (b *Bridge) Active() bool {
+	return b.active == nil || b.active()
+}
+
+// SetTopicCredentials sets the credentials used for individual Ntfy topics, taking precedence
+// over route and default credentials
+func (b *Bridge) SetTopicCredentials(topicAuth map[string]NtfyAuth) {
+	b.topicAuth = topicAuth
+}
+
+// authFor returns the credentials for delivering to ntfyURL on route: those of the Ntfy topic,
+// else those of the route, else the default
+func (b *Bridge) authFor(route Route, ntfyURL string) NtfyAuth {
+	if auth, ok := b.topicAuth[ntfyTopicOfURL(ntfyURL)]; ok {
+		return auth
+	}
+	if route.Auth != nil {
+		return *route.Auth
+	}
+	return b.auth
+}
+
+// SetDeadLetterQueue records messages that are dropped because they could not be delivered or routed
+func (b *Bridge) SetDeadLetterQueue(queue *DeadLetterQueue) {
+	b.deadLetter = queue
+}
+
+// Stats returns a snapshot of the delivery counters
+func (b *Bridge) Stats() BridgeStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.OpenCircuits = defaultCircuitBreakers.Open()
+	return stats
+}
+
+// record updates the delivery counters with the outcome of one message
+func (b *Bridge) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.stats.Forwarded++
+		return
+	}
+	b.stats.Failed++
+	b.stats.LastError = err.Error()
+	b.stats.LastErrorAt = time.Now()
+}
+
+// permanentError marks a failure that redelivering the same message cannot fix
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// IsTransientDeliveryError reports whether a failed message could still be delivered if the
+// broker redelivers it later (e.g. ntfy was unreachable, returned a server error or rate limited it)
+func IsTransientDeliveryError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var permanent permanentError
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var statusErr *NtfyStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode < 500 && statusErr.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// The message expired before it could be delivered
+		return false
+	}
+	return true
+}
+
+// Subscriptions returns the MQTT subscriptions for a route: its own and, if it pairs snapshots
+// with its events, the snapshot topic's
+func (b *Bridge) Subscriptions(route Route) []Subscription {
+	subscriptions := []Subscription{b.Subscription(route)}
+	if route.Snapshot != nil {
+		subscriptions = append(subscriptions, b.snapshotSubscription(route))
+	}
+	return subscriptions
+}
+
+// Subscription returns the MQTT subscription for a route. QoS 1 and 2 messages on a persistent
+// session are only acknowledged once they are delivered to Ntfy or retrying has failed, so the
+// broker redelivers them if mqtt2ntfy stops in between.
+func (b *Bridge) Subscription(route Route) Subscription {
+	b.mu.Lock()
+	b.filters[route.Connection] = append(b.filters[route.Connection], route.Topic)
+	b.mu.Unlock()
+
+	// Set up the route's Ntfy client now rather than on the first message; errors surface on delivery
+	_, _ = b.ntfyClient(route.NtfyURL)
+
+	return Subscription{
+		Topic: route.Topic,
+		QoS:   route.QoS,
+		Callback: func(msg MQTTMessage) {
+			if b.active != nil && !b.active() {
+				b.logger.Debug("Standby instance; leaving message to the leader", "topic", msg.Topic)
+				msg.Ack()
+				return
+			}
+			if route.Snapshot != nil {
+				// Waiting for the snapshot must not hold up the connection's other messages
+				go b.handle(route, msg)
+				return
+			}
+			b.handle(route, msg)
+		},
+	}
+}
+
+// handle delivers a message received on route, then acknowledges it. A QoS 1 or 2 message on a
+// persistent session that failed transiently is retried in the background first, unacknowledged,
+// and any message not sent because its server is rate limited is held until the pause ends.
+func (b *Bridge) handle(route Route, msg MQTTMessage) {
+	receipt, err := b.deliver(route, msg)
+	route = failedRoute(route, err)
+	var limitErr *RateLimitedError
+	if errors.As(err, &limitErr) && b.hold(limitErr, route, msg) {
+		return
+	}
+	b.complete(route, msg, receipt, err)
+}
+
+// complete acknowledges a delivered message, or retries it like handle if it failed transiently
+func (b *Bridge) complete(route Route, msg MQTTMessage, receipt NtfyReceipt, err error) {
+	if err != nil && IsTransientDeliveryError(err) && msg.QoS > 0 && msg.persistent && b.redeliveries > 0 {
+		go b.redeliver(route, msg, err)
+		return
+	}
+	b.finish(route, msg, receipt, err)
+}
+
+// redeliver retries a message that failed transiently with a growing delay. The message stays
+// unacknowledged meanwhile: an unacknowledged message holds up the broker's in-flight window
+// (and, on MQTT v5, the acknowledgements of later messages), so the retries are bounded.
+func (b *Bridge) redeliver(route Route, msg MQTTMessage, err error) {
+	var receipt NtfyReceipt
+	delay := b.redeliveryDelay
+	for attempt := 1; attempt <= b.redeliveries; attempt++ {
+		wait := delay
+		var statusErr *NtfyStatusError
+		if errors.As(err, &statusErr) && statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		var limitErr *RateLimitedError
+		if errors.As(err, &limitErr) && limitErr.RetryAfter > wait {
+			wait = limitErr.RetryAfter
+		}
+		b.logger.Warn("Delivery failed; retrying before acknowledging the message", "topic", msg.Topic, "attempt", attempt, "of", b.redeliveries, "delay", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-b.done:
+			b.logger.Warn("Message not acknowledged; the broker will redeliver it when the session is resumed", "topic", msg.Topic, "qos", msg.QoS)
+			return
+		}
+		receipt, err = b.deliver(route, msg)
+		route = failedRoute(route, err)
+		if err == nil || !IsTransientDeliveryError(err) {
+			break
+		}
+		delay *= 2
+	}
+	b.finish(route, msg, receipt, err)
+}
+
+// hold queues a message that was not sent because its server is rate limited for longer than the
+// message's retries wait. The queue of each server is delivered in order once its pause ends, off
+// the MQTT callbacks. hold returns false if too many messages are held for the server already.
+func (b *Bridge) hold(limitErr *RateLimitedError, route Route, msg MQTTMessage) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	queue, draining := b.held[limitErr.Host]
+	if len(queue) >= maxHeldMessages {
+		b.logger.Error("Too many messages held for a rate limited server; dropping", "host", limitErr.Host, "topic", msg.Topic)
+		return false
+	}
+	b.held[limitErr.Host] = append(queue, heldMessage{route: route, msg: msg})
+	if !draining {
+		go b.deliverHeld(limitErr.Host, limitErr.RetryAfter)
+	}
+	return true
+}
+
+// deliverHeld delivers the messages held for host, starting after wait and waiting again whenever
+// the server is paused again
+func (b *Bridge) deliverHeld(host string, wait time.Duration) {
+	for {
+		b.mu.Lock()
+		count := len(b.held[host])
+		b.mu.Unlock()
+		b.logger.Warn("Ntfy server rate limited delivery; holding messages until the pause ends", "host", host, "messages", count, "wait", wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-b.done:
+			b.mu.Lock()
+			count = len(b.held[host])
+			delete(b.held, host)
+			b.mu.Unlock()
+			b.logger.Warn("Messages held for a rate limit were not delivered before shutdown; QoS 1 and 2 messages on a persistent session are redelivered by the broker", "host", host, "messages", count)
+			return
+		}
+
+		for {
+			b.mu.Lock()
+			queue := b.held[host]
+			if len(queue) == 0 {
+				delete(b.held, host)
+				b.mu.Unlock()
+				return
+			}
+			next := queue[0]
+			b.held[host] = queue[1:]
+			b.mu.Unlock()
+
+			receipt, err := b.deliver(next.route, next.msg)
+			next.route = failedRoute(next.route, err)
+			var limitErr *RateLimitedError
+			if errors.As(err, &limitErr) && limitErr.Host == host {
+				// Paused again; the message stays first in line
+				b.mu.Lock()
+				b.held[host] = append([]heldMessage{next}, b.held[host]...)
+				b.mu.Unlock()
+				wait = limitErr.RetryAfter
+				break
+			}
+			b.complete(next.route, next.msg, receipt, err)
+		}
+	}
+}
+
+// finish records the outcome of a message, dead-letters it if delivery failed and acknowledges it
+func (b *Bridge) finish(route Route, msg MQTTMessage, receipt NtfyReceipt, err error) {
+	b.record(err)
+	b.publishReceipt(route, msg, receipt, err)
+	if err != nil {
+		b.addDeadLetter(route, msg, err)
+	}
+	msg.Ack()
+}
+
+// addDeadLetter records a dropped message in the dead-letter queue, if one is configured
+func (b *Bridge) addDeadLetter(route Route, msg MQTTMessage, err error) {
+	if b.deadLetter == nil {
+		return
+	}
+	client := msg.client
+	if b.deadLetter.topic != "" && client != nil {
+		// A dead letter on a subscribed topic could fail again and loop
+		if filter, ok := b.subscribedFilter(route.Connection, b.deadLetter.topic); ok {
+			b.logger.Warn("Not publishing dead letter on a subscribed topic; choose a dead-letter topic outside the routes", "dead_letter_topic", b.deadLetter.topic, "route", filter)
+			client = nil
+		}
+	}
+	b.deadLetter.Add(newDeadLetter(route, msg, err), client)
+}
+
+// HandleMessage routes a message received on route to its Ntfy topic and delivers it
+func (b *Bridge) HandleMessage(route Route, msg MQTTMessage) error {
+	_, err := b.deliver(route, msg)
+	return err
+}
+
+// deliver routes a message received on route to its Ntfy topic and other backends, delivers it
+// and returns the receipt of the first backend
+func (b *Bridge) deliver(route Route, msg MQTTMessage) (NtfyReceipt, error) {
+	topic := msg.Topic
+	if isAttachment(route.Attachment, msg) {
+		b.logger.Info("Received MQTT message", "topic", topic, "attachment_bytes", len(msg.Payload))
+	} else {
+		b.logger.Info("Received MQTT message", "topic", topic, "payload", string(msg.Payload))
+	}
+
+	// Apply the route's publish options, then the payload (priority prefix or JSON fields) and MQTT v5 properties
+	ntfyMessage, err := b.buildMessage(route, msg)
+	if err != nil {
+		b.logger.Error("Failed to build Ntfy message", "error", err, "topic", topic)
+		return NtfyReceipt{}, permanentError{err}
+	}
+	if route.FetchAttach && ntfyMessage.Attach != "" && ntfyMessage.Attachment == nil {
+		b.fetchAttach(&ntfyMessage)
+	}
+	if route.PayloadFormat != PayloadFormatJSON && ntfyMessage.Attachment == nil && ntfyMessage.Message != string(msg.Payload) {
+		b.logger.Info("Extracted priority from message", "original", string(msg.Payload), "cleaned", ntfyMessage.Message, "priority", ntfyMessage.Priority)
+	}
+	if len(msg.UserProperties) > 0 {
+		b.logger.Debug("Applied MQTT v5 user properties", "properties", msg.UserProperties, "title", ntfyMessage.Title, "tags", ntfyMessage.Tags, "priority", ntfyMessage.Priority, "click", ntfyMessage.Click, "delay", ntfyMessage.Delay)
+	}
+
+	if route.Backends == nil {
+		return b.sendToNtfy(route, topic, ntfyMessage)
+	}
+	// Every backend is tried; a redelivery only sends the message to those that failed (see failedRoute)
+	var receipt NtfyReceipt
+	var errs []error
+	for i, name := range *route.Backends {
+		var backendReceipt NtfyReceipt
+		var err error
+		if name == BackendNtfy {
+			backendReceipt, err = b.sendToNtfy(route, topic, ntfyMessage)
+		} else {
+			backendReceipt, err = b.sendToBackend(name, route, msg, ntfyMessage)
+		}
+		if i == 0 {
+			receipt = backendReceipt
+		}
+		if err != nil {
+			errs = append(errs, backendError{backend: name, err: err})
+		}
+	}
+	return receipt, errors.Join(errs...)
+}
+
+// backendError is the failure of one of the backends of a route
+type backendError struct {
+	backend string
+	err     error
+}
+
+func (e backendError) Error() string {
+	return e.backend + ": " + e.err.Error()
+}
+
+func (e backendError) Unwrap() error {
+	return e.err
+}
+
+// failedRoute returns route limited to the backends that failed with err, the error of deliver,
+// so that redelivering or replaying the message does not send it to the others again
+func failedRoute(route Route, err error) Route {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if route.Backends == nil || !ok {
+		return route
+	}
+	var failed []string
+	for _, err := range joined.Unwrap() {
+		var backendErr backendError
+		if errors.As(err, &backendErr) {
+			failed = append(failed, backendErr.backend)
+		}
+	}
+	if len(failed) == 0 {
+		return route
+	}
+	route.Backends = &failed
+	return route
+}
+
+// sendToBackend delivers a message received on route to the named backend
+func (b *Bridge) sendToBackend(name string, route Route, msg MQTTMessage, message NtfyMessage) (NtfyReceipt, error) {
+	backend, ok := b.backends[name]
+	if !ok {
+		b.logger.Error("Route delivers to an unknown backend", "backend", name)
+		return NtfyReceipt{}, permanentError{fmt.Errorf("unknown backend %q", name)}
+	}
+	auth := backend.Auth
+	if backend.Type == BackendPushover && route.PushoverUser != "" {
+		auth.Username = route.PushoverUser
+	}
+	receipt, err := backend.Client.SendMessage(backend.URL, message, auth)
+	if err != nil {
+		b.logger.Error("Failed to forward message to backend after retries", "backend", name, "type", backend.Type, "error", err, "attempts", receipt.Attempts)
+		return receipt, err
+	}
+	b.logger.Info("Message forwarded to backend successfully", "backend", name, "type", backend.Type, "priority", message.Priority, "id", receipt.MessageID)
+	if tracker, ok := backend.Client.(acknowledgementTracker); ok && receipt.Receipt != "" {
+		b.trackers.Go(func() {
+			b.trackAcknowledgement(backend, tracker, auth, route, msg, receipt.Receipt)
+		})
+	}
+	return receipt, nil
+}
+
+// sendToNtfy delivers a message received on topic to the Ntfy topic of route
+func (b *Bridge) sendToNtfy(route Route, topic string, ntfyMessage NtfyMessage) (NtfyReceipt, error) {
+	// Determine the Ntfy URL to use
+	var ntfyURL string
+	if IsWildcardTopic(route.Topic) {
+		// Extract Ntfy topic from MQTT topic for wildcard subscriptions
+		ntfyTopic, err := ExtractNtfyTopicFromMQTT(route.Topic, topic)
+		if err != nil {
+			b.logger.Error("Failed to extract Ntfy topic from MQTT topic", "error", err, "subscription", route.Topic, "received", topic)
+			return NtfyReceipt{}, permanentError{fmt.Errorf("failed to extract Ntfy topic: %w", err)}
+		}
+
+		// Build the dynamic Ntfy URL
+		ntfyURL, err = BuildNtfyURL(route.NtfyURL, ntfyTopic)
+		if err != nil {
+			b.logger.Error("Failed to build Ntfy URL", "error", err, "base_url", route.NtfyURL, "ntfy_topic", ntfyTopic)
+			return NtfyReceipt{}, permanentError{fmt.Errorf("failed to build Ntfy URL: %w", err)}
+		}
+
+		b.logger.Info("Using dynamic Ntfy topic", "mqtt_topic", topic, "ntfy_topic", ntfyTopic, "ntfy_url", ntfyURL)
+	} else {
+		// Use the configured Ntfy URL directly for non-wildcard subscriptions
+		ntfyURL = route.NtfyURL
+	}
+
+	client, err := b.ntfyClient(ntfyURL)
+	if err != nil {
+		b.logger.Error("Invalid Ntfy URL", "error", err, "ntfy_url", ntfyURL)
+		return NtfyReceipt{}, permanentError{fmt.Errorf("invalid Ntfy URL: %w", err)}
+	}
+
+	// Forward to Ntfy with retry logic using cleaned message and extracted priority
+	receipt, err := client.SendMessage(ntfyURL, ntfyMessage, b.authFor(route, ntfyURL))
+	if err != nil {
+		b.logger.Error("Failed to forward message to Ntfy after retries", "error", err, "attempts", receipt.Attempts)
+		return receipt, err
+	}
+	b.logger.Info("Message forwarded to Ntfy successfully", "priority", ntfyMessage.Priority, "id", receipt.MessageID)
+	return receipt, nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+// testBridge returns a Bridge that gives up after a single delivery attempt
+func testBridge() *Bridge {
+	bridge := NewBridge(NtfyConfig{
+		Timeout:    5 * time.Second,
+		MaxRetries: 1,
+		RetryDelay: 10 * time.Millisecond,
+	}, NtfyAuth{}, testLogger())
+	bridge.redeliveryDelay = 10 * time.Millisecond
+	return bridge
+}
+
+// ntfyStatusServer starts an Ntfy stand-in that answers every request with status and records request paths
+func ntfyStatusServer(t *testing.T, status int) (*httptest.Server, chan string) {
+	t.Helper()
+	paths := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server, paths
+}
+
+func TestBridgeHandleMessage(t *testing.T) {
+	server, paths := ntfyStatusServer(t, http.StatusOK)
+	bridge := testBridge()
+
+	tests := []struct {
+		name      string
+		route     Route
+		topic     string
+		wantPath  string
+		expectErr bool
+	}{
+		{
+			name:     "exact topic",
+			route:    Route{Topic: "alerts/door", NtfyURL: server.URL + "/door"},
+			topic:    "alerts/door",
+			wantPath: "/door",
+		},
+		{
+			name:     "wildcard topic",
+			route:    Route{Topic: "alerts/#", NtfyURL: server.URL},
+			topic:    "alerts/garage",
+			wantPath: "/garage",
+		},
+		{
+			name:      "wildcard topic with extra levels",
+			route:     Route{Topic: "alerts/#", NtfyURL: server.URL},
+			topic:     "alerts/garage/door",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := bridge.HandleMessage(tt.route, MQTTMessage{Topic: tt.topic, Payload: []byte("open")})
+			if tt.expectErr {
+				if err == nil {
+					t.Fatal("Expected error, got nil")
+				}
+				if IsTransientDeliveryError(err) {
+					t.Errorf("Routing error %v should not be transient", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("HandleMessage failed: %v", err)
+			}
+			if path := <-paths; path != tt.wantPath {
+				t.Errorf("Delivered to %s, want %s", path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestBridgeSubscriptionAck(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		qos          byte
+		persistent   bool
+		wantAttempts int
+	}{
+		{name: "delivered", status: http.StatusOK, qos: 1, wantAttempts: 1},
+		{name: "server error at QoS 1", status: http.StatusBadGateway, qos: 1, wantAttempts: 1},
+		{name: "server error at QoS 1 on a persistent session", status: http.StatusBadGateway, qos: 1, persistent: true, wantAttempts: 4},
+		{name: "server error at QoS 2 on a persistent session", status: http.StatusServiceUnavailable, qos: 2, persistent: true, wantAttempts: 4},
+		{name: "server error at QoS 0 on a persistent session", status: http.StatusBadGateway, qos: 0, persistent: true, wantAttempts: 1},
+		{name: "client error on a persistent session", status: http.StatusBadRequest, qos: 1, persistent: true, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, paths := ntfyStatusServer(t, tt.status)
+			route := Route{Topic: "alerts/door", QoS: tt.qos, NtfyURL: server.URL + "/door"}
+			subscription := testBridge().Subscription(route)
+
+			if subscription.Topic != route.Topic || subscription.QoS != route.QoS {
+				t.Errorf("Subscription = %s QoS %d, want %s QoS %d", subscription.Topic, subscription.QoS, route.Topic, route.QoS)
+			}
+
+			acked := make(chan struct{})
+			subscription.Callback(MQTTMessage{
+				Topic:      "alerts/door",
+				Payload:    []byte("open"),
+				QoS:        tt.qos,
+				ack:        func() { close(acked) },
+				persistent: tt.persistent,
+			})
+			select {
+			case <-acked:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Message was not acknowledged")
+			}
+			if len(paths) != tt.wantAttempts {
+				t.Errorf("Delivered %d times, want %d", len(paths), tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestBridgeRedelivery(t *testing.T) {
+	var failures atomic.Int32
+	failures.Store(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"abc"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	bridge := testBridge()
+	subscription := bridge.Subscription(Route{Topic: "alerts/door", QoS: 1, NtfyURL: server.URL + "/door"})
+	acked := make(chan struct{})
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), QoS: 1, ack: func() { close(acked) }, persistent: true})
+	select {
+	case <-acked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message was not acknowledged after it was delivered")
+	}
+	if stats := bridge.Stats(); stats.Forwarded != 1 || stats.Failed != 0 {
+		t.Errorf("Stats() = %d forwarded, %d failed, want the redelivered message forwarded", stats.Forwarded, stats.Failed)
+	}
+
+	// Messages still being retried when the bridge closes are left for the broker to redeliver
+	failures.Store(100)
+	bridge.redeliveryDelay = time.Hour
+	acked = make(chan struct{})
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), QoS: 1, ack: func() { close(acked) }, persistent: true})
+	bridge.Close()
+	select {
+	case <-acked:
+		t.Error("Message was acknowledged although it was not delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBridgeHoldsRateLimitedMessages(t *testing.T) {
+	server, paths := ntfyStatusServer(t, http.StatusOK)
+	bridge := NewBridge(NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 3, RetryDelay: 10 * time.Millisecond}, NtfyAuth{}, testLogger())
+	subscription := bridge.Subscription(Route{Topic: "alerts/#", NtfyURL: server.URL})
+
+	// The pause outlasts the retries of the messages, which are held instead of dropped
+	defaultRateLimits.Pause(server.Listener.Addr().String(), 300*time.Millisecond)
+	start := time.Now()
+	acked := make(chan string, 2)
+	for _, topic := range []string{"alerts/door", "alerts/window"} {
+		subscription.Callback(MQTTMessage{Topic: topic, Payload: []byte("open"), ack: func() { acked <- topic }})
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Callbacks returned after %s, want them not to wait for the pause", elapsed)
+	}
+
+	for _, want := range []string{"/door", "/window"} {
+		select {
+		case path := <-paths:
+			if path != want {
+				t.Errorf("Delivered to %s, want %s", path, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Held message was not delivered after the pause")
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Held messages delivered after %s, want them to wait for the pause", elapsed)
+	}
+	for range 2 {
+		select {
+		case <-acked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Held message was not acknowledged after it was delivered")
+		}
+	}
+	if stats := bridge.Stats(); stats.Forwarded != 2 || stats.Failed != 0 {
+		t.Errorf("Stats() = %d forwarded, %d failed, want both messages forwarded", stats.Forwarded, stats.Failed)
+	}
+
+	// Messages still held when the bridge closes are not acknowledged
+	defaultRateLimits.Pause(server.Listener.Addr().String(), time.Minute)
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), QoS: 1, ack: func() { acked <- "alerts/door" }, persistent: true})
+	bridge.Close()
+	select {
+	case <-acked:
+		t.Error("Held message was acknowledged although it was not delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBridgeStats(t *testing.T) {
+	okServer, _ := ntfyStatusServer(t, http.StatusOK)
+	failServer, _ := ntfyStatusServer(t, http.StatusBadRequest)
+	bridge := testBridge()
+
+	delivered := bridge.Subscription(Route{Topic: "alerts/door", NtfyURL: okServer.URL + "/door"})
+	rejected := bridge.Subscription(Route{Topic: "alerts/window", NtfyURL: failServer.URL + "/window"})
+	delivered.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open")})
+	delivered.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("closed")})
+	rejected.Callback(MQTTMessage{Topic: "alerts/window", Payload: []byte("open")})
+
+	stats := bridge.Stats()
+	if stats.Forwarded != 2 || stats.Failed != 1 {
+		t.Errorf("Stats() = %d forwarded, %d failed, want 2 and 1", stats.Forwarded, stats.Failed)
+	}
+	if stats.LastError == "" || stats.LastErrorAt.IsZero() {
+		t.Errorf("Stats() last error = %q at %v, want the rejected delivery", stats.LastError, stats.LastErrorAt)
+	}
+}
+
+func TestBridgeStandbyDropsMessages(t *testing.T) {
+	server, paths := ntfyStatusServer(t, http.StatusOK)
+	bridge := testBridge()
+	leader := false
+	bridge.SetActiveCheck(func() bool { return leader })
+	subscription := bridge.Subscription(Route{Topic: "alerts/door", QoS: 1, NtfyURL: server.URL + "/door"})
+
+	acked := false
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), QoS: 1, ack: func() { acked = true }})
+	if !acked {
+		t.Error("Standby instance did not acknowledge the message")
+	}
+	if len(paths) != 0 {
+		t.Errorf("Standby instance forwarded the message to %s", <-paths)
+	}
+
+	leader = true
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), QoS: 1})
+	if path := <-paths; path != "/door" {
+		t.Errorf("Leader delivered to %s, want /door", path)
+	}
+}
+
+func TestIsTransientDeliveryError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "network error", err: errors.New("connection refused"), want: true},
+		{name: "server error", err: fmt.Errorf("send failed: %w", &NtfyStatusError{StatusCode: 503}), want: true},
+		{name: "client error", err: fmt.Errorf("send failed: %w", &NtfyStatusError{StatusCode: 403}), want: false},
+		{name: "rate limited", err: fmt.Errorf("send failed: %w", &NtfyStatusError{StatusCode: 429, RetryAfter: time.Second}), want: true},
+		{name: "paused by a rate limit", err: retry.Unrecoverable(&RateLimitedError{Host: "ntfy.sh", RetryAfter: time.Minute}), want: true},
+		{name: "routing error", err: permanentError{errors.New("bad topic")}, want: false},
+		{name: "message expired", err: fmt.Errorf("send failed: %w", context.DeadlineExceeded), want: false},
+	}
+
+	for _, tt := range tests {
+		if got := IsTransientDeliveryError(tt.err); got != tt.want {
+			t.Errorf("IsTransientDeliveryError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBridgeReusesConnections(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+
+	bridge := testBridge()
+	t.Cleanup(bridge.Close)
+	for _, topic := range []string{"door", "window", "garage"} {
+		if err := bridge.HandleMessage(Route{Topic: "alerts/#", NtfyURL: server.URL}, MQTTMessage{Topic: "alerts/" + topic, Payload: []byte("open")}); err != nil {
+			t.Fatalf("HandleMessage(%s) failed: %v", topic, err)
+		}
+	}
+	if got := connections.Load(); got != 1 {
+		t.Errorf("Server accepted %d connections, want 1 reused for all messages", got)
+	}
+	if len(bridge.clients) != 1 {
+		t.Errorf("Bridge created %d clients for one server, want 1", len(bridge.clients))
+	}
+}
+
+// BenchmarkNtfyBurst delivers bursts of messages to a local Ntfy stand-in, through the bridge's
+// pooled client and with a new client (and connection) for every message as before
+func BenchmarkNtfyBurst(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unpooled" {
+			// Without reuse every message pays for a new connection
+			w.Header().Set("Connection", "close")
+		}
+		_, _ = w.Write([]byte(`{"id":"hwQ2YpKdmg"}`))
+	}))
+	b.Cleanup(server.Close)
+	config := NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1, MaxIdleConns: 64}
+	logger := slog.New(slog.DiscardHandler)
+
+	b.Run("pooled", func(b *testing.B) {
+		bridge := NewBridge(config, NtfyAuth{}, logger)
+		defer bridge.Close()
+		route := Route{Topic: "alerts/#", NtfyURL: server.URL}
+		msg := MQTTMessage{Topic: "alerts/door", Payload: []byte("open")}
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := bridge.HandleMessage(route, msg); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+
+	b.Run("client per message", func(b *testing.B) {
+		b.SetParallelism(16)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				client := NewNtfyClient(config, logger)
+				if _, err := client.SendMessage(server.URL+"/unpooled", NtfyMessage{Message: "open"}, NtfyAuth{}); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of sending a message to an Ntfy server whose circuit is open
+var ErrCircuitOpen = errors.New("ntfy circuit breaker is open")
+
+// CircuitBreakerConfig configures the circuit breakers; a FailureThreshold of 0 disables them
+type CircuitBreakerConfig struct {
+	FailureThreshold int           // consecutive failed requests that open the circuit
+	OpenTimeout      time.Duration // how long the circuit stays open before a probe request
+}
+
+// CircuitState is the state of the circuit breaker of one Ntfy server
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // requests are sent
+	CircuitOpen                         // requests fail immediately
+	CircuitHalfOpen                     // a single probe request is sent
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuit tracks the recent requests to one Ntfy server
+type circuit struct {
+	state    CircuitState
+	failures int       // consecutive failures
+	probeAt  time.Time // when an open circuit lets a probe request through
+}
+
+// CircuitBreakers stops sending to Ntfy servers that keep failing, keyed by host, so messages fail
+// fast instead of each one waiting through all retries
+type CircuitBreakers struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// NewCircuitBreakers creates CircuitBreakers with every circuit closed
+func NewCircuitBreakers() *CircuitBreakers {
+	return &CircuitBreakers{now: time.Now, circuits: map[string]*circuit{}}
+}
+
+// defaultCircuitBreakers is shared by all Ntfy clients, so every message for a failing server fails fast
+var defaultCircuitBreakers = NewCircuitBreakers()
+
+// Allow returns an error wrapping ErrCircuitOpen if a request to host must not be sent now. Once
+// an open circuit's timeout has passed, one probe request is allowed through.
+func (c *CircuitBreakers) Allow(host string, config CircuitBreakerConfig, logger *slog.Logger) error {
+	if config.FailureThreshold <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	circ, ok := c.circuits[host]
+	if !ok {
+		return nil
+	}
+	switch circ.state {
+	case CircuitOpen:
+		if wait := circ.probeAt.Sub(c.now()); wait > 0 {
+			return fmt.Errorf("%w for %s; next probe in %s", ErrCircuitOpen, host, wait.Round(time.Second))
+		}
+		circ.state = CircuitHalfOpen
+		logger.Info("Ntfy circuit breaker half-open; sending a probe request", "host", host)
+		return nil
+	case CircuitHalfOpen:
+		return fmt.Errorf("%w for %s; waiting for the probe request", ErrCircuitOpen, host)
+	default:
+		return nil
+	}
+}
+
+// Record updates the circuit of host with the outcome of a request. Only failures that suggest the
+// server is down (no response or a 5xx status) count; any other response closes the circuit.
+func (c *CircuitBreakers) Record(host string, config CircuitBreakerConfig, failed bool, logger *slog.Logger) {
+	if config.FailureThreshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	circ, ok := c.circuits[host]
+	if !ok {
+		if !failed {
+			return
+		}
+		circ = &circuit{}
+		c.circuits[host] = circ
+	}
+
+	if !failed {
+		if circ.state != CircuitClosed {
+			logger.Info("Ntfy circuit breaker closed; server is responding again", "host", host)
+		}
+		delete(c.circuits, host)
+		return
+	}
+
+	circ.failures++
+	if circ.state == CircuitHalfOpen || (circ.state == CircuitClosed && circ.failures >= config.FailureThreshold) {
+		circ.state = CircuitOpen
+		circ.probeAt = c.now().Add(config.OpenTimeout)
+		logger.Warn("Ntfy circuit breaker open; failing messages fast until the server recovers",
+			"host", host, "consecutive_failures", circ.failures, "retry_in", config.OpenTimeout)
+	}
+}
+
+// State returns the state of the circuit of host
+func (c *CircuitBreakers) State(host string) CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if circ, ok := c.circuits[host]; ok {
+		return circ.state
+	}
+	return CircuitClosed
+}
+
+// Open returns the sorted hosts whose circuit is open or half-open
+func (c *CircuitBreakers) Open() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hosts []string
+	for host, circ := range c.circuits {
+		if circ.state != CircuitClosed {
+			hosts = append(hosts, host)
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
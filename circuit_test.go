@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Now()
+	breakers := NewCircuitBreakers()
+	breakers.now = func() time.Time { return now }
+	config := CircuitBreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute}
+	logger := testLogger()
+
+	// Failures below the threshold, or interrupted by a success, keep the circuit closed
+	breakers.Record("ntfy.sh", config, true, logger)
+	breakers.Record("ntfy.sh", config, true, logger)
+	breakers.Record("ntfy.sh", config, false, logger)
+	breakers.Record("ntfy.sh", config, true, logger)
+	breakers.Record("ntfy.sh", config, true, logger)
+	if state := breakers.State("ntfy.sh"); state != CircuitClosed {
+		t.Fatalf("State() = %s, want closed", state)
+	}
+
+	breakers.Record("ntfy.sh", config, true, logger)
+	if state := breakers.State("ntfy.sh"); state != CircuitOpen {
+		t.Fatalf("State() = %s, want open after 3 consecutive failures", state)
+	}
+	if err := breakers.Allow("ntfy.sh", config, logger); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow() = %v, want ErrCircuitOpen", err)
+	}
+	if err := breakers.Allow("ntfy.example.com", config, logger); err != nil {
+		t.Errorf("Allow(other host) = %v, want nil", err)
+	}
+	if open := breakers.Open(); len(open) != 1 || open[0] != "ntfy.sh" {
+		t.Errorf("Open() = %v, want [ntfy.sh]", open)
+	}
+
+	// After the timeout a single probe is let through; its failure opens the circuit again
+	now = now.Add(time.Minute)
+	if err := breakers.Allow("ntfy.sh", config, logger); err != nil {
+		t.Fatalf("Allow() after the timeout = %v, want a probe", err)
+	}
+	if err := breakers.Allow("ntfy.sh", config, logger); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("Allow() during the probe = %v, want ErrCircuitOpen", err)
+	}
+	breakers.Record("ntfy.sh", config, true, logger)
+	if state := breakers.State("ntfy.sh"); state != CircuitOpen {
+		t.Fatalf("State() after a failed probe = %s, want open", state)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	if err := breakers.Allow("ntfy.sh", config, logger); err != nil {
+		t.Fatalf("Allow() after the timeout = %v, want a probe", err)
+	}
+	breakers.Record("ntfy.sh", config, false, logger)
+	if state := breakers.State("ntfy.sh"); state != CircuitClosed {
+		t.Errorf("State() after a successful probe = %s, want closed", state)
+	}
+
+	// A zero threshold disables the breaker
+	for range 10 {
+		breakers.Record("disabled.example.com", CircuitBreakerConfig{}, true, logger)
+	}
+	if err := breakers.Allow("disabled.example.com", CircuitBreakerConfig{}, logger); err != nil {
+		t.Errorf("Allow() with the breaker disabled = %v, want nil", err)
+	}
+}
+
+func TestSendMessageCircuitOpen(t *testing.T) {
+	var requests atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	breakers := NewCircuitBreakers()
+	breakers.now = func() time.Time { return now }
+	config := NtfyConfig{
+		Timeout:        10 * time.Second,
+		MaxRetries:     5,
+		RetryDelay:     time.Millisecond,
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: time.Minute},
+	}
+	newClient := func() *HTTPNtfyClient {
+		client := NewNtfyClient(config, testLogger())
+		client.circuits = breakers
+		return client
+	}
+
+	// Retries stop as soon as the circuit opens
+	_, err := newClient().SendMessage(server.URL, NtfyMessage{Message: "first"}, NtfyAuth{})
+	if !errors.Is(err, ErrCircuitOpen) || !IsTransientDeliveryError(err) {
+		t.Errorf("SendMessage() = %v, want a transient ErrCircuitOpen", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Server received %d requests, want 2", got)
+	}
+
+	// Further messages fail without a request
+	if _, err := newClient().SendMessage(server.URL, NtfyMessage{Message: "second"}, NtfyAuth{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("SendMessage() = %v, want ErrCircuitOpen", err)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("Server received %d requests with the circuit open, want 2", got)
+	}
+
+	// Once the server is back, the probe delivers the message and closes the circuit
+	down.Store(false)
+	now = now.Add(time.Minute)
+	if _, err := newClient().SendMessage(server.URL, NtfyMessage{Message: "third"}, NtfyAuth{}); err != nil {
+		t.Errorf("SendMessage() after recovery = %v, want nil", err)
+	}
+	if state := breakers.State(server.Listener.Addr().String()); state != CircuitClosed {
+		t.Errorf("State() = %s, want closed", state)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMQTTClientID is used when mqtt.client_id is not set. It is the fixed ID mqtt2ntfy has
+// always used, so broker ACLs and persistent sessions keyed on it keep working; instances sharing
+// a broker need a template such as mqtt2ntfy-{hostname} instead.
+const DefaultMQTTClientID = "mqtt2ntfy"
+
+// clientIDPlaceholder matches {name} placeholders in an mqtt.client_id template
+var clientIDPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// randomClientIDSuffix is generated once per process so reconnects reuse the same client ID
+var randomClientIDSuffix = sync.OnceValue(func() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b) // never returns an error
+	return hex.EncodeToString(b)
+})
+
+// ExpandClientID replaces the {hostname}, {pid} and {random} placeholders in a client ID template
+func ExpandClientID(template string) (string, error) {
+	if err := validateClientIDTemplate("client_id", template); err != nil {
+		return "", err
+	}
+
+	var expandErr error
+	clientID := clientIDPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{hostname}":
+			hostname, err := os.Hostname()
+			if err != nil {
+				expandErr = fmt.Errorf("failed to determine hostname for MQTT client ID: %w", err)
+				return ""
+			}
+			return hostname
+		case "{pid}":
+			return strconv.Itoa(os.Getpid())
+		default: // {random}
+			return randomClientIDSuffix()
+		}
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return clientID, nil
+}
+
+// validateClientIDTemplate checks that a client ID template only uses known placeholders
+func validateClientIDTemplate(field, template string) error {
+	for _, match := range clientIDPlaceholder.FindAllStringSubmatch(template, -1) {
+		switch match[1] {
+		case "hostname", "pid", "random":
+		default:
+			return fmt.Errorf("%s contains unknown placeholder %s (supported: {hostname}, {pid}, {random})", field, match[0])
+		}
+	}
+	return nil
+}
+
+// isStableClientIDTemplate reports whether a client ID template expands to the same value after a restart
+func isStableClientIDTemplate(template string) bool {
+	return !strings.Contains(template, "{pid}") && !strings.Contains(template, "{random}")
+}
+
+// hasSharedRoute reports whether any of routes subscribes to a shared subscription, which
+// implies several replicas
+func hasSharedRoute(routes []Route) bool {
+	return slices.ContainsFunc(routes, func(route Route) bool { return strings.HasPrefix(route.Topic, "$share/") })
+}
+
+// Thresholds for reporting a client ID collision on brokers that do not send a reason (MQTT 3.1.1)
+const (
+	takeoverShortConnection = 30 * time.Second
+	takeoverWindow          = 5 * time.Minute
+	takeoverThreshold       = 3
+)
+
+// takeoverDetector recognizes another client connecting with the same client ID, which makes the
+// broker drop our connection right after every reconnect
+type takeoverDetector struct {
+	clientID string
+	logger   *slog.Logger
+	now      func() time.Time
+
+	mu          sync.Mutex
+	connectedAt time.Time
+	drops       []time.Time
+}
+
+func newTakeoverDetector(clientID string, logger *slog.Logger) *takeoverDetector {
+	return &takeoverDetector{
+		clientID: clientID,
+		logger:   logger,
+		now:      time.Now,
+	}
+}
+
+// connected records a successful (re)connect
+func (d *takeoverDetector) connected() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.connectedAt = d.now()
+}
+
+// disconnected records a lost connection and reports whether connections have repeatedly
+// been dropped shortly after connecting, as happens when two clients share a client ID
+func (d *takeoverDetector) disconnected() bool {
+	d.mu.Lock()
+	now := d.now()
+	if d.connectedAt.IsZero() || now.Sub(d.connectedAt) > takeoverShortConnection {
+		d.mu.Unlock()
+		return false
+	}
+	recent := d.drops[:0]
+	for _, drop := range d.drops {
+		if now.Sub(drop) <= takeoverWindow {
+			recent = append(recent, drop)
+		}
+	}
+	d.drops = append(recent, now)
+	count := len(d.drops)
+	d.mu.Unlock()
+
+	if count < takeoverThreshold {
+		return false
+	}
+	d.logger.Error("MQTT connection keeps dropping shortly after connecting; another client is probably using the same client ID",
+		"client_id", d.clientID, "drops", count, "window", takeoverWindow)
+	return true
+}
+
+// sessionTakenOver reports a broker DISCONNECT with reason "session taken over" (MQTT v5)
+func (d *takeoverDetector) sessionTakenOver() {
+	d.logger.Error("MQTT broker disconnected us because another client connected with the same client ID; set a unique mqtt.client_id",
+		"client_id", d.clientID)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpandClientID(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("os.Hostname failed: %v", err)
+	}
+	pid := strconv.Itoa(os.Getpid())
+
+	tests := []struct {
+		template  string
+		want      string
+		expectErr bool
+	}{
+		{template: "mqtt2ntfy", want: "mqtt2ntfy"},
+		{template: "mqtt2ntfy-{hostname}", want: "mqtt2ntfy-" + hostname},
+		{template: "bridge-{pid}", want: "bridge-" + pid},
+		{template: "{hostname}/{pid}", want: hostname + "/" + pid},
+		{template: "mqtt2ntfy-{random}", want: "mqtt2ntfy-" + randomClientIDSuffix()},
+		{template: "mqtt2ntfy-{uuid}", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ExpandClientID(tt.template)
+		if tt.expectErr {
+			if err == nil {
+				t.Errorf("ExpandClientID(%q) expected error, got %q", tt.template, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ExpandClientID(%q) unexpected error: %v", tt.template, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ExpandClientID(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+
+	if suffix := randomClientIDSuffix(); len(suffix) != 8 {
+		t.Errorf("randomClientIDSuffix() = %q, want 8 hex characters", suffix)
+	}
+}
+
+func TestIsStableClientIDTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     bool
+	}{
+		{template: "mqtt2ntfy", want: true},
+		{template: DefaultMQTTClientID, want: true},
+		{template: "mqtt2ntfy-{pid}", want: false},
+		{template: "mqtt2ntfy-{hostname}-{random}", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isStableClientIDTemplate(tt.template); got != tt.want {
+			t.Errorf("isStableClientIDTemplate(%q) = %v, want %v", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestTakeoverDetector(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	detector := newTakeoverDetector("mqtt2ntfy", testLogger())
+	detector.now = func() time.Time { return now }
+
+	// A disconnect before the first connect is not a takeover
+	if detector.disconnected() {
+		t.Error("disconnected() before connected() reported a takeover")
+	}
+
+	// Long-lived connections are ordinary network drops
+	for range 5 {
+		detector.connected()
+		now = now.Add(time.Hour)
+		if detector.disconnected() {
+			t.Fatal("disconnected() after a long-lived connection reported a takeover")
+		}
+	}
+
+	// Connections dropped right after connecting point at a client ID collision
+	var reported []bool
+	for range takeoverThreshold {
+		detector.connected()
+		now = now.Add(2 * time.Second)
+		reported = append(reported, detector.disconnected())
+		now = now.Add(10 * time.Second)
+	}
+	for i, got := range reported {
+		want := i == takeoverThreshold-1
+		if got != want {
+			t.Errorf("short drop %d reported takeover = %v, want %v", i+1, got, want)
+		}
+	}
+
+	// Old drops fall out of the window
+	now = now.Add(takeoverWindow + time.Minute)
+	detector.connected()
+	now = now.Add(time.Second)
+	if detector.disconnected() {
+		t.Error("disconnected() counted drops outside the window")
+	}
+}
+
+func TestHasSharedRoute(t *testing.T) {
+	if hasSharedRoute([]Route{{Topic: "alerts/#"}, {Topic: "weather/daily"}}) {
+		t.Error("hasSharedRoute() = true for routes without a shared subscription")
+	}
+	if !hasSharedRoute([]Route{{Topic: "alerts/#"}, {Topic: "$share/mqtt2ntfy/weather/daily"}}) {
+		t.Error("hasSharedRoute() = false for a shared subscription")
+	}
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,21 +14,43 @@ import (
 
 // Config holds the application configuration
 type Config struct {
-	MQTT struct {
-		Broker         string `yaml:"broker"`
-		Topic          string `yaml:"topic"`
-		Username       string `yaml:"username,omitempty"`
-		Password       string `yaml:"password,omitempty"`
-		ConnectTimeout string `yaml:"connect_timeout,omitempty"`
-		PingTimeout    string `yaml:"ping_timeout,omitempty"`
-	} `yaml:"mqtt"`
+	MQTT MQTTSettings `yaml:"mqtt"`
 	Ntfy struct {
-		URL        string `yaml:"url"`
-		AuthToken  string `yaml:"auth_token,omitempty"`
-		Priority   string `yaml:"priority,omitempty"`
-		Timeout    string `yaml:"timeout,omitempty"`
-		MaxRetries int    `yaml:"max_retries,omitempty"`
-		RetryDelay string `yaml:"retry_delay,omitempty"`
+		URL           string `yaml:"url"`
+		AuthToken     string `yaml:"auth_token,omitempty"`
+		AuthTokenFile string `yaml:"auth_token_file,omitempty"`
+		Username      string `yaml:"username,omitempty"`
+		Password      string `yaml:"password,omitempty"`
+		PasswordFile  string `yaml:"password_file,omitempty"`
+
+		// Credentials overrides the credentials above for individual Ntfy topics
+		Credentials map[string]NtfyCredentials `yaml:"credentials,omitempty"`
+
+		Priority    string `yaml:"priority,omitempty"`
+		Timeout     string `yaml:"timeout,omitempty"`
+		MaxRetries  int    `yaml:"max_retries,omitempty"`
+		RetryDelay  string `yaml:"retry_delay,omitempty"`
+		ResultTopic string `yaml:"result_topic,omitempty"`
+
+		// Publish options and payload format for all routes
+		NtfyOptions   `yaml:",inline"`
+		PayloadFormat string `yaml:"payload_format,omitempty"`
+		Attachment    string `yaml:"attachment,omitempty"`
+
+		// Download attach URLs and upload the files, up to a size limit
+		FetchAttach        bool   `yaml:"fetch_attach,omitempty"`
+		FetchAttachMaxSize string `yaml:"fetch_attach_max_size,omitempty"`
+		FetchAttachTimeout string `yaml:"fetch_attach_timeout,omitempty"`
+
+		MaxIdleConnections int       `yaml:"max_idle_connections,omitempty"`
+		IdleTimeout        string    `yaml:"idle_timeout,omitempty"`
+		TLS                TLSConfig `yaml:"tls,omitempty"`
+		ProxyURL           string    `yaml:"proxy_url,omitempty"`
+
+		CircuitBreaker struct {
+			FailureThreshold int    `yaml:"failure_threshold,omitempty"` // negative disables the circuit breaker
+			OpenTimeout      string `yaml:"open_timeout,omitempty"`
+		} `yaml:"circuit_breaker,omitempty"`
 	} `yaml:"ntfy"`
 	Heartbeat struct {
 		URL               string `yaml:"url,omitempty"`
@@ -34,6 +58,123 @@ type Config struct {
 		LivenessThreshold string `yaml:"liveness_threshold,omitempty"`
 		Port              int    `yaml:"port,omitempty"`
 	} `yaml:"heartbeat"`
+	Election struct {
+		Enabled    bool   `yaml:"enabled,omitempty"`
+		Topic      string `yaml:"topic,omitempty"`
+		ClaimDelay string `yaml:"claim_delay,omitempty"`
+	} `yaml:"election,omitempty"`
+	DeadLetter struct {
+		File  string `yaml:"file,omitempty"`
+		Topic string `yaml:"topic,omitempty"`
+	} `yaml:"dead_letter,omitempty"`
+	Status struct {
+		Topic         string `yaml:"topic,omitempty"`
+		StatsTopic    string `yaml:"stats_topic,omitempty"`
+		StatsInterval string `yaml:"stats_interval,omitempty"`
+	} `yaml:"status,omitempty"`
+	Callback struct {
+		Listen     string `yaml:"listen,omitempty"`
+		BaseURL    string `yaml:"base_url,omitempty"`
+		Secret     string `yaml:"secret,omitempty"`
+		SecretFile string `yaml:"secret_file,omitempty"`
+		TokenTTL   string `yaml:"token_ttl,omitempty"`
+	} `yaml:"callback,omitempty"`
+	NtfySubscribe struct {
+		StateFile string                   `yaml:"state_file,omitempty"`
+		Topics    []NtfySubscriptionConfig `yaml:"topics,omitempty"`
+	} `yaml:"ntfy_subscribe,omitempty"`
+	Backends    map[string]BackendConfig `yaml:"backends,omitempty"`
+	Routes      []RouteConfig            `yaml:"routes,omitempty"`
+	Connections []ConnectionConfig       `yaml:"connections,omitempty"`
+}
+
+// NtfySubscriptionConfig subscribes to Ntfy topics and publishes their messages to MQTT
+type NtfySubscriptionConfig struct {
+	Topic       string           `yaml:"topic"`                // one or more comma-separated Ntfy topics
+	URL         string           `yaml:"url,omitempty"`        // Ntfy server; default: that of ntfy.url
+	MQTTTopic   string           `yaml:"mqtt_topic,omitempty"` // template; default: ntfy/{{.Topic}}
+	QoS         int              `yaml:"qos,omitempty"`
+	Retain      bool             `yaml:"retain,omitempty"`
+	Since       string           `yaml:"since,omitempty"`      // where to start on the first run
+	Connection  string           `yaml:"connection,omitempty"` // default: the mqtt section's
+	Credentials *NtfyCredentials `yaml:"credentials,omitempty"`
+}
+
+// MQTTSettings holds the settings of one MQTT connection: the mqtt section or a connections entry
+type MQTTSettings struct {
+	Broker          string          `yaml:"broker"`
+	Brokers         []string        `yaml:"brokers,omitempty"` // failover brokers, tried in order after broker
+	Topic           string          `yaml:"topic"`
+	ClientID        string          `yaml:"client_id,omitempty"`
+	Username        string          `yaml:"username,omitempty"`
+	Password        string          `yaml:"password,omitempty"`
+	ConnectTimeout  string          `yaml:"connect_timeout,omitempty"`
+	PingTimeout     string          `yaml:"ping_timeout,omitempty"`
+	ProtocolVersion string          `yaml:"protocol_version,omitempty"`
+	QoS             int             `yaml:"qos,omitempty"`
+	ShareGroup      string          `yaml:"share_group,omitempty"`
+	CleanSession    *bool           `yaml:"clean_session,omitempty"`
+	SessionExpiry   string          `yaml:"session_expiry,omitempty"`
+	TLS             TLSConfig       `yaml:"tls,omitempty"`
+	WebSocket       WebSocketConfig `yaml:"websocket,omitempty"`
+}
+
+// ConnectionConfig is an additional MQTT connection with its own broker, credentials and routes;
+// its messages are delivered by the same bridge as those of the mqtt section
+type ConnectionConfig struct {
+	Name   string        `yaml:"name"`
+	MQTT   MQTTSettings  `yaml:"mqtt"`
+	Routes []RouteConfig `yaml:"routes,omitempty"`
+}
+
+// DefaultConnectionName identifies the connection configured by the mqtt section in logs
+const DefaultConnectionName = "default"
+
+// RouteConfig maps an additional MQTT topic to an Ntfy URL; unset fields default to the mqtt and ntfy sections
+type RouteConfig struct {
+	Topic       string `yaml:"topic"`
+	QoS         *int   `yaml:"qos,omitempty"`
+	ShareGroup  string `yaml:"share_group,omitempty"`
+	NtfyURL     string `yaml:"ntfy_url,omitempty"`
+	Priority    string `yaml:"priority,omitempty"`
+	ResultTopic string `yaml:"result_topic,omitempty"`
+
+	Credentials *NtfyCredentials `yaml:"credentials,omitempty"` // overrides the ntfy section's credentials
+
+	NtfyOptions   `yaml:",inline"` // overrides the ntfy section's publish options
+	PayloadFormat string           `yaml:"payload_format,omitempty"`
+	Attachment    string           `yaml:"attachment,omitempty"`
+	FetchAttach   *bool            `yaml:"fetch_attach,omitempty"`
+
+	Snapshot *SnapshotConfig `yaml:"snapshot,omitempty"`
+	Actions  []ActionButton  `yaml:"actions,omitempty"`
+
+	Backends     []string `yaml:"backends,omitempty"`      // names of backends; "ntfy" is the route's Ntfy topic
+	PushoverUser string   `yaml:"pushover_user,omitempty"` // overrides the user key of Pushover backends
+}
+
+// SnapshotConfig pairs a topic carrying images with a route's events
+type SnapshotConfig struct {
+	Topic string `yaml:"topic"`
+	Match string `yaml:"match,omitempty"` // template for the snapshot topic of an event
+	Wait  string `yaml:"wait,omitempty"`
+}
+
+// TLSConfig holds TLS settings for a connection
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file,omitempty"`
+	CertFile           string `yaml:"cert_file,omitempty"`
+	KeyFile            string `yaml:"key_file,omitempty"`
+	ServerName         string `yaml:"server_name,omitempty"`
+	MinVersion         string `yaml:"min_version,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+}
+
+// WebSocketConfig holds settings for MQTT over WebSockets (ws:// and wss:// brokers)
+type WebSocketConfig struct {
+	Path     string            `yaml:"path,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+	ProxyURL string            `yaml:"proxy_url,omitempty"`
 }
 
 // LoadConfig reads and parses the YAML configuration file
@@ -54,27 +195,170 @@ func LoadConfig(filePath string) (*Config, error) {
 
 	setDefaults(&config)
 
-	// Normalize the broker URL
-	normalizedBroker, err := normalizeBrokerURL(config.MQTT.Broker)
-	if err != nil {
-		return nil, fmt.Errorf("invalid MQTT broker URL: %w", err)
+	if err := config.loadSecretFiles(); err != nil {
+		return nil, err
+	}
+
+	// Normalize the broker URLs
+	if err := config.normalizeBrokers(); err != nil {
+		return nil, err
 	}
-	config.MQTT.Broker = normalizedBroker
 
 	return &config, nil
 }
 
 // validateConfig checks that required fields are present
 func validateConfig(config *Config) error {
-	if config.MQTT.Broker == "" {
-		return fmt.Errorf("mqtt.broker is required in config")
-	}
-	if config.MQTT.Topic == "" {
-		return fmt.Errorf("mqtt.topic is required in config")
+	if config.hasDefaultConnection() {
+		if config.MQTT.Broker == "" {
+			return fmt.Errorf("mqtt.broker is required in config")
+		}
+		if config.MQTT.Topic == "" && len(config.Routes) == 0 {
+			return fmt.Errorf("mqtt.topic is required in config")
+		}
+	} else if config.MQTT.Topic != "" || len(config.Routes) > 0 {
+		return fmt.Errorf("mqtt.broker is required when mqtt.topic or routes are set")
 	}
-	if config.Ntfy.URL == "" {
+	if config.Ntfy.URL == "" && config.needsNtfyURL() {
 		return fmt.Errorf("ntfy.url is required in config")
 	}
+	if err := validateResultTopic("ntfy.result_topic", config.Ntfy.ResultTopic); err != nil {
+		return err
+	}
+	if err := config.Ntfy.NtfyOptions.validate("ntfy"); err != nil {
+		return err
+	}
+	if err := validatePayloadFormat("ntfy.payload_format", config.Ntfy.PayloadFormat); err != nil {
+		return err
+	}
+	if err := validateAttachmentMode("ntfy.attachment", config.Ntfy.Attachment); err != nil {
+		return err
+	}
+	if config.Ntfy.FetchAttachMaxSize != "" {
+		if size, err := parseByteSize(config.Ntfy.FetchAttachMaxSize); err != nil || size <= 0 {
+			return fmt.Errorf("ntfy.fetch_attach_max_size must be a positive size like 15M (got %q)", config.Ntfy.FetchAttachMaxSize)
+		}
+	}
+	if config.Ntfy.FetchAttachTimeout != "" {
+		if d, err := time.ParseDuration(config.Ntfy.FetchAttachTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("ntfy.fetch_attach_timeout must be a positive duration (got %q)", config.Ntfy.FetchAttachTimeout)
+		}
+	}
+	if err := config.ntfyCredentials().validate("ntfy", "auth_token"); err != nil {
+		return err
+	}
+	for topic, credentials := range config.Ntfy.Credentials {
+		if err := validateCredentials("ntfy.credentials."+topic, credentials); err != nil {
+			return err
+		}
+	}
+	if err := config.Ntfy.TLS.validate("ntfy.tls"); err != nil {
+		return err
+	}
+	if config.Ntfy.ProxyURL != "" {
+		if u, err := url.Parse(config.Ntfy.ProxyURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("ntfy.proxy_url must be an http://, https:// or socks5:// URL (got %q)", config.Ntfy.ProxyURL)
+		}
+	}
+	if config.Ntfy.MaxIdleConnections < 0 {
+		return fmt.Errorf("ntfy.max_idle_connections must not be negative (got %d)", config.Ntfy.MaxIdleConnections)
+	}
+	if config.Ntfy.IdleTimeout != "" {
+		if d, err := time.ParseDuration(config.Ntfy.IdleTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("ntfy.idle_timeout must be a positive duration (got %q)", config.Ntfy.IdleTimeout)
+		}
+	}
+	if config.Ntfy.CircuitBreaker.OpenTimeout != "" {
+		if d, err := time.ParseDuration(config.Ntfy.CircuitBreaker.OpenTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("ntfy.circuit_breaker.open_timeout must be a positive duration (got %q)", config.Ntfy.CircuitBreaker.OpenTimeout)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(config.Backends)) {
+		if name == BackendNtfy {
+			return fmt.Errorf("backends.%s is reserved for the ntfy section", name)
+		}
+		if err := config.Backends[name].validate("backends." + name); err != nil {
+			return err
+		}
+	}
+	if config.hasDefaultConnection() {
+		if err := config.MQTT.validate("mqtt"); err != nil {
+			return err
+		}
+		if err := validateRoutes("routes", config.Routes, config.Backends); err != nil {
+			return err
+		}
+		if err := config.validateResultTopicLoops("routes", config.MQTT, config.Routes); err != nil {
+			return err
+		}
+	}
+
+	names := map[string]bool{DefaultConnectionName: true}
+	for i, connection := range config.Connections {
+		prefix := fmt.Sprintf("connections[%d]", i)
+		if connection.Name == "" {
+			return fmt.Errorf("%s.name is required", prefix)
+		}
+		if names[connection.Name] {
+			return fmt.Errorf("%s.name must be unique and not %q (got %q)", prefix, DefaultConnectionName, connection.Name)
+		}
+		names[connection.Name] = true
+		if connection.MQTT.Broker == "" {
+			return fmt.Errorf("%s.mqtt.broker is required in config", prefix)
+		}
+		if connection.MQTT.Topic == "" && len(connection.Routes) == 0 {
+			return fmt.Errorf("%s.mqtt.topic or %s.routes is required in config", prefix, prefix)
+		}
+		if err := connection.MQTT.validate(prefix + ".mqtt"); err != nil {
+			return err
+		}
+		if err := validateRoutes(prefix+".routes", connection.Routes, config.Backends); err != nil {
+			return err
+		}
+		if err := config.validateResultTopicLoops(prefix+".routes", connection.MQTT, connection.Routes); err != nil {
+			return err
+		}
+	}
+
+	if config.Election.Enabled && !config.hasDefaultConnection() {
+		return fmt.Errorf("election requires mqtt.broker; leader election runs on the mqtt section connection")
+	}
+	if config.Election.Topic != "" && strings.ContainsAny(config.Election.Topic, "+#") {
+		return fmt.Errorf("election.topic must not contain wildcards (got %q)", config.Election.Topic)
+	}
+	if config.Election.ClaimDelay != "" {
+		if _, err := time.ParseDuration(config.Election.ClaimDelay); err != nil {
+			return fmt.Errorf("election.claim_delay must be a duration (got %q)", config.Election.ClaimDelay)
+		}
+	}
+
+	if err := config.validateCallback(); err != nil {
+		return err
+	}
+	if err := config.validateNtfySubscribe(names); err != nil {
+		return err
+	}
+
+	if strings.ContainsAny(config.DeadLetter.Topic, "+#") {
+		return fmt.Errorf("dead_letter.topic must not contain wildcards (got %q)", config.DeadLetter.Topic)
+	}
+	if strings.ContainsAny(config.Status.Topic, "+#") {
+		return fmt.Errorf("status.topic must not contain wildcards (got %q)", config.Status.Topic)
+	}
+	if strings.ContainsAny(config.Status.StatsTopic, "+#") {
+		return fmt.Errorf("status.stats_topic must not contain wildcards (got %q)", config.Status.StatsTopic)
+	}
+	if config.Status.Topic != "" && config.Election.Enabled && !slices.Contains(strings.Split(config.Status.Topic, "/"), "{client_id}") {
+		return fmt.Errorf("status.topic must have {client_id} as a topic level when election is enabled (got %q)", config.Status.Topic)
+	}
+	if config.Status.StatsInterval != "" {
+		if _, err := time.ParseDuration(config.Status.StatsInterval); err != nil {
+			return fmt.Errorf("status.stats_interval must be a duration (got %q)", config.Status.StatsInterval)
+		}
+		if config.Status.Topic == "" && config.Status.StatsTopic == "" {
+			return fmt.Errorf("status.stats_interval requires status.topic or status.stats_topic")
+		}
+	}
 
 	// Check heartbeat configuration
 	if config.Heartbeat.URL != "" || config.Heartbeat.Port > 0 {
@@ -90,13 +374,318 @@ func validateConfig(config *Config) error {
 	return nil
 }
 
+// validate checks the settings of one MQTT connection; prefix names the config section in errors
+func (s MQTTSettings) validate(prefix string) error {
+	for i, broker := range s.Brokers {
+		if broker == "" {
+			return fmt.Errorf("%s.brokers[%d] must not be empty", prefix, i)
+		}
+	}
+	if err := validateTopicFilter(prefix+".topic", s.Topic); err != nil {
+		return err
+	}
+	if err := validateShareGroup(prefix+".share_group", s.ShareGroup); err != nil {
+		return err
+	}
+	if err := validateClientIDTemplate(prefix+".client_id", s.ClientID); err != nil {
+		return err
+	}
+	if s.QoS < 0 || s.QoS > 2 {
+		return fmt.Errorf("%s.qos must be 0, 1, or 2 (got %d)", prefix, s.QoS)
+	}
+	if s.SessionExpiry != "" {
+		if _, err := time.ParseDuration(s.SessionExpiry); err != nil {
+			return fmt.Errorf("%s.session_expiry must be a duration (got %q)", prefix, s.SessionExpiry)
+		}
+	}
+	if s.ProtocolVersion != "" && s.ProtocolVersion != MQTTProtocol311 && s.ProtocolVersion != MQTTProtocol5 {
+		return fmt.Errorf("%s.protocol_version must be %s or %s (got %q)", prefix, MQTTProtocol311, MQTTProtocol5, s.ProtocolVersion)
+	}
+	if err := s.TLS.validate(prefix + ".tls"); err != nil {
+		return err
+	}
+	return s.WebSocket.validate(prefix + ".websocket")
+}
+
+// validateRoutes checks a routes list against the configured backends; prefix names the config
+// section in errors
+func validateRoutes(prefix string, routes []RouteConfig, backends map[string]BackendConfig) error {
+	for i, route := range routes {
+		if route.Topic == "" {
+			return fmt.Errorf("%s[%d].topic is required", prefix, i)
+		}
+		if route.QoS != nil && (*route.QoS < 0 || *route.QoS > 2) {
+			return fmt.Errorf("%s[%d].qos must be 0, 1, or 2 (got %d)", prefix, i, *route.QoS)
+		}
+		if err := validateTopicFilter(fmt.Sprintf("%s[%d].topic", prefix, i), route.Topic); err != nil {
+			return err
+		}
+		if err := validateShareGroup(fmt.Sprintf("%s[%d].share_group", prefix, i), route.ShareGroup); err != nil {
+			return err
+		}
+		if err := validateResultTopic(fmt.Sprintf("%s[%d].result_topic", prefix, i), route.ResultTopic); err != nil {
+			return err
+		}
+		if err := route.NtfyOptions.validate(fmt.Sprintf("%s[%d]", prefix, i)); err != nil {
+			return err
+		}
+		if err := validatePayloadFormat(fmt.Sprintf("%s[%d].payload_format", prefix, i), route.PayloadFormat); err != nil {
+			return err
+		}
+		if err := validateAttachmentMode(fmt.Sprintf("%s[%d].attachment", prefix, i), route.Attachment); err != nil {
+			return err
+		}
+		if route.Snapshot != nil {
+			if err := route.Snapshot.validate(fmt.Sprintf("%s[%d].snapshot", prefix, i)); err != nil {
+				return err
+			}
+		}
+		if len(route.Actions) > maxNtfyActions {
+			return fmt.Errorf("%s[%d].actions must have at most %d buttons (got %d)", prefix, i, maxNtfyActions, len(route.Actions))
+		}
+		for j, action := range route.Actions {
+			if err := action.validate(fmt.Sprintf("%s[%d].actions[%d]", prefix, i, j)); err != nil {
+				return err
+			}
+		}
+		if route.Credentials != nil {
+			if err := validateCredentials(fmt.Sprintf("%s[%d].credentials", prefix, i), *route.Credentials); err != nil {
+				return err
+			}
+		}
+		if route.Backends != nil && len(route.Backends) == 0 {
+			return fmt.Errorf("%s[%d].backends must not be empty", prefix, i)
+		}
+		for j, name := range route.Backends {
+			if _, ok := backends[name]; !ok && name != BackendNtfy {
+				return fmt.Errorf("%s[%d].backends[%d] must be %q or name a backend (got %q)", prefix, i, j, BackendNtfy, name)
+			}
+			if slices.Index(route.Backends, name) != j {
+				return fmt.Errorf("%s[%d].backends lists %q more than once", prefix, i, name)
+			}
+			if backend := backends[name]; backend.Type == BackendPushover && backend.User == "" && route.PushoverUser == "" {
+				return fmt.Errorf("%s[%d].pushover_user is required because backends.%s has no user", prefix, i, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateNtfySubscribe checks the ntfy_subscribe section; connections are the known connection names
+func (c *Config) validateNtfySubscribe(connections map[string]bool) error {
+	for i, sub := range c.NtfySubscribe.Topics {
+		prefix := fmt.Sprintf("ntfy_subscribe.topics[%d]", i)
+		if sub.Topic == "" || strings.ContainsAny(sub.Topic, "/?# ") {
+			return fmt.Errorf("%s.topic must be one or more comma-separated Ntfy topics (got %q)", prefix, sub.Topic)
+		}
+		if sub.URL == "" && c.Ntfy.URL == "" {
+			return fmt.Errorf("%s.url is required when ntfy.url is not set", prefix)
+		}
+		if sub.URL != "" {
+			if u, err := url.Parse(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s.url must be an http:// or https:// URL (got %q)", prefix, sub.URL)
+			}
+		}
+		if sub.MQTTTopic != "" {
+			if _, err := parseSubscribeTopic(sub.MQTTTopic); err != nil {
+				return fmt.Errorf("%s.mqtt_topic is not a valid template: %w", prefix, err)
+			}
+			if !strings.Contains(sub.MQTTTopic, "{{") && strings.ContainsAny(sub.MQTTTopic, "+#") {
+				return fmt.Errorf("%s.mqtt_topic must not contain wildcards (got %q)", prefix, sub.MQTTTopic)
+			}
+		}
+		if sub.QoS < 0 || sub.QoS > 2 {
+			return fmt.Errorf("%s.qos must be 0, 1, or 2 (got %d)", prefix, sub.QoS)
+		}
+		if sub.Connection != "" && !connections[sub.Connection] {
+			return fmt.Errorf("%s.connection must name a connection (got %q)", prefix, sub.Connection)
+		}
+		if sub.Connection == "" && !c.hasDefaultConnection() {
+			return fmt.Errorf("%s.connection is required without mqtt.broker", prefix)
+		}
+		if sub.Credentials != nil {
+			if err := validateCredentials(prefix+".credentials", *sub.Credentials); err != nil {
+				return err
+			}
+		}
+		// Forwarding the published messages back to Ntfy would loop. Templates are rendered for a
+		// message on each of the subscription's Ntfy topics.
+		text := sub.MQTTTopic
+		if text == "" {
+			text = defaultSubscribeMQTTTopic
+		}
+		tmpl, err := parseSubscribeTopic(text)
+		if err != nil {
+			continue
+		}
+		for _, ntfyTopic := range strings.Split(sub.Topic, ",") {
+			topic, err := renderTemplate(tmpl, NtfyEvent{ID: "sample", Topic: ntfyTopic})
+			if err != nil {
+				continue
+			}
+			for _, connection := range c.GetConnections() {
+				for _, route := range connection.Routes {
+					_, filter := SplitSharedSubscription(route.Topic)
+					if TopicMatchesFilter(filter, topic) {
+						return fmt.Errorf("%s.mqtt_topic must not match the topic of a route (%q matches %q)", prefix, topic, route.Topic)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateCallback checks the callback section, which routes with actions require
+func (c *Config) validateCallback() error {
+	if !c.hasActions() {
+		return nil
+	}
+	if c.Callback.BaseURL == "" {
+		return fmt.Errorf("callback.base_url is required for routes with actions")
+	}
+	if u, err := url.Parse(c.Callback.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("callback.base_url must be an http:// or https:// URL (got %q)", c.Callback.BaseURL)
+	}
+	switch {
+	case c.Callback.Secret != "" && c.Callback.SecretFile != "":
+		return fmt.Errorf("callback.secret and callback.secret_file are mutually exclusive")
+	case c.Callback.Secret == "" && c.Callback.SecretFile == "":
+		return fmt.Errorf("callback.secret or callback.secret_file is required for routes with actions")
+	case c.Callback.SecretFile == "" && len(c.Callback.Secret) < minCallbackSecretLength:
+		return fmt.Errorf("callback.secret must be at least %d characters", minCallbackSecretLength)
+	}
+	if c.Callback.TokenTTL != "" {
+		if d, err := time.ParseDuration(c.Callback.TokenTTL); err != nil || d <= 0 {
+			return fmt.Errorf("callback.token_ttl must be a positive duration (got %q)", c.Callback.TokenTTL)
+		}
+	}
+	return nil
+}
+
+// hasActions reports whether any route has action buttons
+func (c *Config) hasActions() bool {
+	for _, route := range c.Routes {
+		if len(route.Actions) > 0 {
+			return true
+		}
+	}
+	for _, connection := range c.Connections {
+		for _, route := range connection.Routes {
+			if len(route.Actions) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validate checks a snapshot block; prefix names it in errors
+func (s SnapshotConfig) validate(prefix string) error {
+	if s.Topic == "" {
+		return fmt.Errorf("%s.topic is required", prefix)
+	}
+	if err := validateTopicFilter(prefix+".topic", s.Topic); err != nil {
+		return err
+	}
+	if isTemplate(s.Match) {
+		if _, err := parseOptionTemplate(s.Match); err != nil {
+			return fmt.Errorf("%s.match is not a valid template: %w", prefix, err)
+		}
+	} else if s.Match != "" && !TopicMatchesFilter(s.Topic, s.Match) {
+		return fmt.Errorf("%s.match must be a topic matching %s.topic (got %q)", prefix, prefix, s.Match)
+	}
+	if s.Wait != "" {
+		if d, err := time.ParseDuration(s.Wait); err != nil || d <= 0 {
+			return fmt.Errorf("%s.wait must be a positive duration (got %q)", prefix, s.Wait)
+		}
+	}
+	return nil
+}
+
+// pairing returns the snapshot pairing of a route, with the default wait if none is set
+func (s SnapshotConfig) pairing() *SnapshotPairing {
+	wait := defaultSnapshotWait
+	if d, err := time.ParseDuration(s.Wait); err == nil && d > 0 {
+		wait = d
+	}
+	return &SnapshotPairing{Topic: s.Topic, Match: s.Match, Wait: wait}
+}
+
+// validateCredentials checks a credentials block, which must set a token or a username
+func validateCredentials(prefix string, credentials NtfyCredentials) error {
+	if credentials.isEmpty() {
+		return fmt.Errorf("%s must set token or username", prefix)
+	}
+	return credentials.validate(prefix, "token")
+}
+
+// validateResultTopic checks that a result topic template parses and only uses known fields
+func validateResultTopic(field, text string) error {
+	if text == "" {
+		return nil
+	}
+	if _, err := parseResultTopic(text); err != nil {
+		return fmt.Errorf("%s is not a valid template: %w", field, err)
+	}
+	return nil
+}
+
+// validateResultTopicLoops checks that no route of a connection publishes its receipts on a topic
+// the connection subscribes to, which would forward every receipt again. Templates are rendered
+// for a sample topic of each route.
+func (c *Config) validateResultTopicLoops(prefix string, settings MQTTSettings, configs []RouteConfig) error {
+	routes := c.buildRoutes(settings, configs)
+	var filters []string
+	for _, route := range routes {
+		filters = append(filters, route.Topic)
+		if route.Snapshot != nil {
+			filters = append(filters, route.Snapshot.Topic)
+		}
+	}
+	for i, route := range routes {
+		if route.ResultTopic == "" {
+			continue
+		}
+		field := "ntfy.result_topic"
+		if j := i - (len(routes) - len(configs)); j >= 0 && configs[j].ResultTopic != "" {
+			field = fmt.Sprintf("%s[%d].result_topic", prefix, j)
+		}
+		tmpl, err := parseResultTopic(route.ResultTopic)
+		if err != nil {
+			continue // reported by validateResultTopic
+		}
+		sample := sampleTopic(route.Topic)
+		topic, err := renderTemplate(tmpl, resultTopicData{Topic: sample, Subscription: route.Topic})
+		if err != nil {
+			continue
+		}
+		for _, filter := range filters {
+			if TopicMatchesFilter(filter, topic) {
+				return fmt.Errorf("%s must be outside the topics the routes subscribe to (got %q for a message on %s, which %s matches)", field, topic, sample, filter)
+			}
+		}
+	}
+	return nil
+}
+
+// sampleTopic returns a topic matched by filter, with "example" for its wildcards
+func sampleTopic(filter string) string {
+	_, filter = SplitSharedSubscription(filter)
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "+" || level == "#" {
+			levels[i] = "example"
+		}
+	}
+	return strings.Join(levels, "/")
+}
+
 // setDefaults sets default values for optional configuration fields
 func setDefaults(config *Config) {
-	if config.MQTT.ConnectTimeout == "" {
-		config.MQTT.ConnectTimeout = "30s"
-	}
-	if config.MQTT.PingTimeout == "" {
-		config.MQTT.PingTimeout = "10s"
+	config.MQTT.setDefaults()
+	for i := range config.Connections {
+		config.Connections[i].MQTT.setDefaults()
 	}
 	if config.Ntfy.Timeout == "" {
 		config.Ntfy.Timeout = "10s"
@@ -107,6 +696,49 @@ func setDefaults(config *Config) {
 	if config.Ntfy.RetryDelay == "" {
 		config.Ntfy.RetryDelay = "1s"
 	}
+	if config.Ntfy.MaxIdleConnections == 0 {
+		config.Ntfy.MaxIdleConnections = 16
+	}
+	if config.Ntfy.IdleTimeout == "" {
+		config.Ntfy.IdleTimeout = "90s"
+	}
+	if config.Ntfy.FetchAttachMaxSize == "" {
+		config.Ntfy.FetchAttachMaxSize = "15M"
+	}
+	if config.Ntfy.FetchAttachTimeout == "" {
+		config.Ntfy.FetchAttachTimeout = "10s"
+	}
+	if config.Callback.Listen == "" {
+		config.Callback.Listen = ":8081"
+	}
+	for name, backend := range config.Backends {
+		backend.setDefaults()
+		config.Backends[name] = backend
+	}
+	if config.Callback.TokenTTL == "" {
+		config.Callback.TokenTTL = "1h"
+	}
+	if config.Ntfy.CircuitBreaker.FailureThreshold == 0 {
+		config.Ntfy.CircuitBreaker.FailureThreshold = 5
+	}
+	if config.Ntfy.CircuitBreaker.OpenTimeout == "" {
+		config.Ntfy.CircuitBreaker.OpenTimeout = "30s"
+	}
+
+	// Only set election defaults if election is enabled
+	if config.Election.Enabled {
+		if config.Election.Topic == "" {
+			config.Election.Topic = "mqtt2ntfy/leader"
+		}
+		if config.Election.ClaimDelay == "" {
+			config.Election.ClaimDelay = "2s"
+		}
+	}
+
+	// Stats are published below the status topic unless a stats topic is set
+	if config.Status.StatsTopic == "" && config.Status.StatsInterval != "" && config.Status.Topic != "" {
+		config.Status.StatsTopic = config.Status.Topic + "/stats"
+	}
 
 	// Only set heartbeat defaults if heartbeat is configured
 	if config.Heartbeat.URL != "" || config.Heartbeat.Port > 0 {
@@ -122,24 +754,404 @@ func setDefaults(config *Config) {
 	}
 }
 
+// setDefaults sets default values for the optional settings of one MQTT connection
+func (s *MQTTSettings) setDefaults() {
+	if s.ConnectTimeout == "" {
+		s.ConnectTimeout = "30s"
+	}
+	if s.PingTimeout == "" {
+		s.PingTimeout = "10s"
+	}
+	if s.ClientID == "" {
+		s.ClientID = DefaultMQTTClientID
+	}
+	if s.SessionExpiry == "" && !s.GetCleanSession() {
+		s.SessionExpiry = "24h"
+	}
+}
+
+// normalizeBrokers normalizes the broker URLs of every configured connection
+func (c *Config) normalizeBrokers() error {
+	if c.MQTT.Broker != "" {
+		if err := c.MQTT.normalizeBrokers(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Connections {
+		if err := c.Connections[i].MQTT.normalizeBrokers(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeBrokers normalizes broker and the failover brokers
+func (s *MQTTSettings) normalizeBrokers() error {
+	normalizedBroker, err := normalizeBrokerURL(s.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker URL: %w", err)
+	}
+	s.Broker = normalizedBroker
+	for i, broker := range s.Brokers {
+		normalizedBroker, err := normalizeBrokerURL(broker)
+		if err != nil {
+			return fmt.Errorf("invalid MQTT broker URL: %w", err)
+		}
+		s.Brokers[i] = normalizedBroker
+	}
+	return nil
+}
+
 // GetMQTTConnectTimeout parses the MQTT connect timeout duration
 func (c *Config) GetMQTTConnectTimeout() time.Duration {
-	duration, err := time.ParseDuration(c.MQTT.ConnectTimeout)
+	return c.MQTT.GetConnectTimeout()
+}
+
+// GetMQTTPingTimeout parses the MQTT ping timeout duration
+func (c *Config) GetMQTTPingTimeout() time.Duration {
+	return c.MQTT.GetPingTimeout()
+}
+
+// GetMQTTClientID expands the placeholders in the MQTT client ID template
+func (c *Config) GetMQTTClientID() (string, error) {
+	return c.MQTT.GetClientID()
+}
+
+// GetMQTTCleanSession reports whether the broker should discard the session on connect (default: true)
+func (c *Config) GetMQTTCleanSession() bool {
+	return c.MQTT.GetCleanSession()
+}
+
+// GetMQTTSessionExpiry parses how long an MQTT v5 broker keeps a persistent session
+func (c *Config) GetMQTTSessionExpiry() time.Duration {
+	return c.MQTT.GetSessionExpiry()
+}
+
+// GetConnectTimeout parses the connect timeout duration
+func (s *MQTTSettings) GetConnectTimeout() time.Duration {
+	duration, err := time.ParseDuration(s.ConnectTimeout)
 	if err != nil {
 		return 30 * time.Second // fallback default
 	}
 	return duration
 }
 
-// GetMQTTPingTimeout parses the MQTT ping timeout duration
-func (c *Config) GetMQTTPingTimeout() time.Duration {
-	duration, err := time.ParseDuration(c.MQTT.PingTimeout)
+// GetPingTimeout parses the ping timeout duration
+func (s *MQTTSettings) GetPingTimeout() time.Duration {
+	duration, err := time.ParseDuration(s.PingTimeout)
 	if err != nil {
 		return 10 * time.Second // fallback default
 	}
 	return duration
 }
 
+// GetClientID expands the placeholders in the client ID template
+func (s *MQTTSettings) GetClientID() (string, error) {
+	template := s.ClientID
+	if template == "" {
+		template = DefaultMQTTClientID
+	}
+	return ExpandClientID(template)
+}
+
+// GetCleanSession reports whether the broker should discard the session on connect (default: true)
+func (s *MQTTSettings) GetCleanSession() bool {
+	return s.CleanSession == nil || *s.CleanSession
+}
+
+// GetSessionExpiry parses how long an MQTT v5 broker keeps a persistent session
+func (s *MQTTSettings) GetSessionExpiry() time.Duration {
+	if s.GetCleanSession() {
+		return 0
+	}
+	duration, err := time.ParseDuration(s.SessionExpiry)
+	if err != nil {
+		return 24 * time.Hour // fallback default
+	}
+	return duration
+}
+
+// GetMQTTConfig builds the client configuration for this connection
+func (s *MQTTSettings) GetMQTTConfig() (MQTTConfig, error) {
+	clientID, err := s.GetClientID()
+	if err != nil {
+		return MQTTConfig{}, err
+	}
+	return MQTTConfig{
+		Broker:          s.Broker,
+		FailoverBrokers: s.Brokers,
+		ClientID:        clientID,
+		Username:        s.Username,
+		Password:        s.Password,
+		ProtocolVersion: s.ProtocolVersion,
+		CleanSession:    s.GetCleanSession(),
+		SessionExpiry:   s.GetSessionExpiry(),
+		ConnectTimeout:  s.GetConnectTimeout(),
+		PingTimeout:     s.GetPingTimeout(),
+		TLS:             s.TLS,
+		WebSocket:       s.WebSocket,
+	}, nil
+}
+
+// Connection is one MQTT connection and the routes it bridges
+type Connection struct {
+	Name   string
+	MQTT   MQTTSettings
+	Routes []Route
+}
+
+// GetConnections returns the mqtt section connection (if it has a broker) followed by the configured connections
+func (c *Config) GetConnections() []Connection {
+	var connections []Connection
+	if c.hasDefaultConnection() {
+		connections = append(connections, Connection{Name: DefaultConnectionName, MQTT: c.MQTT, Routes: c.GetRoutes()})
+	}
+	for _, connection := range c.Connections {
+		connections = append(connections, Connection{
+			Name:   connection.Name,
+			MQTT:   connection.MQTT,
+			Routes: c.buildRoutes(connection.MQTT, connection.Routes),
+		})
+	}
+	// Action buttons publish their commands on the connection of their route
+	for _, connection := range connections {
+		for i := range connection.Routes {
+			connection.Routes[i].Connection = connection.Name
+		}
+	}
+	return connections
+}
+
+// hasDefaultConnection reports whether the mqtt section configures a connection; it may be left
+// out when all brokers are listed under connections
+func (c *Config) hasDefaultConnection() bool {
+	return c.MQTT.Broker != "" || len(c.Connections) == 0
+}
+
+// GetRoutes returns the route for mqtt.topic (if set) followed by the configured routes,
+// with unset fields filled in from the mqtt and ntfy sections
+func (c *Config) GetRoutes() []Route {
+	return c.buildRoutes(c.MQTT, c.Routes)
+}
+
+// buildRoutes returns the route for the connection's topic (if set) followed by its routes,
+// with unset fields filled in from the connection settings and the ntfy section
+func (c *Config) buildRoutes(settings MQTTSettings, configs []RouteConfig) []Route {
+	var routes []Route
+	if settings.Topic != "" {
+		routes = append(routes, Route{
+			Topic:       sharedRouteTopic(settings.ShareGroup, settings.Topic),
+			QoS:         byte(settings.QoS),
+			NtfyURL:     c.Ntfy.URL,
+			Priority:    c.Ntfy.Priority,
+			ResultTopic: c.Ntfy.ResultTopic,
+
+			Options:       c.Ntfy.NtfyOptions,
+			PayloadFormat: c.Ntfy.PayloadFormat,
+			Attachment:    c.Ntfy.Attachment,
+			FetchAttach:   c.Ntfy.FetchAttach,
+		})
+	}
+	for _, rc := range configs {
+		shareGroup := rc.ShareGroup
+		if shareGroup == "" {
+			shareGroup = settings.ShareGroup
+		}
+		route := Route{
+			Topic:       sharedRouteTopic(shareGroup, rc.Topic),
+			QoS:         byte(settings.QoS),
+			NtfyURL:     rc.NtfyURL,
+			Priority:    rc.Priority,
+			ResultTopic: rc.ResultTopic,
+
+			Options:       rc.NtfyOptions.merge(c.Ntfy.NtfyOptions),
+			PayloadFormat: rc.PayloadFormat,
+			Attachment:    rc.Attachment,
+			FetchAttach:   c.Ntfy.FetchAttach,
+		}
+		if rc.QoS != nil {
+			route.QoS = byte(*rc.QoS)
+		}
+		if route.NtfyURL == "" {
+			route.NtfyURL = c.Ntfy.URL
+		}
+		if route.Priority == "" {
+			route.Priority = c.Ntfy.Priority
+		}
+		if route.ResultTopic == "" {
+			route.ResultTopic = c.Ntfy.ResultTopic
+		}
+		if route.PayloadFormat == "" {
+			route.PayloadFormat = c.Ntfy.PayloadFormat
+		}
+		if route.Attachment == "" {
+			route.Attachment = c.Ntfy.Attachment
+		}
+		if rc.FetchAttach != nil {
+			route.FetchAttach = *rc.FetchAttach
+		}
+		if rc.Snapshot != nil {
+			route.Snapshot = rc.Snapshot.pairing()
+		}
+		if len(rc.Actions) > 0 {
+			actions := rc.Actions
+			route.Actions = &actions
+		}
+		if len(rc.Backends) > 0 {
+			backends := rc.Backends
+			route.Backends = &backends
+		}
+		route.PushoverUser = rc.PushoverUser
+		if rc.Credentials != nil {
+			auth := rc.Credentials.auth()
+			route.Auth = &auth
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// ntfyCredentials returns the default Ntfy credentials of the ntfy section
+func (c *Config) ntfyCredentials() NtfyCredentials {
+	return NtfyCredentials{
+		Token:        c.Ntfy.AuthToken,
+		TokenFile:    c.Ntfy.AuthTokenFile,
+		Username:     c.Ntfy.Username,
+		Password:     c.Ntfy.Password,
+		PasswordFile: c.Ntfy.PasswordFile,
+	}
+}
+
+// loadSecretFiles replaces every token and password file setting with the contents of the file
+func (c *Config) loadSecretFiles() error {
+	credentials := c.ntfyCredentials()
+	if err := credentials.loadFiles("ntfy", "auth_token"); err != nil {
+		return err
+	}
+	c.Ntfy.AuthToken, c.Ntfy.AuthTokenFile = credentials.Token, ""
+	c.Ntfy.Password, c.Ntfy.PasswordFile = credentials.Password, ""
+
+	for topic, credentials := range c.Ntfy.Credentials {
+		if err := credentials.loadFiles("ntfy.credentials."+topic, "token"); err != nil {
+			return err
+		}
+		c.Ntfy.Credentials[topic] = credentials
+	}
+
+	loadRoutes := func(prefix string, routes []RouteConfig) error {
+		for i, route := range routes {
+			if route.Credentials == nil {
+				continue
+			}
+			if err := route.Credentials.loadFiles(fmt.Sprintf("%s[%d].credentials", prefix, i), "token"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := loadRoutes("routes", c.Routes); err != nil {
+		return err
+	}
+	for i, connection := range c.Connections {
+		if err := loadRoutes(fmt.Sprintf("connections[%d].routes", i), connection.Routes); err != nil {
+			return err
+		}
+	}
+
+	for i, sub := range c.NtfySubscribe.Topics {
+		if sub.Credentials == nil {
+			continue
+		}
+		if err := sub.Credentials.loadFiles(fmt.Sprintf("ntfy_subscribe.topics[%d].credentials", i), "token"); err != nil {
+			return err
+		}
+	}
+
+	for name, backend := range c.Backends {
+		if err := backend.loadFiles("backends." + name); err != nil {
+			return err
+		}
+		c.Backends[name] = backend
+	}
+
+	if c.Callback.SecretFile != "" {
+		secret, err := readSecretFile(c.Callback.SecretFile)
+		if err != nil {
+			return fmt.Errorf("callback.secret_file: %w", err)
+		}
+		if len(secret) < minCallbackSecretLength {
+			return fmt.Errorf("callback.secret_file must contain at least %d characters", minCallbackSecretLength)
+		}
+		c.Callback.Secret, c.Callback.SecretFile = secret, ""
+	}
+	return nil
+}
+
+// GetNtfyAuth returns the default credentials for publishing to Ntfy
+func (c *Config) GetNtfyAuth() NtfyAuth {
+	return c.ntfyCredentials().auth()
+}
+
+// GetNtfyTopicAuth returns the credentials configured for individual Ntfy topics
+func (c *Config) GetNtfyTopicAuth() map[string]NtfyAuth {
+	topicAuth := make(map[string]NtfyAuth, len(c.Ntfy.Credentials))
+	for topic, credentials := range c.Ntfy.Credentials {
+		topicAuth[topic] = credentials.auth()
+	}
+	return topicAuth
+}
+
+// sharedRouteTopic prefixes topic with $share/<group>/ unless it already is a shared subscription
+func sharedRouteTopic(group, topic string) string {
+	if existing, _ := SplitSharedSubscription(topic); existing != "" {
+		return topic
+	}
+	return SharedSubscription(group, topic)
+}
+
+// validateTopicFilter checks that a $share/ topic names both a group and a topic filter
+func validateTopicFilter(field, topic string) error {
+	if !strings.HasPrefix(topic, sharedSubscriptionPrefix) {
+		return nil
+	}
+	if group, filter := SplitSharedSubscription(topic); group == "" || filter == "" {
+		return fmt.Errorf("%s must have the form $share/<group>/<topic> (got %q)", field, topic)
+	}
+	return nil
+}
+
+// validateShareGroup checks that a shared subscription group name is a single topic level without wildcards
+func validateShareGroup(field, group string) error {
+	if strings.ContainsAny(group, "/+#") {
+		return fmt.Errorf("%s must not contain /, + or # (got %q)", field, group)
+	}
+	return nil
+}
+
+// needsNtfyURL reports whether any connection has a topic or route that delivers to Ntfy without its own ntfy_url
+func (c *Config) needsNtfyURL() bool {
+	needs := func(topic string, routes []RouteConfig) bool {
+		if topic != "" || len(routes) == 0 {
+			return true
+		}
+		for _, route := range routes {
+			if route.NtfyURL == "" && (route.Backends == nil || slices.Contains(route.Backends, BackendNtfy)) {
+				return true
+			}
+		}
+		return false
+	}
+	if c.hasDefaultConnection() && needs(c.MQTT.Topic, c.Routes) {
+		return true
+	}
+	for _, connection := range c.Connections {
+		if needs(connection.MQTT.Topic, connection.Routes) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetNtfyTimeout parses the Ntfy timeout duration
 func (c *Config) GetNtfyTimeout() time.Duration {
 	duration, err := time.ParseDuration(c.Ntfy.Timeout)
@@ -158,6 +1170,124 @@ func (c *Config) GetNtfyRetryDelay() time.Duration {
 	return duration
 }
 
+// GetNtfyIdleTimeout parses how long idle connections to Ntfy servers are kept open
+func (c *Config) GetNtfyIdleTimeout() time.Duration {
+	duration, err := time.ParseDuration(c.Ntfy.IdleTimeout)
+	if err != nil {
+		return 90 * time.Second // fallback default
+	}
+	return duration
+}
+
+// GetNtfyProxyURL parses the Ntfy proxy URL; nil means the proxy environment variables apply
+func (c *Config) GetNtfyProxyURL() *url.URL {
+	if c.Ntfy.ProxyURL == "" {
+		return nil
+	}
+	proxyURL, err := url.Parse(c.Ntfy.ProxyURL)
+	if err != nil {
+		return nil
+	}
+	return proxyURL
+}
+
+// GetNtfySubscriptions returns the Ntfy subscriptions with unset fields filled in: the server of
+// ntfy.url, the mqtt section's connection and the credentials for the topic or the default ones
+func (c *Config) GetNtfySubscriptions() []NtfySubscription {
+	topicAuth := c.GetNtfyTopicAuth()
+	var subscriptions []NtfySubscription
+	for _, sub := range c.NtfySubscribe.Topics {
+		subscription := NtfySubscription{
+			URL:        sub.URL,
+			Topic:      sub.Topic,
+			MQTTTopic:  sub.MQTTTopic,
+			QoS:        byte(sub.QoS),
+			Retain:     sub.Retain,
+			Since:      sub.Since,
+			Auth:       c.GetNtfyAuth(),
+			Connection: sub.Connection,
+		}
+		if subscription.URL == "" {
+			if u, err := url.Parse(c.Ntfy.URL); err == nil {
+				subscription.URL = u.Scheme + "://" + u.Host
+			}
+		}
+		if subscription.MQTTTopic == "" {
+			subscription.MQTTTopic = defaultSubscribeMQTTTopic
+		}
+		if subscription.Connection == "" {
+			subscription.Connection = DefaultConnectionName
+		}
+		if auth, ok := topicAuth[sub.Topic]; ok {
+			subscription.Auth = auth
+		}
+		if sub.Credentials != nil {
+			subscription.Auth = sub.Credentials.auth()
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// GetCallbackConfig returns the settings of the action callback server
+func (c *Config) GetCallbackConfig() CallbackConfig {
+	ttl, err := time.ParseDuration(c.Callback.TokenTTL)
+	if err != nil || ttl <= 0 {
+		ttl = time.Hour // fallback default
+	}
+	return CallbackConfig{
+		Listen:   c.Callback.Listen,
+		BaseURL:  c.Callback.BaseURL,
+		Secret:   []byte(c.Callback.Secret),
+		TokenTTL: ttl,
+	}
+}
+
+// GetAttachmentFetch returns the limits for downloading attach URLs
+func (c *Config) GetAttachmentFetch() AttachmentFetchConfig {
+	config := AttachmentFetchConfig{MaxSize: defaultFetchMaxSize, Timeout: defaultFetchTimeout}
+	if size, err := parseByteSize(c.Ntfy.FetchAttachMaxSize); err == nil && size > 0 {
+		config.MaxSize = size
+	}
+	if d, err := time.ParseDuration(c.Ntfy.FetchAttachTimeout); err == nil && d > 0 {
+		config.Timeout = d
+	}
+	return config
+}
+
+// GetNtfyCircuitBreaker returns the circuit breaker settings; a negative failure threshold disables it
+func (c *Config) GetNtfyCircuitBreaker() CircuitBreakerConfig {
+	openTimeout, err := time.ParseDuration(c.Ntfy.CircuitBreaker.OpenTimeout)
+	if err != nil {
+		openTimeout = 30 * time.Second // fallback default
+	}
+	return CircuitBreakerConfig{
+		FailureThreshold: max(c.Ntfy.CircuitBreaker.FailureThreshold, 0),
+		OpenTimeout:      openTimeout,
+	}
+}
+
+// GetElectionClaimDelay parses how long to wait for an existing leader before claiming leadership
+func (c *Config) GetElectionClaimDelay() time.Duration {
+	duration, err := time.ParseDuration(c.Election.ClaimDelay)
+	if err != nil {
+		return 2 * time.Second // fallback default
+	}
+	return duration
+}
+
+// GetStatusStatsInterval parses how often stats are published; 0 disables stats
+func (c *Config) GetStatusStatsInterval() time.Duration {
+	if c.Status.StatsInterval == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(c.Status.StatsInterval)
+	if err != nil {
+		return time.Minute // fallback default
+	}
+	return duration
+}
+
 // GetHeartbeatInterval parses the heartbeat interval duration
 func (c *Config) GetHeartbeatInterval() time.Duration {
 	duration, err := time.ParseDuration(c.Heartbeat.Interval)
@@ -176,7 +1306,33 @@ func (c *Config) GetHeartbeatLivenessThreshold() time.Duration {
 	return duration
 }
 
-// normalizeBrokerURL adds default protocol (tcp://) and port (1883) if not specified
+// validate checks the WebSocket settings; prefix names the config section in errors
+func (w WebSocketConfig) validate(prefix string) error {
+	if w.Path != "" && !strings.HasPrefix(w.Path, "/") {
+		return fmt.Errorf("%s.path must start with / (got %q)", prefix, w.Path)
+	}
+	if w.ProxyURL != "" {
+		proxyURL, err := url.Parse(w.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return fmt.Errorf("%s.proxy_url must be an absolute URL (got %q)", prefix, w.ProxyURL)
+		}
+	}
+	return nil
+}
+
+// defaultBrokerPorts maps broker URL schemes to the port used when none is specified
+var defaultBrokerPorts = map[string]string{
+	"tcp":      "1883",
+	"ssl":      "8883",
+	"tls":      "8883",
+	"mqtts":    "8883",
+	"mqtt+ssl": "8883",
+	"tcps":     "8883",
+	"ws":       "80",
+	"wss":      "443",
+}
+
+// normalizeBrokerURL adds default protocol (tcp://) and port (1883; 8883 for TLS; 80/443 for ws/wss) if not specified
 func normalizeBrokerURL(broker string) (string, error) {
 	if broker == "" {
 		return "", fmt.Errorf("broker URL cannot be empty")
@@ -195,13 +1351,13 @@ func normalizeBrokerURL(broker string) (string, error) {
 		return "", fmt.Errorf("failed to parse broker URL '%s': %w", originalBroker, err)
 	}
 
-	// Only add default port for tcp and ssl schemes
-	if (parsedURL.Scheme == "tcp" || parsedURL.Scheme == "ssl") && parsedURL.Port() == "" {
+	// Only add default port for schemes with a well-known port
+	if defaultPort, ok := defaultBrokerPorts[parsedURL.Scheme]; ok && parsedURL.Port() == "" {
 		// Check if we have just a hostname or hostname:port
 		host := parsedURL.Host
 		if !strings.Contains(host, ":") {
-			// No port specified, add default MQTT port
-			parsedURL.Host = host + ":1883"
+			// No port specified, add default port for the scheme
+			parsedURL.Host = host + ":" + defaultPort
 		}
 	}
 
@@ -246,13 +1402,9 @@ func LoadConfigWithOverrides(configPath string, flags FlagConfig) (*Config, erro
 		return nil, err
 	}
 
-	// Normalize broker URL
-	if config.MQTT.Broker != "" {
-		normalizedBroker, err := normalizeBrokerURL(config.MQTT.Broker)
-		if err != nil {
-			return nil, fmt.Errorf("invalid MQTT broker URL: %w", err)
-		}
-		config.MQTT.Broker = normalizedBroker
+	// Normalize broker URLs
+	if err := config.normalizeBrokers(); err != nil {
+		return nil, err
 	}
 
 	return &config, nil
@@ -298,13 +1450,15 @@ func applyFlagOverrides(config *Config, flags FlagConfig) {
 
 // validateRequiredConfig validates that all required configuration is present
 func validateRequiredConfig(config *Config) error {
-	if config.MQTT.Broker == "" {
-		return fmt.Errorf("MQTT broker is required (use --mqtt-broker flag, config file, or both)")
-	}
-	if config.MQTT.Topic == "" {
-		return fmt.Errorf("MQTT topic is required (use --mqtt-topic flag, config file, or both)")
+	if config.hasDefaultConnection() {
+		if config.MQTT.Broker == "" {
+			return fmt.Errorf("MQTT broker is required (use --mqtt-broker flag, config file, or both)")
+		}
+		if config.MQTT.Topic == "" && len(config.Routes) == 0 {
+			return fmt.Errorf("MQTT topic is required (use --mqtt-topic flag, config file, or both)")
+		}
 	}
-	if config.Ntfy.URL == "" {
+	if config.Ntfy.URL == "" && config.needsNtfyURL() {
 		return fmt.Errorf("ntfy URL is required (use --ntfy-url flag, config file, or both)")
 	}
 	return nil
@@ -3,7 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -105,100 +109,850 @@ func TestLoadConfigInvalidYAML(t *testing.T) {
 	}
 }
 
+// newTestConfig builds a Config with the required fields set
+func newTestConfig(broker, topic, ntfyURL string) Config {
+	var config Config
+	config.MQTT.Broker = broker
+	config.MQTT.Topic = topic
+	config.Ntfy.URL = ntfyURL
+	return config
+}
+
 func TestValidateConfig(t *testing.T) {
+	withMQTTTLS := func(tlsConfig TLSConfig) Config {
+		config := newTestConfig("ssl://localhost:8883", "test/topic", "https://ntfy.sh/test")
+		config.MQTT.TLS = tlsConfig
+		return config
+	}
+
 	tests := []struct {
 		name   string
 		config Config
 		want   error
 	}{
 		{
-			name: "valid config",
-			config: Config{
-				MQTT: struct {
-					Broker         string `yaml:"broker"`
-					Topic          string `yaml:"topic"`
-					Username       string `yaml:"username,omitempty"`
-					Password       string `yaml:"password,omitempty"`
-					ConnectTimeout string `yaml:"connect_timeout,omitempty"`
-					PingTimeout    string `yaml:"ping_timeout,omitempty"`
-				}{Broker: "tcp://localhost:1883", Topic: "test/topic"},
-				Ntfy: struct {
-					URL        string `yaml:"url"`
-					AuthToken  string `yaml:"auth_token,omitempty"`
-					Priority   string `yaml:"priority,omitempty"`
-					Timeout    string `yaml:"timeout,omitempty"`
-					MaxRetries int    `yaml:"max_retries,omitempty"`
-					RetryDelay string `yaml:"retry_delay,omitempty"`
-				}{URL: "https://ntfy.sh/test"},
-			},
+			name:   "valid config",
+			config: newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test"),
+			want:   nil,
+		},
+		{
+			name:   "missing mqtt.broker",
+			config: newTestConfig("", "test/topic", "https://ntfy.sh/test"),
+			want:   fmt.Errorf("mqtt.broker is required in config"),
+		},
+		{
+			name:   "missing mqtt.topic",
+			config: newTestConfig("tcp://localhost:1883", "", "https://ntfy.sh/test"),
+			want:   fmt.Errorf("mqtt.topic is required in config"),
+		},
+		{
+			name:   "missing ntfy.url",
+			config: newTestConfig("tcp://localhost:1883", "test/topic", ""),
+			want:   fmt.Errorf("ntfy.url is required in config"),
+		},
+		{
+			name: "mqtt.protocol_version 5",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.ProtocolVersion = "5"
+				return config
+			}(),
 			want: nil,
 		},
 		{
-			name: "missing mqtt.broker",
-			config: Config{
-				MQTT: struct {
-					Broker         string `yaml:"broker"`
-					Topic          string `yaml:"topic"`
-					Username       string `yaml:"username,omitempty"`
-					Password       string `yaml:"password,omitempty"`
-					ConnectTimeout string `yaml:"connect_timeout,omitempty"`
-					PingTimeout    string `yaml:"ping_timeout,omitempty"`
-				}{Topic: "test/topic"},
-				Ntfy: struct {
-					URL        string `yaml:"url"`
-					AuthToken  string `yaml:"auth_token,omitempty"`
-					Priority   string `yaml:"priority,omitempty"`
-					Timeout    string `yaml:"timeout,omitempty"`
-					MaxRetries int    `yaml:"max_retries,omitempty"`
-					RetryDelay string `yaml:"retry_delay,omitempty"`
-				}{URL: "https://ntfy.sh/test"},
-			},
-			want: fmt.Errorf("mqtt.broker is required in config"),
-		},
-		{
-			name: "missing mqtt.topic",
-			config: Config{
-				MQTT: struct {
-					Broker         string `yaml:"broker"`
-					Topic          string `yaml:"topic"`
-					Username       string `yaml:"username,omitempty"`
-					Password       string `yaml:"password,omitempty"`
-					ConnectTimeout string `yaml:"connect_timeout,omitempty"`
-					PingTimeout    string `yaml:"ping_timeout,omitempty"`
-				}{Broker: "tcp://localhost:1883"},
-				Ntfy: struct {
-					URL        string `yaml:"url"`
-					AuthToken  string `yaml:"auth_token,omitempty"`
-					Priority   string `yaml:"priority,omitempty"`
-					Timeout    string `yaml:"timeout,omitempty"`
-					MaxRetries int    `yaml:"max_retries,omitempty"`
-					RetryDelay string `yaml:"retry_delay,omitempty"`
-				}{URL: "https://ntfy.sh/test"},
-			},
-			want: fmt.Errorf("mqtt.topic is required in config"),
-		},
-		{
-			name: "missing ntfy.url",
-			config: Config{
-				MQTT: struct {
-					Broker         string `yaml:"broker"`
-					Topic          string `yaml:"topic"`
-					Username       string `yaml:"username,omitempty"`
-					Password       string `yaml:"password,omitempty"`
-					ConnectTimeout string `yaml:"connect_timeout,omitempty"`
-					PingTimeout    string `yaml:"ping_timeout,omitempty"`
-				}{Broker: "tcp://localhost:1883", Topic: "test/topic"},
-				Ntfy: struct {
-					URL        string `yaml:"url"`
-					AuthToken  string `yaml:"auth_token,omitempty"`
-					Priority   string `yaml:"priority,omitempty"`
-					Timeout    string `yaml:"timeout,omitempty"`
-					MaxRetries int    `yaml:"max_retries,omitempty"`
-					RetryDelay string `yaml:"retry_delay,omitempty"`
-				}{},
-			},
+			name: "unsupported mqtt.protocol_version",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.ProtocolVersion = "3"
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.protocol_version must be 3.1.1 or 5 (got \"3\")"),
+		},
+		{
+			name: "mqtt.websocket path without leading slash",
+			config: func() Config {
+				config := newTestConfig("wss://localhost", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.WebSocket.Path = "mqtt"
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.websocket.path must start with / (got \"mqtt\")"),
+		},
+		{
+			name: "mqtt.websocket relative proxy_url",
+			config: func() Config {
+				config := newTestConfig("wss://localhost", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.WebSocket.ProxyURL = "proxy:3128"
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.websocket.proxy_url must be an absolute URL (got \"proxy:3128\")"),
+		},
+		{
+			name: "routes without mqtt.topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "", "")
+				config.Routes = []RouteConfig{{Topic: "alerts/#", NtfyURL: "https://ntfy.sh"}}
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "route without ntfy_url and no ntfy.url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "", "")
+				config.Routes = []RouteConfig{{Topic: "alerts/#"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.url is required in config"),
+		},
+		{
+			name: "route without topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{NtfyURL: "https://ntfy.sh"}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].topic is required"),
+		},
+		{
+			name: "invalid route qos",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				qos := 3
+				config.Routes = []RouteConfig{{Topic: "alerts/#", QoS: &qos}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].qos must be 0, 1, or 2 (got 3)"),
+		},
+		{
+			name: "mqtt.client_id template",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.ClientID = "mqtt2ntfy-{hostname}-{pid}-{random}"
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "mqtt.client_id unknown placeholder",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.ClientID = "mqtt2ntfy-{host}"
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.client_id contains unknown placeholder {host} (supported: {hostname}, {pid}, {random})"),
+		},
+		{
+			name:   "shared subscription mqtt.topic",
+			config: newTestConfig("tcp://localhost:1883", "$share/mqtt2ntfy/alerts/#", "https://ntfy.sh"),
+			want:   nil,
+		},
+		{
+			name:   "shared subscription mqtt.topic without filter",
+			config: newTestConfig("tcp://localhost:1883", "$share/mqtt2ntfy", "https://ntfy.sh"),
+			want:   fmt.Errorf("mqtt.topic must have the form $share/<group>/<topic> (got \"$share/mqtt2ntfy\")"),
+		},
+		{
+			name: "route share_group with wildcard",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "alerts/#", ShareGroup: "group/#"}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].share_group must not contain /, + or # (got \"group/#\")"),
+		},
+		{
+			name: "election.topic with wildcard",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Election.Enabled = true
+				config.Election.Topic = "mqtt2ntfy/#"
+				return config
+			}(),
+			want: fmt.Errorf("election.topic must not contain wildcards (got \"mqtt2ntfy/#\")"),
+		},
+		{
+			name: "invalid election.claim_delay",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Election.Enabled = true
+				config.Election.ClaimDelay = "soon"
+				return config
+			}(),
+			want: fmt.Errorf("election.claim_delay must be a duration (got \"soon\")"),
+		},
+		{
+			name: "invalid mqtt.qos",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.QoS = -1
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.qos must be 0, 1, or 2 (got -1)"),
+		},
+		{
+			name: "invalid mqtt.session_expiry",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.SessionExpiry = "1 day"
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.session_expiry must be a duration (got \"1 day\")"),
+		},
+		{
+			name: "connections without mqtt section",
+			config: func() Config {
+				config := newTestConfig("", "", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{
+					{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883", Topic: "alerts/#"}},
+					{Name: "site-b", MQTT: MQTTSettings{Broker: "tcp://b:1883"}, Routes: []RouteConfig{{Topic: "doors/#"}}},
+				}
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "mqtt.topic without mqtt.broker next to connections",
+			config: func() Config {
+				config := newTestConfig("", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883", Topic: "alerts/#"}}}
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.broker is required when mqtt.topic or routes are set"),
+		},
+		{
+			name: "connection without name",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{MQTT: MQTTSettings{Broker: "tcp://a:1883", Topic: "alerts/#"}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].name is required"),
+		},
+		{
+			name: "duplicate connection name",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{Name: "default", MQTT: MQTTSettings{Broker: "tcp://a:1883", Topic: "alerts/#"}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].name must be unique and not \"default\" (got \"default\")"),
+		},
+		{
+			name: "connection without broker",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Topic: "alerts/#"}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].mqtt.broker is required in config"),
+		},
+		{
+			name: "connection without topic or routes",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883"}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].mqtt.topic or connections[0].routes is required in config"),
+		},
+		{
+			name: "connection route without ntfy_url and no ntfy.url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "", "")
+				config.Routes = []RouteConfig{{Topic: "alerts/#", NtfyURL: "https://ntfy.sh"}}
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883"}, Routes: []RouteConfig{{Topic: "doors/#"}}}}
+				return config
+			}(),
 			want: fmt.Errorf("ntfy.url is required in config"),
 		},
+		{
+			name: "invalid connection tls",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "ssl://a:8883", Topic: "alerts/#", TLS: TLSConfig{KeyFile: "client.key"}}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].mqtt.tls.cert_file and connections[0].mqtt.tls.key_file must be set together"),
+		},
+		{
+			name: "invalid connection route qos",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				qos := 5
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883"}, Routes: []RouteConfig{{Topic: "doors/#", QoS: &qos}}}}
+				return config
+			}(),
+			want: fmt.Errorf("connections[0].routes[0].qos must be 0, 1, or 2 (got 5)"),
+		},
+		{
+			name: "empty failover broker",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.MQTT.Brokers = []string{"tcp://backup:1883", ""}
+				return config
+			}(),
+			want: fmt.Errorf("mqtt.brokers[1] must not be empty"),
+		},
+		{
+			name: "election without mqtt section",
+			config: func() Config {
+				config := newTestConfig("", "", "https://ntfy.sh/test")
+				config.Election.Enabled = true
+				config.Connections = []ConnectionConfig{{Name: "site-a", MQTT: MQTTSettings{Broker: "tcp://a:1883", Topic: "alerts/#"}}}
+				return config
+			}(),
+			want: fmt.Errorf("election requires mqtt.broker; leader election runs on the mqtt section connection"),
+		},
+		{
+			name: "dead_letter.topic with wildcard",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.DeadLetter.Topic = "mqtt2ntfy/dead/#"
+				return config
+			}(),
+			want: fmt.Errorf("dead_letter.topic must not contain wildcards (got \"mqtt2ntfy/dead/#\")"),
+		},
+		{
+			name: "status.topic with wildcard",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Status.Topic = "mqtt2ntfy/+"
+				return config
+			}(),
+			want: fmt.Errorf("status.topic must not contain wildcards (got \"mqtt2ntfy/+\")"),
+		},
+		{
+			name: "status.topic shared by elected instances",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Status.Topic = "mqtt2ntfy/status"
+				config.Election.Enabled = true
+				return config
+			}(),
+			want: fmt.Errorf("status.topic must have {client_id} as a topic level when election is enabled (got \"mqtt2ntfy/status\")"),
+		},
+		{
+			name: "status.topic with election",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Status.Topic = "mqtt2ntfy/{client_id}/status"
+				config.Election.Enabled = true
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "status.stats_interval without topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Status.StatsInterval = "1m"
+				return config
+			}(),
+			want: fmt.Errorf("status.stats_interval requires status.topic or status.stats_topic"),
+		},
+		{
+			name: "invalid status.stats_interval",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Status.Topic = "mqtt2ntfy/status"
+				config.Status.StatsInterval = "often"
+				return config
+			}(),
+			want: fmt.Errorf("status.stats_interval must be a duration (got \"often\")"),
+		},
+		{
+			name: "invalid ntfy.email",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.Email = "alerts"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.email must be an email address (got \"alerts\")"),
+		},
+		{
+			name: "invalid route title template",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/#", NtfyOptions: NtfyOptions{Title: "{{.Topic"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].title is not a valid template: template: option:1: unclosed action"),
+		},
+		{
+			name: "invalid route payload_format",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/#", PayloadFormat: "xml"}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].payload_format must be \"text\" or \"json\" (got \"xml\")"),
+		},
+		{
+			name: "invalid ntfy.attachment",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.Attachment = "sometimes"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.attachment must be \"auto\", \"always\" or \"never\" (got \"sometimes\")"),
+		},
+		{
+			name: "invalid ntfy.fetch_attach_max_size",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.FetchAttachMaxSize = "big"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.fetch_attach_max_size must be a positive size like 15M (got \"big\")"),
+		},
+		{
+			name: "invalid ntfy.fetch_attach_timeout",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.FetchAttachTimeout = "0s"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.fetch_attach_timeout must be a positive duration (got \"0s\")"),
+		},
+		{
+			name: "invalid ntfy.attach",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.Attach = "/snapshot.jpg"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.attach must be an http:// or https:// URL (got \"/snapshot.jpg\")"),
+		},
+		{
+			name: "route actions without callback",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/door/state", Actions: []ActionButton{{Label: "Close", Topic: "garage/door/set"}}}}
+				return config
+			}(),
+			want: fmt.Errorf("callback.base_url is required for routes with actions"),
+		},
+		{
+			name: "short callback.secret",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/door/state", Actions: []ActionButton{{Label: "Close", Topic: "garage/door/set"}}}}
+				config.Callback.BaseURL = "https://mqtt2ntfy.example.com"
+				config.Callback.Secret = "secret"
+				return config
+			}(),
+			want: fmt.Errorf("callback.secret must be at least 16 characters"),
+		},
+		{
+			name: "too many route actions",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				button := ActionButton{Label: "Close", Topic: "garage/door/set"}
+				config.Routes = []RouteConfig{{Topic: "garage/door/state", Actions: []ActionButton{button, button, button, button}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].actions must have at most 3 buttons (got 4)"),
+		},
+		{
+			name: "invalid route action",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/door/state", Actions: []ActionButton{{Label: "Close"}}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].actions[0].topic is required"),
+		},
+		{
+			name: "backend named ntfy",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"ntfy": {Type: BackendGotify, URL: "https://gotify.example.com", Token: "app"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.ntfy is reserved for the ntfy section"),
+		},
+		{
+			name: "unknown backend type",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"home": {Type: "smoke-signal"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.home.type must be gotify, pushover, webhook or matrix (got \"smoke-signal\")"),
+		},
+		{
+			name: "gotify backend without token",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"home": {Type: BackendGotify, URL: "https://gotify.example.com"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.home.token or backends.home.token_file is required"),
+		},
+		{
+			name: "gotify backend with invalid url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"home": {Type: BackendGotify, URL: "gotify.example.com", Token: "app"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.home.url must be an http:// or https:// URL (got \"gotify.example.com\")"),
+		},
+		{
+			name: "pushover backend retry too short",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"oncall": {Type: BackendPushover, URL: defaultPushoverURL, Token: "app", User: "uOnCall", Retry: "10s"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.oncall.retry must be a duration of at least 30s (got \"10s\")"),
+		},
+		{
+			name: "pushover backend expire too long",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"oncall": {Type: BackendPushover, URL: defaultPushoverURL, Token: "app", User: "uOnCall", Expire: "4h"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.oncall.expire must be a positive duration of at most 3h0m0s (got \"4h\")"),
+		},
+		{
+			name: "pushover backend ack_topic with wildcard",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"oncall": {Type: BackendPushover, URL: defaultPushoverURL, Token: "app", User: "uOnCall", AckTopic: "ack/#"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.oncall.ack_topic must not contain wildcards (got \"ack/#\")"),
+		},
+		{
+			name: "route to pushover backend without user",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"oncall": {Type: BackendPushover, URL: defaultPushoverURL, Token: "app"}}
+				config.Routes = []RouteConfig{{Topic: "alarm/#", Backends: []string{"oncall"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].pushover_user is required because backends.oncall has no user"),
+		},
+		{
+			name: "matrix backend without room",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"ops": {Type: BackendMatrix, URL: "https://matrix.example.com", Token: "syt_abc"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.ops.room must be a room ID starting with ! (got \"\")"),
+		},
+		{
+			name: "matrix backend with room alias",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"ops": {Type: BackendMatrix, URL: "https://matrix.example.com", Token: "syt_abc", Room: "#ops:example.com"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.ops.room must be a room ID starting with ! (got \"#ops:example.com\")"),
+		},
+		{
+			name: "matrix backend without token",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"ops": {Type: BackendMatrix, URL: "https://matrix.example.com", Room: "!ops:example.com"}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.ops.token or backends.ops.token_file is required"),
+		},
+		{
+			name: "webhook backend without url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"slack": {Type: BackendWebhook}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.slack.url is required"),
+		},
+		{
+			name: "webhook backend with invalid body template",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"slack": {Type: BackendWebhook, URL: "https://hooks.slack.com/services/T0/B0/x", Body: `{"text": {{json .Text}}}`}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.slack.body is not a valid template: template: body:1:16: executing \"body\" at <.Text>: can't evaluate field Text in type main.webhookData"),
+		},
+		{
+			name: "webhook backend with invalid header name",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"api": {Type: BackendWebhook, URL: "https://api.example.com/alerts", Headers: map[string]string{"X Token": "abc"}}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.api.headers must have valid header names (got \"X Token\")"),
+		},
+		{
+			name: "webhook backend with invalid success code",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"api": {Type: BackendWebhook, URL: "https://api.example.com/alerts", SuccessCodes: []int{200, 2000}}}
+				return config
+			}(),
+			want: fmt.Errorf("backends.api.success_codes[1] must be an HTTP status code (got 2000)"),
+		},
+		{
+			name: "webhook backend with templated url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Backends = map[string]BackendConfig{"api": {Type: BackendWebhook, URL: "https://api.example.com/rooms/{{.JSON.room}}", Method: "PUT"}}
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "route with unknown backend",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/#", Backends: []string{"ntfy", "home"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].backends[1] must be \"ntfy\" or name a backend (got \"home\")"),
+		},
+		{
+			name: "route with duplicate backend",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/#", Backends: []string{"ntfy", "ntfy"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].backends lists \"ntfy\" more than once"),
+		},
+		{
+			name: "gotify-only routes without ntfy.url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "", "")
+				config.Backends = map[string]BackendConfig{"home": {Type: BackendGotify, URL: "https://gotify.example.com", Token: "app"}}
+				config.Routes = []RouteConfig{{Topic: "garage/#", Backends: []string{"home"}}}
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name: "ntfy_subscribe topic with path",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts/json"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].topic must be one or more comma-separated Ntfy topics (got \"alerts/json\")"),
+		},
+		{
+			name: "ntfy_subscribe unknown connection",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts", Connection: "cabin"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].connection must name a connection (got \"cabin\")"),
+		},
+		{
+			name: "ntfy_subscribe mqtt_topic matching a route",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "phone/#", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts", MQTTTopic: "phone/alerts"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].mqtt_topic must not match the topic of a route (\"phone/alerts\" matches \"phone/#\")"),
+		},
+		{
+			name: "ntfy_subscribe default mqtt_topic matching a route",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "#", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].mqtt_topic must not match the topic of a route (\"ntfy/alerts\" matches \"#\")"),
+		},
+		{
+			name: "ntfy_subscribe mqtt_topic template matching a route",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "$share/group/phone/+"}}
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts,door", MQTTTopic: "phone/{{.Topic}}"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].mqtt_topic must not match the topic of a route (\"phone/alerts\" matches \"$share/group/phone/+\")"),
+		},
+		{
+			name: "ntfy_subscribe invalid mqtt_topic template",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts", MQTTTopic: "phone/{{.Camera}}"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].mqtt_topic is not a valid template: template: mqtt_topic:1:8: executing \"mqtt_topic\" at <.Camera>: can't evaluate field Camera in type main.NtfyEvent"),
+		},
+		{
+			name: "ntfy_subscribe mqtt_topic template with unknown field in a branch",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.NtfySubscribe.Topics = []NtfySubscriptionConfig{{Topic: "alerts", MQTTTopic: "phone/{{if .Title}}{{.Nope}}{{end}}"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy_subscribe.topics[0].mqtt_topic is not a valid template: template: mqtt_topic:1:21: executing \"mqtt_topic\" at <.Nope>: can't evaluate field Nope in type main.NtfyEvent"),
+		},
+		{
+			name: "route snapshot without topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "frigate/events", Snapshot: &SnapshotConfig{}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].snapshot.topic is required"),
+		},
+		{
+			name: "route snapshot match outside topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "frigate/events", Snapshot: &SnapshotConfig{Topic: "frigate/+/person/snapshot", Match: "frigate/door"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].snapshot.match must be a topic matching routes[0].snapshot.topic (got \"frigate/door\")"),
+		},
+		{
+			name: "invalid route snapshot wait",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "frigate/events", Snapshot: &SnapshotConfig{Topic: "frigate/+/person/snapshot", Wait: "-1s"}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].snapshot.wait must be a positive duration (got \"-1s\")"),
+		},
+		{
+			name: "ntfy.auth_token and ntfy.username",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.AuthToken = "tk_test"
+				config.Ntfy.Username = "mqtt2ntfy"
+				config.Ntfy.Password = "secret"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.auth_token and ntfy.username are mutually exclusive"),
+		},
+		{
+			name: "empty route credentials",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "garage/#", Credentials: &NtfyCredentials{}}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].credentials must set token or username"),
+		},
+		{
+			name: "ntfy.tls cert without key",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.TLS.CertFile = "/etc/mqtt2ntfy/client.pem"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.tls.cert_file and ntfy.tls.key_file must be set together"),
+		},
+		{
+			name: "invalid ntfy.proxy_url",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.ProxyURL = "proxy.example.com:3128"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.proxy_url must be an http://, https:// or socks5:// URL (got \"proxy.example.com:3128\")"),
+		},
+		{
+			name: "invalid ntfy.idle_timeout",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.IdleTimeout = "forever"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.idle_timeout must be a positive duration (got \"forever\")"),
+		},
+		{
+			name: "negative ntfy.max_idle_connections",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.MaxIdleConnections = -1
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.max_idle_connections must not be negative (got -1)"),
+		},
+		{
+			name: "invalid ntfy.circuit_breaker.open_timeout",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.CircuitBreaker.OpenTimeout = "-5s"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.circuit_breaker.open_timeout must be a positive duration (got \"-5s\")"),
+		},
+		{
+			name: "invalid ntfy.result_topic",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.ResultTopic = "{{.Topic"
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.result_topic is not a valid template: template: result_topic:1: unclosed action"),
+		},
+		{
+			name: "route result_topic with unknown field",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "alerts/#", ResultTopic: "{{.Payload}}"}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].result_topic is not a valid template: template: result_topic:1:2: executing \"result_topic\" at <.Payload>: can't evaluate field Payload in type main.resultTopicData"),
+		},
+		{
+			name: "route result_topic matched by its route",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Routes = []RouteConfig{{Topic: "alerts/#", ResultTopic: "{{.Topic}}/ntfy_result"}}
+				return config
+			}(),
+			want: fmt.Errorf("routes[0].result_topic must be outside the topics the routes subscribe to (got \"alerts/example/ntfy_result\" for a message on alerts/example, which alerts/# matches)"),
+		},
+		{
+			name: "ntfy.result_topic matched by another route",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.ResultTopic = "receipts/{{.Topic}}"
+				config.Routes = []RouteConfig{{Topic: "$share/group/receipts/+/+"}}
+				return config
+			}(),
+			want: fmt.Errorf("ntfy.result_topic must be outside the topics the routes subscribe to (got \"receipts/test/topic\" for a message on test/topic, which $share/group/receipts/+/+ matches)"),
+		},
+		{
+			name: "result_topic outside the routes",
+			config: func() Config {
+				config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+				config.Ntfy.ResultTopic = "ntfy_results/{{.Topic}}"
+				config.Routes = []RouteConfig{{Topic: "alerts/#", ResultTopic: "receipts/{{.Subscription}}"}}
+				return config
+			}(),
+			want: nil,
+		},
+		{
+			name:   "valid mqtt.tls",
+			config: withMQTTTLS(TLSConfig{CAFile: "ca.pem", CertFile: "client.pem", KeyFile: "client.key", MinVersion: "1.3"}),
+			want:   nil,
+		},
+		{
+			name:   "mqtt.tls cert without key",
+			config: withMQTTTLS(TLSConfig{CertFile: "client.pem"}),
+			want:   fmt.Errorf("mqtt.tls.cert_file and mqtt.tls.key_file must be set together"),
+		},
+		{
+			name:   "mqtt.tls invalid min_version",
+			config: withMQTTTLS(TLSConfig{MinVersion: "1.4"}),
+			want:   fmt.Errorf("mqtt.tls.min_version must be one of 1.0, 1.1, 1.2, 1.3 (got \"1.4\")"),
+		},
 	}
 
 	for _, tt := range tests {
@@ -217,6 +971,432 @@ func TestValidateConfig(t *testing.T) {
 	}
 }
 
+func TestLoadConfigRoutesAndSession(t *testing.T) {
+	configContent := `
+mqtt:
+  broker: "localhost"
+  topic: "home/alerts"
+  qos: 1
+  clean_session: false
+ntfy:
+  url: "https://ntfy.sh/home"
+  priority: "3"
+routes:
+  - topic: "garage/#"
+    ntfy_url: "https://ntfy.example.com"
+    priority: "4"
+  - topic: "weather/daily"
+    qos: 0
+    result_topic: "receipts/{{.Topic}}"
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if config.GetMQTTCleanSession() {
+		t.Error("GetMQTTCleanSession() = true, want false")
+	}
+	if got := config.GetMQTTSessionExpiry(); got != 24*time.Hour {
+		t.Errorf("GetMQTTSessionExpiry() = %v, want default 24h", got)
+	}
+
+	want := []Route{
+		{Topic: "home/alerts", QoS: 1, NtfyURL: "https://ntfy.sh/home", Priority: "3"},
+		{Topic: "garage/#", QoS: 1, NtfyURL: "https://ntfy.example.com", Priority: "4"},
+		{Topic: "weather/daily", QoS: 0, NtfyURL: "https://ntfy.sh/home", Priority: "3", ResultTopic: "receipts/{{.Topic}}"},
+	}
+	if got := config.GetRoutes(); !slices.Equal(got, want) {
+		t.Errorf("GetRoutes() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadConfigPublishOptions(t *testing.T) {
+	configContent := `
+mqtt:
+  broker: "localhost"
+  topic: "home/alerts"
+ntfy:
+  url: "https://ntfy.sh/home"
+  title: "Home"
+  tags: "house"
+  email: "alerts@example.com"
+  cache: false
+routes:
+  - topic: "frigate/events"
+    payload_format: "json"
+    message: "{{.JSON.label}} on {{.JSON.camera}}"
+    title: "Frigate"
+    delay: "1m"
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	routes := config.GetRoutes()
+	if got := routes[0]; got.PayloadFormat != "" || got.Options.Title != "Home" || got.Options.Cache == nil || *got.Options.Cache {
+		t.Errorf("Default route = %+v, want the ntfy section's options", got)
+	}
+	got := routes[1]
+	if got.PayloadFormat != PayloadFormatJSON || got.Options.Message != "{{.JSON.label}} on {{.JSON.camera}}" || got.Options.Title != "Frigate" ||
+		got.Options.Delay != "1m" || got.Options.Tags != "house" || got.Options.Email != "alerts@example.com" || got.Options.Cache == nil {
+		t.Errorf("Frigate route = %+v, want its options merged with the ntfy section's", got)
+	}
+}
+
+func TestLoadConfigAttachments(t *testing.T) {
+	configContent := `
+mqtt:
+  broker: "localhost"
+  topic: "home/alerts"
+ntfy:
+  url: "https://ntfy.sh/home"
+  attachment: "never"
+routes:
+  - topic: "frigate/events"
+    payload_format: "json"
+    attachment: "auto"
+    fetch_attach: true
+    filename: "{{.JSON.after.camera}}.jpg"
+    snapshot:
+      topic: "frigate/+/+/snapshot"
+      match: "frigate/{{.JSON.after.camera}}/{{.JSON.after.label}}/snapshot"
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	routes := config.GetRoutes()
+	if got := routes[0]; got.Attachment != AttachmentNever || got.Snapshot != nil {
+		t.Errorf("Default route = %+v, want attachment never without snapshots", got)
+	}
+	got := routes[1]
+	if got.Attachment != AttachmentAuto || !got.FetchAttach || got.Options.Filename != "{{.JSON.after.camera}}.jpg" {
+		t.Errorf("Frigate route = %+v, want attachment auto, fetch_attach and a filename template", got)
+	}
+	want := SnapshotPairing{Topic: "frigate/+/+/snapshot", Match: "frigate/{{.JSON.after.camera}}/{{.JSON.after.label}}/snapshot", Wait: defaultSnapshotWait}
+	if got.Snapshot == nil || *got.Snapshot != want {
+		t.Errorf("Frigate route snapshot = %+v, want %+v", got.Snapshot, want)
+	}
+}
+
+func TestLoadConfigActions(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "callback-secret")
+	if err := os.WriteFile(secretFile, []byte("0123456789abcdef0123\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	configContent := `
+mqtt:
+  broker: "localhost"
+ntfy:
+  url: "https://ntfy.sh/home"
+callback:
+  base_url: "https://mqtt2ntfy.example.com"
+  secret_file: "` + secretFile + `"
+routes:
+  - topic: "garage/door/state"
+    actions:
+      - label: "Close"
+        topic: "garage/door/set"
+        payload: "CLOSE"
+        qos: 1
+        clear: true
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	callback := config.GetCallbackConfig()
+	if callback.Listen != ":8081" || string(callback.Secret) != "0123456789abcdef0123" || callback.TokenTTL != time.Hour {
+		t.Errorf("GetCallbackConfig() = %+v, want defaults with the secret from the file", callback)
+	}
+
+	route := config.GetConnections()[0].Routes[0]
+	want := []ActionButton{{Label: "Close", Topic: "garage/door/set", Payload: "CLOSE", QoS: 1, Clear: true}}
+	if route.Actions == nil || !slices.Equal(*route.Actions, want) || route.Connection != DefaultConnectionName {
+		t.Errorf("Route = %+v, want the Close action on the default connection", route)
+	}
+}
+
+func TestGetNtfySubscriptions(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "home/alerts", "https://ntfy.example.com/home")
+	config.Ntfy.AuthToken = "tk_default"
+	config.Ntfy.Credentials = map[string]NtfyCredentials{"phone": {Token: "tk_phone"}}
+	config.NtfySubscribe.Topics = []NtfySubscriptionConfig{
+		{Topic: "phone", Since: "1h"},
+		{Topic: "cabin", URL: "https://ntfy.sh", MQTTTopic: "cabin/{{.Title}}", QoS: 1, Retain: true, Connection: "cabin", Credentials: &NtfyCredentials{Username: "cabin", Password: "secret"}},
+	}
+
+	want := []NtfySubscription{
+		{URL: "https://ntfy.example.com", Topic: "phone", MQTTTopic: "ntfy/{{.Topic}}", Since: "1h", Auth: NtfyAuth{Token: "tk_phone"}, Connection: DefaultConnectionName},
+		{URL: "https://ntfy.sh", Topic: "cabin", MQTTTopic: "cabin/{{.Title}}", QoS: 1, Retain: true, Auth: NtfyAuth{Username: "cabin", Password: "secret"}, Connection: "cabin"},
+	}
+	if got := config.GetNtfySubscriptions(); !slices.Equal(got, want) {
+		t.Errorf("GetNtfySubscriptions() = %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadConfigCredentials(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "garage-password")
+	tokenFile := filepath.Join(dir, "door-token")
+	if err := os.WriteFile(passwordFile, []byte("garage-secret\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write password file: %v", err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("tk_door\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	configContent := fmt.Sprintf(`
+mqtt:
+  broker: "localhost"
+  topic: "home/alerts"
+ntfy:
+  url: "https://ntfy.example.com/home"
+  username: "mqtt2ntfy"
+  password: "default-secret"
+  credentials:
+    door:
+      token_file: %q
+routes:
+  - topic: "garage/#"
+    credentials:
+      username: "garage"
+      password_file: %q
+`, tokenFile, passwordFile)
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.GetNtfyAuth(); got != (NtfyAuth{Username: "mqtt2ntfy", Password: "default-secret"}) {
+		t.Errorf("GetNtfyAuth() = %+v, want the default username and password", got)
+	}
+	if got := config.GetNtfyTopicAuth(); got["door"] != (NtfyAuth{Token: "tk_door"}) {
+		t.Errorf("GetNtfyTopicAuth() = %+v, want the door token from its file", got)
+	}
+	routes := config.GetRoutes()
+	if routes[0].Auth != nil {
+		t.Errorf("Route %s has credentials %+v, want nil", routes[0].Topic, *routes[0].Auth)
+	}
+	if routes[1].Auth == nil || *routes[1].Auth != (NtfyAuth{Username: "garage", Password: "garage-secret"}) {
+		t.Errorf("Route %s credentials = %v, want garage with the password from its file", routes[1].Topic, routes[1].Auth)
+	}
+
+	// A missing secret file fails loading
+	if err := os.Remove(tokenFile); err != nil {
+		t.Fatalf("Failed to remove token file: %v", err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("LoadConfig with a missing token file expected error, got nil")
+	}
+}
+
+func TestLoadConfigConnections(t *testing.T) {
+	configContent := `
+mqtt:
+  broker: "primary.example.com"
+  brokers:
+    - "backup.example.com"
+    - "ssl://backup2.example.com:8883"
+  topic: "home/alerts"
+  qos: 1
+ntfy:
+  url: "https://ntfy.sh/home"
+connections:
+  - name: "cabin"
+    mqtt:
+      broker: "cabin.example.com"
+      client_id: "mqtt2ntfy-cabin"
+      username: "cabin"
+      qos: 2
+    routes:
+      - topic: "cabin/#"
+        ntfy_url: "https://ntfy.example.com"
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	wantBrokers := []string{"tcp://backup.example.com:1883", "ssl://backup2.example.com:8883"}
+	if !slices.Equal(config.MQTT.Brokers, wantBrokers) {
+		t.Errorf("MQTT.Brokers = %v, want %v", config.MQTT.Brokers, wantBrokers)
+	}
+
+	connections := config.GetConnections()
+	if len(connections) != 2 {
+		t.Fatalf("GetConnections() returned %d connections, want 2", len(connections))
+	}
+	if connections[0].Name != DefaultConnectionName || connections[1].Name != "cabin" {
+		t.Errorf("Connection names = %s, %s, want %s, cabin", connections[0].Name, connections[1].Name, DefaultConnectionName)
+	}
+
+	cabin := connections[1]
+	wantRoutes := []Route{{Topic: "cabin/#", QoS: 2, NtfyURL: "https://ntfy.example.com", Connection: "cabin"}}
+	if !slices.Equal(cabin.Routes, wantRoutes) {
+		t.Errorf("cabin routes = %+v, want %+v", cabin.Routes, wantRoutes)
+	}
+	mqttConfig, err := cabin.MQTT.GetMQTTConfig()
+	if err != nil {
+		t.Fatalf("GetMQTTConfig failed: %v", err)
+	}
+	if mqttConfig.Broker != "tcp://cabin.example.com:1883" || len(mqttConfig.FailoverBrokers) != 0 {
+		t.Errorf("cabin brokers = %s %v, want tcp://cabin.example.com:1883 only", mqttConfig.Broker, mqttConfig.FailoverBrokers)
+	}
+	if mqttConfig.ClientID != "mqtt2ntfy-cabin" || mqttConfig.Username != "cabin" {
+		t.Errorf("cabin client ID/username = %s/%s, want mqtt2ntfy-cabin/cabin", mqttConfig.ClientID, mqttConfig.Username)
+	}
+	if mqttConfig.ConnectTimeout != 30*time.Second {
+		t.Errorf("cabin ConnectTimeout = %v, want default 30s", mqttConfig.ConnectTimeout)
+	}
+}
+
+func TestGetRoutesSharedSubscriptions(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "home/alerts", "https://ntfy.sh/home")
+	config.MQTT.ShareGroup = "mqtt2ntfy"
+	config.Routes = []RouteConfig{
+		{Topic: "garage/#", ShareGroup: "garage"},
+		{Topic: "$share/weather/weather/#"},
+	}
+
+	want := []string{
+		"$share/mqtt2ntfy/home/alerts",
+		"$share/garage/garage/#",
+		"$share/weather/weather/#",
+	}
+	routes := config.GetRoutes()
+	if len(routes) != len(want) {
+		t.Fatalf("GetRoutes() returned %d routes, want %d", len(routes), len(want))
+	}
+	for i, route := range routes {
+		if route.Topic != want[i] {
+			t.Errorf("GetRoutes()[%d].Topic = %q, want %q", i, route.Topic, want[i])
+		}
+	}
+}
+
+func TestElectionDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	setDefaults(&config)
+	if config.Election.Topic != "" || config.Election.ClaimDelay != "" {
+		t.Errorf("Election defaults set while election is disabled: %+v", config.Election)
+	}
+
+	config.Election.Enabled = true
+	setDefaults(&config)
+	if config.Election.Topic != "mqtt2ntfy/leader" {
+		t.Errorf("Election.Topic = %q, want mqtt2ntfy/leader", config.Election.Topic)
+	}
+	if got := config.GetElectionClaimDelay(); got != 2*time.Second {
+		t.Errorf("GetElectionClaimDelay() = %v, want 2s", got)
+	}
+}
+
+func TestStatusDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	config.Status.Topic = "mqtt2ntfy/status"
+	setDefaults(&config)
+	if config.Status.StatsTopic != "" || config.GetStatusStatsInterval() != 0 {
+		t.Errorf("Stats enabled without stats_interval: topic %q, interval %v", config.Status.StatsTopic, config.GetStatusStatsInterval())
+	}
+
+	config.Status.StatsInterval = "5m"
+	setDefaults(&config)
+	if config.Status.StatsTopic != "mqtt2ntfy/status/stats" {
+		t.Errorf("Status.StatsTopic = %q, want mqtt2ntfy/status/stats", config.Status.StatsTopic)
+	}
+	if got := config.GetStatusStatsInterval(); got != 5*time.Minute {
+		t.Errorf("GetStatusStatsInterval() = %v, want 5m", got)
+	}
+}
+
+func TestNtfyConnectionDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	setDefaults(&config)
+	if config.Ntfy.MaxIdleConnections != 16 {
+		t.Errorf("Ntfy.MaxIdleConnections = %d, want 16", config.Ntfy.MaxIdleConnections)
+	}
+	if got := config.GetNtfyIdleTimeout(); got != 90*time.Second {
+		t.Errorf("GetNtfyIdleTimeout() = %v, want 90s", got)
+	}
+}
+
+func TestAttachmentFetchDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	setDefaults(&config)
+	want := AttachmentFetchConfig{MaxSize: 15 << 20, Timeout: 10 * time.Second}
+	if got := config.GetAttachmentFetch(); got != want {
+		t.Errorf("GetAttachmentFetch() = %+v, want %+v", got, want)
+	}
+
+	config.Ntfy.FetchAttachMaxSize = "2M"
+	config.Ntfy.FetchAttachTimeout = "3s"
+	want = AttachmentFetchConfig{MaxSize: 2 << 20, Timeout: 3 * time.Second}
+	if got := config.GetAttachmentFetch(); got != want {
+		t.Errorf("GetAttachmentFetch() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCircuitBreakerDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	setDefaults(&config)
+	if got := config.GetNtfyCircuitBreaker(); got != (CircuitBreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second}) {
+		t.Errorf("GetNtfyCircuitBreaker() = %+v, want 5 failures and 30s", got)
+	}
+
+	config.Ntfy.CircuitBreaker.FailureThreshold = -1
+	if got := config.GetNtfyCircuitBreaker(); got.FailureThreshold != 0 {
+		t.Errorf("GetNtfyCircuitBreaker().FailureThreshold = %d, want 0 (disabled)", got.FailureThreshold)
+	}
+}
+
+func TestGetMQTTSessionDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	setDefaults(&config)
+	if !config.GetMQTTCleanSession() {
+		t.Error("GetMQTTCleanSession() = false, want true by default")
+	}
+	if got := config.GetMQTTSessionExpiry(); got != 0 {
+		t.Errorf("GetMQTTSessionExpiry() = %v, want 0 with a clean session", got)
+	}
+	if config.MQTT.ClientID != DefaultMQTTClientID {
+		t.Errorf("MQTT.ClientID = %q, want %q", config.MQTT.ClientID, DefaultMQTTClientID)
+	}
+	if routes := config.GetRoutes(); len(routes) != 1 || routes[0].QoS != 0 {
+		t.Errorf("GetRoutes() = %+v, want a single QoS 0 route", routes)
+	}
+}
+
 func TestNormalizeBrokerURL(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -251,7 +1431,19 @@ func TestNormalizeBrokerURL(t *testing.T) {
 		{
 			name:     "ssl without port",
 			input:    "ssl://localhost",
-			expected: "ssl://localhost:1883",
+			expected: "ssl://localhost:8883",
+			wantErr:  false,
+		},
+		{
+			name:     "mqtts without port",
+			input:    "mqtts://broker.example.com",
+			expected: "mqtts://broker.example.com:8883",
+			wantErr:  false,
+		},
+		{
+			name:     "tls without port",
+			input:    "tls://broker.example.com",
+			expected: "tls://broker.example.com:8883",
 			wantErr:  false,
 		},
 		{
@@ -272,6 +1464,18 @@ func TestNormalizeBrokerURL(t *testing.T) {
 			expected: "wss://localhost:8080/mqtt",
 			wantErr:  false,
 		},
+		{
+			name:     "websocket without port",
+			input:    "ws://localhost/mqtt",
+			expected: "ws://localhost:80/mqtt",
+			wantErr:  false,
+		},
+		{
+			name:     "secure websocket without port",
+			input:    "wss://mqtt.example.com/mqtt",
+			expected: "wss://mqtt.example.com:443/mqtt",
+			wantErr:  false,
+		},
 		{
 			name:     "IP address",
 			input:    "192.168.1.100",
@@ -410,3 +1614,63 @@ func TestEnvironmentVariableOverrides(t *testing.T) {
 		t.Errorf("Ntfy.AuthToken = %s, want env-token", config.Ntfy.AuthToken)
 	}
 }
+
+func TestLoadConfigBackends(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "gotify-token")
+	if err := os.WriteFile(tokenFile, []byte("AbCdEf123\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+	configContent := `
+mqtt:
+  broker: "localhost"
+ntfy:
+  url: "https://ntfy.sh/home"
+backends:
+  home:
+    type: gotify
+    url: "https://gotify.example.com"
+    token_file: "` + tokenFile + `"
+routes:
+  - topic: "garage/#"
+    backends: [ntfy, home]
+  - topic: "alarm/#"
+`
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(configContent), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if got := config.Backends["home"]; got.Token != "AbCdEf123" || got.TokenFile != "" {
+		t.Errorf("Backend = %+v, want the token from the file", got)
+	}
+
+	routes := config.GetRoutes()
+	if routes[0].Backends == nil || !slices.Equal(*routes[0].Backends, []string{"ntfy", "home"}) {
+		t.Errorf("Route backends = %v, want ntfy and home", routes[0].Backends)
+	}
+	if routes[1].Backends != nil {
+		t.Errorf("Route backends = %v, want nil for Ntfy only", *routes[1].Backends)
+	}
+}
+
+func TestPushoverBackendDefaults(t *testing.T) {
+	config := newTestConfig("tcp://localhost:1883", "test/topic", "https://ntfy.sh/test")
+	config.Backends = map[string]BackendConfig{"oncall": {Type: BackendPushover, Token: "app", User: "uOnCall"}}
+	config.Routes = []RouteConfig{{Topic: "alarm/#", Backends: []string{"oncall"}, PushoverUser: "gOps"}}
+	setDefaults(&config)
+	if err := validateConfig(&config); err != nil {
+		t.Fatalf("validateConfig failed: %v", err)
+	}
+
+	want := BackendConfig{Type: BackendPushover, URL: "https://api.pushover.net", Token: "app", User: "uOnCall", Retry: "1m0s", Expire: "1h0m0s"}
+	if got := config.Backends["oncall"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Backend = %+v, want %+v", got, want)
+	}
+	if route := config.GetRoutes()[1]; route.PushoverUser != "gOps" {
+		t.Errorf("Route PushoverUser = %q, want the route's group key", route.PushoverUser)
+	}
+}
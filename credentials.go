@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// NtfyCredentials authenticates to Ntfy with an access token or a username and password. Secrets
+// can be read from files (e.g. Docker or systemd credentials) instead of being written in the config.
+type NtfyCredentials struct {
+	Token        string `yaml:"token,omitempty"`
+	TokenFile    string `yaml:"token_file,omitempty"`
+	Username     string `yaml:"username,omitempty"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// NtfyAuth holds the resolved credentials sent with a publish request; the zero value is anonymous
+type NtfyAuth struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// apply sets the Authorization header of req; a token takes precedence over a username and password
+func (a NtfyAuth) apply(req *http.Request) {
+	if a.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	} else if a.Username != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+}
+
+// validate checks that the credentials are consistent; prefix names the config section and tokenKey
+// the name of its token field in errors
+func (c NtfyCredentials) validate(prefix, tokenKey string) error {
+	hasToken := c.Token != "" || c.TokenFile != ""
+	hasPassword := c.Password != "" || c.PasswordFile != ""
+	switch {
+	case c.Token != "" && c.TokenFile != "":
+		return fmt.Errorf("%s.%s and %s.%s_file are mutually exclusive", prefix, tokenKey, prefix, tokenKey)
+	case c.Password != "" && c.PasswordFile != "":
+		return fmt.Errorf("%s.password and %s.password_file are mutually exclusive", prefix, prefix)
+	case hasToken && c.Username != "":
+		return fmt.Errorf("%s.%s and %s.username are mutually exclusive", prefix, tokenKey, prefix)
+	case c.Username != "" && !hasPassword:
+		return fmt.Errorf("%s.username requires %s.password or %s.password_file", prefix, prefix, prefix)
+	case c.Username == "" && hasPassword:
+		return fmt.Errorf("%s.password requires %s.username", prefix, prefix)
+	}
+	return nil
+}
+
+// isEmpty reports whether no credential is set
+func (c NtfyCredentials) isEmpty() bool {
+	return c == NtfyCredentials{}
+}
+
+// loadFiles replaces token_file and password_file with the contents of the files
+func (c *NtfyCredentials) loadFiles(prefix, tokenKey string) error {
+	if c.TokenFile != "" {
+		token, err := readSecretFile(c.TokenFile)
+		if err != nil {
+			return fmt.Errorf("%s.%s_file: %w", prefix, tokenKey, err)
+		}
+		c.Token, c.TokenFile = token, ""
+	}
+	if c.PasswordFile != "" {
+		password, err := readSecretFile(c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("%s.password_file: %w", prefix, err)
+		}
+		c.Password, c.PasswordFile = password, ""
+	}
+	return nil
+}
+
+// auth returns the credentials to send
+func (c NtfyCredentials) auth() NtfyAuth {
+	return NtfyAuth{Token: c.Token, Username: c.Username, Password: c.Password}
+}
+
+// readSecretFile reads a secret from a file, ignoring a trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %w", err)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// ntfyTopicOfURL returns the Ntfy topic a publish URL points to: its last path segment
+func ntfyTopicOfURL(ntfyURL string) string {
+	ntfyURL, _, _ = strings.Cut(ntfyURL, "?")
+	return ntfyURL[strings.LastIndex(ntfyURL, "/")+1:]
+}
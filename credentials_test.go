@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNtfyCredentialsValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials NtfyCredentials
+		want        error
+	}{
+		{name: "empty", credentials: NtfyCredentials{}},
+		{name: "token", credentials: NtfyCredentials{Token: "tk_alerts"}},
+		{name: "token file", credentials: NtfyCredentials{TokenFile: "/run/secrets/ntfy"}},
+		{name: "password", credentials: NtfyCredentials{Username: "alerts", Password: "secret"}},
+		{name: "password file", credentials: NtfyCredentials{Username: "alerts", PasswordFile: "/run/secrets/ntfy"}},
+		{
+			name:        "token and token file",
+			credentials: NtfyCredentials{Token: "tk_alerts", TokenFile: "/run/secrets/ntfy"},
+			want:        fmt.Errorf("ntfy.credentials.alerts.token and ntfy.credentials.alerts.token_file are mutually exclusive"),
+		},
+		{
+			name:        "password and password file",
+			credentials: NtfyCredentials{Username: "alerts", Password: "secret", PasswordFile: "/run/secrets/ntfy"},
+			want:        fmt.Errorf("ntfy.credentials.alerts.password and ntfy.credentials.alerts.password_file are mutually exclusive"),
+		},
+		{
+			name:        "token and username",
+			credentials: NtfyCredentials{Token: "tk_alerts", Username: "alerts", Password: "secret"},
+			want:        fmt.Errorf("ntfy.credentials.alerts.token and ntfy.credentials.alerts.username are mutually exclusive"),
+		},
+		{
+			name:        "username without password",
+			credentials: NtfyCredentials{Username: "alerts"},
+			want:        fmt.Errorf("ntfy.credentials.alerts.username requires ntfy.credentials.alerts.password or ntfy.credentials.alerts.password_file"),
+		},
+		{
+			name:        "password without username",
+			credentials: NtfyCredentials{Password: "secret"},
+			want:        fmt.Errorf("ntfy.credentials.alerts.password requires ntfy.credentials.alerts.username"),
+		},
+	}
+
+	for _, tt := range tests {
+		err := tt.credentials.validate("ntfy.credentials.alerts", "token")
+		if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+			t.Errorf("validate(%s) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNtfyCredentialsLoadFiles(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	passwordFile := filepath.Join(dir, "password")
+	emptyFile := filepath.Join(dir, "empty")
+	for path, content := range map[string]string{tokenFile: "tk_alerts\n", passwordFile: "secret\r\n", emptyFile: "\n"} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	credentials := NtfyCredentials{TokenFile: tokenFile}
+	if err := credentials.loadFiles("ntfy", "auth_token"); err != nil {
+		t.Fatalf("loadFiles failed: %v", err)
+	}
+	if credentials != (NtfyCredentials{Token: "tk_alerts"}) {
+		t.Errorf("Credentials = %+v, want the token from the file", credentials)
+	}
+
+	credentials = NtfyCredentials{Username: "alerts", PasswordFile: passwordFile}
+	if err := credentials.loadFiles("ntfy", "auth_token"); err != nil {
+		t.Fatalf("loadFiles failed: %v", err)
+	}
+	if credentials.Password != "secret" || credentials.PasswordFile != "" {
+		t.Errorf("Credentials = %+v, want the password from the file", credentials)
+	}
+
+	for _, path := range []string{emptyFile, filepath.Join(dir, "missing")} {
+		credentials = NtfyCredentials{Username: "alerts", PasswordFile: path}
+		if err := credentials.loadFiles("ntfy", "auth_token"); err == nil {
+			t.Errorf("loadFiles(%s) expected error, got nil", path)
+		}
+	}
+}
+
+func TestNtfyTopicOfURL(t *testing.T) {
+	tests := map[string]string{
+		"https://ntfy.sh/alerts":             "alerts",
+		"https://ntfy.example.com/ntfy/door": "door",
+		"https://ntfy.sh/alerts?x=1":         "alerts",
+		"https://ntfy.sh/":                   "",
+	}
+	for url, want := range tests {
+		if got := ntfyTopicOfURL(url); got != want {
+			t.Errorf("ntfyTopicOfURL(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestBridgeCredentials(t *testing.T) {
+	authorization := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization <- r.Header.Get("Authorization")
+	}))
+	t.Cleanup(server.Close)
+
+	basic := func(username, password string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	}
+
+	bridge := testBridge()
+	bridge.auth = NtfyAuth{Token: "tk_default"}
+	bridge.SetTopicCredentials(map[string]NtfyAuth{
+		"door": {Username: "door", Password: "door-secret"},
+	})
+	garage := Route{Topic: "garage/#", NtfyURL: server.URL, Auth: &NtfyAuth{Username: "garage", Password: "garage-secret"}}
+
+	tests := []struct {
+		name  string
+		route Route
+		topic string
+		want  string
+	}{
+		{name: "default", route: Route{Topic: "alerts/#", NtfyURL: server.URL}, topic: "alerts/window", want: "Bearer tk_default"},
+		{name: "topic", route: Route{Topic: "alerts/#", NtfyURL: server.URL}, topic: "alerts/door", want: basic("door", "door-secret")},
+		{name: "route", route: garage, topic: "garage/opener", want: basic("garage", "garage-secret")},
+		{name: "topic before route", route: garage, topic: "garage/door", want: basic("door", "door-secret")},
+	}
+
+	for _, tt := range tests {
+		if err := bridge.HandleMessage(tt.route, MQTTMessage{Topic: tt.topic, Payload: []byte("open")}); err != nil {
+			t.Fatalf("HandleMessage(%s) failed: %v", tt.name, err)
+		}
+		if got := <-authorization; got != tt.want {
+			t.Errorf("Authorization for %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
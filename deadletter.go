@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// DeadLetter records a message that could not be delivered or routed and was dropped
+type DeadLetter struct {
+	Time           time.Time         `json:"time"`
+	Topic          string            `json:"topic"`
+	Subscription   string            `json:"subscription"`
+	Payload        string            `json:"payload,omitempty"`
+	PayloadBase64  []byte            `json:"payload_base64,omitempty"` // set instead of payload if it is not UTF-8
+	QoS            byte              `json:"qos"`
+	ContentType    string            `json:"content_type,omitempty"`
+	UserProperties map[string]string `json:"user_properties,omitempty"`
+	Backends       []string          `json:"backends,omitempty"` // the route's backends the message was not delivered to
+	Received       time.Time         `json:"received,omitzero"`  // when the message arrived, which identifies it on replay
+	Reason         string            `json:"reason"`
+}
+
+// newDeadLetter records msg, received on route, as dropped because of err
+func newDeadLetter(route Route, msg MQTTMessage, err error) DeadLetter {
+	letter := DeadLetter{
+		Time:           time.Now().UTC(),
+		Topic:          msg.Topic,
+		Subscription:   route.Topic,
+		QoS:            msg.QoS,
+		ContentType:    msg.ContentType,
+		UserProperties: msg.UserProperties,
+		Received:       msg.Received,
+		Reason:         err.Error(),
+	}
+	if route.Backends != nil {
+		letter.Backends = *route.Backends
+	}
+	if utf8.Valid(msg.Payload) {
+		letter.Payload = string(msg.Payload)
+	} else {
+		letter.PayloadBase64 = msg.Payload
+	}
+	return letter
+}
+
+// Message rebuilds the original MQTT message for replaying
+func (d DeadLetter) Message() MQTTMessage {
+	payload := []byte(d.Payload)
+	if d.PayloadBase64 != nil {
+		payload = d.PayloadBase64
+	}
+	return MQTTMessage{
+		Topic:          d.Topic,
+		Payload:        payload,
+		QoS:            d.QoS,
+		ContentType:    d.ContentType,
+		UserProperties: d.UserProperties,
+		Received:       d.Received,
+	}
+}
+
+// DeadLetterQueue appends dead letters to a JSONL file and/or publishes them on an MQTT topic
+type DeadLetterQueue struct {
+	file   string
+	topic  string
+	logger *slog.Logger
+
+	mu sync.Mutex // serializes appends to the file
+}
+
+// NewDeadLetterQueue creates a DeadLetterQueue; an empty file or topic disables that destination
+func NewDeadLetterQueue(file, topic string, logger *slog.Logger) *DeadLetterQueue {
+	return &DeadLetterQueue{file: file, topic: topic, logger: logger}
+}
+
+// Add records a dead letter. The file is written before Add returns; the topic is published on
+// client (if not nil) in the background.
+func (q *DeadLetterQueue) Add(letter DeadLetter, client MQTTClient) {
+	data, _ := json.Marshal(letter)
+
+	if q.file != "" {
+		if err := q.appendToFile(data); err != nil {
+			q.logger.Error("Failed to write dead letter", "file", q.file, "topic", letter.Topic, "error", err)
+		}
+	}
+	if q.topic != "" && client != nil {
+		go func() {
+			if err := client.Publish(q.topic, 1, false, data); err != nil {
+				q.logger.Error("Failed to publish dead letter", "dead_letter_topic", q.topic, "topic", letter.Topic, "error", err)
+			}
+		}()
+	}
+}
+
+// appendToFile appends one JSON line. The file is opened for every record so that a replay can
+// move it aside while mqtt2ntfy keeps running.
+func (q *DeadLetterQueue) appendToFile(line []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := os.OpenFile(q.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReadDeadLetters reads the dead letters from a JSONL file
+func ReadDeadLetters(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("invalid dead letter on line %d of %s: %w", line, path, err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, scanner.Err()
+}
+
+// ReplayDeadLetters delivers the dead letters in path again using the current routes. The file is
+// moved aside first; letters that fail again are appended to a new file at path. The file left
+// aside by an interrupted replay is replayed too.
+func ReplayDeadLetters(path string, bridge *Bridge, routes []Route, logger *slog.Logger) (replayed, failed int, err error) {
+	replaying := path + ".replaying"
+	if _, err := os.Stat(replaying); err == nil {
+		logger.Warn("Resuming an interrupted dead letter replay; letters it delivered before stopping are delivered again", "file", replaying)
+		if err := appendDeadLetterFile(replaying, path); err != nil {
+			return 0, 0, fmt.Errorf("failed to merge dead letters into the interrupted replay: %w", err)
+		}
+	} else if err := os.Rename(path, replaying); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, 0, nil // nothing to replay
+		}
+		return 0, 0, fmt.Errorf("failed to move dead letter file aside: %w", err)
+	}
+	letters, err := ReadDeadLetters(replaying)
+	if err != nil {
+		// Put the file back so no dead letters are lost
+		_ = os.Rename(replaying, path)
+		return 0, 0, err
+	}
+
+	queue := NewDeadLetterQueue(path, "", logger)
+	for _, letter := range letters {
+		route, ok := replayRoute(letter, routes)
+		if !ok {
+			logger.Warn("No route matches dead letter; keeping it", "topic", letter.Topic, "subscription", letter.Subscription)
+			queue.Add(letter, nil)
+			failed++
+			continue
+		}
+		if len(letter.Backends) > 0 {
+			// Only the backends the message was not delivered to
+			backends := letter.Backends
+			route.Backends = &backends
+		}
+		msg := letter.Message()
+		_, err := bridge.deliver(route, msg)
+		bridge.record(err)
+		if err != nil {
+			queue.Add(newDeadLetter(failedRoute(route, err), msg, err), nil)
+			failed++
+			continue
+		}
+		replayed++
+	}
+
+	if err := os.Remove(replaying); err != nil {
+		return replayed, failed, fmt.Errorf("failed to remove replayed dead letter file: %w", err)
+	}
+	return replayed, failed, nil
+}
+
+// appendDeadLetterFile appends the dead letters in src, if it exists, to dst and removes src
+func appendDeadLetterFile(dst, src string) error {
+	data, err := os.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// replayRoute picks the route a dead letter was received on, or else the first route matching its topic
+func replayRoute(letter DeadLetter, routes []Route) (Route, bool) {
+	for _, route := range routes {
+		if route.Topic == letter.Subscription {
+			return route, true
+		}
+	}
+	for _, route := range routes {
+		if TopicMatchesFilter(route.Topic, letter.Topic) {
+			return route, true
+		}
+	}
+	return Route{}, false
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBridgeDeadLetters(t *testing.T) {
+	okServer, _ := ntfyStatusServer(t, http.StatusOK)
+	rejectServer, _ := ntfyStatusServer(t, http.StatusBadRequest)
+	failServer, _ := ntfyStatusServer(t, http.StatusBadGateway)
+
+	broker := newMemoryBroker()
+	published := make(chan DeadLetter, 10)
+	err := broker.connect(nil).Subscribe(Subscription{Topic: "mqtt2ntfy/dead_letter", Callback: func(msg MQTTMessage) {
+		var letter DeadLetter
+		if err := json.Unmarshal(msg.Payload, &letter); err != nil {
+			t.Errorf("Invalid dead letter %q: %v", msg.Payload, err)
+		}
+		published <- letter
+	}})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	client := broker.connect(nil)
+
+	tests := []struct {
+		name       string
+		route      Route
+		topic      string
+		qos        byte
+		persistent bool
+		want       bool
+	}{
+		{name: "delivered", route: Route{Topic: "alerts/door", NtfyURL: okServer.URL + "/door"}, topic: "alerts/door", want: false},
+		{name: "not routable", route: Route{Topic: "alerts/#", NtfyURL: okServer.URL}, topic: "alerts/garage/door", want: true},
+		{name: "rejected by ntfy", route: Route{Topic: "alerts/door", QoS: 1, NtfyURL: rejectServer.URL + "/door"}, topic: "alerts/door", qos: 1, want: true},
+		{name: "server error at QoS 1", route: Route{Topic: "alerts/door", QoS: 1, NtfyURL: failServer.URL + "/door"}, topic: "alerts/door", qos: 1, want: true},
+		{name: "server error at QoS 1 after redeliveries", route: Route{Topic: "alerts/door", QoS: 1, NtfyURL: failServer.URL + "/door"}, topic: "alerts/door", qos: 1, persistent: true, want: true},
+		{name: "server error at QoS 0", route: Route{Topic: "alerts/door", NtfyURL: failServer.URL + "/door"}, topic: "alerts/door", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+			bridge := testBridge()
+			bridge.SetDeadLetterQueue(NewDeadLetterQueue(file, "mqtt2ntfy/dead_letter", testLogger()))
+
+			subscription := bridge.Subscription(tt.route)
+			acked := make(chan struct{})
+			subscription.Callback(MQTTMessage{Topic: tt.topic, Payload: []byte("open"), QoS: tt.qos, client: client, ack: func() { close(acked) }, persistent: tt.persistent})
+			<-acked
+
+			letters, err := ReadDeadLetters(file)
+			if !tt.want {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("ReadDeadLetters() = %+v, %v, want no dead letter file", letters, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadDeadLetters failed: %v", err)
+			}
+			if len(letters) != 1 {
+				t.Fatalf("Got %d dead letters, want 1", len(letters))
+			}
+			letter := letters[0]
+			if letter.Topic != tt.topic || letter.Subscription != tt.route.Topic || letter.Payload != "open" || letter.Reason == "" || letter.Time.IsZero() {
+				t.Errorf("Dead letter = %+v, want topic, subscription, payload, reason and time", letter)
+			}
+
+			select {
+			case got := <-published:
+				if got.Topic != tt.topic || got.Reason != letter.Reason {
+					t.Errorf("Published dead letter = %+v, want %+v", got, letter)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the dead letter on MQTT")
+			}
+		})
+	}
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	msg := MQTTMessage{
+		Topic:          "alerts/door",
+		Payload:        []byte{0xff, 0x00, 0x01},
+		QoS:            1,
+		ContentType:    "application/octet-stream",
+		UserProperties: map[string]string{"title": "Door"},
+	}
+	letter := newDeadLetter(Route{Topic: "alerts/#"}, msg, errors.New("rejected"))
+	if letter.Payload != "" || !slices.Equal(letter.PayloadBase64, msg.Payload) {
+		t.Errorf("Binary payload stored as %q / %v, want payload_base64", letter.Payload, letter.PayloadBase64)
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var decoded DeadLetter
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	replayed := decoded.Message()
+	if replayed.Topic != msg.Topic || !slices.Equal(replayed.Payload, msg.Payload) || replayed.QoS != msg.QoS ||
+		replayed.ContentType != msg.ContentType || replayed.UserProperties["title"] != "Door" {
+		t.Errorf("Message() = %+v, want %+v", replayed, msg)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	server, paths := ntfyStatusServer(t, http.StatusOK)
+	rejectServer, _ := ntfyStatusServer(t, http.StatusForbidden)
+	routes := []Route{
+		{Topic: "alerts/#", NtfyURL: server.URL},
+		{Topic: "private/#", NtfyURL: rejectServer.URL},
+	}
+
+	file := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	queue := NewDeadLetterQueue(file, "", testLogger())
+	queue.Add(newDeadLetter(Route{Topic: "alerts/#"}, MQTTMessage{Topic: "alerts/door", Payload: []byte("open")}, errors.New("ntfy down")), nil)
+	queue.Add(newDeadLetter(Route{Topic: "private/#"}, MQTTMessage{Topic: "private/safe", Payload: []byte("open")}, errors.New("ntfy down")), nil)
+	queue.Add(newDeadLetter(Route{Topic: "old/#"}, MQTTMessage{Topic: "old/route", Payload: []byte("open")}, errors.New("ntfy down")), nil)
+
+	replayed, failed, err := ReplayDeadLetters(file, testBridge(), routes, testLogger())
+	if err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	if replayed != 1 || failed != 2 {
+		t.Errorf("ReplayDeadLetters() = %d replayed, %d failed, want 1 and 2", replayed, failed)
+	}
+	if path := <-paths; path != "/door" {
+		t.Errorf("Replayed message delivered to %s, want /door", path)
+	}
+
+	letters, err := ReadDeadLetters(file)
+	if err != nil {
+		t.Fatalf("ReadDeadLetters failed: %v", err)
+	}
+	var topics []string
+	for _, letter := range letters {
+		topics = append(topics, letter.Topic)
+	}
+	if !slices.Equal(topics, []string{"private/safe", "old/route"}) {
+		t.Errorf("Remaining dead letters = %v, want private/safe and old/route", topics)
+	}
+	if _, err := os.Stat(file + ".replaying"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Replay left %s.replaying behind", file)
+	}
+
+	// Nothing to replay
+	missing := filepath.Join(t.TempDir(), "missing.jsonl")
+	if replayed, failed, err := ReplayDeadLetters(missing, testBridge(), routes, testLogger()); err != nil || replayed != 0 || failed != 0 {
+		t.Errorf("ReplayDeadLetters(missing) = %d, %d, %v, want 0, 0, nil", replayed, failed, err)
+	}
+}
+
+func TestReplayDeadLettersAfterInterruptedReplay(t *testing.T) {
+	server, paths := ntfyStatusServer(t, http.StatusOK)
+	routes := []Route{{Topic: "alerts/#", NtfyURL: server.URL}}
+
+	// An interrupted replay left its file aside, and a new dead letter was added since
+	file := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	NewDeadLetterQueue(file+".replaying", "", testLogger()).Add(newDeadLetter(Route{Topic: "alerts/#"}, MQTTMessage{Topic: "alerts/door", Payload: []byte("open")}, errors.New("ntfy down")), nil)
+	NewDeadLetterQueue(file, "", testLogger()).Add(newDeadLetter(Route{Topic: "alerts/#"}, MQTTMessage{Topic: "alerts/window", Payload: []byte("open")}, errors.New("ntfy down")), nil)
+
+	replayed, failed, err := ReplayDeadLetters(file, testBridge(), routes, testLogger())
+	if err != nil {
+		t.Fatalf("ReplayDeadLetters failed: %v", err)
+	}
+	if replayed != 2 || failed != 0 {
+		t.Errorf("ReplayDeadLetters() = %d replayed, %d failed, want 2 and 0", replayed, failed)
+	}
+	delivered := []string{<-paths, <-paths}
+	if !slices.Equal(delivered, []string{"/door", "/window"}) {
+		t.Errorf("Replayed messages delivered to %v, want /door and /window", delivered)
+	}
+	for _, leftover := range []string{file, file + ".replaying"} {
+		if _, err := os.Stat(leftover); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Replay left %s behind", leftover)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles reported by the health endpoint when leader election is enabled
+const (
+	RoleLeader  = "leader"
+	RoleStandby = "standby"
+)
+
+// electionSettleDelay is how long a claim must stand unchallenged before this instance starts
+// forwarding, so two instances claiming at the same time do not both act as leader
+const electionSettleDelay = 500 * time.Millisecond
+
+// ElectionConfig holds settings for active/standby leader election
+type ElectionConfig struct {
+	Topic      string        // retained lock topic; member status is published below <Topic>/members/
+	ClientID   string        // identifies this instance in the lock and member topics
+	ClaimDelay time.Duration // how long to wait for the current lock before claiming it
+
+	// StatusTopic, if set, replaces the member topics: a topic with {client_id} as one of its levels
+	// on which each instance's StatusPublisher publishes "online", with "offline" as its Last Will
+	StatusTopic string
+}
+
+// electionLock is the retained payload of the lock topic
+type electionLock struct {
+	Holder string    `json:"holder"`
+	Since  time.Time `json:"since"`
+}
+
+// electionMember is the retained payload of a member status topic; the broker publishes
+// the offline status as the instance's Last Will when its connection drops
+type electionMember struct {
+	Status   string `json:"status"`
+	ClientID string `json:"client_id"`
+}
+
+// Election coordinates instances through a retained MQTT lock topic so only the leader forwards
+// messages. Every instance publishes a retained member status with an offline Last Will; when the
+// lock holder's will fires, the standbys claim the lock.
+type Election struct {
+	topic       string
+	clientID    string
+	claimDelay  time.Duration
+	memberLevel int    // level of the member topics holding the client ID
+	statusTopic string // see ElectionConfig.StatusTopic
+	logger      *slog.Logger
+	announce    func() // republishes this instance's status on the status topic
+
+	mu        sync.Mutex
+	client    MQTTClient
+	connected bool
+	leader    bool
+	holder    string          // current lock holder; empty if the lock is free or unknown
+	offline   map[string]bool // members whose retained status is offline
+	timer     *time.Timer
+}
+
+// NewElection creates an Election; it takes part once Start is called with a connected client
+func NewElection(config ElectionConfig, logger *slog.Logger) *Election {
+	e := &Election{
+		topic:       config.Topic,
+		clientID:    config.ClientID,
+		claimDelay:  config.ClaimDelay,
+		statusTopic: config.StatusTopic,
+		logger:      logger,
+		offline:     map[string]bool{},
+	}
+	e.memberLevel = slices.Index(strings.Split(e.memberTopic("{client_id}"), "/"), "{client_id}")
+	return e
+}
+
+// SetStatusAnnouncer sets the function republishing this instance's status when its role changes
+// or a stale Last Will marked it offline; only used with a status topic
+func (e *Election) SetStatusAnnouncer(announce func()) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.announce = announce
+}
+
+// memberTopic returns the retained status topic of an instance
+func (e *Election) memberTopic(clientID string) string {
+	if e.statusTopic != "" {
+		return strings.ReplaceAll(e.statusTopic, "{client_id}", clientID)
+	}
+	return e.topic + "/members/" + clientID
+}
+
+// Will returns the Last Will that marks this instance offline when its connection drops, or nil
+// if the StatusPublisher of the status topic provides it
+func (e *Election) Will() *MQTTWill {
+	if e.statusTopic != "" {
+		return nil
+	}
+	return &MQTTWill{
+		Topic:    e.memberTopic(e.clientID),
+		Payload:  e.memberPayload("offline"),
+		QoS:      1,
+		Retained: true,
+	}
+}
+
+// Subscriptions returns the lock and member status subscriptions the election needs
+func (e *Election) Subscriptions() []Subscription {
+	return []Subscription{
+		{Topic: e.topic, QoS: 1, Callback: e.onLock},
+		{Topic: e.memberTopic("+"), QoS: 1, Callback: e.onMember},
+	}
+}
+
+// Start joins the election using a connected client
+func (e *Election) Start(client MQTTClient) {
+	e.mu.Lock()
+	e.client = client
+	e.mu.Unlock()
+	e.ConnectionUp()
+}
+
+// ConnectionUp announces this instance and claims the lock if nobody holds it
+func (e *Election) ConnectionUp() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client == nil {
+		return // Start has not been called yet
+	}
+	e.connected = true
+	if e.statusTopic == "" {
+		// With a status topic, the StatusPublisher announces this instance on connect
+		go e.publishMember("online")
+	}
+	if e.holder == "" {
+		e.scheduleLocked(e.claimDelay, e.claim)
+	}
+}
+
+// ConnectionDown steps down; without a connection this instance cannot act as leader
+func (e *Election) ConnectionDown() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.connected = false
+	e.holder = ""
+	e.stopTimerLocked()
+	e.setLeaderLocked(false, "MQTT connection lost")
+}
+
+// IsLeader reports whether this instance currently forwards messages
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Role returns RoleLeader or RoleStandby
+func (e *Election) Role() string {
+	if e.IsLeader() {
+		return RoleLeader
+	}
+	return RoleStandby
+}
+
+// Release gives up the lock (if held) and marks this instance offline ahead of a clean shutdown,
+// which does not trigger the Last Will
+func (e *Election) Release() {
+	e.mu.Lock()
+	client, wasLeader := e.client, e.leader
+	e.connected = false // do not claim the lock again once it is released
+	e.stopTimerLocked()
+	e.setLeaderLocked(false, "shutting down")
+	e.mu.Unlock()
+
+	if client == nil {
+		return
+	}
+	if wasLeader {
+		if err := client.Publish(e.topic, 1, true, nil); err != nil {
+			e.logger.Warn("Failed to release leader lock", "topic", e.topic, "error", err)
+		}
+	}
+	e.publishMember("offline")
+}
+
+// onLock handles the retained lock topic
+func (e *Election) onLock(msg MQTTMessage) {
+	defer msg.Ack()
+
+	var lock electionLock
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &lock); err != nil {
+			e.logger.Warn("Ignoring invalid leader lock", "topic", msg.Topic, "payload", string(msg.Payload), "error", err)
+			return
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.holder = lock.Holder
+	if e.offline[e.holder] && e.holder != e.clientID {
+		// A stale lock whose holder's Last Will has already fired
+		e.holder = ""
+	}
+	e.updateLocked()
+}
+
+// onMember handles member status topics
+func (e *Election) onMember(msg MQTTMessage) {
+	defer msg.Ack()
+
+	levels := strings.Split(msg.Topic, "/")
+	if e.memberLevel < 0 || e.memberLevel >= len(levels) {
+		return
+	}
+	clientID := levels[e.memberLevel]
+	var offline bool
+	if e.statusTopic != "" {
+		offline = len(msg.Payload) == 0 || string(msg.Payload) == StatusOffline
+	} else {
+		var member electionMember
+		if len(msg.Payload) > 0 {
+			if err := json.Unmarshal(msg.Payload, &member); err != nil {
+				e.logger.Warn("Ignoring invalid election member status", "topic", msg.Topic, "payload", string(msg.Payload), "error", err)
+				return
+			}
+		}
+		offline = member.Status != "online"
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if clientID == e.clientID {
+		if offline && e.connected {
+			// A Last Will from a previous connection; announce ourselves again
+			go e.publishMember("online")
+		}
+		return
+	}
+
+	e.offline[clientID] = offline
+	if offline && clientID == e.holder {
+		e.logger.Info("Leader went offline; claiming leadership", "leader", clientID)
+		e.holder = ""
+		e.updateLocked()
+	}
+}
+
+// updateLocked reacts to a change of the lock holder
+func (e *Election) updateLocked() {
+	switch e.holder {
+	case e.clientID:
+		if !e.leader {
+			// Our claim stands; take over once it has settled
+			e.scheduleLocked(electionSettleDelay, func() {
+				e.mu.Lock()
+				defer e.mu.Unlock()
+				if e.holder == e.clientID && e.connected {
+					e.setLeaderLocked(true, "lock acquired")
+				}
+			})
+		}
+	case "":
+		e.setLeaderLocked(false, "lock released")
+		if e.connected {
+			// Spread the claims of several standbys a little
+			jitter := time.Duration(rand.Int64N(int64(e.claimDelay/2) + 1))
+			e.scheduleLocked(e.claimDelay/2+jitter, e.claim)
+		}
+	default:
+		e.stopTimerLocked()
+		e.setLeaderLocked(false, "lock held by "+e.holder)
+	}
+}
+
+// claim publishes this instance as the lock holder if the lock is still free
+func (e *Election) claim() {
+	e.mu.Lock()
+	client := e.client
+	free := e.holder == "" && e.connected
+	e.mu.Unlock()
+	if !free || client == nil {
+		return
+	}
+
+	payload, _ := json.Marshal(electionLock{Holder: e.clientID, Since: time.Now().UTC()})
+	e.logger.Debug("Claiming leader lock", "topic", e.topic, "client_id", e.clientID)
+	if err := client.Publish(e.topic, 1, true, payload); err != nil {
+		e.logger.Warn("Failed to claim leader lock", "topic", e.topic, "error", err)
+	}
+}
+
+// publishMember publishes this instance's retained member status. With a status topic, the
+// StatusPublisher publishes it instead: online is announced, offline is left to Stop.
+func (e *Election) publishMember(status string) {
+	e.mu.Lock()
+	client, announce := e.client, e.announce
+	e.mu.Unlock()
+	if e.statusTopic != "" {
+		if status != StatusOffline && announce != nil {
+			announce()
+		}
+		return
+	}
+	if client == nil {
+		return
+	}
+	if err := client.Publish(e.memberTopic(e.clientID), 1, true, e.memberPayload(status)); err != nil {
+		e.logger.Warn("Failed to publish election member status", "status", status, "error", err)
+	}
+}
+
+func (e *Election) memberPayload(status string) []byte {
+	payload, _ := json.Marshal(electionMember{Status: status, ClientID: e.clientID})
+	return payload
+}
+
+// setLeaderLocked changes the role and logs the transition
+func (e *Election) setLeaderLocked(leader bool, reason string) {
+	if e.leader == leader {
+		return
+	}
+	e.leader = leader
+	if e.statusTopic != "" && e.connected {
+		go e.publishMember(StatusOnline)
+	}
+	if leader {
+		e.logger.Info("This instance is now the leader and forwards messages", "client_id", e.clientID, "reason", reason)
+	} else {
+		e.logger.Info("This instance is now on standby and does not forward messages", "client_id", e.clientID, "reason", reason)
+	}
+}
+
+// scheduleLocked replaces any pending timer with f after delay
+func (e *Election) scheduleLocked(delay time.Duration, f func()) {
+	e.stopTimerLocked()
+	e.timer = time.AfterFunc(delay, f)
+}
+
+func (e *Election) stopTimerLocked() {
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryBroker is an in-memory MQTT broker supporting retained messages and Last Wills
+type memoryBroker struct {
+	deliver sync.Mutex // serializes publishes so every client sees them in the same order
+
+	mu       sync.Mutex
+	retained map[string][]byte
+	clients  []*memoryClient
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{retained: map[string][]byte{}}
+}
+
+// memoryClient implements MQTTClient against a memoryBroker
+type memoryClient struct {
+	broker    *memoryBroker
+	will      *MQTTWill
+	connected bool
+	subs      []Subscription
+}
+
+func (b *memoryBroker) connect(will *MQTTWill) *memoryClient {
+	client := &memoryClient{broker: b, will: will, connected: true}
+	b.mu.Lock()
+	b.clients = append(b.clients, client)
+	b.mu.Unlock()
+	return client
+}
+
+func (b *memoryBroker) publish(topic string, retained bool, payload []byte) {
+	b.deliver.Lock()
+	defer b.deliver.Unlock()
+
+	b.mu.Lock()
+	if retained {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = payload
+		}
+	}
+	var callbacks []func(MQTTMessage)
+	for _, client := range b.clients {
+		if !client.connected {
+			continue
+		}
+		for _, sub := range client.subs {
+			if TopicMatchesFilter(sub.Topic, topic) {
+				callbacks = append(callbacks, sub.Callback)
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(MQTTMessage{Topic: topic, Payload: payload, QoS: 1})
+	}
+}
+
+func (b *memoryBroker) retainedMessage(topic string) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retained[topic]
+}
+
+func (c *memoryClient) Connect() error { return nil }
+
+func (c *memoryClient) Subscribe(subscription Subscription) error {
+	c.broker.deliver.Lock()
+	defer c.broker.deliver.Unlock()
+
+	c.broker.mu.Lock()
+	c.subs = append(c.subs, subscription)
+	var retained []MQTTMessage
+	for topic, payload := range c.broker.retained {
+		if TopicMatchesFilter(subscription.Topic, topic) {
+			retained = append(retained, MQTTMessage{Topic: topic, Payload: payload, QoS: 1})
+		}
+	}
+	c.broker.mu.Unlock()
+
+	for _, msg := range retained {
+		subscription.Callback(msg)
+	}
+	return nil
+}
+
+func (c *memoryClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	c.broker.publish(topic, retained, payload)
+	return nil
+}
+
+func (c *memoryClient) Disconnect(quiesce uint) {
+	c.broker.mu.Lock()
+	c.connected = false
+	c.broker.mu.Unlock()
+}
+
+// drop simulates a lost connection: the broker publishes the client's Last Will
+func (c *memoryClient) drop() {
+	c.Disconnect(0)
+	if c.will != nil {
+		c.broker.publish(c.will.Topic, c.will.Retained, c.will.Payload)
+	}
+}
+
+// reconnect restores a dropped connection
+func (c *memoryClient) reconnect() {
+	c.broker.mu.Lock()
+	c.connected = true
+	c.broker.mu.Unlock()
+}
+
+// startTestElection joins an election on broker as clientID
+func startTestElection(t *testing.T, broker *memoryBroker, clientID string) (*Election, *memoryClient) {
+	t.Helper()
+	election := NewElection(ElectionConfig{
+		Topic:      "mqtt2ntfy/leader",
+		ClientID:   clientID,
+		ClaimDelay: 50 * time.Millisecond,
+	}, testLogger())
+	client := broker.connect(election.Will())
+	for _, subscription := range election.Subscriptions() {
+		if err := client.Subscribe(subscription); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	election.Start(client)
+	return election, client
+}
+
+// waitForRole waits until the election reports the wanted role
+func waitForRole(t *testing.T, election *Election, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if election.Role() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s role = %s, want %s", election.clientID, election.Role(), want)
+}
+
+func TestElectionSingleInstanceBecomesLeader(t *testing.T) {
+	broker := newMemoryBroker()
+	election, _ := startTestElection(t, broker, "a")
+	if election.Role() != RoleStandby {
+		t.Errorf("Role() before claiming = %s, want standby", election.Role())
+	}
+	waitForRole(t, election, RoleLeader)
+
+	var lock electionLock
+	if err := json.Unmarshal(broker.retainedMessage("mqtt2ntfy/leader"), &lock); err != nil {
+		t.Fatalf("Invalid retained lock: %v", err)
+	}
+	if lock.Holder != "a" {
+		t.Errorf("Lock holder = %s, want a", lock.Holder)
+	}
+	var member electionMember
+	if err := json.Unmarshal(broker.retainedMessage("mqtt2ntfy/leader/members/a"), &member); err != nil {
+		t.Fatalf("Invalid retained member status: %v", err)
+	}
+	if member.Status != "online" {
+		t.Errorf("Member status = %s, want online", member.Status)
+	}
+}
+
+func TestElectionFailoverOnLastWill(t *testing.T) {
+	broker := newMemoryBroker()
+	leader, leaderClient := startTestElection(t, broker, "a")
+	waitForRole(t, leader, RoleLeader)
+
+	standby, _ := startTestElection(t, broker, "b")
+	time.Sleep(700 * time.Millisecond)
+	if standby.Role() != RoleStandby {
+		t.Fatalf("Second instance role = %s, want standby while a leads", standby.Role())
+	}
+
+	leaderClient.drop()
+	leader.ConnectionDown()
+	if leader.Role() != RoleStandby {
+		t.Errorf("Disconnected leader role = %s, want standby", leader.Role())
+	}
+	waitForRole(t, standby, RoleLeader)
+}
+
+func TestElectionReleaseOnShutdown(t *testing.T) {
+	broker := newMemoryBroker()
+	leader, leaderClient := startTestElection(t, broker, "a")
+	waitForRole(t, leader, RoleLeader)
+	standby, _ := startTestElection(t, broker, "b")
+
+	leader.Release()
+	leaderClient.Disconnect(0)
+	waitForRole(t, standby, RoleLeader)
+
+	var member electionMember
+	if err := json.Unmarshal(broker.retainedMessage("mqtt2ntfy/leader/members/a"), &member); err != nil {
+		t.Fatalf("Invalid retained member status: %v", err)
+	}
+	if member.Status != "offline" {
+		t.Errorf("Released member status = %s, want offline", member.Status)
+	}
+}
+
+func TestElectionIgnoresStaleLock(t *testing.T) {
+	broker := newMemoryBroker()
+	// A previous leader crashed: its lock is still retained, but its Last Will marked it offline
+	broker.publish("mqtt2ntfy/leader", true, []byte(`{"holder":"old"}`))
+	broker.publish("mqtt2ntfy/leader/members/old", true, []byte(`{"status":"offline","client_id":"old"}`))
+
+	election, _ := startTestElection(t, broker, "a")
+	waitForRole(t, election, RoleLeader)
+}
+
+func TestElectionResumesOwnLock(t *testing.T) {
+	broker := newMemoryBroker()
+	// This instance led before restarting; the broker fired its Last Will when the old connection dropped
+	broker.publish("mqtt2ntfy/leader", true, []byte(`{"holder":"a"}`))
+	broker.publish("mqtt2ntfy/leader/members/a", true, []byte(`{"status":"offline","client_id":"a"}`))
+
+	election, _ := startTestElection(t, broker, "a")
+	waitForRole(t, election, RoleLeader)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var member electionMember
+		if err := json.Unmarshal(broker.retainedMessage("mqtt2ntfy/leader/members/a"), &member); err == nil && member.Status == "online" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Instance did not announce itself online again")
+}
+
+// startTestElectionWithStatus joins an election on broker as clientID whose members report
+// on a status topic and their role in its stats
+func startTestElectionWithStatus(t *testing.T, broker *memoryBroker, clientID string) (*Election, *StatusPublisher, *memoryClient) {
+	t.Helper()
+	election := NewElection(ElectionConfig{
+		Topic:       "mqtt2ntfy/leader",
+		ClientID:    clientID,
+		ClaimDelay:  50 * time.Millisecond,
+		StatusTopic: "bridges/{client_id}/status",
+	}, testLogger())
+	status := NewStatusPublisher(StatusConfig{
+		Topic:         "bridges/{client_id}/status",
+		StatsTopic:    "bridges/{client_id}/status/stats",
+		StatsInterval: time.Hour,
+		ClientID:      clientID,
+		Started:       time.Now(),
+		Role:          election.Role,
+	}, func() BridgeStats { return BridgeStats{} }, testLogger())
+	election.SetStatusAnnouncer(status.ConnectionUp)
+	if election.Will() != nil {
+		t.Error("Election with a status topic has its own Last Will")
+	}
+	client := broker.connect(status.Will())
+	for _, subscription := range election.Subscriptions() {
+		if err := client.Subscribe(subscription); err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+	}
+	status.Start(client)
+	election.Start(client)
+	return election, status, client
+}
+
+// waitForStatsRole waits until the retained stats on topic report role
+func waitForStatsRole(t *testing.T, broker *memoryBroker, topic, role string) {
+	t.Helper()
+	var stats statusStats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if json.Unmarshal(broker.retainedMessage(topic), &stats) == nil && stats.Role == role {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Stats on %s = %q, want role %q", topic, broker.retainedMessage(topic), role)
+}
+
+func TestElectionWithStatusTopic(t *testing.T) {
+	broker := newMemoryBroker()
+	leader, _, leaderClient := startTestElectionWithStatus(t, broker, "a")
+	waitForRole(t, leader, RoleLeader)
+	waitForStatsRole(t, broker, "bridges/a/status/stats", RoleLeader)
+	waitForRetained(t, broker, "bridges/a/status", StatusOnline)
+
+	standby, standbyStatus, _ := startTestElectionWithStatus(t, broker, "b")
+	waitForStatsRole(t, broker, "bridges/b/status/stats", RoleStandby)
+	waitForRetained(t, broker, "bridges/b/status", StatusOnline)
+	if len(broker.retainedMessage("mqtt2ntfy/leader/members/a")) != 0 {
+		t.Error("Election published member status besides the status topic")
+	}
+
+	// The leader's Last Will on its status topic hands over leadership
+	leaderClient.drop()
+	leader.ConnectionDown()
+	waitForRole(t, standby, RoleLeader)
+	waitForStatsRole(t, broker, "bridges/b/status/stats", RoleLeader)
+	waitForRetained(t, broker, "bridges/b/status", StatusOnline)
+	waitForRetained(t, broker, "bridges/a/status", StatusOffline)
+
+	standby.Release()
+	standbyStatus.Stop()
+	waitForRetained(t, broker, "bridges/b/status", StatusOffline)
+}
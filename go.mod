@@ -3,14 +3,15 @@ module mqtt2ntfy
 go 1.25.0
 
 require (
+	github.com/avast/retry-go/v4 v4.6.1
+	github.com/cdzombak/heartbeat v1.1.1
+	github.com/eclipse/paho.golang v0.23.0
 	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/avast/retry-go/v4 v4.6.1 // indirect
-	github.com/cdzombak/heartbeat v1.1.1 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/net v0.44.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
 )
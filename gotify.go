@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// gotifyPriorities maps the Ntfy priorities 1-5 to Gotify's 0-10: 1-3 notify silently, 4-7 with
+// a sound and 8-10 with high importance on Gotify's Android app
+var gotifyPriorities = [...]int{1: 1, 2: 3, 3: 5, 4: 8, 5: 10}
+
+// gotifyMessage is the body of Gotify's POST /message
+type gotifyMessage struct {
+	Title    string         `json:"title,omitempty"`
+	Message  string         `json:"message"`
+	Priority int            `json:"priority"`
+	Extras   map[string]any `json:"extras,omitempty"`
+}
+
+// gotifyPublishResponse is the part of Gotify's response mqtt2ntfy uses
+type gotifyPublishResponse struct {
+	ID int `json:"id"`
+}
+
+// GotifyClient implements NtfyClient for Gotify: the URL is that of the Gotify server and the
+// token of the auth that of a Gotify application
+type GotifyClient struct {
+	sender *backendSender
+}
+
+// NewGotifyClient creates a Gotify client with the timeout, retry and connection settings of config
+func NewGotifyClient(config NtfyConfig, logger *slog.Logger) *GotifyClient {
+	return &GotifyClient{sender: newBackendSender(BackendGotify, config, logger)}
+}
+
+// CloseIdleConnections closes the client's idle keep-alive connections
+func (g *GotifyClient) CloseIdleConnections() {
+	g.sender.CloseIdleConnections()
+}
+
+// SendMessage implements NtfyClient with the retry logic of HTTPNtfyClient
+func (g *GotifyClient) SendMessage(serverURL string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	body, err := json.Marshal(newGotifyMessage(message))
+	if err != nil {
+		return NtfyReceipt{}, err
+	}
+	endpoint := strings.TrimSuffix(serverURL, "/") + "/message"
+	return sendWithRetry(g.sender.config, message.ExpiresAt, func(ctx context.Context) (string, int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Gotify-Key", auth.Token)
+
+		response, status, err := g.sender.do(req)
+		if err != nil {
+			return "", status, err
+		}
+		var published gotifyPublishResponse
+		if err := json.Unmarshal(response, &published); err != nil || published.ID == 0 {
+			return "", status, nil
+		}
+		return strconv.Itoa(published.ID), status, nil
+	})
+}
+
+// newGotifyMessage converts a message to Gotify's format. Gotify has no tags, actions or uploaded
+// attachments; an attach URL is shown as the notification's image.
+func newGotifyMessage(message NtfyMessage) gotifyMessage {
+	gotify := gotifyMessage{
+		Title:    message.Title,
+		Message:  message.Message,
+		Priority: gotifyPriorities[priorityLevel(message.Priority)],
+	}
+	// Gotify rejects messages without text
+	if gotify.Message == "" {
+		switch {
+		case message.Attach != "":
+			gotify.Message = message.Attach
+		case message.Filename != "":
+			gotify.Message = message.Filename
+		case message.Title != "":
+			gotify.Message = message.Title
+		default:
+			gotify.Message = "(no message)"
+		}
+	}
+
+	extras := map[string]any{}
+	if message.Markdown {
+		extras["client::display"] = map[string]any{"contentType": "text/markdown"}
+	}
+	notification := map[string]any{}
+	if message.Click != "" {
+		notification["click"] = map[string]any{"url": message.Click}
+	}
+	if message.Attach != "" {
+		notification["bigImageUrl"] = message.Attach
+	}
+	if len(notification) > 0 {
+		extras["client::notification"] = notification
+	}
+	if len(extras) > 0 {
+		gotify.Extras = extras
+	}
+	return gotify
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestNewGotifyMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message NtfyMessage
+		want    gotifyMessage
+	}{
+		{
+			name:    "default priority",
+			message: NtfyMessage{Message: "Door opened"},
+			want:    gotifyMessage{Message: "Door opened", Priority: 5},
+		},
+		{
+			name:    "urgent markdown",
+			message: NtfyMessage{Message: "**Fire**", Title: "Alarm", Priority: "urgent", Markdown: true, Click: "https://home.example.com"},
+			want: gotifyMessage{Title: "Alarm", Message: "**Fire**", Priority: 10, Extras: map[string]any{
+				"client::display":      map[string]any{"contentType": "text/markdown"},
+				"client::notification": map[string]any{"click": map[string]any{"url": "https://home.example.com"}},
+			}},
+		},
+		{
+			name:    "min priority",
+			message: NtfyMessage{Message: "Backup done", Priority: "1"},
+			want:    gotifyMessage{Message: "Backup done", Priority: 1},
+		},
+		{
+			name:    "attach url without message",
+			message: NtfyMessage{Attach: "https://cam.example.com/snapshot.jpg", Priority: "4"},
+			want: gotifyMessage{Message: "https://cam.example.com/snapshot.jpg", Priority: 8, Extras: map[string]any{
+				"client::notification": map[string]any{"bigImageUrl": "https://cam.example.com/snapshot.jpg"},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := newGotifyMessage(tt.message); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("newGotifyMessage(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGotifySendMessage(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Status: http.StatusServiceUnavailable}, backendResponse{Body: `{"id":42,"appid":1,"message":"ok"}`})
+	client := NewGotifyClient(testBackendConfig(), testLogger())
+
+	receipt, err := client.SendMessage(server.URL+"/", NtfyMessage{Message: "Door opened", Title: "Garage", Priority: "high"}, NtfyAuth{Token: "AbCdEf123"})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if receipt.MessageID != "42" || receipt.Attempts != 2 || receipt.StatusCode != http.StatusOK {
+		t.Errorf("Receipt = %+v, want message 42 after retrying the 503", receipt)
+	}
+
+	<-requests
+	request := <-requests
+	if got := request.Header.Get("X-Gotify-Key"); got != "AbCdEf123" {
+		t.Errorf("X-Gotify-Key = %q, want the application token", got)
+	}
+	if request.Method != http.MethodPost || request.Path != "/message" || request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Request = %s %s (%s), want a JSON POST to /message", request.Method, request.Path, request.Header.Get("Content-Type"))
+	}
+	var body gotifyMessage
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		t.Fatalf("Body %s is not JSON: %v", request.Body, err)
+	}
+	if want := (gotifyMessage{Title: "Garage", Message: "Door opened", Priority: 8}); !reflect.DeepEqual(body, want) {
+		t.Errorf("Body = %+v, want %+v", body, want)
+	}
+}
+
+func TestGotifySendMessageRejected(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Status: http.StatusUnauthorized, Body: `{"error":"Unauthorized","errorCode":401}`})
+	client := NewGotifyClient(testBackendConfig(), testLogger())
+
+	receipt, err := client.SendMessage(server.URL, NtfyMessage{Message: "Door opened"}, NtfyAuth{Token: "wrong"})
+	var statusErr *NtfyStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("SendMessage() error = %v, want status 401", err)
+	}
+	if statusErr.Error() != "gotify server returned status: 401 (client error)" {
+		t.Errorf("Error = %q, want it to name Gotify", statusErr)
+	}
+	if receipt.Attempts != 1 || len(requests) != 1 {
+		t.Errorf("Attempts = %d, want a rejected token not to be retried", receipt.Attempts)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthServer serves the heartbeat health endpoint: {"ok":true} while Alive has been called
+// within the liveness threshold, plus the instance's role when leader election is enabled
+type HealthServer struct {
+	port              int
+	livenessThreshold time.Duration
+	role              func() string
+	logger            *slog.Logger
+
+	mu        sync.Mutex
+	lastAlive time.Time
+}
+
+// healthResponse is the JSON body returned by the health endpoint
+type healthResponse struct {
+	OK   bool   `json:"ok"`
+	Role string `json:"role,omitempty"`
+}
+
+// NewHealthServer creates a health endpoint on port; role may be nil
+func NewHealthServer(port int, livenessThreshold time.Duration, role func() string, logger *slog.Logger) *HealthServer {
+	return &HealthServer{
+		port:              port,
+		livenessThreshold: livenessThreshold,
+		role:              role,
+		logger:            logger,
+	}
+}
+
+// Start serves the health endpoint in the background
+func (h *HealthServer) Start() {
+	go func() {
+		server := &http.Server{
+			Addr:              fmt.Sprintf(":%d", h.port),
+			Handler:           h,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			h.logger.Error("Heartbeat error", "error", err)
+		}
+	}()
+}
+
+// Alive records that the bridge was working at the given time
+func (h *HealthServer) Alive(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastAlive.Before(at) {
+		h.lastAlive = at
+	}
+}
+
+func (h *HealthServer) ok() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.lastAlive) < h.livenessThreshold
+}
+
+// ServeHTTP implements http.Handler
+func (h *HealthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := healthResponse{OK: h.ok()}
+	if h.role != nil {
+		response.Role = h.role()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !response.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	body, _ := json.Marshal(response)
+	_, _ = w.Write(body)
+}
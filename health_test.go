@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthServer(t *testing.T) {
+	role := RoleStandby
+	health := NewHealthServer(0, time.Minute, func() string { return role }, testLogger())
+
+	tests := []struct {
+		name       string
+		method     string
+		alive      time.Time
+		role       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "never alive", method: http.MethodGet, role: RoleStandby, wantStatus: http.StatusServiceUnavailable, wantBody: `{"ok":false,"role":"standby"}`},
+		{name: "alive standby", method: http.MethodGet, alive: time.Now(), role: RoleStandby, wantStatus: http.StatusOK, wantBody: `{"ok":true,"role":"standby"}`},
+		{name: "alive leader", method: http.MethodGet, role: RoleLeader, wantStatus: http.StatusOK, wantBody: `{"ok":true,"role":"leader"}`},
+		{name: "wrong method", method: http.MethodPost, role: RoleLeader, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.alive.IsZero() {
+				health.Alive(tt.alive)
+			}
+			role = tt.role
+
+			recorder := httptest.NewRecorder()
+			health.ServeHTTP(recorder, httptest.NewRequest(tt.method, "/", nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && recorder.Body.String() != tt.wantBody {
+				t.Errorf("body = %s, want %s", recorder.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHealthServerWithoutElection(t *testing.T) {
+	health := NewHealthServer(0, time.Minute, nil, testLogger())
+	health.Alive(time.Now())
+
+	recorder := httptest.NewRecorder()
+	health.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK || recorder.Body.String() != `{"ok":true}` {
+		t.Errorf("response = %d %s, want 200 {\"ok\":true}", recorder.Code, recorder.Body.String())
+	}
+}
@@ -14,9 +14,11 @@ import (
 var version = "dev"
 
 func main() {
+	started := time.Now()
 	var configPath string
 	var verbose bool
 	var showVersion bool
+	var replayDeadLetters bool
 
 	// MQTT flags
 	var mqttBroker string
@@ -32,6 +34,7 @@ func main() {
 	flag.StringVar(&configPath, "config", "", "Path to YAML configuration file (optional if all required flags provided)")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging")
 	flag.BoolVar(&showVersion, "version", false, "Show version information")
+	flag.BoolVar(&replayDeadLetters, "replay-dead-letters", false, "Deliver the messages in dead_letter.file again and exit")
 
 	// MQTT flags
 	flag.StringVar(&mqttBroker, "mqtt-broker", "", "MQTT broker URL (e.g., localhost, tcp://localhost:1883)")
@@ -71,79 +74,234 @@ func main() {
 		os.Exit(1)
 	}
 
-	logger.Info("Config loaded successfully", "mqtt_broker", config.MQTT.Broker, "mqtt_topic", config.MQTT.Topic, "ntfy_url", config.Ntfy.URL)
+	logger.Info("Config loaded successfully", "mqtt_broker", config.MQTT.Broker, "mqtt_topic", config.MQTT.Topic, "connections", len(config.Connections), "ntfy_url", config.Ntfy.URL)
 
 	// Create Ntfy configuration
 	ntfyConfig := NtfyConfig{
-		Timeout:    config.GetNtfyTimeout(),
-		MaxRetries: config.Ntfy.MaxRetries,
-		RetryDelay: config.GetNtfyRetryDelay(),
+		Timeout:         config.GetNtfyTimeout(),
+		MaxRetries:      config.Ntfy.MaxRetries,
+		RetryDelay:      config.GetNtfyRetryDelay(),
+		CircuitBreaker:  config.GetNtfyCircuitBreaker(),
+		MaxIdleConns:    config.Ntfy.MaxIdleConnections,
+		IdleConnTimeout: config.GetNtfyIdleTimeout(),
+		ProxyURL:        config.GetNtfyProxyURL(),
+	}
+	if config.Ntfy.TLS.IsEnabled() {
+		reloader, err := NewTLSReloader(config.Ntfy.TLS)
+		if err != nil {
+			logger.Error("Failed to load Ntfy TLS configuration", "error", err)
+			os.Exit(1)
+		}
+		ntfyConfig.TLS = reloader
+		if config.Ntfy.TLS.InsecureSkipVerify {
+			logger.Warn("Ntfy TLS certificate verification is disabled (ntfy.tls.insecure_skip_verify)")
+		}
 	}
 
-	// Connect to MQTT and subscribe
-	mqttHandler, err := ConnectAndSubscribe(context.Background(), config.MQTT.Broker, config.MQTT.Topic, config.MQTT.Username, config.MQTT.Password, config.GetMQTTConnectTimeout(), config.GetMQTTPingTimeout(), func(topic string, payload []byte) {
-		logger.Info("Received MQTT message", "topic", topic, "payload", string(payload))
+	// All connections feed the same bridge
+	bridge := NewBridge(ntfyConfig, config.GetNtfyAuth(), logger)
+	bridge.SetTopicCredentials(config.GetNtfyTopicAuth())
+	bridge.SetAttachmentFetch(config.GetAttachmentFetch())
 
-		// Parse message for priority prefix and get cleaned message
-		cleanedMessage, messagePriority := ParseMessagePriority(string(payload), config.Ntfy.Priority)
-		if cleanedMessage != string(payload) {
-			logger.Info("Extracted priority from message", "original", string(payload), "cleaned", cleanedMessage, "priority", messagePriority)
+	// Other notification services routes can deliver to
+	backends := make(map[string]Backend, len(config.Backends))
+	for name, backendConfig := range config.Backends {
+		backend, err := NewBackend(name, backendConfig, ntfyConfig, logger)
+		if err != nil {
+			logger.Error("Failed to create backend", "backend", name, "error", err)
+			os.Exit(1)
 		}
+		backends[name] = backend
+		logger.Info("Backend configured", "backend", name, "type", backend.Type, "url", backend.URL)
+	}
+	bridge.SetBackends(backends)
 
-		// Determine the Ntfy URL to use
-		var ntfyURL string
-		if IsWildcardTopic(config.MQTT.Topic) {
-			// Extract Ntfy topic from MQTT topic for wildcard subscriptions
-			ntfyTopic, err := ExtractNtfyTopicFromMQTT(config.MQTT.Topic, topic)
-			if err != nil {
-				logger.Error("Failed to extract Ntfy topic from MQTT topic", "error", err, "subscription", config.MQTT.Topic, "received", topic)
-				return
+	// Replay dead letters and exit if requested
+	if replayDeadLetters {
+		if config.DeadLetter.File == "" {
+			logger.Error("--replay-dead-letters requires dead_letter.file in the config")
+			os.Exit(1)
+		}
+		var routes []Route
+		for _, connection := range config.GetConnections() {
+			routes = append(routes, connection.Routes...)
+		}
+		replayed, failed, err := ReplayDeadLetters(config.DeadLetter.File, bridge, routes, logger)
+		if err != nil {
+			logger.Error("Failed to replay dead letters", "file", config.DeadLetter.File, "error", err)
+			os.Exit(1)
+		}
+		logger.Info("Dead letters replayed", "file", config.DeadLetter.File, "delivered", replayed, "failed", failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if config.DeadLetter.File != "" || config.DeadLetter.Topic != "" {
+		bridge.SetDeadLetterQueue(NewDeadLetterQueue(config.DeadLetter.File, config.DeadLetter.Topic, logger))
+		logger.Info("Recording dropped messages as dead letters", "file", config.DeadLetter.File, "topic", config.DeadLetter.Topic)
+	}
+
+	// Serve the action buttons of routes that have them
+	var callbacks *CallbackServer
+	if config.Callback.BaseURL != "" {
+		callbacks = NewCallbackServer(config.GetCallbackConfig(), logger)
+		if err := callbacks.Start(); err != nil {
+			logger.Error("Failed to start action callback server", "error", err)
+			os.Exit(1)
+		}
+		bridge.SetCallbacks(callbacks)
+		logger.Info("Action callback server started", "listen", config.Callback.Listen, "base_url", config.Callback.BaseURL)
+	}
+
+	// Subscribe to Ntfy topics to publish their messages to MQTT, resuming where the last run stopped
+	var subscribeState *SubscribeState
+	if config.NtfySubscribe.StateFile != "" {
+		subscribeState, err = LoadSubscribeState(config.NtfySubscribe.StateFile)
+		if err != nil {
+			logger.Error("Failed to load Ntfy subscription state", "error", err)
+			os.Exit(1)
+		}
+	}
+	var ntfySubscribers []*NtfySubscriber
+
+	var election *Election
+	var mqttHandlers []MQTTClient
+	var statusPublishers []*StatusPublisher
+	for _, connection := range config.GetConnections() {
+		connLogger := logger.With("connection", connection.Name)
+
+		mqttConfig, err := connection.MQTT.GetMQTTConfig()
+		if err != nil {
+			connLogger.Error("Failed to determine MQTT client ID", "error", err)
+			os.Exit(1)
+		}
+		connLogger.Info("Using MQTT client ID", "client_id", mqttConfig.ClientID)
+		if !mqttConfig.CleanSession && !isStableClientIDTemplate(connection.MQTT.ClientID) {
+			connLogger.Warn("mqtt.client_id changes on every restart, so the persistent session will not be resumed; use a stable client ID with clean_session: false", "client_id_template", connection.MQTT.ClientID)
+		}
+		if connection.MQTT.ClientID == DefaultMQTTClientID && (config.Election.Enabled && connection.Name == DefaultConnectionName || hasSharedRoute(connection.Routes)) {
+			connLogger.Warn("Replicas using the default client ID disconnect each other; set a unique mqtt.client_id such as mqtt2ntfy-{hostname}", "client_id", mqttConfig.ClientID)
+		}
+
+		// Build the subscriptions of each route
+		var subscriptions []Subscription
+		for _, route := range connection.Routes {
+			subscriptions = append(subscriptions, bridge.Subscriptions(route)...)
+		}
+
+		var onConnectionUp, onConnectionDown []func()
+
+		// Set up active/standby leader election on the mqtt section connection if enabled
+		electionConnection := config.Election.Enabled && connection.Name == DefaultConnectionName
+		if electionConnection {
+			election = NewElection(ElectionConfig{
+				Topic:       config.Election.Topic,
+				ClientID:    mqttConfig.ClientID,
+				ClaimDelay:  config.GetElectionClaimDelay(),
+				StatusTopic: config.Status.Topic,
+			}, logger)
+			bridge.SetActiveCheck(election.IsLeader)
+			subscriptions = append(subscriptions, election.Subscriptions()...)
+			mqttConfig.Will = election.Will()
+			onConnectionUp = append(onConnectionUp, election.ConnectionUp)
+			onConnectionDown = append(onConnectionDown, election.ConnectionDown)
+		}
+
+		// Publish birth/will status messages and stats if configured
+		var status *StatusPublisher
+		if config.Status.Topic != "" || config.Status.StatsTopic != "" {
+			statusConfig := StatusConfig{
+				Topic:         config.Status.Topic,
+				StatsTopic:    config.Status.StatsTopic,
+				StatsInterval: config.GetStatusStatsInterval(),
+				ClientID:      mqttConfig.ClientID,
+				Started:       started,
+			}
+			if electionConnection {
+				// The stats report the role and the status topic replaces the election's member topics
+				statusConfig.Role = election.Role
 			}
+			status = NewStatusPublisher(statusConfig, bridge.Stats, connLogger)
+			if electionConnection {
+				election.SetStatusAnnouncer(status.ConnectionUp)
+			}
+			if will := status.Will(); will != nil {
+				mqttConfig.Will = will
+			}
+			onConnectionUp = append(onConnectionUp, status.ConnectionUp)
+		}
+		mqttConfig.OnConnectionUp = runHooks(onConnectionUp)
+		mqttConfig.OnConnectionDown = runHooks(onConnectionDown)
 
-			// Build the dynamic Ntfy URL
-			ntfyURL, err = BuildNtfyURL(config.Ntfy.URL, ntfyTopic)
+		// Connect to MQTT and subscribe
+		mqttHandler, err := ConnectAndSubscribe(context.Background(), mqttConfig, subscriptions, connLogger)
+		if err != nil {
+			connLogger.Error("Failed to connect to MQTT", "error", err)
+			os.Exit(1)
+		}
+		defer mqttHandler.Disconnect(1000)
+		mqttHandlers = append(mqttHandlers, mqttHandler)
+		if callbacks != nil {
+			callbacks.AddConnection(connection.Name, mqttHandler)
+		}
+		for _, subscription := range config.GetNtfySubscriptions() {
+			if subscription.Connection != connection.Name {
+				continue
+			}
+			subscriber, err := NewNtfySubscriber(subscription, ntfyConfig, subscribeState, connLogger)
 			if err != nil {
-				logger.Error("Failed to build Ntfy URL", "error", err, "base_url", config.Ntfy.URL, "ntfy_topic", ntfyTopic)
-				return
+				connLogger.Error("Failed to subscribe to Ntfy topic", "ntfy_topic", subscription.Topic, "error", err)
+				os.Exit(1)
 			}
-
-			logger.Info("Using dynamic Ntfy topic", "mqtt_topic", topic, "ntfy_topic", ntfyTopic, "ntfy_url", ntfyURL)
-		} else {
-			// Use the configured Ntfy URL directly for non-wildcard subscriptions
-			ntfyURL = config.Ntfy.URL
+			subscriber.SetActiveCheck(bridge.Active)
+			subscriber.SetSubscribedCheck(func(topic string) bool {
+				_, ok := bridge.subscribedFilter(connection.Name, topic)
+				return ok
+			})
+			subscriber.Start(mqttHandler)
+			ntfySubscribers = append(ntfySubscribers, subscriber)
 		}
 
-		// Forward to Ntfy with retry logic using cleaned message and extracted priority
-		if err := ForwardToNtfy(ntfyURL, cleanedMessage, config.Ntfy.AuthToken, messagePriority, ntfyConfig, logger); err != nil {
-			logger.Error("Failed to forward message to Ntfy after retries", "error", err)
-		} else {
-			logger.Info("Message forwarded to Ntfy successfully", "priority", messagePriority)
+		for _, route := range connection.Routes {
+			connLogger.Info("Connected to MQTT broker and subscribed to topic", "topic", route.Topic, "qos", route.QoS)
+		}
+		if electionConnection {
+			election.Start(mqttHandler)
+			connLogger.Info("Leader election started; on standby until elected", "topic", config.Election.Topic)
+		}
+		if status != nil {
+			status.Start(mqttHandler)
+			statusPublishers = append(statusPublishers, status)
+			connLogger.Info("Publishing status", "topic", config.Status.Topic, "stats_topic", config.Status.StatsTopic)
 		}
-	})
-	if err != nil {
-		logger.Error("Failed to connect to MQTT", "error", err)
-		os.Exit(1)
 	}
-	defer mqttHandler.Disconnect(1000)
-
-	logger.Info("Connected to MQTT broker and subscribed to topic", "topic", config.MQTT.Topic)
 
 	// Initialize heartbeat if configured
 	var hb heartbeat.Heartbeat
 	if config.Heartbeat.URL != "" || config.Heartbeat.Port > 0 {
-		var err error
-		hb, err = heartbeat.NewHeartbeat(&heartbeat.Config{
-			HeartbeatInterval: config.GetHeartbeatInterval(),
-			LivenessThreshold: config.GetHeartbeatLivenessThreshold(),
-			HeartbeatURL:      config.Heartbeat.URL,
-			Port:              config.Heartbeat.Port,
-			OnError: func(err error) {
-				logger.Error("Heartbeat error", "error", err)
-			},
-		})
-		if err != nil {
-			logger.Error("Failed to create heartbeat", "error", err)
-			os.Exit(1)
+		if config.Heartbeat.Port > 0 {
+			// The health endpoint also reports the election role
+			var role func() string
+			if election != nil {
+				role = election.Role
+			}
+			hb = NewHealthServer(config.Heartbeat.Port, config.GetHeartbeatLivenessThreshold(), role, logger)
+		} else {
+			var err error
+			hb, err = heartbeat.NewHeartbeat(&heartbeat.Config{
+				HeartbeatInterval: config.GetHeartbeatInterval(),
+				LivenessThreshold: config.GetHeartbeatLivenessThreshold(),
+				HeartbeatURL:      config.Heartbeat.URL,
+				OnError: func(err error) {
+					logger.Error("Heartbeat error", "error", err)
+				},
+			})
+			if err != nil {
+				logger.Error("Failed to create heartbeat", "error", err)
+				os.Exit(1)
+			}
 		}
 
 		hb.Start()
@@ -170,6 +328,33 @@ func main() {
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
 	logger.Info("Received shutdown signal, disconnecting from MQTT")
-	mqttHandler.Disconnect(1000)
+	if election != nil {
+		election.Release()
+	}
+	for _, status := range statusPublishers {
+		status.Stop()
+	}
+	for _, subscriber := range ntfySubscribers {
+		subscriber.Stop()
+	}
+	if callbacks != nil {
+		callbacks.Stop()
+	}
+	for _, mqttHandler := range mqttHandlers {
+		mqttHandler.Disconnect(1000)
+	}
+	bridge.Close()
 	logger.Info("Shutdown complete")
 }
+
+// runHooks returns a function calling each hook in order, or nil if there are none
+func runHooks(hooks []func()) func() {
+	if len(hooks) == 0 {
+		return nil
+	}
+	return func() {
+		for _, hook := range hooks {
+			hook()
+		}
+	}
+}
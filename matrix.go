@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// matrixHTMLFormat is the format of HTML message bodies in Matrix
+const matrixHTMLFormat = "org.matrix.custom.html"
+
+// matrixTags matches the HTML tags removed from the plain text body of HTML messages
+var matrixTags = regexp.MustCompile(`<[^>]*>`)
+
+// matrixMessage is the content of an m.room.message event
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+}
+
+// matrixResponse is the part of Matrix's responses mqtt2ntfy uses
+type matrixResponse struct {
+	EventID string `json:"event_id"`
+	ErrCode string `json:"errcode,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// MatrixClient implements NtfyClient for Matrix rooms: the URL is that of the homeserver and the
+// token of the auth an access token of the account sending the messages, which must have joined
+// the room
+type MatrixClient struct {
+	sender *backendSender
+	room   string // room ID, e.g. !abc:example.com
+	html   bool   // messages are HTML
+}
+
+// NewMatrixClient creates a client sending to room with the timeout, retry and connection
+// settings of config; with html, messages are sent as HTML with a plain text fallback
+func NewMatrixClient(config NtfyConfig, room string, html bool, logger *slog.Logger) *MatrixClient {
+	return &MatrixClient{
+		sender: newBackendSender(BackendMatrix, config, logger),
+		room:   room,
+		html:   html,
+	}
+}
+
+// CloseIdleConnections closes the client's idle keep-alive connections
+func (m *MatrixClient) CloseIdleConnections() {
+	m.sender.CloseIdleConnections()
+}
+
+// SendMessage implements NtfyClient with the retry logic of HTTPNtfyClient. The transaction ID
+// is derived from the received message, so the homeserver does not post a message twice when a
+// response is lost, the message is redelivered or a dead letter of it is replayed. The event ID
+// is returned as the message ID.
+func (m *MatrixClient) SendMessage(homeserver string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	body, err := json.Marshal(m.newMessage(message))
+	if err != nil {
+		return NtfyReceipt{}, err
+	}
+	txnID := message.SourceID
+	if txnID == "" {
+		txnID = rand.Text() // only its retries share the ID
+	}
+	endpoint := strings.TrimSuffix(homeserver, "/") + "/_matrix/client/v3/rooms/" + url.PathEscape(m.room) +
+		"/send/m.room.message/" + url.PathEscape("mqtt2ntfy-"+txnID)
+	return sendWithRetry(m.sender.config, message.ExpiresAt, func(ctx context.Context) (string, int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+auth.Token)
+
+		response, status, err := m.sender.do(req)
+		var sent matrixResponse
+		_ = json.Unmarshal(response, &sent)
+		if err != nil {
+			if sent.ErrCode != "" {
+				return "", status, fmt.Errorf("%w: %s: %s", err, sent.ErrCode, sent.Error)
+			}
+			return "", status, err
+		}
+		return sent.EventID, status, nil
+	})
+}
+
+// newMessage converts a message to an m.text event: the title, the message and the click URL
+// on separate lines. Matrix has no priorities, tags or actions.
+func (m *MatrixClient) newMessage(message NtfyMessage) matrixMessage {
+	text := message.Message
+	if text == "" {
+		switch {
+		case message.Attach != "":
+			text = message.Attach
+		case message.Filename != "":
+			text = message.Filename
+		case message.Title == "":
+			text = "(no message)"
+		}
+	}
+
+	if !m.html {
+		return matrixMessage{MsgType: "m.text", Body: joinNonEmpty("\n", message.Title, text, message.Click)}
+	}
+	// The message is HTML; clients that do not render it show the text without tags
+	formatted, plain := text, html.UnescapeString(matrixTags.ReplaceAllString(text, ""))
+	if message.Message == "" {
+		formatted, plain = html.EscapeString(text), text
+	}
+	var title, link string
+	if message.Title != "" {
+		title = "<strong>" + html.EscapeString(message.Title) + "</strong>"
+	}
+	if message.Click != "" {
+		link = `<a href="` + html.EscapeString(message.Click) + `">` + html.EscapeString(message.Click) + "</a>"
+	}
+	return matrixMessage{
+		MsgType:       "m.text",
+		Body:          joinNonEmpty("\n", message.Title, plain, message.Click),
+		Format:        matrixHTMLFormat,
+		FormattedBody: joinNonEmpty("<br>", title, formatted, link),
+	}
+}
+
+// joinNonEmpty joins the non-empty parts with sep
+func joinNonEmpty(sep string, parts ...string) string {
+	return strings.Join(slices.DeleteFunc(parts, func(part string) bool { return part == "" }), sep)
+}
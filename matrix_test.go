@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatrixNewMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		html    bool
+		message NtfyMessage
+		want    matrixMessage
+	}{
+		{
+			name:    "plain",
+			message: NtfyMessage{Message: "Door <b>opened</b>", Title: "Garage", Click: "https://home.example.com"},
+			want:    matrixMessage{MsgType: "m.text", Body: "Garage\nDoor <b>opened</b>\nhttps://home.example.com"},
+		},
+		{
+			name:    "plain without message",
+			message: NtfyMessage{Attach: "https://cam.example.com/snapshot.jpg"},
+			want:    matrixMessage{MsgType: "m.text", Body: "https://cam.example.com/snapshot.jpg"},
+		},
+		{
+			name:    "html",
+			html:    true,
+			message: NtfyMessage{Message: "Door <b>opened</b> &amp; left open", Title: "Garage & Shed", Click: "https://home.example.com/?a=1&b=2"},
+			want: matrixMessage{
+				MsgType:       "m.text",
+				Body:          "Garage & Shed\nDoor opened & left open\nhttps://home.example.com/?a=1&b=2",
+				Format:        "org.matrix.custom.html",
+				FormattedBody: `<strong>Garage &amp; Shed</strong><br>Door <b>opened</b> &amp; left open<br><a href="https://home.example.com/?a=1&amp;b=2">https://home.example.com/?a=1&amp;b=2</a>`,
+			},
+		},
+		{
+			name:    "html title only",
+			html:    true,
+			message: NtfyMessage{Title: "Garage"},
+			want:    matrixMessage{MsgType: "m.text", Body: "Garage", Format: "org.matrix.custom.html", FormattedBody: "<strong>Garage</strong>"},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := NewMatrixClient(testBackendConfig(), "!ops:example.com", tt.html, testLogger()).newMessage(tt.message); got != tt.want {
+			t.Errorf("newMessage(%s) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMatrixSendMessage(t *testing.T) {
+	// The proxy in front of the homeserver loses the first response
+	server, requests := backendServer(t, backendResponse{Status: http.StatusBadGateway}, backendResponse{Body: `{"event_id":"$event0"}`}, backendResponse{Body: `{"event_id":"$event1"}`})
+	client := NewMatrixClient(testBackendConfig(), "!ops:example.com", false, testLogger())
+
+	receipt, err := client.SendMessage(server.URL+"/", NtfyMessage{Message: "Door opened"}, NtfyAuth{Token: "syt_ops"})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if receipt.MessageID != "$event0" || receipt.Attempts != 2 {
+		t.Errorf("Receipt = %+v, want event $event0 after retrying the 502", receipt)
+	}
+
+	first, second := <-requests, <-requests
+	if first.Method != http.MethodPut || first.Header.Get("Authorization") != "Bearer syt_ops" {
+		t.Errorf("Request = %s with Authorization %q, want a PUT with the access token", first.Method, first.Header.Get("Authorization"))
+	}
+	if first.Path != second.Path || !strings.HasPrefix(first.Path, "/_matrix/client/v3/rooms/!ops:example.com/send/m.room.message/mqtt2ntfy-") {
+		t.Errorf("Request paths = %s and %s, want the retry to reuse the transaction", first.Path, second.Path)
+	}
+	var body matrixMessage
+	if err := json.Unmarshal(second.Body, &body); err != nil {
+		t.Fatalf("Body %s is not JSON: %v", second.Body, err)
+	}
+	if body != (matrixMessage{MsgType: "m.text", Body: "Door opened"}) {
+		t.Errorf("Body = %+v, want the message as m.text", body)
+	}
+
+	receipt, err = client.SendMessage(server.URL, NtfyMessage{Message: "Door closed"}, NtfyAuth{Token: "syt_ops"})
+	if err != nil || receipt.MessageID != "$event1" {
+		t.Errorf("SendMessage() = %+v, %v, want the event of the next message", receipt, err)
+	}
+	if third := <-requests; third.Path == first.Path {
+		t.Errorf("Request path = %s, want a new transaction for the next message", third.Path)
+	}
+}
+
+func TestMatrixSendMessageRejected(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Status: http.StatusUnauthorized, Body: `{"errcode":"M_UNKNOWN_TOKEN","error":"Invalid access token passed."}`})
+	client := NewMatrixClient(testBackendConfig(), "!ops:example.com", false, testLogger())
+
+	receipt, err := client.SendMessage(server.URL, NtfyMessage{Message: "Door opened"}, NtfyAuth{Token: "expired"})
+	var statusErr *NtfyStatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("SendMessage() error = %v, want status 401", err)
+	}
+	if !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN: Invalid access token passed.") {
+		t.Errorf("Error = %q, want the homeserver's explanation", err)
+	}
+	if receipt.Attempts != 1 || len(requests) != 1 {
+		t.Errorf("Attempts = %d, want a rejected token not to be retried", receipt.Attempts)
+	}
+}
+
+func TestBridgeMatrix(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Body: `{"event_id":"$event0"}`})
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{
+		"ops": {Name: "ops", Type: BackendMatrix, URL: server.URL, Auth: NtfyAuth{Token: "syt_ops"}, Client: NewMatrixClient(testBackendConfig(), "!ops:example.com", true, testLogger())},
+	})
+
+	backends := []string{"ops"}
+	route := Route{Topic: "alarm/#", Backends: &backends, Options: NtfyOptions{Title: "Alarm"}}
+	if err := bridge.HandleMessage(route, MQTTMessage{Topic: "alarm/smoke", Payload: []byte("Smoke in the <i>kitchen</i>")}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	var body matrixMessage
+	if err := json.Unmarshal((<-requests).Body, &body); err != nil {
+		t.Fatalf("Body is not JSON: %v", err)
+	}
+	if body.Body != "Alarm\nSmoke in the kitchen" || body.FormattedBody != "<strong>Alarm</strong><br>Smoke in the <i>kitchen</i>" {
+		t.Errorf("Body = %+v, want the titled HTML message", body)
+	}
+}
+
+func TestBridgeMatrixTransactionIDs(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Body: `{"event_id":"$event0"}`})
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{
+		"ops": {Name: "ops", Type: BackendMatrix, URL: server.URL, Auth: NtfyAuth{Token: "syt_ops"}, Client: NewMatrixClient(testBackendConfig(), "!ops:example.com", false, testLogger())},
+	})
+	backends := []string{"ops"}
+	route := Route{Topic: "alarm/#", Backends: &backends}
+	msg := MQTTMessage{Topic: "alarm/smoke", Payload: []byte("Smoke detected"), Received: time.Now()}
+
+	send := func(msg MQTTMessage) string {
+		t.Helper()
+		if err := bridge.HandleMessage(route, msg); err != nil {
+			t.Fatalf("HandleMessage failed: %v", err)
+		}
+		return (<-requests).Path
+	}
+	first := send(msg)
+	if redelivered := send(msg); redelivered != first {
+		t.Errorf("Redelivery path = %s, want the transaction %s again", redelivered, first)
+	}
+
+	// A replayed dead letter keeps the transaction
+	data, _ := json.Marshal(newDeadLetter(route, msg, errors.New("homeserver down")))
+	var letter DeadLetter
+	if err := json.Unmarshal(data, &letter); err != nil {
+		t.Fatalf("Dead letter %s is not JSON: %v", data, err)
+	}
+	if replayed := send(letter.Message()); replayed != first {
+		t.Errorf("Replay path = %s, want the transaction %s again", replayed, first)
+	}
+
+	// The same payload received again is a new message
+	msg.Received = msg.Received.Add(time.Second)
+	if next := send(msg); next == first {
+		t.Errorf("Path of the next message = %s, want a new transaction", next)
+	}
+}
@@ -2,52 +2,310 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
+// MQTT protocol versions supported by mqtt2ntfy
+const (
+	MQTTProtocol311 = "3.1.1"
+	MQTTProtocol5   = "5"
+)
+
 // MQTTClient interface for dependency injection and testing
 type MQTTClient interface {
-	Connect() mqtt.Token
-	Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token
+	Connect() error
+	Subscribe(subscription Subscription) error
+	Publish(topic string, qos byte, retained bool, payload []byte) error
 	Disconnect(quiesce uint)
 }
 
-// MQTTHandler wraps the paho MQTT client
+// MQTTWill is the Last Will message the broker publishes when the connection drops unexpectedly
+type MQTTWill struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+}
+
+// Subscription is an MQTT topic filter with the QoS and callback used to subscribe to it
+type Subscription struct {
+	Topic    string
+	QoS      byte
+	Callback func(MQTTMessage)
+}
+
+// MQTTMessage is a received MQTT message, independent of the protocol version
+type MQTTMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+
+	// MQTT v5 properties; always empty for MQTT 3.1.1 connections
+	ContentType    string
+	MessageExpiry  time.Duration // zero if the publisher set no expiry
+	UserProperties map[string]string
+
+	// Received is when the message arrived; with its topic and payload it identifies the message
+	// across redeliveries and replays
+	Received time.Time
+
+	ack        func()
+	client     MQTTClient // the connection the message arrived on, for publishing replies
+	persistent bool       // the connection resumes its session, so unacknowledged messages are redelivered
+}
+
+// Ack acknowledges a QoS 1 or 2 message to the broker. Messages are not acknowledged
+// automatically; a message that is never acknowledged is redelivered by the broker
+// when a persistent session is resumed.
+func (m MQTTMessage) Ack() {
+	if m.ack != nil {
+		m.ack()
+	}
+}
+
+// MQTTConfig holds configuration for the MQTT client
+type MQTTConfig struct {
+	Broker          string
+	FailoverBrokers []string // tried in order when Broker is unreachable
+	ClientID        string
+	Username        string
+	Password        string
+	ProtocolVersion string
+	CleanSession    bool
+	SessionExpiry   time.Duration // MQTT v5 only; how long the broker keeps a persistent session
+	ConnectTimeout  time.Duration
+	PingTimeout     time.Duration
+	TLS             TLSConfig
+	WebSocket       WebSocketConfig
+	Will            *MQTTWill
+
+	// OnConnectionUp is called after every (re)connect once subscriptions are restored;
+	// OnConnectionDown is called when an established connection is lost
+	OnConnectionUp   func()
+	OnConnectionDown func()
+}
+
+// brokerConnection holds the transport settings shared by the MQTT 3.1.1 and v5 clients
+type brokerConnection struct {
+	brokers   []string // primary broker followed by the failover brokers
+	headers   http.Header
+	websocket *mqtt.WebsocketOptions
+	tls       *TLSReloader
+}
+
+// newBrokerConnection resolves the broker URLs, WebSocket and TLS settings from config
+func newBrokerConnection(config MQTTConfig, logger *slog.Logger) (*brokerConnection, error) {
+	conn := &brokerConnection{}
+	usesWebSocket, usesTLS := false, false
+	for _, broker := range append([]string{config.Broker}, config.FailoverBrokers...) {
+		if isWebSocketBrokerURL(broker) {
+			var err error
+			broker, err = applyWebSocketPath(broker, config.WebSocket.Path)
+			if err != nil {
+				return nil, err
+			}
+			usesWebSocket = true
+		}
+		usesTLS = usesTLS || isTLSBrokerURL(broker)
+		conn.brokers = append(conn.brokers, broker)
+	}
+
+	if usesWebSocket {
+		var err error
+		conn.websocket, err = newWebsocketOptions(config.WebSocket)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(config.WebSocket.Headers) > 0 {
+			conn.headers = http.Header{}
+			for name, value := range config.WebSocket.Headers {
+				conn.headers.Set(name, value)
+			}
+		}
+	} else if config.WebSocket.Path != "" || len(config.WebSocket.Headers) > 0 || config.WebSocket.ProxyURL != "" {
+		logger.Warn("MQTT WebSocket settings are configured but the broker URL does not use ws:// or wss://; they will be ignored", "broker", config.Broker)
+	}
+
+	if config.TLS.IsEnabled() {
+		if !usesTLS {
+			logger.Warn("MQTT TLS settings are configured but the broker URL does not use a TLS scheme; they will be ignored", "broker", config.Broker)
+		}
+
+		var err error
+		conn.tls, err = NewTLSReloader(config.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT TLS configuration: %w", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// tlsConfig returns the current TLS configuration, or nil if none is configured.
+// Reload failures are logged and the previously loaded certificates are used.
+func (b *brokerConnection) tlsConfig(logger *slog.Logger) *tls.Config {
+	if b.tls == nil {
+		return nil
+	}
+	tlsConfig, err := b.tls.Config()
+	if err != nil {
+		logger.Error("Failed to reload MQTT TLS files; using previously loaded certificates", "error", err)
+	}
+	return tlsConfig
+}
+
+// MQTTHandler wraps the paho MQTT 3.1.1 client
 type MQTTHandler struct {
-	client mqtt.Client
+	client     mqtt.Client
+	logger     *slog.Logger
+	persistent bool // the session is kept across reconnects
+
+	mu            sync.Mutex
+	subscriptions []Subscription
+	connected     bool // a connection was made before, so the next one is a reconnect
 }
 
-// NewMQTTHandler creates a new MQTT handler with configurable timeouts
-func NewMQTTHandler(broker, username, password string, connectTimeout, pingTimeout time.Duration) (*MQTTHandler, error) {
+// NewMQTTHandler creates a new MQTT handler with configurable timeouts and TLS settings
+func NewMQTTHandler(config MQTTConfig, logger *slog.Logger) (*MQTTHandler, error) {
+	conn, err := newBrokerConnection(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker(broker)
-	opts.SetClientID("mqtt2ntfy")
+	for _, broker := range conn.brokers {
+		opts.AddBroker(broker) // paho tries the brokers in order on every (re)connect
+	}
+	opts.SetClientID(mqttClientID(config))
 	opts.SetKeepAlive(60 * time.Second)
-	opts.SetPingTimeout(pingTimeout)
-	opts.SetConnectTimeout(connectTimeout)
+	opts.SetPingTimeout(config.PingTimeout)
+	opts.SetConnectTimeout(config.ConnectTimeout)
+	opts.SetCleanSession(config.CleanSession)
+	opts.SetAutoAckDisabled(true)
+
+	m := &MQTTHandler{logger: logger, persistent: !config.CleanSession}
+	takeover := newTakeoverDetector(mqttClientID(config), logger)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		takeover.connected()
+		if m.reconnected() {
+			m.resubscribe()
+		}
+		if config.OnConnectionUp != nil {
+			config.OnConnectionUp()
+		}
+	})
+	opts.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+		logger.Warn("MQTT connection lost", "error", err)
+		takeover.disconnected()
+		if config.OnConnectionDown != nil {
+			config.OnConnectionDown()
+		}
+	})
+	if config.Will != nil {
+		opts.SetBinaryWill(config.Will.Topic, config.Will.Payload, config.Will.QoS, config.Will.Retained)
+	}
+
+	if config.Username != "" {
+		opts.SetUsername(config.Username)
+	}
+	if config.Password != "" {
+		opts.SetPassword(config.Password)
+	}
 
-	if username != "" {
-		opts.SetUsername(username)
+	if conn.websocket != nil {
+		opts.SetWebsocketOptions(conn.websocket)
 	}
-	if password != "" {
-		opts.SetPassword(password)
+	if conn.headers != nil {
+		opts.SetHTTPHeaders(conn.headers)
 	}
 
-	client := mqtt.NewClient(opts)
-	return &MQTTHandler{client: client}, nil
+	if conn.tls != nil {
+		tlsConfig, err := conn.tls.Config()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT TLS configuration: %w", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+
+		// Rebuild the TLS config before every (re)connect so a renewed CA bundle or client certificate is picked up
+		opts.SetConnectionAttemptHandler(func(_ *url.URL, _ *tls.Config) *tls.Config {
+			return conn.tlsConfig(logger)
+		})
+	}
+
+	m.client = mqtt.NewClient(opts)
+	return m, nil
 }
 
 // Connect implements MQTTClient interface
-func (m *MQTTHandler) Connect() mqtt.Token {
-	return m.client.Connect()
+func (m *MQTTHandler) Connect() error {
+	token := m.client.Connect()
+	token.Wait()
+	return token.Error()
 }
 
 // Subscribe implements MQTTClient interface
-func (m *MQTTHandler) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
-	return m.client.Subscribe(topic, qos, callback)
+func (m *MQTTHandler) Subscribe(subscription Subscription) error {
+	m.mu.Lock()
+	m.subscriptions = append(m.subscriptions, subscription)
+	m.mu.Unlock()
+	return m.subscribe(subscription)
+}
+
+// reconnected records a connection and reports whether it is a reconnect. The first connection
+// is subscribed by Subscribe, so resubscribing then would send every SUBSCRIBE twice.
+func (m *MQTTHandler) reconnected() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reconnect := m.connected
+	m.connected = true
+	return reconnect
+}
+
+// resubscribe restores subscriptions after a reconnect. paho does not do this itself, and
+// subscribing again also makes the broker resend retained messages.
+func (m *MQTTHandler) resubscribe() {
+	m.mu.Lock()
+	subscriptions := append([]Subscription(nil), m.subscriptions...)
+	m.mu.Unlock()
+
+	for _, subscription := range subscriptions {
+		if err := m.subscribe(subscription); err != nil {
+			m.logger.Error("Failed to resubscribe after MQTT reconnect", "topic", subscription.Topic, "error", err)
+		}
+	}
+}
+
+func (m *MQTTHandler) subscribe(subscription Subscription) error {
+	token := m.client.Subscribe(subscription.Topic, subscription.QoS, func(client mqtt.Client, msg mqtt.Message) {
+		subscription.Callback(MQTTMessage{
+			Topic:      msg.Topic(),
+			Payload:    msg.Payload(),
+			QoS:        msg.Qos(),
+			Received:   time.Now(),
+			ack:        msg.Ack,
+			client:     m,
+			persistent: m.persistent,
+		})
+	})
+	token.Wait()
+	return token.Error()
+}
+
+// Publish implements MQTTClient interface
+func (m *MQTTHandler) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	token := m.client.Publish(topic, qos, retained, payload)
+	token.Wait()
+	return token.Error()
 }
 
 // Disconnect implements MQTTClient interface
@@ -55,32 +313,152 @@ func (m *MQTTHandler) Disconnect(quiesce uint) {
 	m.client.Disconnect(quiesce)
 }
 
-// ConnectAndSubscribe connects to MQTT broker and subscribes to topic with retry logic
-func ConnectAndSubscribe(ctx context.Context, broker, topic, username, password string, connectTimeout, pingTimeout time.Duration, messageHandler func(string, []byte)) (*MQTTHandler, error) {
-	handler, err := NewMQTTHandler(broker, username, password, connectTimeout, pingTimeout)
+// mqttClientID returns the configured client ID, falling back to the default for an MQTTConfig
+// that was not built from a configuration file
+func mqttClientID(config MQTTConfig) string {
+	if config.ClientID == "" {
+		return DefaultMQTTClientID
+	}
+	return config.ClientID
+}
+
+// NewMQTTClient creates an MQTT client for the configured protocol version
+func NewMQTTClient(config MQTTConfig, logger *slog.Logger) (MQTTClient, error) {
+	switch config.ProtocolVersion {
+	case "", MQTTProtocol311:
+		return NewMQTTHandler(config, logger)
+	case MQTTProtocol5:
+		return NewMQTT5Handler(config, logger)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT protocol version %q", config.ProtocolVersion)
+	}
+}
+
+// ConnectAndSubscribe connects to MQTT broker and subscribes to topics with retry logic
+func ConnectAndSubscribe(ctx context.Context, config MQTTConfig, subscriptions []Subscription, logger *slog.Logger) (MQTTClient, error) {
+	handler, err := NewMQTTClient(config, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create MQTT handler: %w", err)
 	}
 
 	// Retry connection up to 3 times
 	for i := range 3 {
-		token := handler.Connect()
-		if token.Wait() && token.Error() == nil {
+		err := handler.Connect()
+		if err == nil {
 			break
 		}
 		if i == 2 {
-			return nil, fmt.Errorf("failed to connect to MQTT broker after 3 attempts: %w", token.Error())
+			return nil, fmt.Errorf("failed to connect to MQTT broker after 3 attempts: %w", err)
 		}
 		time.Sleep(time.Duration(i+1) * time.Second)
 	}
 
-	token := handler.Subscribe(topic, 0, func(client mqtt.Client, msg mqtt.Message) {
-		messageHandler(msg.Topic(), msg.Payload())
-	})
-	if token.Wait() && token.Error() != nil {
-		handler.Disconnect(0)
-		return nil, fmt.Errorf("failed to subscribe to topic: %w", token.Error())
+	for _, subscription := range subscriptions {
+		if err := handler.Subscribe(subscription); err != nil {
+			handler.Disconnect(0)
+			return nil, fmt.Errorf("failed to subscribe to topic %s: %w", subscription.Topic, err)
+		}
 	}
 
 	return handler, nil
 }
+
+// isTLSBrokerURL reports whether the broker URL uses a scheme that paho connects to over TLS
+func isTLSBrokerURL(broker string) bool {
+	parsedURL, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch parsedURL.Scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// isWebSocketBrokerURL reports whether the broker URL connects over WebSockets
+func isWebSocketBrokerURL(broker string) bool {
+	parsedURL, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	return parsedURL.Scheme == "ws" || parsedURL.Scheme == "wss"
+}
+
+// applyWebSocketPath replaces the path of a ws:// or wss:// broker URL when a path is configured
+func applyWebSocketPath(broker, path string) (string, error) {
+	if path == "" {
+		return broker, nil
+	}
+	parsedURL, err := url.Parse(broker)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse broker URL '%s': %w", broker, err)
+	}
+	parsedURL.Path = path
+	return parsedURL.String(), nil
+}
+
+// newWebsocketOptions builds paho WebSocket options; without an explicit proxy_url the
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables are honored
+func newWebsocketOptions(config WebSocketConfig) (*mqtt.WebsocketOptions, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MQTT WebSocket proxy URL '%s': %w", config.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	return &mqtt.WebsocketOptions{Proxy: proxy}, nil
+}
+
+// sharedSubscriptionPrefix starts a shared subscription filter: $share/<group>/<filter>
+const sharedSubscriptionPrefix = "$share/"
+
+// SharedSubscription returns the filter for subscribing to topic as a member of a shared
+// subscription group; the broker delivers each message to only one member of the group
+func SharedSubscription(group, topic string) string {
+	if group == "" {
+		return topic
+	}
+	return sharedSubscriptionPrefix + group + "/" + topic
+}
+
+// SplitSharedSubscription splits a $share/<group>/<filter> subscription into its group and
+// topic filter. Other filters are returned unchanged with an empty group.
+func SplitSharedSubscription(filter string) (group, topic string) {
+	if !strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+		return "", filter
+	}
+	group, topic, found := strings.Cut(strings.TrimPrefix(filter, sharedSubscriptionPrefix), "/")
+	if !found {
+		return "", filter
+	}
+	return group, topic
+}
+
+// TopicMatchesFilter reports whether a topic name matches an MQTT subscription filter,
+// including the + (single level) and # (multi level) wildcards and shared subscriptions
+func TopicMatchesFilter(filter, topic string) bool {
+	_, filter = SplitSharedSubscription(filter)
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	// Wildcards at the first level do not match topics starting with $ (MQTT spec 4.7.2)
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "#" || filterLevels[0] == "+") {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
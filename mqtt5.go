@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT5Handler wraps the paho.golang MQTT v5 client
+type MQTT5Handler struct {
+	config     autopaho.ClientConfig
+	connection *brokerConnection
+	takeover   *takeoverDetector
+	timeout    time.Duration
+	logger     *slog.Logger
+	onUp       func()
+	onDown     func()
+	persistent bool // the session is kept across reconnects
+
+	mu               sync.Mutex
+	cm               *autopaho.ConnectionManager
+	cancel           context.CancelFunc
+	subscriptions    []Subscription
+	connected        bool // a connection was made before, so the next one is a reconnect
+	lastConnectError error
+}
+
+// NewMQTT5Handler creates a new MQTT v5 handler with configurable timeouts and TLS settings
+func NewMQTT5Handler(config MQTTConfig, logger *slog.Logger) (*MQTT5Handler, error) {
+	conn, err := newBrokerConnection(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	var serverURLs []*url.URL
+	for _, broker := range conn.brokers {
+		brokerURL, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse broker URL '%s': %w", broker, err)
+		}
+		serverURLs = append(serverURLs, brokerURL)
+	}
+
+	takeover := newTakeoverDetector(mqttClientID(config), logger)
+	m := &MQTT5Handler{
+		connection: conn,
+		takeover:   takeover,
+		timeout:    config.ConnectTimeout,
+		logger:     logger,
+		onUp:       config.OnConnectionUp,
+		onDown:     config.OnConnectionDown,
+		persistent: !config.CleanSession,
+	}
+
+	m.config = autopaho.ClientConfig{
+		ServerUrls:                    serverURLs, // autopaho tries the brokers in order
+		KeepAlive:                     60,
+		CleanStartOnInitialConnection: config.CleanSession,
+		SessionExpiryInterval:         uint32(config.SessionExpiry / time.Second),
+		ConnectTimeout:                config.ConnectTimeout,
+		ReconnectBackoff:              mqtt5ReconnectBackoff,
+		ConnectUsername:               config.Username,
+		ConnectPassword:               []byte(config.Password),
+		AttemptConnection:             m.attemptConnection,
+		OnConnectionUp:                m.onConnectionUp,
+		OnConnectionDown:              m.onConnectionDown,
+		OnConnectError:                m.onConnectError,
+		ClientConfig: paho.ClientConfig{
+			ClientID:                   mqttClientID(config),
+			EnableManualAcknowledgment: true,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					m.route(pr)
+					return true, nil
+				},
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				if d.ReasonCode == reasonSessionTakenOver {
+					takeover.sessionTakenOver()
+					return
+				}
+				logger.Warn("MQTT broker closed the connection", "reason_code", d.ReasonCode, "reason", disconnectReason(d))
+			},
+		},
+	}
+	if config.Will != nil {
+		m.config.WillMessage = &paho.WillMessage{
+			Topic:   config.Will.Topic,
+			Payload: config.Will.Payload,
+			QoS:     config.Will.QoS,
+			Retain:  config.Will.Retained,
+		}
+	}
+
+	return m, nil
+}
+
+// reasonSessionTakenOver is the DISCONNECT reason code sent when another client connects with our client ID
+const reasonSessionTakenOver = 0x8E
+
+// mqtt5ReconnectBackoff connects immediately on the first attempt and backs off
+// exponentially (up to 10 minutes) afterwards, similar to the MQTT 3.1.1 client
+func mqtt5ReconnectBackoff(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+	delay := time.Second << min(attempt-1, 10)
+	return min(delay, 10*time.Minute)
+}
+
+// Connect implements MQTTClient interface
+func (m *MQTT5Handler) Connect() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, m.config)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to create MQTT v5 connection: %w", err)
+	}
+
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, m.timeout)
+	defer awaitCancel()
+	if err := cm.AwaitConnection(awaitCtx); err != nil {
+		cancel()
+		if connectErr := m.connectError(); connectErr != nil {
+			return connectErr
+		}
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+
+	m.mu.Lock()
+	m.cm = cm
+	m.cancel = cancel
+	m.mu.Unlock()
+	return nil
+}
+
+// Subscribe implements MQTTClient interface
+func (m *MQTT5Handler) Subscribe(subscription Subscription) error {
+	m.mu.Lock()
+	m.subscriptions = append(m.subscriptions, subscription)
+	cm := m.cm
+	m.mu.Unlock()
+
+	if cm == nil {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	return m.subscribe(cm, []Subscription{subscription})
+}
+
+// route passes a received PUBLISH to the callback of every matching subscription. The
+// PUBLISH is acknowledged to the broker once all of them have acknowledged it.
+func (m *MQTT5Handler) route(pr paho.PublishReceived) {
+	m.mu.Lock()
+	var matched []Subscription
+	for _, subscription := range m.subscriptions {
+		if TopicMatchesFilter(subscription.Topic, pr.Packet.Topic) {
+			matched = append(matched, subscription)
+		}
+	}
+	m.mu.Unlock()
+
+	ack := func() {
+		if err := pr.Client.Ack(pr.Packet); err != nil {
+			m.logger.Warn("Failed to acknowledge MQTT message", "topic", pr.Packet.Topic, "error", err)
+		}
+	}
+	if len(matched) == 0 {
+		m.logger.Debug("Received MQTT message that matches no subscription", "topic", pr.Packet.Topic)
+		ack()
+		return
+	}
+
+	var mu sync.Mutex
+	pending := len(matched)
+	received := time.Now()
+	for _, subscription := range matched {
+		var once sync.Once
+		msg := mqttMessageFromPublish(pr.Packet)
+		msg.Received = received
+		msg.client = m
+		msg.persistent = m.persistent
+		msg.ack = func() {
+			once.Do(func() {
+				mu.Lock()
+				pending--
+				done := pending == 0
+				mu.Unlock()
+				if done {
+					ack()
+				}
+			})
+		}
+		subscription.Callback(msg)
+	}
+}
+
+// subscribe sends a SUBSCRIBE and checks the reason codes in the SUBACK
+func (m *MQTT5Handler) subscribe(cm *autopaho.ConnectionManager, subscriptions []Subscription) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	options := make([]paho.SubscribeOptions, len(subscriptions))
+	for i, subscription := range subscriptions {
+		options[i] = paho.SubscribeOptions{Topic: subscription.Topic, QoS: subscription.QoS}
+	}
+	suback, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: options})
+	if err != nil {
+		return err
+	}
+	for i, reasonCode := range suback.Reasons {
+		if reasonCode >= 0x80 && i < len(subscriptions) {
+			return fmt.Errorf("broker rejected subscription to %s (reason code 0x%02x)", subscriptions[i].Topic, reasonCode)
+		}
+	}
+	return nil
+}
+
+// Publish implements MQTTClient interface
+func (m *MQTT5Handler) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	m.mu.Lock()
+	cm := m.cm
+	m.mu.Unlock()
+	if cm == nil {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	_, err := cm.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: payload})
+	return err
+}
+
+// Disconnect implements MQTTClient interface
+func (m *MQTT5Handler) Disconnect(quiesce uint) {
+	m.mu.Lock()
+	cm, cancel := m.cm, m.cancel
+	m.cm, m.cancel = nil, nil
+	m.mu.Unlock()
+
+	if cm == nil {
+		return
+	}
+	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer ctxCancel()
+	if err := cm.Disconnect(ctx); err != nil {
+		m.logger.Debug("MQTT v5 disconnect did not complete cleanly", "error", err)
+	}
+	cancel()
+}
+
+// onConnectionUp restores subscriptions after a reconnect. Subscribing again even when the
+// broker kept the session makes it resend retained messages. The first connection is
+// subscribed by Subscribe, so resubscribing then would send every SUBSCRIBE twice.
+func (m *MQTT5Handler) onConnectionUp(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+	m.mu.Lock()
+	var subscriptions []Subscription
+	if m.connected {
+		subscriptions = append(subscriptions, m.subscriptions...)
+	}
+	m.connected = true
+	m.lastConnectError = nil
+	m.mu.Unlock()
+	m.takeover.connected()
+
+	// OnConnectionUp must not block
+	go func() {
+		if len(subscriptions) > 0 {
+			if err := m.subscribe(cm, subscriptions); err != nil {
+				m.logger.Error("Failed to resubscribe after MQTT reconnect", "error", err)
+			}
+		}
+		if m.onUp != nil {
+			m.onUp()
+		}
+	}()
+}
+
+// onConnectionDown keeps autopaho reconnecting and watches for client ID collisions
+func (m *MQTT5Handler) onConnectionDown() bool {
+	m.takeover.disconnected()
+	if m.onDown != nil {
+		go m.onDown()
+	}
+	return true
+}
+
+// onConnectError records the most recent connection failure so Connect can report it
+func (m *MQTT5Handler) onConnectError(err error) {
+	m.mu.Lock()
+	m.lastConnectError = err
+	m.mu.Unlock()
+	m.logger.Debug("MQTT v5 connection attempt failed", "error", err)
+}
+
+func (m *MQTT5Handler) connectError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastConnectError
+}
+
+// attemptConnection dials the broker, building the TLS config fresh for each attempt so
+// renewed certificates are picked up
+func (m *MQTT5Handler) attemptConnection(ctx context.Context, _ autopaho.ClientConfig, u *url.URL) (net.Conn, error) {
+	// Bound each dial so an unreachable broker does not hold up the failover brokers
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+
+	switch u.Scheme {
+	case "mqtt", "tcp", "":
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		dialer := tls.Dialer{Config: m.connection.tlsConfig(m.logger)}
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	case "ws", "wss":
+		var tlsConfig *tls.Config
+		if u.Scheme == "wss" {
+			tlsConfig = m.connection.tlsConfig(m.logger)
+		}
+		conn, err = mqtt.NewWebsocket(u.String(), tlsConfig, m.timeout, m.connection.headers, m.connection.websocket)
+	default:
+		return nil, fmt.Errorf("unsupported broker URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return packets.NewThreadSafeConn(conn), nil
+}
+
+// mqttMessageFromPublish converts a received MQTT v5 PUBLISH into an MQTTMessage
+func mqttMessageFromPublish(p *paho.Publish) MQTTMessage {
+	msg := MQTTMessage{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+		QoS:     p.QoS,
+	}
+	if p.Properties == nil {
+		return msg
+	}
+
+	msg.ContentType = p.Properties.ContentType
+	if p.Properties.MessageExpiry != nil {
+		msg.MessageExpiry = time.Duration(*p.Properties.MessageExpiry) * time.Second
+	}
+	if len(p.Properties.User) > 0 {
+		msg.UserProperties = make(map[string]string, len(p.Properties.User))
+		for _, prop := range p.Properties.User {
+			// Keep the first value for repeated keys, matching UserProperties.Get
+			if _, exists := msg.UserProperties[prop.Key]; !exists {
+				msg.UserProperties[prop.Key] = prop.Value
+			}
+		}
+	}
+	return msg
+}
+
+// disconnectReason returns the broker-supplied reason string for a DISCONNECT, if any
+func disconnectReason(d *paho.Disconnect) string {
+	if d.Properties == nil {
+		return ""
+	}
+	return d.Properties.ReasonString
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// mqtt5Broker is a minimal MQTT v5 stand-in that acknowledges CONNECT and SUBSCRIBE and can publish to its client
+type mqtt5Broker struct {
+	listener   net.Listener
+	connects   chan *packets.Connect
+	subscribes chan *packets.Subscribe
+	pubacks    chan *packets.Puback
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newMQTT5Broker starts an MQTT v5 stand-in on a random local port
+func newMQTT5Broker(t *testing.T) *mqtt5Broker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	broker := &mqtt5Broker{
+		listener:   listener,
+		connects:   make(chan *packets.Connect, 10),
+		subscribes: make(chan *packets.Subscribe, 10),
+		pubacks:    make(chan *packets.Puback, 10),
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		broker.mu.Lock()
+		if broker.conn != nil {
+			_ = broker.conn.Close()
+		}
+		broker.mu.Unlock()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+// brokerURL returns the tcp:// URL of the stand-in
+func (b *mqtt5Broker) brokerURL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *mqtt5Broker) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.Content.(type) {
+		case *packets.Connect:
+			b.mu.Lock()
+			b.conn = conn
+			b.mu.Unlock()
+			b.connects <- p
+			if _, err := b.write(packets.NewControlPacket(packets.CONNACK)); err != nil {
+				return
+			}
+		case *packets.Subscribe:
+			suback := packets.NewControlPacket(packets.SUBACK)
+			suback.Content.(*packets.Suback).PacketID = p.PacketID
+			for _, subscription := range p.Subscriptions {
+				suback.Content.(*packets.Suback).Reasons = append(suback.Content.(*packets.Suback).Reasons, subscription.QoS)
+			}
+			if _, err := b.write(suback); err != nil {
+				return
+			}
+			b.subscribes <- p
+		case *packets.Puback:
+			b.pubacks <- p
+		case *packets.Pingreq:
+			if _, err := b.write(packets.NewControlPacket(packets.PINGRESP)); err != nil {
+				return
+			}
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+// write sends a packet to the currently connected client
+func (b *mqtt5Broker) write(packet *packets.ControlPacket) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return packet.WriteTo(b.conn)
+}
+
+// publish sends a PUBLISH to the connected client
+func (b *mqtt5Broker) publish(t *testing.T, publish *packets.Publish) {
+	t.Helper()
+	packet := packets.NewControlPacket(packets.PUBLISH)
+	packet.Content = publish
+	if _, err := b.write(packet); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+}
+
+func TestMQTT5ConnectSubscribeAndReceive(t *testing.T) {
+	broker := newMQTT5Broker(t)
+
+	config := testMQTTConfig(broker.brokerURL())
+	config.ProtocolVersion = MQTTProtocol5
+	config.ConnectTimeout = 5 * time.Second
+	config.Username = "bridge"
+	config.Password = "secret"
+	config.ClientID = "mqtt2ntfy-test"
+
+	received := make(chan MQTTMessage, 1)
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{
+		Topic:    "alerts/#",
+		Callback: func(msg MQTTMessage) { received <- msg },
+	}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(100)
+
+	connect := <-broker.connects
+	if connect.ProtocolVersion != 5 {
+		t.Errorf("CONNECT protocol version = %d, want 5", connect.ProtocolVersion)
+	}
+	if connect.ClientID != "mqtt2ntfy-test" {
+		t.Errorf("CONNECT client ID = %q, want mqtt2ntfy-test", connect.ClientID)
+	}
+	if connect.Username != "bridge" || string(connect.Password) != "secret" {
+		t.Errorf("CONNECT credentials = %s/%s, want bridge/secret", connect.Username, connect.Password)
+	}
+	subscribe := <-broker.subscribes
+	if len(subscribe.Subscriptions) != 1 || subscribe.Subscriptions[0].Topic != "alerts/#" {
+		t.Errorf("SUBSCRIBE = %+v, want alerts/#", subscribe.Subscriptions)
+	}
+	select {
+	case subscribe := <-broker.subscribes:
+		t.Errorf("Unexpected second SUBSCRIBE %+v on the first connection", subscribe.Subscriptions)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	expiry := uint32(30)
+	broker.publish(t, &packets.Publish{
+		Topic:   "alerts/garage",
+		Payload: []byte("Garage door open"),
+		Properties: &packets.Properties{
+			ContentType:   "text/markdown",
+			MessageExpiry: &expiry,
+			User: []packets.User{
+				{Key: "title", Value: "Garage"},
+				{Key: "tags", Value: "warning,door"},
+			},
+		},
+	})
+
+	select {
+	case msg := <-received:
+		if msg.Topic != "alerts/garage" || string(msg.Payload) != "Garage door open" {
+			t.Errorf("Received %s %q, want alerts/garage %q", msg.Topic, msg.Payload, "Garage door open")
+		}
+		if msg.ContentType != "text/markdown" {
+			t.Errorf("ContentType = %q, want text/markdown", msg.ContentType)
+		}
+		if msg.MessageExpiry != 30*time.Second {
+			t.Errorf("MessageExpiry = %v, want 30s", msg.MessageExpiry)
+		}
+		if msg.UserProperties["title"] != "Garage" || msg.UserProperties["tags"] != "warning,door" {
+			t.Errorf("UserProperties = %v, want title and tags", msg.UserProperties)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for MQTT v5 message")
+	}
+}
+
+func TestMQTT5PersistentSessionAndManualAck(t *testing.T) {
+	broker := newMQTT5Broker(t)
+
+	config := testMQTTConfig(broker.brokerURL())
+	config.ProtocolVersion = MQTTProtocol5
+	config.ConnectTimeout = 5 * time.Second
+	config.CleanSession = false
+	config.SessionExpiry = time.Hour
+	config.Will = &MQTTWill{Topic: "mqtt2ntfy/status", Payload: []byte("offline"), QoS: 1, Retained: true}
+
+	received := make(chan MQTTMessage, 1)
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{
+		Topic:    "alerts/+",
+		QoS:      1,
+		Callback: func(msg MQTTMessage) { received <- msg },
+	}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(100)
+
+	connect := <-broker.connects
+	if connect.CleanStart {
+		t.Error("CONNECT has clean start set, want a persistent session")
+	}
+	if connect.Properties == nil || connect.Properties.SessionExpiryInterval == nil || *connect.Properties.SessionExpiryInterval != 3600 {
+		t.Errorf("CONNECT session expiry = %+v, want 3600", connect.Properties)
+	}
+	if !connect.WillFlag || connect.WillTopic != "mqtt2ntfy/status" || string(connect.WillMessage) != "offline" || !connect.WillRetain || connect.WillQOS != 1 {
+		t.Errorf("CONNECT will = %s %q (retain %v, QoS %d), want retained QoS 1 offline on mqtt2ntfy/status", connect.WillTopic, connect.WillMessage, connect.WillRetain, connect.WillQOS)
+	}
+	subscribe := <-broker.subscribes
+	if subscribe.Subscriptions[0].QoS != 1 {
+		t.Errorf("SUBSCRIBE QoS = %d, want 1", subscribe.Subscriptions[0].QoS)
+	}
+
+	broker.publish(t, &packets.Publish{Topic: "alerts/door", QoS: 1, PacketID: 7, Payload: []byte("open")})
+
+	var msg MQTTMessage
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for MQTT v5 message")
+	}
+	if msg.QoS != 1 {
+		t.Errorf("QoS = %d, want 1", msg.QoS)
+	}
+
+	select {
+	case puback := <-broker.pubacks:
+		t.Fatalf("PUBACK %d sent before the message was acknowledged", puback.PacketID)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	msg.Ack()
+	select {
+	case puback := <-broker.pubacks:
+		if puback.PacketID != 7 {
+			t.Errorf("PUBACK packet ID = %d, want 7", puback.PacketID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for PUBACK")
+	}
+}
+
+func TestMQTT5SharedSubscription(t *testing.T) {
+	broker := newMQTT5Broker(t)
+
+	config := testMQTTConfig(broker.brokerURL())
+	config.ProtocolVersion = MQTTProtocol5
+	config.ConnectTimeout = 5 * time.Second
+
+	received := make(chan MQTTMessage, 1)
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{
+		Topic:    "$share/mqtt2ntfy/alerts/#",
+		Callback: func(msg MQTTMessage) { received <- msg },
+	}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(100)
+
+	subscribe := <-broker.subscribes
+	if subscribe.Subscriptions[0].Topic != "$share/mqtt2ntfy/alerts/#" {
+		t.Errorf("SUBSCRIBE topic = %s, want $share/mqtt2ntfy/alerts/#", subscribe.Subscriptions[0].Topic)
+	}
+
+	// The broker delivers shared subscription messages with their original topic
+	broker.publish(t, &packets.Publish{Topic: "alerts/door", Payload: []byte("open")})
+	select {
+	case msg := <-received:
+		if msg.Topic != "alerts/door" {
+			t.Errorf("Received topic %s, want alerts/door", msg.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for shared subscription message")
+	}
+}
+
+func TestMQTT5ConnectFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+
+	config := testMQTTConfig("tcp://" + addr)
+	config.ProtocolVersion = MQTTProtocol5
+	config.ConnectTimeout = 500 * time.Millisecond
+
+	handler, err := NewMQTT5Handler(config, testLogger())
+	if err != nil {
+		t.Fatalf("NewMQTT5Handler failed: %v", err)
+	}
+	if err := handler.Connect(); err == nil {
+		handler.Disconnect(0)
+		t.Error("Expected error connecting to closed port, got nil")
+	}
+}
+
+func TestMQTT5Failover(t *testing.T) {
+	broker := newMQTT5Broker(t)
+
+	config := testMQTTConfig(unusedBrokerURL(t))
+	config.FailoverBrokers = []string{broker.brokerURL()}
+	config.ProtocolVersion = MQTTProtocol5
+	config.ConnectTimeout = 5 * time.Second
+
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{Topic: "alerts/#", Callback: func(msg MQTTMessage) {}}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(100)
+
+	select {
+	case <-broker.connects:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for CONNECT on the failover broker")
+	}
+}
+
+func TestNewMQTTClientProtocolVersion(t *testing.T) {
+	tests := []struct {
+		version   string
+		expectErr bool
+	}{
+		{version: "", expectErr: false},
+		{version: MQTTProtocol311, expectErr: false},
+		{version: MQTTProtocol5, expectErr: false},
+		{version: "4", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		config := testMQTTConfig("tcp://localhost:1883")
+		config.ProtocolVersion = tt.version
+		_, err := NewMQTTClient(config, testLogger())
+		if tt.expectErr && err == nil {
+			t.Errorf("NewMQTTClient(%q) expected error, got nil", tt.version)
+		}
+		if !tt.expectErr && err != nil {
+			t.Errorf("NewMQTTClient(%q) unexpected error: %v", tt.version, err)
+		}
+	}
+}
+
+func TestMQTTMessageFromPublish(t *testing.T) {
+	expiry := uint32(60)
+	msg := mqttMessageFromPublish(&paho.Publish{
+		Topic:   "alerts/door",
+		Payload: []byte("open"),
+		Properties: &paho.PublishProperties{
+			ContentType:   "text/plain",
+			MessageExpiry: &expiry,
+			User: paho.UserProperties{
+				{Key: "priority", Value: "5"},
+				{Key: "priority", Value: "1"},
+			},
+		},
+	})
+
+	if msg.Topic != "alerts/door" || string(msg.Payload) != "open" {
+		t.Errorf("mqttMessageFromPublish() = %s %q, want alerts/door %q", msg.Topic, msg.Payload, "open")
+	}
+	if msg.ContentType != "text/plain" {
+		t.Errorf("ContentType = %q, want text/plain", msg.ContentType)
+	}
+	if msg.MessageExpiry != time.Minute {
+		t.Errorf("MessageExpiry = %v, want 1m", msg.MessageExpiry)
+	}
+	if msg.UserProperties["priority"] != "5" {
+		t.Errorf("UserProperties[priority] = %q, want first value 5", msg.UserProperties["priority"])
+	}
+
+	noProps := mqttMessageFromPublish(&paho.Publish{Topic: "alerts/door", Payload: []byte("open")})
+	if noProps.UserProperties != nil || noProps.ContentType != "" || noProps.MessageExpiry != 0 {
+		t.Errorf("mqttMessageFromPublish() without properties = %+v, want no properties", noProps)
+	}
+}
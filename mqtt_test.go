@@ -2,10 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/gorilla/websocket"
 )
 
 // MockMQTTClient for testing
@@ -15,45 +26,37 @@ type MockMQTTClient struct {
 	disconnectCount int
 }
 
-func (m *MockMQTTClient) Connect() mqtt.Token {
-	token := &MockToken{err: m.connectError}
-	return token
+func (m *MockMQTTClient) Connect() error {
+	return m.connectError
 }
 
-func (m *MockMQTTClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
-	token := &MockToken{err: m.subscribeError}
-	return token
+func (m *MockMQTTClient) Subscribe(subscription Subscription) error {
+	return m.subscribeError
 }
 
-func (m *MockMQTTClient) Disconnect(quiesce uint) {
-	m.disconnectCount++
-}
-
-// MockToken for testing
-type MockToken struct {
-	err error
+func (m *MockMQTTClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return nil
 }
 
-func (m *MockToken) Wait() bool {
-	return true
-}
-
-func (m *MockToken) WaitTimeout(d time.Duration) bool {
-	return true
+func (m *MockMQTTClient) Disconnect(quiesce uint) {
+	m.disconnectCount++
 }
 
-func (m *MockToken) Error() error {
-	return m.err
+// testMQTTConfig returns an MQTTConfig for the given broker with default timeouts
+func testMQTTConfig(broker string) MQTTConfig {
+	return MQTTConfig{
+		Broker:         broker,
+		ConnectTimeout: 30 * time.Second,
+		PingTimeout:    10 * time.Second,
+	}
 }
 
-func (m *MockToken) Done() <-chan struct{} {
-	ch := make(chan struct{})
-	close(ch)
-	return ch
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 }
 
 func TestNewMQTTHandler(t *testing.T) {
-	handler, err := NewMQTTHandler("tcp://localhost:1883", "", "", 30*time.Second, 10*time.Second)
+	handler, err := NewMQTTHandler(testMQTTConfig("tcp://localhost:1883"), testLogger())
 	if err != nil {
 		t.Errorf("NewMQTTHandler failed: %v", err)
 	}
@@ -70,8 +73,426 @@ func TestConnectAndSubscribeSuccess(t *testing.T) {
 
 func TestConnectAndSubscribeFailure(t *testing.T) {
 	// Test with invalid broker
-	_, err := ConnectAndSubscribe(context.Background(), "invalid://broker", "test/topic", "", "", 30*time.Second, 10*time.Second, func(topic string, payload []byte) {})
+	_, err := ConnectAndSubscribe(context.Background(), testMQTTConfig("invalid://broker"), []Subscription{{Topic: "test/topic", Callback: func(msg MQTTMessage) {}}}, testLogger())
 	if err == nil {
 		t.Error("Expected error for invalid broker, got nil")
 	}
 }
+
+func TestNewMQTTHandlerTLS(t *testing.T) {
+	files := writeTestCertificates(t)
+
+	config := testMQTTConfig("ssl://localhost:8883")
+	config.TLS = TLSConfig{
+		CAFile:     files.caFile,
+		CertFile:   files.clientCertFile,
+		KeyFile:    files.clientKeyFile,
+		ServerName: "mqtt.example.com",
+		MinVersion: "1.2",
+	}
+	handler, err := NewMQTTHandler(config, testLogger())
+	if err != nil {
+		t.Fatalf("NewMQTTHandler failed: %v", err)
+	}
+	if handler == nil {
+		t.Error("NewMQTTHandler returned nil handler")
+	}
+}
+
+func TestNewMQTTHandlerTLSUnreadableFiles(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+
+	tests := []struct {
+		name string
+		tls  TLSConfig
+	}{
+		{name: "missing CA file", tls: TLSConfig{CAFile: missing}},
+		{name: "missing client certificate", tls: TLSConfig{CertFile: missing, KeyFile: missing}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testMQTTConfig("ssl://localhost:8883")
+			config.TLS = tt.tls
+			if _, err := NewMQTTHandler(config, testLogger()); err == nil {
+				t.Error("Expected error for unreadable TLS file, got nil")
+			}
+		})
+	}
+}
+
+func TestIsTLSBrokerURL(t *testing.T) {
+	tests := []struct {
+		broker   string
+		expected bool
+	}{
+		{broker: "ssl://localhost:8883", expected: true},
+		{broker: "mqtts://localhost:8883", expected: true},
+		{broker: "wss://localhost/mqtt", expected: true},
+		{broker: "tcp://localhost:1883", expected: false},
+		{broker: "ws://localhost/mqtt", expected: false},
+	}
+
+	for _, tt := range tests {
+		if result := isTLSBrokerURL(tt.broker); result != tt.expected {
+			t.Errorf("isTLSBrokerURL(%s) = %v, want %v", tt.broker, result, tt.expected)
+		}
+	}
+}
+
+// webSocketBroker is a minimal MQTT-over-WebSocket stand-in that acknowledges CONNECT, SUBSCRIBE and PINGREQ
+type webSocketBroker struct {
+	server   *httptest.Server
+	requests chan *http.Request
+}
+
+// newWebSocketBroker starts a WebSocket MQTT stand-in, using TLS if requested
+func newWebSocketBroker(t *testing.T, useTLS bool) *webSocketBroker {
+	t.Helper()
+	broker := &webSocketBroker{requests: make(chan *http.Request, 10)}
+	upgrader := websocket.Upgrader{Subprotocols: []string{"mqtt"}}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		broker.requests <- r.Clone(context.Background())
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		serveMQTTPackets(&webSocketReader{conn: conn}, func(packet packets.ControlPacket) error {
+			writer, err := conn.NextWriter(websocket.BinaryMessage)
+			if err != nil {
+				return err
+			}
+			if err := packet.Write(writer); err != nil {
+				return err
+			}
+			return writer.Close()
+		})
+	})
+
+	if useTLS {
+		broker.server = httptest.NewTLSServer(handler)
+	} else {
+		broker.server = httptest.NewServer(handler)
+	}
+	t.Cleanup(broker.server.Close)
+	return broker
+}
+
+// brokerURL returns the broker URL with the given scheme and no path
+func (b *webSocketBroker) brokerURL(scheme string) string {
+	return scheme + "://" + strings.TrimPrefix(strings.TrimPrefix(b.server.URL, "https://"), "http://")
+}
+
+// webSocketReader presents consecutive WebSocket messages as a single stream
+type webSocketReader struct {
+	conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (r *webSocketReader) Read(p []byte) (int, error) {
+	for {
+		if r.reader == nil {
+			_, reader, err := r.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			r.reader = reader
+		}
+		n, err := r.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			r.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// serveMQTTPackets answers the MQTT packets a subscribing client sends until the stream ends
+func serveMQTTPackets(reader io.Reader, write func(packets.ControlPacket) error) {
+	for {
+		packet, err := packets.ReadPacket(reader)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			if err := write(packets.NewControlPacket(packets.Connack)); err != nil {
+				return
+			}
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = p.Qoss
+			if err := write(suback); err != nil {
+				return
+			}
+		case *packets.PingreqPacket:
+			if err := write(packets.NewControlPacket(packets.Pingresp)); err != nil {
+				return
+			}
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// newConnectProxy starts an HTTP CONNECT proxy that counts tunnelled connections
+func newConnectProxy(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var tunnels atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			_ = upstream.Close()
+			return
+		}
+		tunnels.Add(1)
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			_ = upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		_ = conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, &tunnels
+}
+
+func TestConnectAndSubscribeWebSocket(t *testing.T) {
+	tests := []struct {
+		name   string
+		scheme string
+		useTLS bool
+	}{
+		{name: "ws", scheme: "ws", useTLS: false},
+		{name: "wss", scheme: "wss", useTLS: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newWebSocketBroker(t, tt.useTLS)
+
+			config := testMQTTConfig(broker.brokerURL(tt.scheme))
+			config.ConnectTimeout = 5 * time.Second
+			config.WebSocket = WebSocketConfig{
+				Path:    "/custom/mqtt",
+				Headers: map[string]string{"Authorization": "Bearer proxy-token"},
+			}
+			if tt.useTLS {
+				caFile := filepath.Join(t.TempDir(), "ca.pem")
+				writePEM(t, caFile, "CERTIFICATE", broker.server.Certificate().Raw)
+				config.TLS = TLSConfig{CAFile: caFile}
+			}
+
+			handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{Topic: "test/topic", Callback: func(msg MQTTMessage) {}}}, testLogger())
+			if err != nil {
+				t.Fatalf("ConnectAndSubscribe failed: %v", err)
+			}
+			defer handler.Disconnect(0)
+
+			request := <-broker.requests
+			if request.URL.Path != "/custom/mqtt" {
+				t.Errorf("WebSocket path = %s, want /custom/mqtt", request.URL.Path)
+			}
+			if got := request.Header.Get("Authorization"); got != "Bearer proxy-token" {
+				t.Errorf("Authorization header = %q, want %q", got, "Bearer proxy-token")
+			}
+			if got := request.Header.Get("Sec-WebSocket-Protocol"); got != "mqtt" {
+				t.Errorf("Sec-WebSocket-Protocol = %q, want mqtt", got)
+			}
+		})
+	}
+}
+
+// unusedBrokerURL returns a tcp:// URL on which nothing accepts connections
+func unusedBrokerURL(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return "tcp://" + addr
+}
+
+func TestConnectAndSubscribeFailover(t *testing.T) {
+	broker := newWebSocketBroker(t, false)
+
+	config := testMQTTConfig(unusedBrokerURL(t))
+	config.FailoverBrokers = []string{broker.brokerURL("ws") + "/mqtt"}
+	config.ConnectTimeout = 5 * time.Second
+
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{Topic: "test/topic", Callback: func(msg MQTTMessage) {}}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(0)
+
+	if request := <-broker.requests; request.URL.Path != "/mqtt" {
+		t.Errorf("WebSocket path = %s, want /mqtt", request.URL.Path)
+	}
+}
+
+func TestConnectAndSubscribeWebSocketProxy(t *testing.T) {
+	broker := newWebSocketBroker(t, false)
+	proxy, tunnels := newConnectProxy(t)
+
+	config := testMQTTConfig(broker.brokerURL("ws") + "/mqtt")
+	config.ConnectTimeout = 5 * time.Second
+	config.WebSocket = WebSocketConfig{ProxyURL: proxy.URL}
+
+	handler, err := ConnectAndSubscribe(context.Background(), config, []Subscription{{Topic: "test/topic", Callback: func(msg MQTTMessage) {}}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(0)
+
+	if tunnels.Load() == 0 {
+		t.Error("Expected the WebSocket connection to be tunnelled through the configured proxy")
+	}
+}
+
+func TestApplyWebSocketPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		broker   string
+		path     string
+		expected string
+	}{
+		{name: "no configured path", broker: "wss://mqtt.example.com:443/mqtt", path: "", expected: "wss://mqtt.example.com:443/mqtt"},
+		{name: "adds path", broker: "ws://mqtt.example.com:80", path: "/mqtt", expected: "ws://mqtt.example.com:80/mqtt"},
+		{name: "replaces path", broker: "wss://proxy.example.com:443/old", path: "/broker/ws", expected: "wss://proxy.example.com:443/broker/ws"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := applyWebSocketPath(tt.broker, tt.path)
+			if err != nil {
+				t.Fatalf("applyWebSocketPath() unexpected error: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("applyWebSocketPath() = %s, want %s", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestTopicMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "alerts/door", topic: "alerts/door", want: true},
+		{filter: "alerts/door", topic: "alerts/garage", want: false},
+		{filter: "alerts/+", topic: "alerts/door", want: true},
+		{filter: "alerts/+", topic: "alerts/door/front", want: false},
+		{filter: "alerts/+/front", topic: "alerts/door/front", want: true},
+		{filter: "alerts/#", topic: "alerts/door/front", want: true},
+		{filter: "alerts/#", topic: "alerts", want: true},
+		{filter: "alerts/#", topic: "other/door", want: false},
+		{filter: "#", topic: "alerts/door", want: true},
+		{filter: "#", topic: "$SYS/uptime", want: false},
+		{filter: "+/uptime", topic: "$SYS/uptime", want: false},
+		{filter: "$SYS/#", topic: "$SYS/uptime", want: true},
+		{filter: "$share/mqtt2ntfy/alerts/+", topic: "alerts/door", want: true},
+		{filter: "$share/mqtt2ntfy/alerts/+", topic: "mqtt2ntfy/alerts/door", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := TopicMatchesFilter(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("TopicMatchesFilter(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestSharedSubscription(t *testing.T) {
+	if got := SharedSubscription("", "alerts/#"); got != "alerts/#" {
+		t.Errorf("SharedSubscription without group = %q, want alerts/#", got)
+	}
+	if got := SharedSubscription("mqtt2ntfy", "alerts/#"); got != "$share/mqtt2ntfy/alerts/#" {
+		t.Errorf("SharedSubscription = %q, want $share/mqtt2ntfy/alerts/#", got)
+	}
+
+	tests := []struct {
+		filter    string
+		wantGroup string
+		wantTopic string
+	}{
+		{filter: "$share/mqtt2ntfy/alerts/#", wantGroup: "mqtt2ntfy", wantTopic: "alerts/#"},
+		{filter: "$share/mqtt2ntfy/#", wantGroup: "mqtt2ntfy", wantTopic: "#"},
+		{filter: "alerts/#", wantGroup: "", wantTopic: "alerts/#"},
+		{filter: "$share/mqtt2ntfy", wantGroup: "", wantTopic: "$share/mqtt2ntfy"},
+		{filter: "$SYS/uptime", wantGroup: "", wantTopic: "$SYS/uptime"},
+	}
+	for _, tt := range tests {
+		group, topic := SplitSharedSubscription(tt.filter)
+		if group != tt.wantGroup || topic != tt.wantTopic {
+			t.Errorf("SplitSharedSubscription(%q) = %q, %q, want %q, %q", tt.filter, group, topic, tt.wantGroup, tt.wantTopic)
+		}
+	}
+}
+
+func TestConnectAndSubscribeResubscribesOnlyOnReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	subscribes := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				serveMQTTPackets(conn, func(packet packets.ControlPacket) error {
+					if _, ok := packet.(*packets.SubackPacket); ok {
+						subscribes <- conn
+					}
+					return packet.Write(conn)
+				})
+			}()
+		}
+	}()
+
+	handler, err := ConnectAndSubscribe(context.Background(), testMQTTConfig("tcp://"+listener.Addr().String()), []Subscription{{Topic: "test/topic", Callback: func(msg MQTTMessage) {}}}, testLogger())
+	if err != nil {
+		t.Fatalf("ConnectAndSubscribe failed: %v", err)
+	}
+	defer handler.Disconnect(0)
+
+	conn := <-subscribes
+	select {
+	case <-subscribes:
+		t.Fatal("Expected a single SUBSCRIBE on the first connection")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Dropping the connection makes paho reconnect, which must restore the subscription
+	_ = conn.Close()
+	select {
+	case <-subscribes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the subscription to be restored after reconnecting")
+	}
+}
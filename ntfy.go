@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
-	"net"
+	"mime"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -14,67 +18,263 @@ import (
 
 // NtfyClient interface for dependency injection and testing
 type NtfyClient interface {
-	SendMessage(url, message, authToken, priority string) error
+	SendMessage(url string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error)
+}
+
+// NtfyReceipt describes the outcome of sending a message to Ntfy
+type NtfyReceipt struct {
+	MessageID  string // ID Ntfy assigned to the published message
+	StatusCode int    // HTTP status of the last attempt; 0 if no response was received
+	Attempts   int
+	Receipt    string // identifies a message awaiting acknowledgement, e.g. a Pushover emergency message
+}
+
+// ntfyPublishResponse is the part of Ntfy's JSON publish response mqtt2ntfy uses
+type ntfyPublishResponse struct {
+	ID string `json:"id"`
+}
+
+// NtfyMessage holds the body and publish options of a single Ntfy notification
+type NtfyMessage struct {
+	Message  string
+	Title    string
+	Priority string
+	Tags     []string
+	Click    string
+	Icon     string
+	Delay    string // scheduled delivery, e.g. "30m" or "tomorrow, 10am"
+	Email    string
+	Call     string
+	Markdown bool
+
+	Actions         []NtfyAction
+	DisableCache    bool // Cache: no
+	DisableFirebase bool // Firebase: no
+
+	// Attachment, if set, is uploaded as a file with the message; Message is then optional
+	Attachment []byte
+	Attach     string // URL of a file to attach instead of uploading one
+	Filename   string
+
+	// ExpiresAt, if set, is the time after which delivery is abandoned instead of retried
+	ExpiresAt time.Time
+
+	// Source is the received message, for backends rendering templates over it
+	Source messageData
+	// SourceID identifies the received message, the same for its redeliveries and replays; empty
+	// if the time it was received is unknown
+	SourceID string
 }
 
 // NtfyConfig holds configuration for the Ntfy client
 type NtfyConfig struct {
-	Timeout    time.Duration
-	MaxRetries int
-	RetryDelay time.Duration
+	Timeout        time.Duration
+	MaxRetries     int
+	RetryDelay     time.Duration
+	CircuitBreaker CircuitBreakerConfig
+
+	MaxIdleConns    int           // idle keep-alive connections kept open to each server
+	IdleConnTimeout time.Duration // how long an idle connection is kept open
+
+	TLS      *TLSReloader // custom CA, client certificate etc.; nil uses the system defaults
+	ProxyURL *url.URL     // HTTP proxy; nil honors HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+}
+
+// NtfyStatusError is returned when the Ntfy server, or that of another backend, responds with an error status
+type NtfyStatusError struct {
+	StatusCode int
+	RetryAfter time.Duration // how long the server asked mqtt2ntfy to wait, for 429 responses
+	Service    string        // backend type of the server, e.g. gotify; empty for Ntfy
+}
+
+func (e *NtfyStatusError) Error() string {
+	service := e.Service
+	if service == "" {
+		service = "ntfy"
+	}
+	if e.StatusCode == http.StatusTooManyRequests {
+		return fmt.Sprintf("%s server returned status: %d (rate limited, retry after %s)", service, e.StatusCode, e.RetryAfter)
+	}
+	if e.StatusCode >= 500 {
+		return fmt.Sprintf("%s server returned status: %d (server error)", service, e.StatusCode)
+	}
+	return fmt.Sprintf("%s server returned status: %d (client error)", service, e.StatusCode)
 }
 
 // HTTPNtfyClient implements NtfyClient using HTTP
 type HTTPNtfyClient struct {
-	client *http.Client
-	config NtfyConfig
-	logger *slog.Logger
+	client     *http.Client
+	config     NtfyConfig
+	rateLimits *RateLimits
+	circuits   *CircuitBreakers
+	logger     *slog.Logger
 }
 
 // NewNtfyClient creates a new HTTP Ntfy client with configuration
 func NewNtfyClient(config NtfyConfig, logger *slog.Logger) *HTTPNtfyClient {
 	return &HTTPNtfyClient{
 		client: &http.Client{
-			Timeout: config.Timeout,
+			Timeout:   config.Timeout,
+			Transport: newNtfyTransport(config, logger),
 		},
-		config: config,
-		logger: logger,
+		config:     config,
+		rateLimits: defaultRateLimits,
+		circuits:   defaultCircuitBreakers,
+		logger:     logger,
+	}
+}
+
+// newNtfyTransport creates the connection pool of a client: keep-alive connections are reused
+// across messages and HTTP/2 is negotiated where the server supports it
+func newNtfyTransport(config NtfyConfig, logger *slog.Logger) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	if config.TLS != nil {
+		tlsConfig, err := config.TLS.Config()
+		if err != nil {
+			logger.Error("Failed to reload Ntfy TLS files; using previously loaded certificates", "error", err)
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	if config.ProxyURL != nil {
+		transport.Proxy = http.ProxyURL(config.ProxyURL)
 	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+		transport.MaxIdleConnsPerHost = config.MaxIdleConns
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	return transport
+}
+
+// CloseIdleConnections closes the client's idle keep-alive connections
+func (n *HTTPNtfyClient) CloseIdleConnections() {
+	n.client.CloseIdleConnections()
 }
 
 // SendMessage implements NtfyClient interface with retry logic
-func (n *HTTPNtfyClient) SendMessage(url, message, authToken, priority string) error {
-	return retry.Do(
+func (n *HTTPNtfyClient) SendMessage(url string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	return sendWithRetry(n.config, message.ExpiresAt, func(ctx context.Context) (string, int, error) {
+		return n.sendMessageOnce(ctx, url, message, auth)
+	})
+}
+
+// sendWithRetry calls send until it succeeds or fails with an unrecoverable error, backing off
+// between attempts, and gives up once the attempts are used up or the message expires. send
+// returns the ID the server assigned to the message and the response status (0 if there was no
+// response).
+func sendWithRetry(config NtfyConfig, expiresAt time.Time, send func(ctx context.Context) (string, int, error)) (NtfyReceipt, error) {
+	ctx := context.Background()
+	if !expiresAt.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, expiresAt)
+		defer cancel()
+	}
+
+	var receipt NtfyReceipt
+	err := retry.Do(
 		func() error {
-			return n.sendMessageOnce(url, message, authToken, priority)
+			receipt.Attempts++
+			var err error
+			receipt.MessageID, receipt.StatusCode, err = send(ctx)
+			return err
 		},
-		retry.Attempts(uint(n.config.MaxRetries)),
-		retry.Delay(n.config.RetryDelay),
+		retry.Context(ctx),
+		retry.Attempts(uint(config.MaxRetries)),
+		retry.Delay(config.RetryDelay),
 		retry.DelayType(retry.BackOffDelay),
 		retry.RetryIf(func(err error) bool {
 			return isRetryableError(err)
 		}),
 	)
+	return receipt, err
 }
 
-// sendMessageOnce performs a single HTTP request to send a message
-func (n *HTTPNtfyClient) sendMessageOnce(url, message, authToken, priority string) error {
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(message))
+// sendMessageOnce performs a single HTTP request to send a message and returns the ID Ntfy
+// assigned to it along with the response status (0 if there was no response)
+func (n *HTTPNtfyClient) sendMessageOnce(ctx context.Context, url string, message NtfyMessage, auth NtfyAuth) (string, int, error) {
+	// Attachments are uploaded as the body of a PUT, with the message in a header
+	method, body := "POST", []byte(message.Message)
+	if message.Attachment != nil {
+		method, body = "PUT", message.Attachment
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return "", 0, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// A rate limit pauses every message for the server, not just the one that was rejected
+	if err := n.rateLimits.Wait(ctx, req.URL.Host, retryBudget(n.config), n.logger); err != nil {
+		return "", 0, retry.Unrecoverable(err)
 	}
 
-	req.Header.Set("Content-Type", "text/plain")
-	if authToken != "" {
-		req.Header.Set("Authorization", "Bearer "+authToken)
+	if message.Attachment != nil {
+		if message.Message != "" {
+			// Ntfy turns \n in the header back into line breaks
+			req.Header.Set("Message", mime.QEncoding.Encode("utf-8", strings.ReplaceAll(message.Message, "\n", `\n`)))
+		}
+	} else {
+		req.Header.Set("Content-Type", "text/plain")
+		if message.Attach != "" {
+			req.Header.Set("Attach", message.Attach)
+		}
+	}
+	if message.Filename != "" && (message.Attachment != nil || message.Attach != "") {
+		req.Header.Set("Filename", mime.QEncoding.Encode("utf-8", message.Filename))
+	}
+	auth.apply(req)
+	if message.Priority != "" {
+		req.Header.Set("Priority", message.Priority)
+	}
+	if message.Title != "" {
+		req.Header.Set("Title", mime.QEncoding.Encode("utf-8", message.Title))
+	}
+	if len(message.Tags) > 0 {
+		req.Header.Set("Tags", mime.QEncoding.Encode("utf-8", strings.Join(message.Tags, ",")))
+	}
+	if message.Click != "" {
+		req.Header.Set("Click", message.Click)
+	}
+	if message.Markdown {
+		req.Header.Set("Markdown", "yes")
+	}
+	if message.Icon != "" {
+		req.Header.Set("Icon", message.Icon)
 	}
-	if priority != "" {
-		req.Header.Set("Priority", priority)
+	if message.Delay != "" {
+		req.Header.Set("Delay", message.Delay)
+	}
+	if message.Email != "" {
+		req.Header.Set("Email", message.Email)
+	}
+	if message.Call != "" {
+		req.Header.Set("Call", message.Call)
+	}
+	if len(message.Actions) > 0 {
+		actions := make([]string, len(message.Actions))
+		for i, action := range message.Actions {
+			actions[i] = action.header()
+		}
+		req.Header.Set("Actions", strings.Join(actions, "; "))
+	}
+	if message.DisableCache {
+		req.Header.Set("Cache", "no")
+	}
+	if message.DisableFirebase {
+		req.Header.Set("Firebase", "no")
+	}
+
+	// An open circuit fails the message at once instead of retrying against a server that is down
+	if err := n.circuits.Allow(req.URL.Host, n.config.CircuitBreaker, n.logger); err != nil {
+		return "", 0, retry.Unrecoverable(err)
 	}
 
 	resp, err := n.client.Do(req)
+	n.circuits.Record(req.URL.Host, n.config.CircuitBreaker, err != nil || resp.StatusCode >= 500, n.logger)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return "", 0, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -83,48 +283,60 @@ func (n *HTTPNtfyClient) sendMessageOnce(url, message, authToken, priority strin
 		}
 	}()
 
+	if resp.StatusCode == http.StatusTooManyRequests {
+		delay, ok := rateLimitDelay(resp.Header, time.Now())
+		if !ok {
+			delay = defaultRateLimitPause
+		}
+		n.logger.Warn("Ntfy server rate limited mqtt2ntfy; pausing delivery", "host", req.URL.Host, "retry_after", delay)
+		n.rateLimits.Pause(req.URL.Host, delay)
+		return "", resp.StatusCode, &NtfyStatusError{StatusCode: resp.StatusCode, RetryAfter: delay}
+	}
 	if resp.StatusCode >= 500 {
-		return fmt.Errorf("ntfy server returned status: %d (server error)", resp.StatusCode)
+		return "", resp.StatusCode, &NtfyStatusError{StatusCode: resp.StatusCode}
 	}
 	if resp.StatusCode >= 400 {
-		return retry.Unrecoverable(fmt.Errorf("ntfy server returned status: %d (client error)", resp.StatusCode))
+		return "", resp.StatusCode, retry.Unrecoverable(&NtfyStatusError{StatusCode: resp.StatusCode})
 	}
 
-	return nil
-}
-
-// isRetryableError determines if an error is worth retrying
-func isRetryableError(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	// Retry on network errors
-	if _, ok := err.(net.Error); ok {
-		return true
+	// The last request allowed before the limit resets; hold the next one back instead of being rejected
+	if rateLimitExhausted(resp.Header) {
+		if delay, ok := rateLimitDelay(resp.Header, time.Now()); ok && delay > 0 {
+			n.logger.Info("Ntfy rate limit exhausted; pausing delivery until it resets", "host", req.URL.Host, "reset", delay)
+			n.rateLimits.Pause(req.URL.Host, delay)
+		}
 	}
 
-	// Retry on timeout errors
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		return true
+	// The message was published; a response without the expected JSON only loses the ID
+	var published ntfyPublishResponse
+	if body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && len(body) > 0 {
+		if err := json.Unmarshal(body, &published); err != nil {
+			n.logger.Debug("Could not parse Ntfy response", "error", err)
+		}
 	}
+	return published.ID, resp.StatusCode, nil
+}
 
-	// Don't retry on unrecoverable errors
-	if retry.IsRecoverable(err) {
+// isRetryableError determines if an error is worth retrying: network errors, server errors and
+// rate limiting are; errors marked unrecoverable (other 4xx responses) are not
+func isRetryableError(err error) bool {
+	if err == nil {
 		return false
 	}
-
-	return true
+	return retry.IsRecoverable(err)
 }
 
-// ForwardToNtfy forwards a message to Ntfy with retry logic
-func ForwardToNtfy(url, message, authToken, priority string, config NtfyConfig, logger *slog.Logger) error {
+// ForwardToNtfy forwards a message to Ntfy with retry logic. It creates a new client for the one
+// message; Bridge keeps a client per Ntfy server to reuse connections.
+func ForwardToNtfy(url string, message NtfyMessage, auth NtfyAuth, config NtfyConfig, logger *slog.Logger) error {
 	client := NewNtfyClient(config, logger)
-	return client.SendMessage(url, message, authToken, priority)
+	_, err := client.SendMessage(url, message, auth)
+	return err
 }
 
-// IsWildcardTopic checks if the MQTT topic ends with /# or is just #
+// IsWildcardTopic checks if the MQTT topic ends with /# or is just #, ignoring any $share/group/ prefix
 func IsWildcardTopic(mqttTopic string) bool {
+	_, mqttTopic = SplitSharedSubscription(mqttTopic)
 	if mqttTopic == "#" {
 		return true
 	}
@@ -133,10 +345,12 @@ func IsWildcardTopic(mqttTopic string) bool {
 
 // ExtractNtfyTopicFromMQTT extracts the Ntfy topic from an MQTT topic when using wildcards
 // For example: "my/notifications/alerts" with subscription "my/notifications/#" returns "alerts"
+// Shared subscriptions are matched on the topic filter after the $share/group/ prefix
 func ExtractNtfyTopicFromMQTT(subscriptionTopic, receivedTopic string) (string, error) {
 	if !IsWildcardTopic(subscriptionTopic) {
 		return "", fmt.Errorf("subscription topic %s is not a wildcard topic", subscriptionTopic)
 	}
+	_, subscriptionTopic = SplitSharedSubscription(subscriptionTopic)
 
 	// Handle root wildcard case (subscription is just "#")
 	if subscriptionTopic == "#" {
@@ -229,3 +443,77 @@ func ParseMessagePriority(message, defaultPriority string) (cleanedMessage, prio
 
 	return cleanedMessage, priority
 }
+
+// BuildNtfyMessage converts a received MQTT message into an Ntfy message.
+// The payload may carry a priority prefix (see ParseMessagePriority); MQTT v5 properties are
+// applied on top (see applyMessageProperties).
+func BuildNtfyMessage(msg MQTTMessage, defaultPriority string) NtfyMessage {
+	cleanedMessage, priority := ParseMessagePriority(string(msg.Payload), defaultPriority)
+	message := NtfyMessage{
+		Message:  cleanedMessage,
+		Priority: priority,
+	}
+	applyMessageProperties(&message, msg)
+	return message
+}
+
+// applyMessageProperties applies the MQTT v5 properties of msg: user properties named after Ntfy
+// publish options (title, tags, priority, click, icon, delay, email, call, markdown, cache,
+// firebase) take precedence, a content type of text/markdown enables Markdown rendering, and a
+// message expiry bounds delivery retries.
+func applyMessageProperties(message *NtfyMessage, msg MQTTMessage) {
+	for key, value := range msg.UserProperties {
+		switch strings.ToLower(key) {
+		case "title":
+			message.Title = value
+		case "tags", "tag":
+			message.Tags = splitTags(value)
+		case "priority", "prio":
+			message.Priority = value
+		case "click":
+			message.Click = value
+		case "icon":
+			message.Icon = value
+		case "delay", "at", "in":
+			message.Delay = value
+		case "email":
+			message.Email = value
+		case "call":
+			message.Call = value
+		case "attach":
+			message.Attach = value
+		case "filename":
+			message.Filename = value
+		case "markdown":
+			if enabled, ok := parseBool(value); ok {
+				message.Markdown = enabled
+			}
+		case "cache":
+			if enabled, ok := parseBool(value); ok {
+				message.DisableCache = !enabled
+			}
+		case "firebase":
+			if enabled, ok := parseBool(value); ok {
+				message.DisableFirebase = !enabled
+			}
+		}
+	}
+
+	if mediaType, _, _ := strings.Cut(msg.ContentType, ";"); strings.EqualFold(strings.TrimSpace(mediaType), "text/markdown") {
+		message.Markdown = true
+	}
+	if msg.MessageExpiry > 0 {
+		message.ExpiresAt = time.Now().Add(msg.MessageExpiry)
+	}
+}
+
+// splitTags splits a comma-separated tag list, dropping empty entries
+func splitTags(value string) []string {
+	var tags []string
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -14,8 +22,8 @@ type MockNtfyClient struct {
 	sendError error
 }
 
-func (m *MockNtfyClient) SendMessage(url, message, authToken, priority string) error {
-	return m.sendError
+func (m *MockNtfyClient) SendMessage(url string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	return NtfyReceipt{}, m.sendError
 }
 
 func TestNewNtfyClient(t *testing.T) {
@@ -45,7 +53,7 @@ func TestForwardToNtfySuccess(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
-	err := ForwardToNtfy(server.URL, "test message", "", "", config, logger)
+	err := ForwardToNtfy(server.URL, NtfyMessage{Message: "test message"}, NtfyAuth{}, config, logger)
 	if err != nil {
 		t.Errorf("ForwardToNtfy failed: %v", err)
 	}
@@ -65,7 +73,7 @@ func TestForwardToNtfyFailure(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
-	err := ForwardToNtfy(server.URL, "test message", "", "", config, logger)
+	err := ForwardToNtfy(server.URL, NtfyMessage{Message: "test message"}, NtfyAuth{}, config, logger)
 	if err == nil {
 		t.Error("Expected error for server error, got nil")
 	}
@@ -79,7 +87,7 @@ func TestForwardToNtfyInvalidURL(t *testing.T) {
 	}
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
 
-	err := ForwardToNtfy("invalid-url", "test message", "", "", config, logger)
+	err := ForwardToNtfy("invalid-url", NtfyMessage{Message: "test message"}, NtfyAuth{}, config, logger)
 	if err == nil {
 		t.Error("Expected error for invalid URL, got nil")
 	}
@@ -131,6 +139,21 @@ func TestIsWildcardTopic(t *testing.T) {
 			topic:    "/",
 			expected: false,
 		},
+		{
+			name:     "shared wildcard topic",
+			topic:    "$share/mqtt2ntfy/my/notifications/#",
+			expected: true,
+		},
+		{
+			name:     "shared root wildcard",
+			topic:    "$share/mqtt2ntfy/#",
+			expected: true,
+		},
+		{
+			name:     "shared regular topic",
+			topic:    "$share/mqtt2ntfy/my/notifications/alerts",
+			expected: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -207,6 +230,27 @@ func TestExtractNtfyTopicFromMQTT(t *testing.T) {
 			expectedTopic:    "",
 			expectError:      true,
 		},
+		{
+			name:             "shared subscription",
+			subscriptionTopic: "$share/mqtt2ntfy/my/notifications/#",
+			receivedTopic:    "my/notifications/alerts",
+			expectedTopic:    "alerts",
+			expectError:      false,
+		},
+		{
+			name:             "shared root wildcard",
+			subscriptionTopic: "$share/mqtt2ntfy/#",
+			receivedTopic:    "alerts",
+			expectedTopic:    "alerts",
+			expectError:      false,
+		},
+		{
+			name:             "shared subscription with mismatched base pattern",
+			subscriptionTopic: "$share/mqtt2ntfy/my/notifications/#",
+			receivedTopic:    "mqtt2ntfy/my/notifications/alerts",
+			expectedTopic:    "",
+			expectError:      true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -443,3 +487,326 @@ func TestParseMessagePriority(t *testing.T) {
 		})
 	}
 }
+
+func TestSendMessageHeaders(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{
+		Timeout:    10 * time.Second,
+		MaxRetries: 1,
+		RetryDelay: 10 * time.Millisecond,
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	message := NtfyMessage{
+		Message:  "Garage door open",
+		Title:    "Garage",
+		Priority: "4",
+		Tags:     []string{"warning", "door"},
+		Click:    "https://home.example.com/garage",
+		Markdown: true,
+		Icon:     "https://home.example.com/garage.png",
+		Delay:    "30m",
+		Email:    "alerts@example.com",
+		Call:     "+12223334444",
+
+		DisableCache:    true,
+		DisableFirebase: true,
+	}
+	if err := ForwardToNtfy(server.URL, message, NtfyAuth{Token: "tk_test"}, config, logger); err != nil {
+		t.Fatalf("ForwardToNtfy failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"Authorization": "Bearer tk_test",
+		"Title":         "Garage",
+		"Priority":      "4",
+		"Tags":          "warning,door",
+		"Click":         "https://home.example.com/garage",
+		"Markdown":      "yes",
+		"Icon":          "https://home.example.com/garage.png",
+		"Delay":         "30m",
+		"Email":         "alerts@example.com",
+		"Call":          "+12223334444",
+		"Cache":         "no",
+		"Firebase":      "no",
+	}
+	for header, value := range expected {
+		if got := received.Header.Get(header); got != value {
+			t.Errorf("Header %s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestSendMessageEncodesHeaders(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{Timeout: 10 * time.Second, MaxRetries: 1, RetryDelay: 10 * time.Millisecond}
+	message := NtfyMessage{Message: "open", Title: "Garage\nDoor open", Tags: []string{"warnung", "tür"}}
+	if err := ForwardToNtfy(server.URL, message, NtfyAuth{}, config, testLogger()); err != nil {
+		t.Fatalf("ForwardToNtfy failed: %v", err)
+	}
+
+	// Ntfy decodes RFC 2047 encoded headers
+	decoder := new(mime.WordDecoder)
+	expected := map[string]string{"Title": "Garage\nDoor open", "Tags": "warnung,tür"}
+	for header, value := range expected {
+		raw := received.Header.Get(header)
+		if strings.ContainsAny(raw, "\r\n") {
+			t.Errorf("Header %s = %q contains a line break", header, raw)
+		}
+		if got, err := decoder.DecodeHeader(raw); err != nil || got != value {
+			t.Errorf("Header %s = %q, decoded %q, %v, want %q", header, raw, got, err, value)
+		}
+	}
+}
+
+func TestSendMessageReceipt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id":"hwQ2YpKdmg","time":1700000000,"event":"message","topic":"alerts","message":"hello"}`))
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{
+		Timeout:    10 * time.Second,
+		MaxRetries: 3,
+		RetryDelay: 10 * time.Millisecond,
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	receipt, err := NewNtfyClient(config, logger).SendMessage(server.URL, NtfyMessage{Message: "hello"}, NtfyAuth{})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	expected := NtfyReceipt{MessageID: "hwQ2YpKdmg", StatusCode: http.StatusOK, Attempts: 1}
+	if receipt != expected {
+		t.Errorf("Receipt = %+v, want %+v", receipt, expected)
+	}
+}
+
+func TestSendMessageExpired(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{
+		Timeout:    10 * time.Second,
+		MaxRetries: 3,
+		RetryDelay: 10 * time.Millisecond,
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	message := NtfyMessage{Message: "stale", ExpiresAt: time.Now().Add(-time.Second)}
+	if err := ForwardToNtfy(server.URL, message, NtfyAuth{}, config, logger); err == nil {
+		t.Error("Expected error for expired message, got nil")
+	}
+	if requests != 0 {
+		t.Errorf("Expired message was sent %d times, want 0", requests)
+	}
+}
+
+func TestBuildNtfyMessage(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      MQTTMessage
+		expected NtfyMessage
+	}{
+		{
+			name:     "plain payload",
+			msg:      MQTTMessage{Topic: "alerts", Payload: []byte("hello")},
+			expected: NtfyMessage{Message: "hello", Priority: "3"},
+		},
+		{
+			name:     "priority prefix",
+			msg:      MQTTMessage{Topic: "alerts", Payload: []byte("5|fire")},
+			expected: NtfyMessage{Message: "fire", Priority: "5"},
+		},
+		{
+			name: "user properties",
+			msg: MQTTMessage{
+				Topic:   "alerts",
+				Payload: []byte("Garage door open"),
+				UserProperties: map[string]string{
+					"Title":    "Garage",
+					"tags":     "warning, door,",
+					"priority": "high",
+					"click":    "https://home.example.com",
+					"other":    "ignored",
+				},
+			},
+			expected: NtfyMessage{
+				Message:  "Garage door open",
+				Title:    "Garage",
+				Priority: "high",
+				Tags:     []string{"warning", "door"},
+				Click:    "https://home.example.com",
+			},
+		},
+		{
+			name: "priority property overrides prefix",
+			msg: MQTTMessage{
+				Topic:          "alerts",
+				Payload:        []byte("1|quiet"),
+				UserProperties: map[string]string{"priority": "4"},
+			},
+			expected: NtfyMessage{Message: "quiet", Priority: "4"},
+		},
+		{
+			name:     "markdown content type",
+			msg:      MQTTMessage{Topic: "alerts", Payload: []byte("**bold**"), ContentType: "text/markdown; charset=utf-8"},
+			expected: NtfyMessage{Message: "**bold**", Priority: "3", Markdown: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := BuildNtfyMessage(tt.msg, "3")
+			if result.Message != tt.expected.Message || result.Title != tt.expected.Title || result.Priority != tt.expected.Priority ||
+				result.Click != tt.expected.Click || result.Markdown != tt.expected.Markdown || !slices.Equal(result.Tags, tt.expected.Tags) {
+				t.Errorf("BuildNtfyMessage() = %+v, want %+v", result, tt.expected)
+			}
+			if !result.ExpiresAt.IsZero() {
+				t.Errorf("BuildNtfyMessage() ExpiresAt = %v, want zero without message expiry", result.ExpiresAt)
+			}
+		})
+	}
+
+	expiring := BuildNtfyMessage(MQTTMessage{Topic: "alerts", Payload: []byte("soon"), MessageExpiry: time.Minute}, "3")
+	if remaining := time.Until(expiring.ExpiresAt); remaining <= 0 || remaining > time.Minute {
+		t.Errorf("BuildNtfyMessage() ExpiresAt in %v, want within 1m", remaining)
+	}
+}
+
+func TestSendMessageRetriesServerError(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"hwQ2YpKdmg"}`))
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{
+		Timeout:    10 * time.Second,
+		MaxRetries: 3,
+		RetryDelay: 10 * time.Millisecond,
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError}))
+
+	receipt, err := NewNtfyClient(config, logger).SendMessage(server.URL, NtfyMessage{Message: "hello"}, NtfyAuth{})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if receipt.Attempts != 2 || receipt.MessageID != "hwQ2YpKdmg" {
+		t.Errorf("Receipt = %+v, want delivery on the second attempt", receipt)
+	}
+}
+
+// ntfyTLSConfig returns an NtfyConfig using the given TLS settings
+func ntfyTLSConfig(t *testing.T, tlsConfig TLSConfig) NtfyConfig {
+	t.Helper()
+	reloader, err := NewTLSReloader(tlsConfig)
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %v", err)
+	}
+	return NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1, TLS: reloader}
+}
+
+func TestSendMessageTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+	tests := []struct {
+		name      string
+		config    NtfyConfig
+		expectErr bool
+	}{
+		{name: "system roots", config: NtfyConfig{Timeout: 5 * time.Second, MaxRetries: 1}, expectErr: true},
+		{name: "custom CA", config: ntfyTLSConfig(t, TLSConfig{CAFile: caFile})},
+		{name: "server name mismatch", config: ntfyTLSConfig(t, TLSConfig{CAFile: caFile, ServerName: "ntfy.invalid"}), expectErr: true},
+		{name: "insecure", config: ntfyTLSConfig(t, TLSConfig{InsecureSkipVerify: true})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewNtfyClient(tt.config, testLogger()).SendMessage(server.URL+"/alerts", NtfyMessage{Message: "hello"}, NtfyAuth{})
+			if tt.expectErr && err == nil {
+				t.Error("Expected a TLS error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("SendMessage failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestSendMessageMutualTLS(t *testing.T) {
+	files := writeTestCertificates(t)
+	serverCert, err := tls.LoadX509KeyPair(files.serverCertFile, files.serverKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(files.caCert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	withoutCert := ntfyTLSConfig(t, TLSConfig{CAFile: files.caFile})
+	if _, err := NewNtfyClient(withoutCert, testLogger()).SendMessage(server.URL+"/alerts", NtfyMessage{Message: "hello"}, NtfyAuth{}); err == nil {
+		t.Error("Expected an error without a client certificate, got nil")
+	}
+
+	withCert := ntfyTLSConfig(t, TLSConfig{CAFile: files.caFile, CertFile: files.clientCertFile, KeyFile: files.clientKeyFile})
+	if _, err := NewNtfyClient(withCert, testLogger()).SendMessage(server.URL+"/alerts", NtfyMessage{Message: "hello"}, NtfyAuth{}); err != nil {
+		t.Errorf("SendMessage with a client certificate failed: %v", err)
+	}
+}
+
+func TestSendMessageProxy(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	proxy, tunnels := newConnectProxy(t)
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatalf("Invalid proxy URL: %v", err)
+	}
+
+	config := ntfyTLSConfig(t, TLSConfig{InsecureSkipVerify: true})
+	config.ProxyURL = proxyURL
+	if _, err := NewNtfyClient(config, testLogger()).SendMessage(server.URL+"/alerts", NtfyMessage{Message: "hello"}, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage through proxy failed: %v", err)
+	}
+	if tunnels.Load() != 1 {
+		t.Errorf("Proxy tunnelled %d connections, want 1", tunnels.Load())
+	}
+}
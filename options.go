@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// Payload formats of a route
+const (
+	PayloadFormatText = "text" // the payload is the message, with an optional priority prefix
+	PayloadFormatJSON = "json" // the payload is a JSON object in the format of Ntfy's JSON publishing
+)
+
+// NtfyOptions are Ntfy publish options. In the ntfy section they are defaults for all routes,
+// which can override them. Except for the booleans, options are Go templates over the received
+// message (see messageData).
+type NtfyOptions struct {
+	Message  string `yaml:"message,omitempty"` // replaces the payload as the message body
+	Title    string `yaml:"title,omitempty"`
+	Tags     string `yaml:"tags,omitempty"` // comma-separated
+	Click    string `yaml:"click,omitempty"`
+	Icon     string `yaml:"icon,omitempty"`
+	Delay    string `yaml:"delay,omitempty"` // e.g. "30m", a Unix timestamp or "tomorrow, 10am"
+	Email    string `yaml:"email,omitempty"`
+	Call     string `yaml:"call,omitempty"`     // phone number or "yes"
+	Attach   string `yaml:"attach,omitempty"`   // URL of a file to attach
+	Filename string `yaml:"filename,omitempty"` // file name of attachments
+	Markdown *bool  `yaml:"markdown,omitempty"`
+	Cache    *bool  `yaml:"cache,omitempty"`
+	Firebase *bool  `yaml:"firebase,omitempty"`
+}
+
+// messageData is the data available to option templates
+type messageData struct {
+	Topic        string         // topic the message was received on
+	Subscription string         // topic filter of the route
+	Payload      string         // raw payload; empty if it is sent as an attachment
+	JSON         map[string]any // payload fields if the route's payload_format is json
+}
+
+// minNtfyDelay is the shortest delay Ntfy accepts for scheduled delivery
+const minNtfyDelay = 10 * time.Second
+
+// phoneNumberPattern matches E.164 phone numbers as required by Ntfy's Call option
+var phoneNumberPattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// merge returns o with unset options taken from defaults
+func (o NtfyOptions) merge(defaults NtfyOptions) NtfyOptions {
+	fill := func(value *string, fallback string) {
+		if *value == "" {
+			*value = fallback
+		}
+	}
+	fill(&o.Message, defaults.Message)
+	fill(&o.Title, defaults.Title)
+	fill(&o.Tags, defaults.Tags)
+	fill(&o.Click, defaults.Click)
+	fill(&o.Icon, defaults.Icon)
+	fill(&o.Delay, defaults.Delay)
+	fill(&o.Email, defaults.Email)
+	fill(&o.Call, defaults.Call)
+	fill(&o.Attach, defaults.Attach)
+	fill(&o.Filename, defaults.Filename)
+	if o.Markdown == nil {
+		o.Markdown = defaults.Markdown
+	}
+	if o.Cache == nil {
+		o.Cache = defaults.Cache
+	}
+	if o.Firebase == nil {
+		o.Firebase = defaults.Firebase
+	}
+	return o
+}
+
+// templates returns the templated options by config key
+func (o NtfyOptions) templates() map[string]string {
+	return map[string]string{
+		"message":  o.Message,
+		"title":    o.Title,
+		"tags":     o.Tags,
+		"click":    o.Click,
+		"icon":     o.Icon,
+		"delay":    o.Delay,
+		"email":    o.Email,
+		"call":     o.Call,
+		"attach":   o.Attach,
+		"filename": o.Filename,
+	}
+}
+
+// validate checks the options; prefix names the config section in errors. Templates are checked
+// for syntax and unknown fields, other values for what Ntfy accepts.
+func (o NtfyOptions) validate(prefix string) error {
+	for key, text := range o.templates() {
+		if isTemplate(text) {
+			if _, err := parseOptionTemplate(text); err != nil {
+				return fmt.Errorf("%s.%s is not a valid template: %w", prefix, key, err)
+			}
+		}
+	}
+	for _, field := range []struct{ key, value string }{
+		{"click", o.Click}, {"icon", o.Icon}, {"attach", o.Attach}, {"delay", o.Delay}, {"email", o.Email}, {"call", o.Call},
+	} {
+		if field.value != "" && !isTemplate(field.value) {
+			if err := checkOptionValue(field.key, field.value); err != nil {
+				return fmt.Errorf("%s.%w", prefix, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOptionValue checks a click, icon, attach, delay, email or call value for what Ntfy accepts
+func checkOptionValue(key, value string) error {
+	switch key {
+	case "click":
+		if u, err := url.Parse(value); err != nil || u.Scheme == "" {
+			return fmt.Errorf("click must be a URL (got %q)", value)
+		}
+	case "icon", "attach":
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http:// or https:// URL (got %q)", key, value)
+		}
+	case "delay":
+		if d, err := time.ParseDuration(value); err == nil && d < minNtfyDelay {
+			return fmt.Errorf("delay must be at least %s (got %q)", minNtfyDelay, value)
+		}
+		if strings.ContainsFunc(value, unicode.IsControl) {
+			return fmt.Errorf("delay must be a single line (got %q)", value)
+		}
+	case "email":
+		if _, err := mail.ParseAddress(value); err != nil {
+			return fmt.Errorf("email must be an email address (got %q)", value)
+		}
+	case "call":
+		if value != "yes" && !phoneNumberPattern.MatchString(value) {
+			return fmt.Errorf("call must be \"yes\" or a phone number like +12223334444 (got %q)", value)
+		}
+	}
+	return nil
+}
+
+// checkMessageValues checks the values of a built message that Ntfy reads from headers; templates,
+// JSON payloads and user properties can set them to anything
+func checkMessageValues(message NtfyMessage) error {
+	for _, field := range []struct{ key, value string }{
+		{"click", message.Click}, {"icon", message.Icon}, {"attach", message.Attach}, {"delay", message.Delay}, {"email", message.Email}, {"call", message.Call},
+	} {
+		if field.value != "" {
+			if err := checkOptionValue(field.key, field.value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validatePayloadFormat checks a payload_format setting
+func validatePayloadFormat(field, format string) error {
+	switch format {
+	case "", PayloadFormatText, PayloadFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("%s must be %q or %q (got %q)", field, PayloadFormatText, PayloadFormatJSON, format)
+	}
+}
+
+// isTemplate reports whether an option value contains template actions
+func isTemplate(text string) bool {
+	return strings.Contains(text, "{{")
+}
+
+// parseOptionTemplate parses an option template and checks that it only uses known fields
+func parseOptionTemplate(text string) (*template.Template, error) {
+	return parseTemplate("option", text, nil, messageData{})
+}
+
+// renderOption renders one option for a received message; values without template actions are
+// returned as they are
+func (b *Bridge) renderOption(text string, data messageData) (string, error) {
+	if !isTemplate(text) {
+		return text, nil
+	}
+	b.mu.Lock()
+	tmpl, ok := b.optionTemplates[text]
+	b.mu.Unlock()
+	if !ok {
+		var err error
+		if tmpl, err = parseOptionTemplate(text); err != nil {
+			return "", err
+		}
+		b.mu.Lock()
+		b.optionTemplates[text] = tmpl
+		b.mu.Unlock()
+	}
+
+	rendered, err := renderTemplate(tmpl, data)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(rendered), nil
+}
+
+// buildMessage converts a message received on route into an Ntfy message: the route's options
+// are applied first, then fields of a JSON payload, then MQTT v5 properties (see BuildNtfyMessage).
+// Binary payloads become attachments; on routes with a snapshot topic it waits for the snapshot.
+func (b *Bridge) buildMessage(route Route, msg MQTTMessage) (NtfyMessage, error) {
+	data := messageData{Topic: msg.Topic, Subscription: route.Topic, Payload: string(msg.Payload)}
+	attachment := isAttachment(route.Attachment, msg)
+	if attachment {
+		data.Payload = ""
+	} else if route.PayloadFormat == PayloadFormatJSON {
+		decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+		decoder.UseNumber()
+		if err := decoder.Decode(&data.JSON); err != nil {
+			return NtfyMessage{}, fmt.Errorf("payload is not a JSON object: %w", err)
+		}
+		if data.JSON == nil {
+			return NtfyMessage{}, fmt.Errorf("payload is not a JSON object")
+		}
+	}
+
+	message := NtfyMessage{Source: data}
+	rendered := map[string]*string{
+		"message":  &message.Message,
+		"title":    &message.Title,
+		"click":    &message.Click,
+		"icon":     &message.Icon,
+		"delay":    &message.Delay,
+		"email":    &message.Email,
+		"call":     &message.Call,
+		"attach":   &message.Attach,
+		"filename": &message.Filename,
+	}
+	var tags string
+	rendered["tags"] = &tags
+	for key, text := range route.Options.templates() {
+		value, err := b.renderOption(text, data)
+		if err != nil {
+			return NtfyMessage{}, fmt.Errorf("failed to render %s: %w", key, err)
+		}
+		*rendered[key] = value
+	}
+	message.Tags = splitTags(tags)
+	actions, err := b.actionButtons(route, data)
+	if err != nil {
+		return NtfyMessage{}, err
+	}
+	message.Actions = actions
+	message.Markdown = route.Options.Markdown != nil && *route.Options.Markdown
+	message.DisableCache = route.Options.Cache != nil && !*route.Options.Cache
+	message.DisableFirebase = route.Options.Firebase != nil && !*route.Options.Firebase
+
+	if attachment {
+		// The message is only set by the message option; Ntfy describes the file otherwise
+		message.Priority = route.Priority
+		message.Attachment = msg.Payload
+		if message.Filename == "" {
+			message.Filename = attachmentFilename(msg.Topic, msg)
+		}
+	} else if data.JSON != nil {
+		message.Priority = route.Priority
+		if message.Message == "" {
+			message.Message = string(msg.Payload)
+		}
+		applyJSONPayload(&message, data.JSON)
+	} else {
+		cleanedMessage, priority := ParseMessagePriority(string(msg.Payload), route.Priority)
+		message.Priority = priority
+		if message.Message == "" {
+			message.Message = cleanedMessage
+		}
+	}
+
+	applyMessageProperties(&message, msg)
+	if err := checkMessageValues(message); err != nil {
+		return NtfyMessage{}, err
+	}
+	message.SourceID = sourceID(route, msg)
+	if route.Snapshot != nil && message.Attachment == nil {
+		b.attachSnapshot(route, data, &message)
+	}
+	return message, nil
+}
+
+// sourceID identifies a message received on route by its subscription, topic, payload and the
+// time it was received, or returns "" if that time is unknown
+func sourceID(route Route, msg MQTTMessage) string {
+	if msg.Received.IsZero() {
+		return ""
+	}
+	hash := sha256.New()
+	for _, part := range []string{route.Topic, msg.Topic, strconv.FormatInt(msg.Received.UnixNano(), 10)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(msg.Payload)
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// applyJSONPayload applies the fields of a JSON payload that Ntfy's JSON publishing format defines
+func applyJSONPayload(message *NtfyMessage, fields map[string]any) {
+	setString := func(key string, target *string) {
+		switch value := fields[key].(type) {
+		case string:
+			*target = value
+		case json.Number:
+			*target = value.String()
+		}
+	}
+	setString("message", &message.Message)
+	setString("title", &message.Title)
+	setString("priority", &message.Priority)
+	setString("click", &message.Click)
+	setString("icon", &message.Icon)
+	setString("delay", &message.Delay)
+	setString("email", &message.Email)
+	setString("call", &message.Call)
+	setString("attach", &message.Attach)
+	setString("filename", &message.Filename)
+
+	switch tags := fields["tags"].(type) {
+	case string:
+		message.Tags = splitTags(tags)
+	case []any:
+		message.Tags = nil
+		for _, tag := range tags {
+			if tag, ok := tag.(string); ok && tag != "" {
+				message.Tags = append(message.Tags, tag)
+			}
+		}
+	}
+	if markdown, ok := fields["markdown"].(bool); ok {
+		message.Markdown = markdown
+	}
+}
+
+// parseBool parses a yes/no property value as Ntfy does
+func parseBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "1", "true":
+		return true, true
+	case "no", "0", "false":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestNtfyOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		options NtfyOptions
+		want    error
+	}{
+		{name: "empty", options: NtfyOptions{}},
+		{
+			name: "all options",
+			options: NtfyOptions{
+				Message: "{{.JSON.label}} at {{.JSON.camera}}", Title: "{{.Topic}}", Tags: "warning,{{.JSON.label}}",
+				Click: "https://frigate.example.com/events", Icon: "https://example.com/icon.png", Delay: "30m",
+				Email: "alerts@example.com", Call: "+12223334444",
+			},
+		},
+		{name: "natural language delay", options: NtfyOptions{Delay: "tomorrow, 10am"}},
+		{name: "call yes", options: NtfyOptions{Call: "yes"}},
+		{name: "templated email", options: NtfyOptions{Email: "{{.JSON.email}}"}},
+		{name: "nested JSON field", options: NtfyOptions{Title: "{{.JSON.after.camera}}", Filename: "{{.JSON.after.id}}.jpg"}},
+		{name: "invalid template", options: NtfyOptions{Title: "{{.Topic"}, want: fmt.Errorf("ntfy.title is not a valid template: template: option:1: unclosed action")},
+		{name: "unknown field", options: NtfyOptions{Title: "{{.Camera}}"}, want: fmt.Errorf("ntfy.title is not a valid template: template: option:1:2: executing \"option\" at <.Camera>: can't evaluate field Camera in type main.messageData")},
+		{name: "relative click", options: NtfyOptions{Click: "/events"}, want: fmt.Errorf("ntfy.click must be a URL (got \"/events\")")},
+		{name: "icon not http", options: NtfyOptions{Icon: "file:///icon.png"}, want: fmt.Errorf("ntfy.icon must be an http:// or https:// URL (got \"file:///icon.png\")")},
+		{name: "short delay", options: NtfyOptions{Delay: "5s"}, want: fmt.Errorf("ntfy.delay must be at least 10s (got \"5s\")")},
+		{name: "invalid email", options: NtfyOptions{Email: "alerts"}, want: fmt.Errorf("ntfy.email must be an email address (got \"alerts\")")},
+		{name: "invalid call", options: NtfyOptions{Call: "555-1234"}, want: fmt.Errorf("ntfy.call must be \"yes\" or a phone number like +12223334444 (got \"555-1234\")")},
+	}
+
+	for _, tt := range tests {
+		err := tt.options.validate("ntfy")
+		if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+			t.Errorf("validate(%s) = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNtfyOptionsMerge(t *testing.T) {
+	yes, no := true, false
+	defaults := NtfyOptions{Title: "Home", Tags: "house", Email: "alerts@example.com", Markdown: &yes, Cache: &no}
+	route := NtfyOptions{Title: "Garage", Markdown: &no}
+
+	got := route.merge(defaults)
+	if got.Title != "Garage" || got.Tags != "house" || got.Email != "alerts@example.com" || *got.Markdown || got.Cache != &no {
+		t.Errorf("merge() = %+v, want route title and markdown with the other defaults", got)
+	}
+}
+
+func TestBridgeBuildMessage(t *testing.T) {
+	no := false
+	tests := []struct {
+		name      string
+		route     Route
+		msg       MQTTMessage
+		want      NtfyMessage
+		expectErr bool
+	}{
+		{
+			name:  "text with options",
+			route: Route{Topic: "alerts/#", Priority: "3", Options: NtfyOptions{Title: "Alert on {{.Topic}}", Tags: "warning", Delay: "30m", Cache: &no, Firebase: &no}},
+			msg:   MQTTMessage{Topic: "alerts/door", Payload: []byte("4|Door open")},
+			want:  NtfyMessage{Message: "Door open", Title: "Alert on alerts/door", Priority: "4", Tags: []string{"warning"}, Delay: "30m", DisableCache: true, DisableFirebase: true},
+		},
+		{
+			name:  "message template",
+			route: Route{Topic: "alerts/#", Options: NtfyOptions{Message: "{{.Subscription}}: {{.Payload}}"}},
+			msg:   MQTTMessage{Topic: "alerts/door", Payload: []byte("open")},
+			want:  NtfyMessage{Message: "alerts/#: open"},
+		},
+		{
+			name:  "JSON payload",
+			route: Route{Topic: "alerts/#", Priority: "3", PayloadFormat: PayloadFormatJSON, Options: NtfyOptions{Title: "Default", Email: "alerts@example.com"}},
+			msg:   MQTTMessage{Topic: "alerts/door", Payload: []byte(`{"message":"Door open","title":"Door","priority":5,"tags":["warning","door"],"click":"https://home.example.com","icon":"https://example.com/door.png","delay":"1h","call":"yes","markdown":true}`)},
+			want: NtfyMessage{
+				Message: "Door open", Title: "Door", Priority: "5", Tags: []string{"warning", "door"}, Click: "https://home.example.com",
+				Icon: "https://example.com/door.png", Delay: "1h", Email: "alerts@example.com", Call: "yes", Markdown: true,
+			},
+		},
+		{
+			name:  "JSON fields in templates",
+			route: Route{Topic: "frigate/events", PayloadFormat: PayloadFormatJSON, Options: NtfyOptions{Message: "{{.JSON.label}} on {{.JSON.camera}}{{.JSON.zone}}", Tags: "{{.JSON.label}}"}},
+			msg:   MQTTMessage{Topic: "frigate/events", Payload: []byte(`{"label":"person","camera":"driveway"}`)},
+			want:  NtfyMessage{Message: "person on driveway", Tags: []string{"person"}},
+		},
+		{
+			name:  "JSON without message",
+			route: Route{Topic: "sensors/leak", PayloadFormat: PayloadFormatJSON},
+			msg:   MQTTMessage{Topic: "sensors/leak", Payload: []byte(`{"title":"Leak"}`)},
+			want:  NtfyMessage{Message: `{"title":"Leak"}`, Title: "Leak"},
+		},
+		{
+			name:  "user properties override",
+			route: Route{Topic: "alerts/#", PayloadFormat: PayloadFormatJSON, Options: NtfyOptions{Title: "Default"}},
+			msg: MQTTMessage{Topic: "alerts/door", Payload: []byte(`{"message":"Door open","title":"Door"}`),
+				UserProperties: map[string]string{"title": "Front door", "delay": "10m", "cache": "no", "markdown": "yes"}},
+			want: NtfyMessage{Message: "Door open", Title: "Front door", Delay: "10m", DisableCache: true, Markdown: true},
+		},
+		{
+			name:      "invalid JSON",
+			route:     Route{Topic: "alerts/#", PayloadFormat: PayloadFormatJSON},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte("open")},
+			expectErr: true,
+		},
+		{
+			name:      "JSON array",
+			route:     Route{Topic: "alerts/#", PayloadFormat: PayloadFormatJSON},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte(`["open"]`)},
+			expectErr: true,
+		},
+		{
+			name:      "click from JSON is not a URL",
+			route:     Route{Topic: "alerts/#", PayloadFormat: PayloadFormatJSON},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte(`{"message":"open","click":"home page"}`)},
+			expectErr: true,
+		},
+		{
+			name:      "rendered icon is not an http URL",
+			route:     Route{Topic: "alerts/#", Options: NtfyOptions{Icon: "{{.Payload}}"}},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte("ftp://example.com/door.png")},
+			expectErr: true,
+		},
+		{
+			name:      "rendered email is not an address",
+			route:     Route{Topic: "alerts/#", Options: NtfyOptions{Email: "{{.Payload}}"}},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte("nobody")},
+			expectErr: true,
+		},
+		{
+			name:      "delay from user properties with a line break",
+			route:     Route{Topic: "alerts/#"},
+			msg:       MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), UserProperties: map[string]string{"delay": "10m\nX-Injected: yes"}},
+			expectErr: true,
+		},
+	}
+
+	bridge := testBridge()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bridge.buildMessage(tt.route, tt.msg)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("buildMessage() = %+v, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("buildMessage() failed: %v", err)
+			}
+			if !slices.Equal(got.Tags, tt.want.Tags) {
+				t.Errorf("Tags = %v, want %v", got.Tags, tt.want.Tags)
+			}
+			got.Tags, tt.want.Tags = nil, nil
+			// Source carries the received message to backends rendering templates over it
+			if got.Source.Topic != tt.msg.Topic || got.Source.Subscription != tt.route.Topic {
+				t.Errorf("Source = %+v, want the received message", got.Source)
+			}
+			got.Source = messageData{}
+			if fmt.Sprintf("%+v", got) != fmt.Sprintf("%+v", tt.want) {
+				t.Errorf("buildMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
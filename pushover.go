@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults of the Pushover backend
+const (
+	defaultPushoverURL    = "https://api.pushover.net"
+	defaultPushoverRetry  = time.Minute
+	defaultPushoverExpire = time.Hour
+	// Pushover's limits for emergency messages
+	minPushoverRetry  = 30 * time.Second
+	maxPushoverExpire = 3 * time.Hour
+	// Pushover asks clients not to poll a receipt more often than every 5 seconds
+	defaultPushoverPollInterval = 30 * time.Second
+)
+
+// pushoverPriorities maps the Ntfy priorities 1-5 to Pushover's -2 (lowest) to 2 (emergency)
+var pushoverPriorities = [...]int{1: -2, 2: -1, 3: 0, 4: 1, 5: 2}
+
+// pushoverResponse is the part of Pushover's responses mqtt2ntfy uses
+type pushoverResponse struct {
+	Request string   `json:"request"`
+	Receipt string   `json:"receipt,omitempty"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// pushoverReceipt is Pushover's answer to polling the receipt of an emergency message
+type pushoverReceipt struct {
+	Acknowledged         int    `json:"acknowledged"`
+	AcknowledgedAt       int64  `json:"acknowledged_at"`
+	AcknowledgedBy       string `json:"acknowledged_by"`
+	AcknowledgedByDevice string `json:"acknowledged_by_device"`
+	Expired              int    `json:"expired"`
+	ExpiresAt            int64  `json:"expires_at"`
+}
+
+// Acknowledgement tells whether the recipient acknowledged a message that awaited acknowledgement
+type Acknowledgement struct {
+	Receipt        string    `json:"receipt"`
+	Acknowledged   bool      `json:"acknowledged"`
+	AcknowledgedAt time.Time `json:"acknowledged_at,omitzero"`
+	AcknowledgedBy string    `json:"acknowledged_by,omitempty"` // user key of the recipient
+	Device         string    `json:"device,omitempty"`
+	Expired        bool      `json:"expired"`
+}
+
+// acknowledgementTracker is implemented by clients of backends whose messages can await
+// acknowledgement by the recipient; NtfyReceipt.Receipt identifies such messages
+type acknowledgementTracker interface {
+	// TrackAcknowledgement waits until the message is acknowledged, stops waiting for it or ctx is done
+	TrackAcknowledgement(ctx context.Context, url, receipt string, auth NtfyAuth) (Acknowledgement, error)
+}
+
+// PushoverClient implements NtfyClient for Pushover: the URL is that of the API, the token of the
+// auth that of a Pushover application and its username the user or group key. Messages with the
+// Ntfy priority 5 are sent as emergency messages, which repeat until they are acknowledged.
+type PushoverClient struct {
+	sender       *backendSender
+	retry        time.Duration // how often emergency messages repeat
+	expire       time.Duration // how long they keep repeating
+	pollInterval time.Duration
+}
+
+// NewPushoverClient creates a Pushover client with the timeout, retry and connection settings of
+// config; emergency messages repeat every retry until acknowledged or expire has passed
+func NewPushoverClient(config NtfyConfig, retry, expire time.Duration, logger *slog.Logger) *PushoverClient {
+	return &PushoverClient{
+		sender:       newBackendSender(BackendPushover, config, logger),
+		retry:        retry,
+		expire:       expire,
+		pollInterval: defaultPushoverPollInterval,
+	}
+}
+
+// CloseIdleConnections closes the client's idle keep-alive connections
+func (p *PushoverClient) CloseIdleConnections() {
+	p.sender.CloseIdleConnections()
+}
+
+// SendMessage implements NtfyClient with the retry logic of HTTPNtfyClient. The receipt of an
+// emergency message is returned in NtfyReceipt.Receipt.
+func (p *PushoverClient) SendMessage(apiURL string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	form := p.form(message, auth, time.Now())
+	endpoint := strings.TrimSuffix(apiURL, "/") + "/1/messages.json"
+	var acknowledgement string
+	receipt, err := sendWithRetry(p.sender.config, message.ExpiresAt, func(ctx context.Context) (string, int, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		body, status, err := p.sender.do(req)
+		var response pushoverResponse
+		_ = json.Unmarshal(body, &response)
+		if err != nil {
+			if len(response.Errors) > 0 {
+				return "", status, fmt.Errorf("%w: %s", err, strings.Join(response.Errors, "; "))
+			}
+			return "", status, err
+		}
+		acknowledgement = response.Receipt
+		return response.Request, status, nil
+	})
+	receipt.Receipt = acknowledgement
+	return receipt, err
+}
+
+// form returns the parameters of Pushover's messages API for message
+func (p *PushoverClient) form(message NtfyMessage, auth NtfyAuth, now time.Time) url.Values {
+	priority := pushoverPriorities[priorityLevel(message.Priority)]
+	form := url.Values{
+		"token":    {auth.Token},
+		"user":     {auth.Username},
+		"message":  {message.Message},
+		"priority": {strconv.Itoa(priority)},
+	}
+	// Pushover rejects messages without text
+	if message.Message == "" {
+		switch {
+		case message.Filename != "":
+			form.Set("message", message.Filename)
+		case message.Attach != "":
+			form.Set("message", message.Attach)
+		case message.Title != "":
+			form.Set("message", message.Title)
+		default:
+			form.Set("message", "(no message)")
+		}
+	}
+	if message.Title != "" {
+		form.Set("title", message.Title)
+	}
+	if message.Click != "" {
+		form.Set("url", message.Click)
+	} else if message.Attach != "" {
+		form.Set("url", message.Attach)
+	}
+	if message.Attachment != nil {
+		form.Set("attachment_base64", base64.StdEncoding.EncodeToString(message.Attachment))
+		form.Set("attachment_type", http.DetectContentType(message.Attachment))
+	}
+	if priority == 2 {
+		form.Set("retry", strconv.Itoa(int(p.retry.Seconds())))
+		form.Set("expire", strconv.Itoa(int(p.expire.Seconds())))
+	} else if !message.ExpiresAt.IsZero() && message.ExpiresAt.After(now) {
+		// Pushover deletes the message from the devices when it expires
+		form.Set("ttl", strconv.Itoa(max(int(message.ExpiresAt.Sub(now).Seconds()), 1)))
+	}
+	return form
+}
+
+// TrackAcknowledgement polls the receipt of an emergency message until it is acknowledged or has
+// expired; it gives up once the message has repeated for longer than the client's expire setting,
+// or when ctx is done
+func (p *PushoverClient) TrackAcknowledgement(ctx context.Context, apiURL, receipt string, auth NtfyAuth) (Acknowledgement, error) {
+	endpoint := strings.TrimSuffix(apiURL, "/") + "/1/receipts/" + url.PathEscape(receipt) + ".json?token=" + url.QueryEscape(auth.Token)
+	deadline := time.Now().Add(p.expire + p.pollInterval)
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return Acknowledgement{}, fmt.Errorf("failed to create request: %w", err)
+		}
+		body, _, err := p.sender.do(req)
+		if ctx.Err() != nil {
+			return Acknowledgement{}, ctx.Err()
+		}
+		if err != nil && !isRetryableError(err) {
+			return Acknowledgement{}, fmt.Errorf("failed to poll receipt: %w", err)
+		}
+		if err == nil {
+			var state pushoverReceipt
+			if err := json.Unmarshal(body, &state); err != nil {
+				return Acknowledgement{}, fmt.Errorf("failed to parse receipt: %w", err)
+			}
+			acknowledgement := Acknowledgement{
+				Receipt:        receipt,
+				Acknowledged:   state.Acknowledged == 1,
+				AcknowledgedBy: state.AcknowledgedBy,
+				Device:         state.AcknowledgedByDevice,
+				Expired:        state.Expired == 1,
+			}
+			if state.AcknowledgedAt > 0 {
+				acknowledgement.AcknowledgedAt = time.Unix(state.AcknowledgedAt, 0).UTC()
+			}
+			if acknowledgement.Acknowledged || acknowledgement.Expired {
+				return acknowledgement, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return Acknowledgement{Receipt: receipt, Expired: true}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Acknowledgement{}, ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Responses of the Pushover stand-ins
+var (
+	pushoverSent      = backendResponse{Body: `{"status":1,"request":"m1"}`}
+	pushoverEmergency = backendResponse{Body: `{"status":1,"request":"m1","receipt":"r1"}`}
+	pushoverPending   = backendResponse{Body: `{"status":1,"acknowledged":0,"acknowledged_at":0,"expired":0}`}
+	pushoverAcked     = backendResponse{Body: `{"status":1,"acknowledged":1,"acknowledged_at":1700000100,"acknowledged_by":"uOnCall","acknowledged_by_device":"pixel","expired":0}`}
+)
+
+// pushoverForm parses the form of a request to Pushover
+func pushoverForm(t *testing.T, request ntfyRequest) url.Values {
+	t.Helper()
+	form, err := url.ParseQuery(string(request.Body))
+	if err != nil {
+		t.Fatalf("Body %s is not a form: %v", request.Body, err)
+	}
+	return form
+}
+
+func testPushoverClient() *PushoverClient {
+	client := NewPushoverClient(testBackendConfig(), time.Minute, time.Hour, testLogger())
+	client.pollInterval = 10 * time.Millisecond
+	return client
+}
+
+func TestPushoverForm(t *testing.T) {
+	client := testPushoverClient()
+	now := time.Now()
+	auth := NtfyAuth{Token: "app", Username: "uOnCall"}
+
+	tests := []struct {
+		name    string
+		message NtfyMessage
+		want    map[string]string // expected parameters; "" means absent
+	}{
+		{
+			name:    "default priority",
+			message: NtfyMessage{Message: "Door opened", Title: "Garage"},
+			want:    map[string]string{"token": "app", "user": "uOnCall", "message": "Door opened", "title": "Garage", "priority": "0", "retry": "", "expire": ""},
+		},
+		{
+			name:    "emergency",
+			message: NtfyMessage{Message: "Smoke detected", Priority: "urgent", Click: "https://home.example.com"},
+			want:    map[string]string{"priority": "2", "retry": "60", "expire": "3600", "url": "https://home.example.com", "ttl": ""},
+		},
+		{
+			name:    "min priority with expiry",
+			message: NtfyMessage{Message: "Backup done", Priority: "1", ExpiresAt: now.Add(10 * time.Minute)},
+			want:    map[string]string{"priority": "-2", "ttl": "600"},
+		},
+		{
+			name:    "attachment without message",
+			message: NtfyMessage{Attachment: testJPEG, Filename: "snapshot.jpg", Priority: "4"},
+			want:    map[string]string{"priority": "1", "message": "snapshot.jpg", "attachment_type": "image/jpeg"},
+		},
+	}
+
+	for _, tt := range tests {
+		form := client.form(tt.message, auth, now)
+		for key, want := range tt.want {
+			if got := form.Get(key); got != want {
+				t.Errorf("form(%s)[%s] = %q, want %q", tt.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestPushoverSendMessage(t *testing.T) {
+	server, requests := backendServer(t, pushoverSent, pushoverEmergency, backendResponse{
+		Status: http.StatusBadRequest,
+		Body:   `{"token":"invalid","errors":["application token is invalid"],"status":0,"request":"e1"}`,
+	})
+	client := testPushoverClient()
+
+	receipt, err := client.SendMessage(server.URL, NtfyMessage{Message: "Door opened"}, NtfyAuth{Token: "app", Username: "uOnCall"})
+	if err != nil || receipt.MessageID != "m1" || receipt.Receipt != "" {
+		t.Errorf("SendMessage() = %+v, %v, want message m1 without a receipt", receipt, err)
+	}
+	request := <-requests
+	if form := pushoverForm(t, request); request.Method != http.MethodPost || request.Path != "/1/messages.json" || form.Get("token") != "app" {
+		t.Errorf("Request = %s %s with token %q, want the form POSTed to /1/messages.json", request.Method, request.Path, form.Get("token"))
+	}
+
+	receipt, err = client.SendMessage(server.URL, NtfyMessage{Message: "Smoke detected", Priority: "5"}, NtfyAuth{Token: "app", Username: "uOnCall"})
+	if err != nil || receipt.Receipt != "r1" {
+		t.Errorf("SendMessage() = %+v, %v, want the receipt of the emergency message", receipt, err)
+	}
+	<-requests
+
+	receipt, err = client.SendMessage(server.URL, NtfyMessage{Message: "Door opened"}, NtfyAuth{Token: "wrong", Username: "uOnCall"})
+	if err == nil || !strings.Contains(err.Error(), "application token is invalid") {
+		t.Errorf("SendMessage() error = %v, want Pushover's explanation", err)
+	}
+	if receipt.Attempts != 1 {
+		t.Errorf("Attempts = %d, want a rejected message not to be retried", receipt.Attempts)
+	}
+}
+
+func TestPushoverTrackAcknowledgement(t *testing.T) {
+	server, requests := backendServer(t, pushoverPending, pushoverAcked, backendResponse{
+		Status: http.StatusNotFound,
+		Body:   `{"receipt":"not found","errors":["receipt not found; may be invalid or expired"],"status":0}`,
+	})
+	client := testPushoverClient()
+
+	ack, err := client.TrackAcknowledgement(context.Background(), server.URL, "r1", NtfyAuth{Token: "app"})
+	if err != nil {
+		t.Fatalf("TrackAcknowledgement failed: %v", err)
+	}
+	if request := <-requests; request.Method != http.MethodGet || request.Path != "/1/receipts/r1.json" {
+		t.Errorf("Poll = %s %s, want a GET of /1/receipts/r1.json", request.Method, request.Path)
+	}
+	want := Acknowledgement{Receipt: "r1", Acknowledged: true, AcknowledgedAt: time.Unix(1700000100, 0).UTC(), AcknowledgedBy: "uOnCall", Device: "pixel"}
+	if ack != want {
+		t.Errorf("TrackAcknowledgement() = %+v, want %+v", ack, want)
+	}
+
+	client.expire = 0
+	ack, err = client.TrackAcknowledgement(context.Background(), server.URL, "r2", NtfyAuth{Token: "app"})
+	if err == nil {
+		t.Errorf("TrackAcknowledgement() of an unknown receipt = %+v, want an error", ack)
+	}
+}
+
+func TestPushoverTrackAcknowledgementCancelled(t *testing.T) {
+	server, requests := backendServer(t, pushoverPending)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	ack, err := testPushoverClient().TrackAcknowledgement(ctx, server.URL, "r1", NtfyAuth{Token: "app"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("TrackAcknowledgement() = %+v, %v, want it cancelled", ack, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("TrackAcknowledgement returned %s after being cancelled, want at once", elapsed)
+	}
+	if len(requests) == 0 {
+		t.Error("TrackAcknowledgement did not poll before being cancelled")
+	}
+}
+
+func TestBridgePushoverAcknowledgement(t *testing.T) {
+	server, requests := backendServer(t, pushoverEmergency, pushoverPending, pushoverAcked)
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{
+		"oncall": {Name: "oncall", Type: BackendPushover, URL: server.URL, Auth: NtfyAuth{Token: "app", Username: "uTeam"}, Client: testPushoverClient(), AckTopic: "ack/{{.Topic}}"},
+	})
+	broker := newMemoryBroker()
+	acks := collectMQTT(t, broker)
+
+	backends := []string{"oncall"}
+	route := Route{Topic: "alarm/#", Backends: &backends, PushoverUser: "uOnCall"}
+	subscription := bridge.Subscription(route)
+	subscription.Callback(MQTTMessage{Topic: "alarm/smoke", Payload: []byte("5|Smoke detected"), client: broker.connect(nil)})
+
+	if form := pushoverForm(t, <-requests); form.Get("user") != "uOnCall" || form.Get("priority") != "2" {
+		t.Errorf("Sent user %q with priority %q, want the route's user key and emergency priority", form.Get("user"), form.Get("priority"))
+	}
+	msg := receiveMQTT(t, acks)
+	var ack acknowledgementMessage
+	if err := json.Unmarshal(msg.Payload, &ack); err != nil {
+		t.Fatalf("Payload %s is not JSON: %v", msg.Payload, err)
+	}
+	if msg.Topic != "ack/alarm/smoke" || ack.Backend != "oncall" || ack.Topic != "alarm/smoke" || !ack.Acknowledged || ack.AcknowledgedBy != "uOnCall" {
+		t.Errorf("Published %s %s, want the acknowledgement on ack/alarm/smoke", msg.Topic, msg.Payload)
+	}
+}
+
+func TestBridgeCloseStopsTrackingAcknowledgements(t *testing.T) {
+	server, requests := backendServer(t, pushoverEmergency, pushoverPending)
+	bridge := testBridge()
+	bridge.SetBackends(map[string]Backend{
+		"oncall": {Name: "oncall", Type: BackendPushover, URL: server.URL, Auth: NtfyAuth{Token: "app", Username: "uTeam"}, Client: testPushoverClient()},
+	})
+	backends := []string{"oncall"}
+	if err := bridge.HandleMessage(Route{Topic: "alarm/#", Backends: &backends}, MQTTMessage{Topic: "alarm/smoke", Payload: []byte("5|Smoke detected")}); err != nil {
+		t.Fatalf("HandleMessage failed: %v", err)
+	}
+	<-requests
+	<-requests // the first poll of the receipt
+
+	bridge.Close()
+	for len(requests) > 0 {
+		<-requests
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(requests) != 0 {
+		t.Error("Receipt still polled after Close returned")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRateLimitPause caps how long a single rate limit response can pause delivery to a server
+const maxRateLimitPause = 15 * time.Minute
+
+// defaultRateLimitPause is used for a 429 response that does not say when to retry
+const defaultRateLimitPause = 5 * time.Second
+
+// maxHeldMessages caps how many messages the bridge holds for a server that is rate limited
+const maxHeldMessages = 1000
+
+// RateLimits pauses delivery to Ntfy servers that have rate limited mqtt2ntfy, keyed by host
+type RateLimits struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	paused map[string]time.Time
+}
+
+// NewRateLimits creates an empty RateLimits
+func NewRateLimits() *RateLimits {
+	return &RateLimits{now: time.Now, paused: map[string]time.Time{}}
+}
+
+// defaultRateLimits is shared by all Ntfy clients, so a rate limit pauses every message for that server
+var defaultRateLimits = NewRateLimits()
+
+// Pause stops delivery to host for d; a longer existing pause is kept
+func (r *RateLimits) Pause(host string, d time.Duration) {
+	d = min(d, maxRateLimitPause)
+	until := r.now().Add(d)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until.After(r.paused[host]) {
+		r.paused[host] = until
+	}
+}
+
+// PausedFor returns how long delivery to host is still paused
+func (r *RateLimits) PausedFor(host string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.paused[host]
+	if !ok {
+		return 0
+	}
+	remaining := until.Sub(r.now())
+	if remaining <= 0 {
+		delete(r.paused, host)
+		return 0
+	}
+	return remaining
+}
+
+// RateLimitedError is returned instead of sending a message to a server that is paused for longer
+// than the message may wait
+type RateLimitedError struct {
+	Host       string
+	RetryAfter time.Duration // how long delivery to the server is still paused
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("delivery to %s is paused by its rate limit for another %s", e.Host, e.RetryAfter.Round(time.Second))
+}
+
+// Wait blocks until delivery to host is no longer paused or ctx is done. Messages are delivered
+// from the MQTT callbacks, which must not stall the connection, so a pause longer than limit
+// fails at once with a RateLimitedError; the bridge then holds the message until the pause ends.
+func (r *RateLimits) Wait(ctx context.Context, host string, limit time.Duration, logger *slog.Logger) error {
+	for {
+		remaining := r.PausedFor(host)
+		if remaining <= 0 {
+			return nil
+		}
+		if remaining > limit {
+			return &RateLimitedError{Host: host, RetryAfter: remaining}
+		}
+		logger.Info("Ntfy server rate limited delivery; waiting", "host", host, "wait", remaining.Round(time.Millisecond))
+		timer := time.NewTimer(remaining)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryBudget returns how long the retries of a message back off in total, which is as long as
+// it may wait for a rate limit to end
+func retryBudget(config NtfyConfig) time.Duration {
+	var budget time.Duration
+	delay := config.RetryDelay
+	for range config.MaxRetries - 1 {
+		budget += delay
+		delay *= 2
+	}
+	return budget
+}
+
+// rateLimitDelay reads how long to wait before sending to the server again from a response's
+// Retry-After, RateLimit-Reset or X-RateLimit-Reset header; ok is false if none is set
+func rateLimitDelay(header http.Header, now time.Time) (time.Duration, bool) {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(at.Sub(now), 0), true
+		}
+	}
+	if value := header.Get("RateLimit-Reset"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if value := header.Get("X-RateLimit-Reset"); value != "" {
+		if reset, err := strconv.ParseInt(value, 10, 64); err == nil && reset >= 0 {
+			// Either a Unix timestamp or a number of seconds
+			if reset > 1_000_000_000 {
+				return max(time.Unix(reset, 0).Sub(now), 0), true
+			}
+			return time.Duration(reset) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// rateLimitExhausted reports whether a successful response says no further requests are allowed
+// until the limit resets
+func rateLimitExhausted(header http.Header) bool {
+	for _, name := range []string{"RateLimit-Remaining", "X-RateLimit-Remaining"} {
+		if value := header.Get(name); value != "" {
+			remaining, err := strconv.Atoi(value)
+			return err == nil && remaining <= 0
+		}
+	}
+	return false
+}
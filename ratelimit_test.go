@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitDelay(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    time.Duration
+		wantSet bool
+	}{
+		{name: "none", header: http.Header{}},
+		{name: "retry-after seconds", header: http.Header{"Retry-After": {"30"}}, want: 30 * time.Second, wantSet: true},
+		{name: "retry-after date", header: http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}, want: time.Minute, wantSet: true},
+		{name: "retry-after in the past", header: http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, want: 0, wantSet: true},
+		{name: "invalid retry-after", header: http.Header{"Retry-After": {"soon"}}},
+		{name: "ratelimit-reset", header: http.Header{"Ratelimit-Reset": {"12"}}, want: 12 * time.Second, wantSet: true},
+		{name: "x-ratelimit-reset seconds", header: http.Header{"X-Ratelimit-Reset": {"5"}}, want: 5 * time.Second, wantSet: true},
+		{name: "x-ratelimit-reset timestamp", header: http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Add(10*time.Second).Unix(), 10)}}, want: 10 * time.Second, wantSet: true},
+		{name: "retry-after wins", header: http.Header{"Retry-After": {"1"}, "X-Ratelimit-Reset": {"5"}}, want: time.Second, wantSet: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := rateLimitDelay(tt.header, now)
+		if got != tt.want || ok != tt.wantSet {
+			t.Errorf("rateLimitDelay(%s) = %s, %v, want %s, %v", tt.name, got, ok, tt.want, tt.wantSet)
+		}
+	}
+}
+
+func TestRateLimitsPause(t *testing.T) {
+	now := time.Now()
+	limits := NewRateLimits()
+	limits.now = func() time.Time { return now }
+
+	limits.Pause("ntfy.sh", time.Minute)
+	limits.Pause("ntfy.sh", time.Second) // a shorter pause does not shorten the existing one
+	if got := limits.PausedFor("ntfy.sh"); got != time.Minute {
+		t.Errorf("PausedFor(ntfy.sh) = %s, want 1m", got)
+	}
+	if got := limits.PausedFor("ntfy.example.com"); got != 0 {
+		t.Errorf("PausedFor(ntfy.example.com) = %s, want 0", got)
+	}
+
+	limits.Pause("huge.example.com", 24*time.Hour)
+	if got := limits.PausedFor("huge.example.com"); got != maxRateLimitPause {
+		t.Errorf("PausedFor(huge.example.com) = %s, want the %s cap", got, maxRateLimitPause)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if got := limits.PausedFor("ntfy.sh"); got != 0 {
+		t.Errorf("PausedFor(ntfy.sh) after the pause = %s, want 0", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	limits.Pause("ntfy.sh", time.Minute)
+	if err := limits.Wait(ctx, "ntfy.sh", time.Hour, testLogger()); err == nil {
+		t.Error("Wait with a cancelled context returned nil, want an error")
+	}
+
+	// A pause longer than the limit fails at once instead of blocking
+	var limitErr *RateLimitedError
+	if err := limits.Wait(context.Background(), "huge.example.com", time.Second, testLogger()); !errors.As(err, &limitErr) || limitErr.RetryAfter != maxRateLimitPause-2*time.Minute {
+		t.Errorf("Wait() over the limit = %v, want a RateLimitedError for the rest of the pause", err)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       time.Duration
+	}{
+		{maxRetries: 1, want: 0},
+		{maxRetries: 3, want: 3 * time.Second},
+		{maxRetries: 5, want: 15 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := retryBudget(NtfyConfig{MaxRetries: tt.maxRetries, RetryDelay: time.Second}); got != tt.want {
+			t.Errorf("retryBudget(%d retries) = %s, want %s", tt.maxRetries, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessageRateLimited(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"hwQ2YpKdmg"}`))
+	}))
+	defer server.Close()
+
+	config := NtfyConfig{Timeout: 10 * time.Second, MaxRetries: 3, RetryDelay: 500 * time.Millisecond}
+	limits := NewRateLimits()
+	newClient := func() *HTTPNtfyClient {
+		client := NewNtfyClient(config, testLogger())
+		client.rateLimits = limits
+		return client
+	}
+
+	start := time.Now()
+	receipt, err := newClient().SendMessage(server.URL+"/first", NtfyMessage{Message: "first"}, NtfyAuth{})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if receipt.Attempts != 2 {
+		t.Errorf("Attempts = %d, want 2", receipt.Attempts)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Retried after %s, want at least the 1s Retry-After", elapsed)
+	}
+
+	// Another message to the same server waits for the pause too
+	limits.Pause(server.Listener.Addr().String(), 200*time.Millisecond)
+	start = time.Now()
+	if _, err := newClient().SendMessage(server.URL+"/second", NtfyMessage{Message: "second"}, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Second message sent after %s, want it held back by the pause", elapsed)
+	}
+
+	// A pause longer than the message's retries fails it without waiting or sending
+	limits.Pause(server.Listener.Addr().String(), time.Minute)
+	start = time.Now()
+	receipt, err = newClient().SendMessage(server.URL+"/third", NtfyMessage{Message: "third"}, NtfyAuth{})
+	var limitErr *RateLimitedError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("SendMessage() error = %v, want a RateLimitedError", err)
+	}
+	if receipt.Attempts != 1 || requests.Load() != 3 {
+		t.Errorf("Attempts = %d with %d requests, want 1 attempt and no new request", receipt.Attempts, requests.Load())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("SendMessage failed after %s, want it to fail at once", elapsed)
+	}
+}
+
+func TestSendMessageRateLimitExhausted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", "30")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := NewNtfyClient(NtfyConfig{Timeout: 10 * time.Second, MaxRetries: 1}, testLogger())
+	client.rateLimits = NewRateLimits()
+	if _, err := client.SendMessage(server.URL, NtfyMessage{Message: "last"}, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if got := client.rateLimits.PausedFor(server.Listener.Addr().String()); got <= 0 || got > 30*time.Second {
+		t.Errorf("PausedFor() = %s, want a pause of up to 30s", got)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// resultTopicData is the data available to result topic templates
+type resultTopicData struct {
+	Topic        string // topic the message was received on
+	Subscription string // topic filter of the route
+}
+
+// deliveryReceipt is the JSON payload published on a route's result topic
+type deliveryReceipt struct {
+	Topic     string    `json:"topic"`
+	Delivered bool      `json:"delivered"`
+	MessageID string    `json:"id,omitempty"`
+	Status    int       `json:"status,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// parseResultTopic parses a result topic template such as "{{.Topic}}/ntfy_result"
+func parseResultTopic(text string) (*template.Template, error) {
+	return parseTemplate("result_topic", text, nil, resultTopicData{})
+}
+
+// acknowledgementMessage is the JSON payload published on a backend's ack topic
+type acknowledgementMessage struct {
+	Backend string `json:"backend"`
+	Topic   string `json:"topic"` // topic the message was received on
+	Acknowledgement
+}
+
+// resultTopic renders the result topic of a route for a received message
+func (b *Bridge) resultTopic(route Route, msg MQTTMessage) (string, error) {
+	return b.renderTopic(route.ResultTopic, route, msg)
+}
+
+// renderTopic renders a topic template with the data of result topics for a message received on route
+func (b *Bridge) renderTopic(text string, route Route, msg MQTTMessage) (string, error) {
+	b.mu.Lock()
+	tmpl, ok := b.templates[text]
+	b.mu.Unlock()
+	if !ok {
+		var err error
+		if tmpl, err = parseResultTopic(text); err != nil {
+			return "", err
+		}
+		b.mu.Lock()
+		b.templates[text] = tmpl
+		b.mu.Unlock()
+	}
+
+	topic, err := renderTemplate(tmpl, resultTopicData{Topic: msg.Topic, Subscription: route.Topic})
+	if err != nil {
+		return "", err
+	}
+	if topic == "" || strings.ContainsAny(topic, "+#") {
+		return "", fmt.Errorf("result topic %q is empty or contains wildcards", topic)
+	}
+	return topic, nil
+}
+
+// publishReceipt publishes the outcome of a delivery on the route's result topic, if it has one,
+// back to the broker the message came from
+func (b *Bridge) publishReceipt(route Route, msg MQTTMessage, receipt NtfyReceipt, err error) {
+	if route.ResultTopic == "" || msg.client == nil {
+		return
+	}
+	topic, topicErr := b.resultTopic(route, msg)
+	if topicErr != nil {
+		b.logger.Warn("Failed to build result topic", "template", route.ResultTopic, "topic", msg.Topic, "error", topicErr)
+		return
+	}
+	// A receipt on a subscribed topic would be forwarded and produce another receipt
+	if filter, ok := b.subscribedFilter(route.Connection, topic); ok {
+		b.logger.Warn("Not publishing delivery receipt on a subscribed topic; choose a result topic outside the routes", "result_topic", topic, "route", filter)
+		return
+	}
+
+	payload := deliveryReceipt{
+		Topic:     msg.Topic,
+		Delivered: err == nil,
+		MessageID: receipt.MessageID,
+		Status:    receipt.StatusCode,
+		Attempts:  receipt.Attempts,
+		Time:      time.Now().UTC(),
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	data, _ := json.Marshal(payload)
+
+	// Publish outside the message callback, which must not wait for the broker
+	go func() {
+		if err := msg.client.Publish(topic, 1, false, data); err != nil {
+			b.logger.Warn("Failed to publish delivery receipt", "result_topic", topic, "error", err)
+		}
+	}()
+}
+
+// trackAcknowledgement waits until the recipient acknowledges a message sent to backend, or it
+// expires, and publishes the outcome on the backend's ack topic, if it has one, back to the broker
+// the message came from
+func (b *Bridge) trackAcknowledgement(backend Backend, tracker acknowledgementTracker, auth NtfyAuth, route Route, msg MQTTMessage, receipt string) {
+	ack, err := tracker.TrackAcknowledgement(b.tracking, backend.URL, receipt, auth)
+	if errors.Is(err, context.Canceled) {
+		b.logger.Info("Stopped tracking acknowledgement on shutdown", "backend", backend.Name, "receipt", receipt, "topic", msg.Topic)
+		return
+	}
+	if err != nil {
+		b.logger.Warn("Failed to track acknowledgement", "backend", backend.Name, "receipt", receipt, "error", err)
+		return
+	}
+	if ack.Acknowledged {
+		b.logger.Info("Message acknowledged", "backend", backend.Name, "receipt", receipt, "acknowledged_by", ack.AcknowledgedBy, "device", ack.Device)
+	} else {
+		b.logger.Warn("Message expired without being acknowledged", "backend", backend.Name, "receipt", receipt, "topic", msg.Topic)
+	}
+	if backend.AckTopic == "" || msg.client == nil {
+		return
+	}
+
+	topic, err := b.renderTopic(backend.AckTopic, route, msg)
+	if err != nil {
+		b.logger.Warn("Failed to build ack topic", "template", backend.AckTopic, "topic", msg.Topic, "error", err)
+		return
+	}
+	if filter, ok := b.subscribedFilter(route.Connection, topic); ok {
+		b.logger.Warn("Not publishing acknowledgement on a subscribed topic; choose an ack topic outside the routes", "ack_topic", topic, "route", filter)
+		return
+	}
+	data, _ := json.Marshal(acknowledgementMessage{Backend: backend.Name, Topic: msg.Topic, Acknowledgement: ack})
+	if err := msg.client.Publish(topic, 1, false, data); err != nil {
+		b.logger.Warn("Failed to publish acknowledgement", "ack_topic", topic, "error", err)
+	}
+}
+
+// subscribedFilter returns the topic filter of a route on connection that matches topic, if any;
+// publishing on such a topic would forward the message again
+func (b *Bridge) subscribedFilter(connection, topic string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, filter := range b.filters[connection] {
+		if TopicMatchesFilter(filter, topic) {
+			return filter, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseResultTopic(t *testing.T) {
+	tests := []struct {
+		template  string
+		expectErr bool
+	}{
+		{template: "{{.Topic}}/ntfy_result"},
+		{template: "ntfy_results/{{.Subscription}}"},
+		{template: "{{.Topic", expectErr: true},
+		{template: "{{.MessageID}}/result", expectErr: true},
+		{template: "{{if .Topic}}{{.MessageID}}{{end}}/result", expectErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseResultTopic(tt.template)
+		if tt.expectErr && err == nil {
+			t.Errorf("parseResultTopic(%q) expected error, got nil", tt.template)
+		}
+		if !tt.expectErr && err != nil {
+			t.Errorf("parseResultTopic(%q) unexpected error: %v", tt.template, err)
+		}
+	}
+}
+
+// receiptCollector subscribes to topic on broker and collects the receipts published there
+func receiptCollector(t *testing.T, broker *memoryBroker, topic string) chan deliveryReceipt {
+	t.Helper()
+	receipts := make(chan deliveryReceipt, 10)
+	err := broker.connect(nil).Subscribe(Subscription{Topic: topic, Callback: func(msg MQTTMessage) {
+		var receipt deliveryReceipt
+		if err := json.Unmarshal(msg.Payload, &receipt); err != nil {
+			t.Errorf("Invalid receipt %q: %v", msg.Payload, err)
+		}
+		receipts <- receipt
+	}})
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return receipts
+}
+
+func TestBridgePublishesReceipts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rejected" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id":"hwQ2YpKdmg","time":1700000000,"event":"message","topic":"door"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	broker := newMemoryBroker()
+	receipts := receiptCollector(t, broker, "results/#")
+	client := broker.connect(nil)
+	bridge := testBridge()
+
+	tests := []struct {
+		name  string
+		route Route
+		topic string
+		want  deliveryReceipt
+	}{
+		{
+			name:  "delivered",
+			route: Route{Topic: "alerts/door", NtfyURL: server.URL + "/door", ResultTopic: "results/{{.Topic}}"},
+			topic: "alerts/door",
+			want:  deliveryReceipt{Topic: "alerts/door", Delivered: true, MessageID: "hwQ2YpKdmg", Status: 200, Attempts: 1},
+		},
+		{
+			name:  "rejected",
+			route: Route{Topic: "alerts/window", NtfyURL: server.URL + "/rejected", ResultTopic: "results/{{.Topic}}"},
+			topic: "alerts/window",
+			want:  deliveryReceipt{Topic: "alerts/window", Status: 403, Attempts: 1},
+		},
+		{
+			name:  "not routable",
+			route: Route{Topic: "alerts/#", NtfyURL: server.URL, ResultTopic: "results/{{.Topic}}"},
+			topic: "alerts/garage/door",
+			want:  deliveryReceipt{Topic: "alerts/garage/door"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subscription := bridge.Subscription(tt.route)
+			subscription.Callback(MQTTMessage{Topic: tt.topic, Payload: []byte("open"), client: client})
+
+			select {
+			case got := <-receipts:
+				if got.Topic != tt.want.Topic || got.Delivered != tt.want.Delivered || got.MessageID != tt.want.MessageID ||
+					got.Status != tt.want.Status || got.Attempts != tt.want.Attempts {
+					t.Errorf("Receipt = %+v, want %+v", got, tt.want)
+				}
+				if (got.Error == "") != tt.want.Delivered {
+					t.Errorf("Receipt error = %q, want an error only for failed deliveries", got.Error)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Timed out waiting for the delivery receipt")
+			}
+		})
+	}
+}
+
+func TestBridgeSkipsReceiptOnSubscribedTopic(t *testing.T) {
+	server, _ := ntfyStatusServer(t, http.StatusOK)
+	broker := newMemoryBroker()
+	receipts := receiptCollector(t, broker, "#")
+	bridge := testBridge()
+
+	// The receipt topic alerts/door/ntfy_result is matched by the route itself
+	subscription := bridge.Subscription(Route{Topic: "alerts/#", NtfyURL: server.URL, ResultTopic: "{{.Topic}}/ntfy_result"})
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), client: broker.connect(nil)})
+
+	select {
+	case receipt := <-receipts:
+		t.Errorf("Published receipt %+v on a subscribed topic", receipt)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestBridgeReceiptOnOtherConnectionsTopic(t *testing.T) {
+	server, _ := ntfyStatusServer(t, http.StatusOK)
+	broker := newMemoryBroker()
+	receipts := receiptCollector(t, broker, "#")
+	bridge := testBridge()
+
+	// Only a route on another connection subscribes to the receipt topic
+	bridge.Subscription(Route{Topic: "receipts/#", NtfyURL: server.URL, Connection: "backup"})
+	subscription := bridge.Subscription(Route{Topic: "alerts/#", NtfyURL: server.URL, ResultTopic: "receipts/{{.Topic}}"})
+	subscription.Callback(MQTTMessage{Topic: "alerts/door", Payload: []byte("open"), client: broker.connect(nil)})
+
+	select {
+	case receipt := <-receipts:
+		if receipt.Topic != "alerts/door" {
+			t.Errorf("Receipt topic = %q, want alerts/door", receipt.Topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the delivery receipt")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status payloads published on the status topic
+const (
+	StatusOnline  = "online"
+	StatusOffline = "offline"
+)
+
+// StatusConfig holds settings for the birth/will status topic and periodic stats
+type StatusConfig struct {
+	Topic         string        // retained online/offline topic; empty disables birth and will messages
+	StatsTopic    string        // retained JSON stats topic; empty disables stats
+	StatsInterval time.Duration // how often stats are published
+	ClientID      string        // replaces {client_id} in the topics
+	Started       time.Time     // reported uptime is measured from here
+	Role          func() string // with leader election, the role reported in the stats
+}
+
+// statusStats is the JSON payload published on the stats topic
+type statusStats struct {
+	Status        string     `json:"status"`
+	Role          string     `json:"role,omitempty"`
+	UptimeSeconds int64      `json:"uptime_seconds"`
+	Forwarded     uint64     `json:"forwarded"`
+	Failed        uint64     `json:"failed"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	OpenCircuits  []string   `json:"open_circuits,omitempty"`
+}
+
+// StatusPublisher makes mqtt2ntfy visible on the broker: a retained "online" birth message after
+// every connect, "offline" as the Last Will and on shutdown, and optionally periodic JSON stats
+type StatusPublisher struct {
+	topic         string
+	statsTopic    string
+	statsInterval time.Duration
+	started       time.Time
+	role          func() string
+	stats         func() BridgeStats
+	logger        *slog.Logger
+
+	mu      sync.Mutex
+	client  MQTTClient
+	stopped bool
+	ticker  *time.Ticker
+	done    chan struct{}
+}
+
+// NewStatusPublisher creates a StatusPublisher reporting stats from the given source; it starts
+// publishing once Start is called with a connected client
+func NewStatusPublisher(config StatusConfig, stats func() BridgeStats, logger *slog.Logger) *StatusPublisher {
+	return &StatusPublisher{
+		topic:         strings.ReplaceAll(config.Topic, "{client_id}", config.ClientID),
+		statsTopic:    strings.ReplaceAll(config.StatsTopic, "{client_id}", config.ClientID),
+		statsInterval: config.StatsInterval,
+		started:       config.Started,
+		role:          config.Role,
+		stats:         stats,
+		logger:        logger,
+	}
+}
+
+// Will returns the Last Will that marks mqtt2ntfy offline when its connection drops, or nil
+// if no status topic is configured
+func (s *StatusPublisher) Will() *MQTTWill {
+	if s.topic == "" {
+		return nil
+	}
+	return &MQTTWill{Topic: s.topic, Payload: []byte(StatusOffline), QoS: 1, Retained: true}
+}
+
+// Start begins publishing using a connected client
+func (s *StatusPublisher) Start(client MQTTClient) {
+	s.mu.Lock()
+	s.client = client
+	if s.statsTopic != "" && s.statsInterval > 0 {
+		s.ticker = time.NewTicker(s.statsInterval)
+		s.done = make(chan struct{})
+		go s.publishStatsPeriodically(s.ticker, s.done)
+	}
+	s.mu.Unlock()
+	s.ConnectionUp()
+}
+
+// ConnectionUp publishes the birth message and current stats; the broker may have published
+// the Last Will while the connection was down. It is also called when the election role changes,
+// which only the stats report.
+func (s *StatusPublisher) ConnectionUp() {
+	s.mu.Lock()
+	started := s.client != nil && !s.stopped
+	s.mu.Unlock()
+	if !started {
+		return // Start has not been called yet, or already stopped
+	}
+	go func() {
+		s.publish(s.topic, []byte(StatusOnline))
+		s.publishStats(StatusOnline)
+	}()
+}
+
+// Stop stops the stats and marks mqtt2ntfy offline ahead of a clean shutdown, which does not
+// trigger the Last Will
+func (s *StatusPublisher) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	if s.ticker != nil {
+		s.ticker.Stop()
+		close(s.done)
+		s.ticker = nil
+	}
+	s.mu.Unlock()
+
+	s.publish(s.topic, []byte(StatusOffline))
+	s.publishStats(StatusOffline)
+}
+
+func (s *StatusPublisher) publishStatsPeriodically(ticker *time.Ticker, done chan struct{}) {
+	for {
+		select {
+		case <-ticker.C:
+			s.publishStats(StatusOnline)
+		case <-done:
+			return
+		}
+	}
+}
+
+// publishStats publishes the current stats if a stats topic is configured
+func (s *StatusPublisher) publishStats(status string) {
+	if s.statsTopic == "" || s.statsInterval <= 0 {
+		return
+	}
+	bridgeStats := s.stats()
+	payload := statusStats{
+		Status:        status,
+		UptimeSeconds: int64(time.Since(s.started) / time.Second),
+		Forwarded:     bridgeStats.Forwarded,
+		Failed:        bridgeStats.Failed,
+		LastError:     bridgeStats.LastError,
+		OpenCircuits:  bridgeStats.OpenCircuits,
+	}
+	if s.role != nil && status == StatusOnline {
+		payload.Role = s.role()
+	}
+	if !bridgeStats.LastErrorAt.IsZero() {
+		lastErrorAt := bridgeStats.LastErrorAt.UTC()
+		payload.LastErrorAt = &lastErrorAt
+	}
+	data, _ := json.Marshal(payload)
+	s.publish(s.statsTopic, data)
+}
+
+// publish sends a retained message on topic; an empty topic is skipped
+func (s *StatusPublisher) publish(topic string, payload []byte) {
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+	if topic == "" || client == nil {
+		return
+	}
+	if err := client.Publish(topic, 1, true, payload); err != nil {
+		s.logger.Warn("Failed to publish status", "topic", topic, "error", err)
+	}
+}
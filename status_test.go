@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// waitForRetained waits until the broker retains want on topic
+func waitForRetained(t *testing.T, broker *memoryBroker, topic, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if string(broker.retainedMessage(topic)) == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Retained message on %s = %q, want %q", topic, broker.retainedMessage(topic), want)
+}
+
+func TestStatusPublisherBirthAndWill(t *testing.T) {
+	broker := newMemoryBroker()
+	status := NewStatusPublisher(StatusConfig{Topic: "bridges/{client_id}/status", ClientID: "a"}, func() BridgeStats { return BridgeStats{} }, testLogger())
+
+	will := status.Will()
+	if will == nil || will.Topic != "bridges/a/status" || string(will.Payload) != "offline" || !will.Retained {
+		t.Fatalf("Will() = %+v, want retained offline on bridges/a/status", will)
+	}
+
+	client := broker.connect(will)
+	status.Start(client)
+	waitForRetained(t, broker, "bridges/a/status", "online")
+
+	client.drop()
+	waitForRetained(t, broker, "bridges/a/status", "offline")
+
+	// After reconnecting the birth message replaces the Last Will
+	client.reconnect()
+	status.ConnectionUp()
+	waitForRetained(t, broker, "bridges/a/status", "online")
+
+	status.Stop()
+	waitForRetained(t, broker, "bridges/a/status", "offline")
+	status.ConnectionUp()
+	time.Sleep(50 * time.Millisecond)
+	if got := string(broker.retainedMessage("bridges/a/status")); got != "offline" {
+		t.Errorf("Status after Stop and ConnectionUp = %q, want offline", got)
+	}
+}
+
+func TestStatusPublisherStats(t *testing.T) {
+	broker := newMemoryBroker()
+	lastError := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	stats := BridgeStats{Forwarded: 7, Failed: 2, LastError: "ntfy returned status 502", LastErrorAt: lastError}
+	status := NewStatusPublisher(StatusConfig{
+		StatsTopic:    "mqtt2ntfy/stats",
+		StatsInterval: 20 * time.Millisecond,
+		Started:       time.Now().Add(-time.Minute),
+	}, func() BridgeStats { return stats }, testLogger())
+
+	if will := status.Will(); will != nil {
+		t.Errorf("Will() without a status topic = %+v, want nil", will)
+	}
+
+	status.Start(broker.connect(nil))
+	defer status.Stop()
+
+	var got statusStats
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if err := json.Unmarshal(broker.retainedMessage("mqtt2ntfy/stats"), &got); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got.Status != "online" || got.Forwarded != 7 || got.Failed != 2 || got.LastError != stats.LastError {
+		t.Errorf("Stats = %+v, want online with the bridge counters", got)
+	}
+	if got.LastErrorAt == nil || !got.LastErrorAt.Equal(lastError) {
+		t.Errorf("LastErrorAt = %v, want %v", got.LastErrorAt, lastError)
+	}
+	if got.UptimeSeconds < 60 {
+		t.Errorf("UptimeSeconds = %d, want at least 60", got.UptimeSeconds)
+	}
+}
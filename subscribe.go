@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Defaults of the Ntfy to MQTT direction
+const (
+	defaultSubscribeMQTTTopic = "ntfy/{{.Topic}}"
+	// Ntfy sends a keepalive every 45s; a stream silent for longer than this is reconnected
+	defaultSubscribeIdleTimeout = 2 * time.Minute
+	minSubscribeBackoff         = time.Second
+	maxSubscribeBackoff         = time.Minute
+)
+
+// NtfySubscription subscribes to Ntfy topics and publishes their messages to MQTT
+type NtfySubscription struct {
+	URL        string // Ntfy server, e.g. https://ntfy.sh
+	Topic      string // one or more comma-separated Ntfy topics
+	MQTTTopic  string // template over the Ntfy message (see NtfyEvent)
+	QoS        byte
+	Retain     bool
+	Since      string // where to start without a saved position: a duration, Unix time, message ID or "all"
+	Auth       NtfyAuth
+	Connection string // name of the MQTT connection to publish on
+}
+
+// NtfyEvent is a line of Ntfy's JSON message stream; message events are published to MQTT as JSON
+type NtfyEvent struct {
+	ID         string               `json:"id"`
+	Time       int64                `json:"time"`
+	Event      string               `json:"event,omitempty"`
+	Topic      string               `json:"topic"`
+	Title      string               `json:"title,omitempty"`
+	Message    string               `json:"message,omitempty"`
+	Priority   int                  `json:"priority,omitempty"`
+	Tags       []string             `json:"tags,omitempty"`
+	Click      string               `json:"click,omitempty"`
+	Icon       string               `json:"icon,omitempty"`
+	Attachment *NtfyEventAttachment `json:"attachment,omitempty"`
+}
+
+// NtfyEventAttachment describes the file attached to an Ntfy message
+type NtfyEventAttachment struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	URL  string `json:"url"`
+}
+
+// parseSubscribeTopic parses the MQTT topic template of a subscription
+func parseSubscribeTopic(text string) (*template.Template, error) {
+	return parseTemplate("mqtt_topic", text, nil, NtfyEvent{})
+}
+
+// SubscribeState saves the ID of the last message of each subscription in a file, so a restart
+// resumes where the previous run stopped
+type SubscribeState struct {
+	path string
+
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+// LoadSubscribeState reads the state file at path; a missing file is an empty state
+func LoadSubscribeState(path string) (*SubscribeState, error) {
+	state := &SubscribeState{path: path, ids: map[string]string{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subscribe state: %w", err)
+	}
+	if err := json.Unmarshal(data, &state.ids); err != nil {
+		return nil, fmt.Errorf("failed to parse subscribe state %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// LastID returns the ID of the last message handled for key
+func (s *SubscribeState) LastID(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[key]
+}
+
+// SetLastID records the last message handled for key and writes the file
+func (s *SubscribeState) SetLastID(key, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ids[key] = id
+	data, err := json.Marshal(s.ids)
+	if err != nil {
+		return err
+	}
+	// Write a new file and rename it, so a crash never leaves a truncated state
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write subscribe state: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write subscribe state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write subscribe state: %w", err)
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// NtfySubscriber streams the messages of an Ntfy subscription and publishes them to MQTT. It
+// reconnects with backoff and resumes after the last message it handled, so none are missed.
+type NtfySubscriber struct {
+	subscription NtfySubscription
+	topic        *template.Template
+	client       *http.Client
+	state        *SubscribeState
+	active       func() bool
+	subscribed   func(topic string) bool
+	logger       *slog.Logger
+
+	idleTimeout time.Duration
+	minBackoff  time.Duration
+
+	mu     sync.Mutex
+	lastID string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewNtfySubscriber creates a subscriber; ntfyConfig supplies the TLS and proxy settings and state,
+// if not nil, the saved positions
+func NewNtfySubscriber(subscription NtfySubscription, ntfyConfig NtfyConfig, state *SubscribeState, logger *slog.Logger) (*NtfySubscriber, error) {
+	if subscription.MQTTTopic == "" {
+		subscription.MQTTTopic = defaultSubscribeMQTTTopic
+	}
+	topic, err := parseSubscribeTopic(subscription.MQTTTopic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT topic template: %w", err)
+	}
+	subscriber := &NtfySubscriber{
+		subscription: subscription,
+		topic:        topic,
+		// No client timeout: the stream stays open; idleTimeout detects dead connections
+		client:      &http.Client{Transport: newNtfyTransport(ntfyConfig, logger)},
+		state:       state,
+		logger:      logger.With("ntfy_topic", subscription.Topic),
+		idleTimeout: defaultSubscribeIdleTimeout,
+		minBackoff:  minSubscribeBackoff,
+	}
+	if state != nil {
+		subscriber.lastID = state.LastID(subscriber.key())
+	}
+	return subscriber, nil
+}
+
+// SetActiveCheck makes the subscriber skip publishing while active returns false, e.g. while this
+// instance is on standby during leader election. Skipped messages still advance the position.
+func (s *NtfySubscriber) SetActiveCheck(active func() bool) {
+	s.active = active
+}
+
+// SetSubscribedCheck makes the subscriber drop messages whose MQTT topic subscribed reports as
+// subscribed to by a route, which would forward them back to Ntfy
+func (s *NtfySubscriber) SetSubscribedCheck(subscribed func(topic string) bool) {
+	s.subscribed = subscribed
+}
+
+// key identifies the subscription in the state file
+func (s *NtfySubscriber) key() string {
+	return strings.TrimSuffix(s.subscription.URL, "/") + "/" + s.subscription.Topic
+}
+
+// streamURL returns the URL of the JSON stream, resuming after the last handled message
+func (s *NtfySubscriber) streamURL() string {
+	s.mu.Lock()
+	since := s.lastID
+	s.mu.Unlock()
+	if since == "" {
+		since = s.subscription.Since
+	}
+	streamURL := strings.TrimSuffix(s.subscription.URL, "/") + "/" + s.subscription.Topic + "/json"
+	if since != "" {
+		streamURL += "?since=" + url.QueryEscape(since)
+	}
+	return streamURL
+}
+
+// Start streams messages in the background and publishes them on client
+func (s *NtfySubscriber) Start(client MQTTClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	done := s.done
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		backoff := s.minBackoff
+		for {
+			connected, err := s.stream(ctx, client)
+			if ctx.Err() != nil {
+				return
+			}
+			if connected {
+				backoff = s.minBackoff
+			}
+			s.logger.Warn("Ntfy subscription interrupted; reconnecting", "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxSubscribeBackoff)
+		}
+	}()
+}
+
+// Stop closes the stream and waits for the subscriber to finish
+func (s *NtfySubscriber) Stop() {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// stream reads the JSON stream until it fails and reports whether it connected
+func (s *NtfySubscriber) stream(ctx context.Context, client MQTTClient) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.streamURL(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	s.subscription.Auth.apply(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to connect: %w", err)
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			s.logger.Debug("Failed to close Ntfy stream", "error", err)
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return false, &NtfyStatusError{StatusCode: resp.StatusCode}
+	}
+	s.logger.Info("Subscribed to Ntfy topic", "url", req.URL.Redacted())
+
+	// Ntfy sends keepalives; a stream that goes silent is dead
+	idle := time.AfterFunc(s.idleTimeout, cancel)
+	defer idle.Stop()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(s.idleTimeout)
+		var event NtfyEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			s.logger.Warn("Ignoring invalid line of the Ntfy stream", "error", err)
+			continue
+		}
+		if event.Event != "message" {
+			continue
+		}
+		if err := s.publish(client, event); err != nil {
+			// Reconnect after the last published message, so this one is received again
+			return true, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return true, fmt.Errorf("stream failed: %w", err)
+	}
+	return true, errors.New("stream closed by the server")
+}
+
+// publish publishes a message event to MQTT and records it as handled
+func (s *NtfySubscriber) publish(client MQTTClient, event NtfyEvent) error {
+	if s.active == nil || s.active() {
+		topic, err := renderTemplate(s.topic, event)
+		if err != nil {
+			return fmt.Errorf("failed to render MQTT topic: %w", err)
+		}
+		if topic == "" || strings.ContainsAny(topic, "+#") {
+			s.logger.Error("Dropping Ntfy message with an invalid MQTT topic", "id", event.ID, "mqtt_topic", topic)
+		} else if s.subscribed != nil && s.subscribed(topic) {
+			s.logger.Error("Dropping Ntfy message whose MQTT topic a route subscribes to; it would loop back to Ntfy", "id", event.ID, "mqtt_topic", topic)
+		} else {
+			event.Event = ""
+			if event.Priority == 0 {
+				event.Priority = 3 // Ntfy leaves out the default priority
+			}
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if err := client.Publish(topic, s.subscription.QoS, s.subscription.Retain, payload); err != nil {
+				return fmt.Errorf("failed to publish to MQTT: %w", err)
+			}
+			s.logger.Info("Published Ntfy message to MQTT", "id", event.ID, "mqtt_topic", topic)
+		}
+	}
+
+	s.mu.Lock()
+	s.lastID = event.ID
+	s.mu.Unlock()
+	if s.state != nil {
+		if err := s.state.SetLastID(s.key(), event.ID); err != nil {
+			s.logger.Warn("Failed to save Ntfy subscription position", "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ntfyStreamServer starts an Ntfy stand-in whose JSON stream sends the lines of the next entry
+// of streams on each connection, then closes it; the last entry is held open. It records the
+// since parameter and Authorization header of every connection.
+func ntfyStreamServer(t *testing.T, streams ...[]string) (*httptest.Server, chan *http.Request) {
+	t.Helper()
+	connections := make(chan *http.Request, 10)
+	var mu sync.Mutex
+	next := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alerts/json" {
+			http.NotFound(w, r)
+			return
+		}
+		connections <- r
+		mu.Lock()
+		n := next
+		next++
+		mu.Unlock()
+
+		for _, line := range streams[min(n, len(streams)-1)] {
+			_, _ = fmt.Fprintln(w, line)
+		}
+		w.(http.Flusher).Flush()
+		if n >= len(streams)-1 {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, connections
+}
+
+// failingClient is an MQTTClient whose Publish fails the first failures times
+type failingClient struct {
+	memoryClient
+	mu       sync.Mutex
+	failures int
+}
+
+func (c *failingClient) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("not connected")
+	}
+	return c.memoryClient.Publish(topic, qos, retained, payload)
+}
+
+// testNtfySubscriber returns a subscriber for the alerts topic of server that reconnects quickly
+func testNtfySubscriber(t *testing.T, subscription NtfySubscription, state *SubscribeState) *NtfySubscriber {
+	t.Helper()
+	subscriber, err := NewNtfySubscriber(subscription, NtfyConfig{}, state, testLogger())
+	if err != nil {
+		t.Fatalf("NewNtfySubscriber failed: %v", err)
+	}
+	subscriber.minBackoff = 10 * time.Millisecond
+	t.Cleanup(subscriber.Stop)
+	return subscriber
+}
+
+// collectMQTT subscribes to all topics of broker and returns the received messages
+func collectMQTT(t *testing.T, broker *memoryBroker) chan MQTTMessage {
+	t.Helper()
+	messages := make(chan MQTTMessage, 10)
+	if err := broker.connect(nil).Subscribe(Subscription{Topic: "#", Callback: func(msg MQTTMessage) { messages <- msg }}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return messages
+}
+
+func receiveMQTT(t *testing.T, messages chan MQTTMessage) MQTTMessage {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message was published to MQTT")
+		return MQTTMessage{}
+	}
+}
+
+func TestNtfySubscriberStream(t *testing.T) {
+	server, connections := ntfyStreamServer(t,
+		[]string{
+			`{"id":"a1","time":1700000000,"event":"open","topic":"alerts"}`,
+			`{"id":"m1","time":1700000001,"event":"message","topic":"alerts","title":"Door","message":"Front door opened","priority":4,"tags":["door"]}`,
+			`{"id":"k1","time":1700000002,"event":"keepalive","topic":"alerts"}`,
+		},
+		[]string{
+			`{"id":"m2","time":1700000003,"event":"message","topic":"alerts","message":"Back door opened"}`,
+		},
+	)
+	broker := newMemoryBroker()
+	messages := collectMQTT(t, broker)
+
+	subscriber := testNtfySubscriber(t, NtfySubscription{
+		URL:       server.URL,
+		Topic:     "alerts",
+		MQTTTopic: "phone/{{.Topic}}",
+		Since:     "10m",
+		Auth:      NtfyAuth{Token: "tk_test"},
+	}, nil)
+	subscriber.Start(broker.connect(nil))
+
+	first := <-connections
+	if got := first.URL.Query().Get("since"); got != "10m" {
+		t.Errorf("First connection since = %q, want the configured 10m", got)
+	}
+	if got := first.Header.Get("Authorization"); got != "Bearer tk_test" {
+		t.Errorf("Authorization = %q, want the token", got)
+	}
+
+	msg := receiveMQTT(t, messages)
+	var event NtfyEvent
+	if err := json.Unmarshal(msg.Payload, &event); err != nil {
+		t.Fatalf("Payload %s is not JSON: %v", msg.Payload, err)
+	}
+	want := NtfyEvent{ID: "m1", Time: 1700000001, Topic: "alerts", Title: "Door", Message: "Front door opened", Priority: 4, Tags: []string{"door"}}
+	if msg.Topic != "phone/alerts" || event.ID != want.ID || event.Event != "" || event.Title != want.Title ||
+		event.Message != want.Message || event.Priority != want.Priority || !slices.Equal(event.Tags, want.Tags) {
+		t.Errorf("Published %s %s, want %+v on phone/alerts", msg.Topic, msg.Payload, want)
+	}
+
+	// The server closed the stream; the subscriber resumes after the last message
+	if got := (<-connections).URL.Query().Get("since"); got != "m1" {
+		t.Errorf("Reconnection since = %q, want m1", got)
+	}
+	msg = receiveMQTT(t, messages)
+	if err := json.Unmarshal(msg.Payload, &event); err != nil || event.ID != "m2" || event.Priority != 3 {
+		t.Errorf("Published %s, want m2 with the default priority", msg.Payload)
+	}
+}
+
+func TestNtfySubscriberPublishFailure(t *testing.T) {
+	server, connections := ntfyStreamServer(t,
+		[]string{`{"id":"m1","time":1700000001,"event":"message","topic":"alerts","message":"Front door opened"}`},
+	)
+	broker := newMemoryBroker()
+	messages := collectMQTT(t, broker)
+	client := &failingClient{memoryClient: *broker.connect(nil), failures: 1}
+
+	subscriber := testNtfySubscriber(t, NtfySubscription{URL: server.URL, Topic: "alerts", MQTTTopic: "phone/alerts"}, nil)
+	subscriber.Start(client)
+
+	if got := (<-connections).URL.Query().Has("since"); got {
+		t.Error("First connection has a since parameter, want only new messages")
+	}
+	// The message that failed to publish is received again
+	if got := (<-connections).URL.Query().Has("since"); got {
+		t.Error("Reconnection after a failed publish skipped the message")
+	}
+	if msg := receiveMQTT(t, messages); msg.Topic != "phone/alerts" {
+		t.Errorf("Published on %s, want phone/alerts", msg.Topic)
+	}
+}
+
+func TestNtfySubscriberStandby(t *testing.T) {
+	server, _ := ntfyStreamServer(t,
+		[]string{`{"id":"m1","time":1700000001,"event":"message","topic":"alerts","message":"Front door opened"}`},
+		[]string{`{"id":"m2","time":1700000002,"event":"message","topic":"alerts","message":"Back door opened"}`},
+	)
+	broker := newMemoryBroker()
+	messages := collectMQTT(t, broker)
+	state, err := LoadSubscribeState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatalf("LoadSubscribeState failed: %v", err)
+	}
+
+	var mu sync.Mutex
+	active := false
+	subscriber := testNtfySubscriber(t, NtfySubscription{URL: server.URL, Topic: "alerts"}, state)
+	subscriber.SetActiveCheck(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		// Become active after skipping the first message
+		wasActive := active
+		active = true
+		return wasActive
+	})
+	subscriber.Start(broker.connect(nil))
+
+	msg := receiveMQTT(t, messages)
+	if msg.Topic != "ntfy/alerts" {
+		t.Errorf("Published on %s, want the default ntfy/alerts", msg.Topic)
+	}
+	var event NtfyEvent
+	if err := json.Unmarshal(msg.Payload, &event); err != nil || event.ID != "m2" {
+		t.Errorf("Published %s, want only m2 after the standby skipped m1", msg.Payload)
+	}
+	if got := state.LastID(server.URL + "/alerts"); got != "m2" {
+		t.Errorf("Saved position = %q, want m2", got)
+	}
+}
+
+func TestNtfySubscriberDropsSubscribedTopics(t *testing.T) {
+	server, _ := ntfyStreamServer(t, []string{
+		`{"id":"m1","time":1700000001,"event":"message","topic":"alerts","message":"Front door opened"}`,
+		`{"id":"m2","time":1700000002,"event":"message","topic":"doors","message":"Back door opened"}`,
+	})
+	broker := newMemoryBroker()
+	messages := collectMQTT(t, broker)
+
+	bridge := testBridge()
+	bridge.Subscription(Route{Topic: "ntfy/alerts", Connection: DefaultConnectionName})
+	subscriber := testNtfySubscriber(t, NtfySubscription{URL: server.URL, Topic: "alerts"}, nil)
+	subscriber.SetSubscribedCheck(func(topic string) bool {
+		_, ok := bridge.subscribedFilter(DefaultConnectionName, topic)
+		return ok
+	})
+	subscriber.Start(broker.connect(nil))
+
+	// m1 would be forwarded back to Ntfy by the route
+	if msg := receiveMQTT(t, messages); msg.Topic != "ntfy/doors" {
+		t.Errorf("Published on %s, want only ntfy/doors", msg.Topic)
+	}
+}
+
+func TestNtfySubscriberIdleTimeout(t *testing.T) {
+	server, connections := ntfyStreamServer(t, []string{`{"id":"a1","time":1700000000,"event":"open","topic":"alerts"}`})
+	subscriber := testNtfySubscriber(t, NtfySubscription{URL: server.URL, Topic: "alerts"}, nil)
+	subscriber.idleTimeout = 50 * time.Millisecond
+	subscriber.Start(newMemoryBroker().connect(nil))
+
+	for i := range 2 {
+		select {
+		case <-connections:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection %d was not made; a silent stream must be reconnected", i+1)
+		}
+	}
+}
+
+func TestSubscribeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := LoadSubscribeState(path)
+	if err != nil {
+		t.Fatalf("LoadSubscribeState of a missing file failed: %v", err)
+	}
+	if err := state.SetLastID("https://ntfy.sh/alerts", "m1"); err != nil {
+		t.Fatalf("SetLastID failed: %v", err)
+	}
+
+	loaded, err := LoadSubscribeState(path)
+	if err != nil {
+		t.Fatalf("LoadSubscribeState failed: %v", err)
+	}
+	if got := loaded.LastID("https://ntfy.sh/alerts"); got != "m1" {
+		t.Errorf("LastID() = %q after reloading, want m1", got)
+	}
+
+	subscriber, err := NewNtfySubscriber(NtfySubscription{URL: "https://ntfy.sh/", Topic: "alerts", Since: "all"}, NtfyConfig{}, loaded, testLogger())
+	if err != nil {
+		t.Fatalf("NewNtfySubscriber failed: %v", err)
+	}
+	if got := subscriber.streamURL(); got != "https://ntfy.sh/alerts/json?since=m1" {
+		t.Errorf("streamURL() = %s, want to resume after the saved message", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// emptyFunc is the name of the function every action of a template pipes its value into, so that
+// missing JSON fields render as empty strings instead of "<no value>"
+const emptyFunc = "mqtt2ntfyValue"
+
+// parseTemplate parses a template over data, which has the type of the template's data, and
+// checks that it only uses fields of that type. Maps, such as messageData.JSON, accept any key.
+func parseTemplate(name, text string, funcs template.FuncMap, data any) (*template.Template, error) {
+	tmpl := template.New(name).Option("missingkey=zero").Funcs(template.FuncMap{
+		emptyFunc: func(value any) string {
+			if value == nil {
+				return ""
+			}
+			return fmt.Sprint(value)
+		},
+	})
+	tmpl, err := tmpl.Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		checker := templateChecker{tree: t.Tree, name: t.Name(), root: reflect.TypeOf(data)}
+		dot := checker.root
+		if t != tmpl {
+			dot = nil // templates defined inside the template can be called with any data
+		}
+		if err := checker.check(t.Tree.Root, dot); err != nil {
+			return nil, err
+		}
+	}
+	return tmpl, nil
+}
+
+// renderTemplate executes a template parsed by parseTemplate
+func renderTemplate(tmpl *template.Template, data any) (string, error) {
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// templateChecker walks a parsed template, checking the fields it uses and piping the value of
+// every action into emptyFunc
+type templateChecker struct {
+	tree *parse.Tree
+	name string
+	root reflect.Type
+}
+
+// check checks node with dot of type dot; a nil dot is unknown, e.g. inside range and with
+func (c templateChecker) check(node parse.Node, dot reflect.Type) error {
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return nil
+		}
+		for _, child := range node.Nodes {
+			if err := c.check(child, dot); err != nil {
+				return err
+			}
+		}
+	case *parse.ActionNode:
+		if len(node.Pipe.Decl) == 0 {
+			node.Pipe.Cmds = append(node.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      node.Pos,
+				Args:     []parse.Node{parse.NewIdentifier(emptyFunc).SetTree(c.tree).SetPos(node.Pos)},
+			})
+		}
+		return c.checkPipe(node.Pipe, dot)
+	case *parse.IfNode:
+		return c.checkBranch(&node.BranchNode, dot, dot)
+	case *parse.WithNode:
+		return c.checkBranch(&node.BranchNode, nil, dot)
+	case *parse.RangeNode:
+		return c.checkBranch(&node.BranchNode, nil, dot)
+	case *parse.TemplateNode:
+		return c.checkPipe(node.Pipe, dot)
+	}
+	return nil
+}
+
+// checkBranch checks an if, with or range node whose list runs with dot of type inner
+func (c templateChecker) checkBranch(node *parse.BranchNode, inner, dot reflect.Type) error {
+	if err := c.checkPipe(node.Pipe, dot); err != nil {
+		return err
+	}
+	if err := c.check(node.List, inner); err != nil {
+		return err
+	}
+	return c.check(node.ElseList, dot)
+}
+
+func (c templateChecker) checkPipe(pipe *parse.PipeNode, dot reflect.Type) error {
+	if pipe == nil {
+		return nil
+	}
+	for _, cmd := range pipe.Cmds {
+		for _, arg := range cmd.Args {
+			var err error
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				err = c.checkFields(arg, arg.Ident, dot)
+			case *parse.VariableNode:
+				if arg.Ident[0] == "$" {
+					err = c.checkFields(arg, arg.Ident[1:], c.root)
+				}
+			case *parse.ChainNode:
+				if pipe, ok := arg.Node.(*parse.PipeNode); ok {
+					err = c.checkPipe(pipe, dot)
+				}
+			case *parse.PipeNode:
+				err = c.checkPipe(arg, dot)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkFields checks a chain of field names starting at a value of type typ
+func (c templateChecker) checkFields(node parse.Node, fields []string, typ reflect.Type) error {
+	for _, field := range fields {
+		if typ == nil {
+			return nil
+		}
+		if _, ok := typ.MethodByName(field); ok {
+			return nil
+		}
+		if typ.Kind() == reflect.Pointer {
+			typ = typ.Elem()
+		}
+		switch typ.Kind() {
+		case reflect.Map, reflect.Interface:
+			return nil
+		case reflect.Struct:
+			if f, ok := typ.FieldByName(field); ok && f.IsExported() {
+				typ = f.Type
+				continue
+			}
+		}
+		location, context := c.tree.ErrorContext(node)
+		return fmt.Errorf("template: %s: executing %q at <%s>: can't evaluate field %s in type %s", location, c.name, context, field, typ)
+	}
+	return nil
+}
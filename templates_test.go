@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseTemplate(t *testing.T) {
+	tests := []struct {
+		text string
+		want error
+	}{
+		{text: "{{.Topic}}: {{.JSON.after.camera}}"},
+		{text: "{{with .JSON.after}}{{.camera}}{{else}}{{.Topic}}{{end}}"},
+		{text: "{{range .JSON.zones}}{{.name}} on {{$.Topic}}{{end}}"},
+		{text: "{{if .JSON.label}}{{.JSON.label}}{{end}}"},
+		{text: "{{$label := .JSON.label}}{{$label}}"},
+		{text: "{{.Camera}}", want: fmt.Errorf("template: test:1:2: executing \"test\" at <.Camera>: can't evaluate field Camera in type main.messageData")},
+		{text: "{{.Topic.Name}}", want: fmt.Errorf("template: test:1:8: executing \"test\" at <.Topic.Name>: can't evaluate field Name in type string")},
+		{text: "{{if .Label}}{{end}}", want: fmt.Errorf("template: test:1:5: executing \"test\" at <.Label>: can't evaluate field Label in type main.messageData")},
+		{text: "{{range .JSON.zones}}{{$.Zone}}{{end}}", want: fmt.Errorf("template: test:1:24: executing \"test\" at <$.Zone>: can't evaluate field Zone in type main.messageData")},
+	}
+
+	for _, tt := range tests {
+		_, err := parseTemplate("test", tt.text, nil, messageData{})
+		if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+			t.Errorf("parseTemplate(%q) = %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	data := messageData{Topic: "frigate/events", JSON: map[string]any{"label": "person", "after": map[string]any{"camera": "door"}}}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "{{.JSON.label}} on {{.JSON.after.camera}}", want: "person on door"},
+		{text: "[{{.JSON.zone}}]", want: "[]"},
+		{text: "{{.JSON.after.zone}}", want: ""},
+		{text: "<no value> {{.JSON.label}}", want: "<no value> person"},
+		{text: "{{$zone := .JSON.zone}}{{if $zone}}{{$zone}}{{else}}none{{end}}", want: "none"},
+	}
+
+	for _, tt := range tests {
+		tmpl, err := parseTemplate("test", tt.text, nil, messageData{})
+		if err != nil {
+			t.Fatalf("parseTemplate(%q) failed: %v", tt.text, err)
+		}
+		if got, err := renderTemplate(tmpl, data); err != nil || got != tt.want {
+			t.Errorf("renderTemplate(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+		}
+	}
+}
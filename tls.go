@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps supported min_version config values to crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// IsEnabled reports whether any TLS setting has been configured
+func (t TLSConfig) IsEnabled() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" || t.MinVersion != "" || t.InsecureSkipVerify
+}
+
+// validate checks the TLS settings for consistency; prefix names the config section in errors
+func (t TLSConfig) validate(prefix string) error {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("%s.cert_file and %s.key_file must be set together", prefix, prefix)
+	}
+	if t.MinVersion != "" {
+		if _, ok := tlsVersions[t.MinVersion]; !ok {
+			return fmt.Errorf("%s.min_version must be one of 1.0, 1.1, 1.2, 1.3 (got %q)", prefix, t.MinVersion)
+		}
+	}
+	return nil
+}
+
+// TLSReloader builds tls.Config values from a TLSConfig, reloading the CA
+// bundle and client certificate from disk whenever the files change
+type TLSReloader struct {
+	config TLSConfig
+
+	mu          sync.Mutex
+	caModTime   time.Time
+	certModTime time.Time
+	keyModTime  time.Time
+	rootCAs     *x509.CertPool
+	certificate *tls.Certificate
+}
+
+// NewTLSReloader creates a TLSReloader and performs the initial load of all configured files
+func NewTLSReloader(config TLSConfig) (*TLSReloader, error) {
+	if err := config.validate("tls"); err != nil {
+		return nil, err
+	}
+	r := &TLSReloader{config: config}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns a tls.Config reflecting the current contents of the configured files.
+// If reloading a changed file fails, the previously loaded material is kept and the error is returned
+// alongside a usable config.
+func (r *TLSReloader) Config() (*tls.Config, error) {
+	_, err := r.reload()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tlsConfig := &tls.Config{
+		ServerName:         r.config.ServerName,
+		InsecureSkipVerify: r.config.InsecureSkipVerify, // #nosec G402 -- explicitly requested by the user
+		RootCAs:            r.rootCAs,
+	}
+	if r.config.MinVersion != "" {
+		tlsConfig.MinVersion = tlsVersions[r.config.MinVersion]
+	}
+	if r.certificate != nil {
+		tlsConfig.GetClientCertificate = r.getClientCertificate
+	}
+	return tlsConfig, err
+}
+
+// getClientCertificate returns the current client certificate, picking up
+// renewed certificates between handshakes
+func (r *TLSReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	_, _ = r.reload() // on failure keep presenting the last good certificate
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.certificate, nil
+}
+
+// reload re-reads any configured file whose modification time has changed.
+// It reports whether anything was reloaded.
+func (r *TLSReloader) reload() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reloaded := false
+
+	if r.config.CAFile != "" {
+		modTime, err := fileModTime(r.config.CAFile)
+		if err != nil {
+			return false, fmt.Errorf("failed to read CA file %s: %w", r.config.CAFile, err)
+		}
+		if !modTime.Equal(r.caModTime) {
+			pool, err := loadCertPool(r.config.CAFile)
+			if err != nil {
+				return false, err
+			}
+			r.rootCAs = pool
+			r.caModTime = modTime
+			reloaded = true
+		}
+	}
+
+	if r.config.CertFile != "" && r.config.KeyFile != "" {
+		certModTime, err := fileModTime(r.config.CertFile)
+		if err != nil {
+			return reloaded, fmt.Errorf("failed to read certificate file %s: %w", r.config.CertFile, err)
+		}
+		keyModTime, err := fileModTime(r.config.KeyFile)
+		if err != nil {
+			return reloaded, fmt.Errorf("failed to read key file %s: %w", r.config.KeyFile, err)
+		}
+		if !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime) {
+			cert, err := tls.LoadX509KeyPair(r.config.CertFile, r.config.KeyFile)
+			if err != nil {
+				return reloaded, fmt.Errorf("failed to load client certificate %s / key %s: %w", r.config.CertFile, r.config.KeyFile, err)
+			}
+			r.certificate = &cert
+			r.certModTime = certModTime
+			r.keyModTime = keyModTime
+			reloaded = true
+		}
+	}
+
+	return reloaded, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file %s: %w", path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA file %s contains no valid PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// fileModTime returns the modification time of a file
+func fileModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
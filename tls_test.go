@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificateFiles holds the paths of a generated test PKI
+type testCertificateFiles struct {
+	caFile         string
+	serverCertFile string
+	serverKeyFile  string
+	clientCertFile string
+	clientKeyFile  string
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+}
+
+// writeTestCertificates generates a CA plus server and client certificates signed by it
+func writeTestCertificates(t *testing.T) testCertificateFiles {
+	t.Helper()
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate CA key: %v", err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqtt2ntfy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+
+	files := testCertificateFiles{
+		caFile:         filepath.Join(dir, "ca.pem"),
+		serverCertFile: filepath.Join(dir, "server.pem"),
+		serverKeyFile:  filepath.Join(dir, "server.key"),
+		clientCertFile: filepath.Join(dir, "client.pem"),
+		clientKeyFile:  filepath.Join(dir, "client.key"),
+		caCert:         caCert,
+		caKey:          caKey,
+	}
+	writePEM(t, files.caFile, "CERTIFICATE", caDER)
+	files.writeLeaf(t, files.serverCertFile, files.serverKeyFile, "localhost", 2, x509.ExtKeyUsageServerAuth)
+	files.writeLeaf(t, files.clientCertFile, files.clientKeyFile, "mqtt2ntfy", 3, x509.ExtKeyUsageClientAuth)
+	return files
+}
+
+// writeLeaf writes a certificate and key signed by the test CA
+func (f testCertificateFiles) writeLeaf(t *testing.T, certFile, keyFile, commonName string, serial int64, usage x509.ExtKeyUsage) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, &key.PublicKey, f.caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    TLSConfig
+		expectErr bool
+	}{
+		{name: "empty", config: TLSConfig{}, expectErr: false},
+		{name: "CA only", config: TLSConfig{CAFile: "ca.pem"}, expectErr: false},
+		{name: "cert and key", config: TLSConfig{CertFile: "c.pem", KeyFile: "c.key"}, expectErr: false},
+		{name: "key without cert", config: TLSConfig{KeyFile: "c.key"}, expectErr: true},
+		{name: "valid min version", config: TLSConfig{MinVersion: "1.2"}, expectErr: false},
+		{name: "invalid min version", config: TLSConfig{MinVersion: "TLS1.2"}, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate("mqtt.tls")
+			if tt.expectErr && err == nil {
+				t.Error("validate() expected error, got nil")
+			}
+			if !tt.expectErr && err != nil {
+				t.Errorf("validate() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigIsEnabled(t *testing.T) {
+	if (TLSConfig{}).IsEnabled() {
+		t.Error("IsEnabled() = true for empty TLSConfig")
+	}
+	if !(TLSConfig{InsecureSkipVerify: true}).IsEnabled() {
+		t.Error("IsEnabled() = false with insecure_skip_verify set")
+	}
+	if !(TLSConfig{ServerName: "mqtt.example.com"}).IsEnabled() {
+		t.Error("IsEnabled() = false with server_name set")
+	}
+}
+
+func TestNewTLSReloaderInvalidCA(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	if _, err := NewTLSReloader(TLSConfig{CAFile: caFile}); err == nil {
+		t.Error("Expected error for CA file without certificates, got nil")
+	}
+}
+
+func TestTLSReloaderConfig(t *testing.T) {
+	files := writeTestCertificates(t)
+
+	reloader, err := NewTLSReloader(TLSConfig{
+		CAFile:     files.caFile,
+		CertFile:   files.clientCertFile,
+		KeyFile:    files.clientKeyFile,
+		ServerName: "mqtt.example.com",
+		MinVersion: "1.3",
+	})
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %v", err)
+	}
+
+	tlsConfig, err := reloader.Config()
+	if err != nil {
+		t.Fatalf("Config() failed: %v", err)
+	}
+	if tlsConfig.ServerName != "mqtt.example.com" {
+		t.Errorf("ServerName = %s, want mqtt.example.com", tlsConfig.ServerName)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want %x", tlsConfig.MinVersion, tls.VersionTLS13)
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Error("RootCAs is nil, want CA pool")
+	}
+	if tlsConfig.GetClientCertificate == nil {
+		t.Error("GetClientCertificate is nil, want client certificate callback")
+	}
+}
+
+func TestTLSReloaderMutualTLSHandshake(t *testing.T) {
+	files := writeTestCertificates(t)
+
+	serverCert, err := tls.LoadX509KeyPair(files.serverCertFile, files.serverKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(files.caCert)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_ = conn.(*tls.Conn).Handshake()
+	}()
+
+	reloader, err := NewTLSReloader(TLSConfig{
+		CAFile:     files.caFile,
+		CertFile:   files.clientCertFile,
+		KeyFile:    files.clientKeyFile,
+		ServerName: "localhost",
+	})
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %v", err)
+	}
+	tlsConfig, err := reloader.Config()
+	if err != nil {
+		t.Fatalf("Config() failed: %v", err)
+	}
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatalf("TLS handshake failed: %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Logf("Failed to close connection: %v", err)
+	}
+}
+
+func TestTLSReloaderReloadsChangedCertificate(t *testing.T) {
+	files := writeTestCertificates(t)
+
+	reloader, err := NewTLSReloader(TLSConfig{
+		CertFile: files.clientCertFile,
+		KeyFile:  files.clientKeyFile,
+	})
+	if err != nil {
+		t.Fatalf("NewTLSReloader failed: %v", err)
+	}
+
+	before, err := reloader.getClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("getClientCertificate failed: %v", err)
+	}
+
+	// Replace the certificate and bump its modification time so the change is detected
+	files.writeLeaf(t, files.clientCertFile, files.clientKeyFile, "mqtt2ntfy", 42, x509.ExtKeyUsageClientAuth)
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{files.clientCertFile, files.clientKeyFile} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatalf("Failed to update modification time: %v", err)
+		}
+	}
+
+	after, err := reloader.getClientCertificate(nil)
+	if err != nil {
+		t.Fatalf("getClientCertificate failed: %v", err)
+	}
+	if bytes.Equal(before.Certificate[0], after.Certificate[0]) {
+		t.Error("Client certificate was not reloaded after the file changed")
+	}
+}
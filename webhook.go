@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"text/template"
+)
+
+// defaultWebhookMethod is the method of webhooks that do not set one
+const defaultWebhookMethod = http.MethodPost
+
+// webhookData is the data available to webhook templates: the received MQTT message (Topic,
+// Subscription, Payload and JSON) and the notification built from it
+type webhookData struct {
+	messageData
+	Message  string
+	Title    string
+	Priority int // 1 (min) to 5 (max)
+	Tags     []string
+	Click    string
+	Icon     string
+	Attach   string
+	Token    string // the backend's token, e.g. for an Authorization header
+}
+
+// webhookPayload is the body of webhooks that do not set one
+type webhookPayload struct {
+	Topic    string   `json:"topic"`
+	Title    string   `json:"title,omitempty"`
+	Message  string   `json:"message"`
+	Priority int      `json:"priority"`
+	Tags     []string `json:"tags,omitempty"`
+	Click    string   `json:"click,omitempty"`
+	Icon     string   `json:"icon,omitempty"`
+	Attach   string   `json:"attach,omitempty"`
+}
+
+// webhookFuncs are the functions available to webhook templates
+var webhookFuncs = template.FuncMap{
+	// json encodes a value as JSON, e.g. a message as a quoted and escaped string
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+}
+
+// parseWebhookTemplate parses a webhook template and checks that it only uses known fields
+func parseWebhookTemplate(name, text string) (*template.Template, error) {
+	return parseTemplate(name, text, webhookFuncs, webhookData{})
+}
+
+// WebhookConfig holds the templates of a webhook request
+type WebhookConfig struct {
+	Method       string
+	URL          string
+	Headers      map[string]string
+	Body         string // empty sends the notification as JSON (see webhookPayload)
+	SuccessCodes []int  // empty accepts every 2xx status
+}
+
+// WebhookClient implements NtfyClient for arbitrary HTTP endpoints: the method, URL, headers and
+// body of each request are rendered from templates over the message. The URL passed to
+// SendMessage is ignored in favor of the URL template, and the token of the auth is available
+// to the templates.
+type WebhookClient struct {
+	sender  *backendSender
+	method  *template.Template
+	url     *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+}
+
+// NewWebhookClient creates a webhook client with the timeout, retry and connection settings of config
+func NewWebhookClient(webhook WebhookConfig, config NtfyConfig, logger *slog.Logger) (*WebhookClient, error) {
+	client := &WebhookClient{
+		sender:  newBackendSender(BackendWebhook, config, logger),
+		headers: map[string]*template.Template{},
+	}
+	if webhook.Method == "" {
+		webhook.Method = defaultWebhookMethod
+	}
+	var err error
+	if client.method, err = parseWebhookTemplate("method", webhook.Method); err != nil {
+		return nil, fmt.Errorf("invalid method template: %w", err)
+	}
+	if client.url, err = parseWebhookTemplate("url", webhook.URL); err != nil {
+		return nil, fmt.Errorf("invalid URL template: %w", err)
+	}
+	for name, text := range webhook.Headers {
+		if client.headers[name], err = parseWebhookTemplate("header", text); err != nil {
+			return nil, fmt.Errorf("invalid template for header %s: %w", name, err)
+		}
+	}
+	if webhook.Body != "" {
+		if client.body, err = parseWebhookTemplate("body", webhook.Body); err != nil {
+			return nil, fmt.Errorf("invalid body template: %w", err)
+		}
+	}
+	if len(webhook.SuccessCodes) > 0 {
+		codes := slices.Clone(webhook.SuccessCodes)
+		client.sender.successful = func(status int) bool { return slices.Contains(codes, status) }
+	} else {
+		client.sender.successful = func(status int) bool { return status >= 200 && status < 300 }
+	}
+	return client, nil
+}
+
+// CloseIdleConnections closes the client's idle keep-alive connections
+func (w *WebhookClient) CloseIdleConnections() {
+	w.sender.CloseIdleConnections()
+}
+
+// SendMessage implements NtfyClient with the retry logic of HTTPNtfyClient. The request is
+// rendered once, so every attempt sends the same request.
+func (w *WebhookClient) SendMessage(_ string, message NtfyMessage, auth NtfyAuth) (NtfyReceipt, error) {
+	data := webhookData{
+		messageData: message.Source,
+		Message:     message.Message,
+		Title:       message.Title,
+		Priority:    priorityLevel(message.Priority),
+		Tags:        message.Tags,
+		Click:       message.Click,
+		Icon:        message.Icon,
+		Attach:      message.Attach,
+		Token:       auth.Token,
+	}
+	render := func(tmpl *template.Template) (string, error) {
+		return renderTemplate(tmpl, data)
+	}
+
+	// The same message would fail to render again; errors are permanent
+	method, err := render(w.method)
+	if err != nil {
+		return NtfyReceipt{}, permanentError{fmt.Errorf("failed to render method: %w", err)}
+	}
+	method = strings.ToUpper(strings.TrimSpace(method))
+	if method == "" || strings.ContainsAny(method, " \t\r\n:/") {
+		return NtfyReceipt{}, permanentError{fmt.Errorf("webhook method %q is not an HTTP method", method)}
+	}
+	target, err := render(w.url)
+	if err != nil {
+		return NtfyReceipt{}, permanentError{fmt.Errorf("failed to render URL: %w", err)}
+	}
+	target = strings.TrimSpace(target)
+	if u, err := url.Parse(target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return NtfyReceipt{}, permanentError{fmt.Errorf("webhook URL %q is not an http:// or https:// URL", target)}
+	}
+	header := http.Header{}
+	for name, tmpl := range w.headers {
+		value, err := render(tmpl)
+		if err != nil {
+			return NtfyReceipt{}, permanentError{fmt.Errorf("failed to render header %s: %w", name, err)}
+		}
+		header.Set(name, strings.TrimSpace(value))
+	}
+	var body []byte
+	if w.body != nil {
+		rendered, err := render(w.body)
+		if err != nil {
+			return NtfyReceipt{}, permanentError{fmt.Errorf("failed to render body: %w", err)}
+		}
+		body = []byte(rendered)
+	} else {
+		body, _ = json.Marshal(webhookPayload{
+			Topic:    data.Topic,
+			Title:    data.Title,
+			Message:  data.Message,
+			Priority: data.Priority,
+			Tags:     data.Tags,
+			Click:    data.Click,
+			Icon:     data.Icon,
+			Attach:   data.Attach,
+		})
+	}
+	if header.Get("Content-Type") == "" && len(body) > 0 {
+		header.Set("Content-Type", "application/json")
+	}
+
+	return sendWithRetry(w.sender.config, message.ExpiresAt, func(ctx context.Context) (string, int, error) {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header = header.Clone()
+		_, status, err := w.sender.do(req)
+		return "", status, err
+	})
+}
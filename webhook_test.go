@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testWebhookClient(t *testing.T, webhook WebhookConfig) *WebhookClient {
+	t.Helper()
+	client, err := NewWebhookClient(webhook, testBackendConfig(), testLogger())
+	if err != nil {
+		t.Fatalf("NewWebhookClient failed: %v", err)
+	}
+	return client
+}
+
+func TestParseWebhookTemplate(t *testing.T) {
+	tests := []struct {
+		text string
+		want error
+	}{
+		{text: `{"text": {{json .Message}}}`},
+		{text: "{{.Topic}} {{.JSON.camera.name}} {{.Priority}} {{.Token}}"},
+		{text: "{{.Room}}", want: fmt.Errorf("template: body:1:2: executing \"body\" at <.Room>: can't evaluate field Room in type main.webhookData")},
+		{text: "{{json}", want: fmt.Errorf("template: body:1: bad character U+007D '}'")},
+	}
+
+	for _, tt := range tests {
+		_, err := parseWebhookTemplate("body", tt.text)
+		if fmt.Sprint(err) != fmt.Sprint(tt.want) {
+			t.Errorf("parseWebhookTemplate(%q) = %v, want %v", tt.text, err, tt.want)
+		}
+	}
+}
+
+func TestWebhookSendMessage(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{Status: http.StatusAccepted})
+	client := testWebhookClient(t, WebhookConfig{
+		Method:       "put",
+		URL:          server.URL + "/hooks/{{.JSON.room}}",
+		Headers:      map[string]string{"Authorization": "Bearer {{.Token}}", "Content-Type": "application/vnd.chat+json"},
+		Body:         `{"text": {{json .Message}}, "topic": "{{.Topic}}", "urgent": {{if ge .Priority 4}}true{{else}}false{{end}}, "zone": "{{.JSON.zone}}"}`,
+		SuccessCodes: []int{200, 202},
+	})
+
+	message := NtfyMessage{
+		Message:  `Door "front" opened`,
+		Priority: "high",
+		Source:   messageData{Topic: "alerts/door", JSON: map[string]any{"room": "ops"}},
+	}
+	receipt, err := client.SendMessage("", message, NtfyAuth{Token: "s3cret"})
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if receipt.StatusCode != http.StatusAccepted || receipt.Attempts != 1 {
+		t.Errorf("Receipt = %+v, want one successful attempt", receipt)
+	}
+
+	request := <-requests
+	if request.Method != http.MethodPut || request.Path != "/hooks/ops" {
+		t.Errorf("Request = %s %s, want PUT /hooks/ops", request.Method, request.Path)
+	}
+	if got := request.Header.Get("Authorization"); got != "Bearer s3cret" {
+		t.Errorf("Authorization = %q, want the rendered token", got)
+	}
+	if got := request.Header.Get("Content-Type"); got != "application/vnd.chat+json" {
+		t.Errorf("Content-Type = %q, want the configured header", got)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		t.Fatalf("Body %s is not JSON: %v", request.Body, err)
+	}
+	if body["text"] != `Door "front" opened` || body["topic"] != "alerts/door" || body["urgent"] != true || body["zone"] != "" {
+		t.Errorf("Body = %s, want the rendered template", request.Body)
+	}
+}
+
+func TestWebhookDefaultBody(t *testing.T) {
+	server, requests := backendServer(t, backendResponse{})
+	client := testWebhookClient(t, WebhookConfig{URL: server.URL + "/notify"})
+
+	message := NtfyMessage{Message: "Door opened", Title: "Garage", Tags: []string{"door"}, Source: messageData{Topic: "garage/door"}}
+	if _, err := client.SendMessage("", message, NtfyAuth{}); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+
+	request := <-requests
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Request = %s (%s), want a JSON POST", request.Method, request.Header.Get("Content-Type"))
+	}
+	want := `{"topic":"garage/door","title":"Garage","message":"Door opened","priority":3,"tags":["door"]}`
+	if string(request.Body) != want {
+		t.Errorf("Body = %s, want %s", request.Body, want)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		successCodes []int
+		wantAttempts int
+		wantErr      bool
+		wantRetry    bool // whether a redelivery could still succeed
+	}{
+		{name: "server error then success", statuses: []int{503, 200}, wantAttempts: 2},
+		{name: "server errors", statuses: []int{500}, wantAttempts: 3, wantErr: true, wantRetry: true},
+		{name: "rejected", statuses: []int{400}, wantAttempts: 1, wantErr: true},
+		{name: "success code not configured", statuses: []int{200}, successCodes: []int{204}, wantAttempts: 1, wantErr: true},
+		{name: "configured non-2xx success", statuses: []int{409}, successCodes: []int{201, 409}, wantAttempts: 1},
+	}
+
+	for _, tt := range tests {
+		var responses []backendResponse
+		for _, status := range tt.statuses {
+			responses = append(responses, backendResponse{Status: status})
+		}
+		server, _ := backendServer(t, responses...)
+		client := testWebhookClient(t, WebhookConfig{URL: server.URL, SuccessCodes: tt.successCodes})
+
+		receipt, err := client.SendMessage("", NtfyMessage{Message: "Door opened"}, NtfyAuth{})
+		if (err != nil) != tt.wantErr || receipt.Attempts != tt.wantAttempts {
+			t.Errorf("SendMessage(%s) = %+v, %v, want %d attempts and error %v", tt.name, receipt, err, tt.wantAttempts, tt.wantErr)
+		}
+		if err != nil && IsTransientDeliveryError(err) != tt.wantRetry {
+			t.Errorf("IsTransientDeliveryError(%s) = %v, want %v", tt.name, !tt.wantRetry, tt.wantRetry)
+		}
+	}
+}
+
+func TestWebhookRenderError(t *testing.T) {
+	client := testWebhookClient(t, WebhookConfig{URL: "{{.JSON.url}}"})
+
+	_, err := client.SendMessage("", NtfyMessage{Message: "Door opened", Source: messageData{JSON: map[string]any{"url": "ftp://files.example.com"}}}, NtfyAuth{})
+	var permanent permanentError
+	if !errors.As(err, &permanent) || !strings.Contains(err.Error(), `"ftp://files.example.com" is not an http:// or https:// URL`) {
+		t.Errorf("SendMessage() error = %v, want a permanent error for the rendered URL", err)
+	}
+}